@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	gmailApiSvc "github.com/redjax/archive-gmail/internal/services/gmailApiService"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+	keyringSvc "github.com/redjax/archive-gmail/internal/services/keyringService"
+	notifySvc "github.com/redjax/archive-gmail/internal/services/notifyService"
+)
+
+// accountConfigs returns the configuration of every account to back up: one
+// per ACCOUNTS entry, or cfg itself when ACCOUNTS is not set
+func accountConfigs(cfg config.Config) []config.Config {
+	if len(cfg.Accounts) == 0 {
+		return []config.Config{cfg}
+	}
+	configs := make([]config.Config, len(cfg.Accounts))
+	for i, a := range cfg.Accounts {
+		configs[i] = cfg.ForAccount(a)
+	}
+	return configs
+}
+
+// withDomainUsers adds every user of WORKSPACE_DOMAIN that ACCOUNTS doesn't
+// list to cfg.Accounts. The domain is listed again on every run, so new users
+// are picked up by scheduled runs.
+func withDomainUsers(ctx context.Context, cfg config.Config) (config.Config, error) {
+	if cfg.WorkspaceDomain == "" {
+		return cfg, nil
+	}
+	users, err := gmailApiSvc.DomainUsers(ctx, cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	listed := map[string]bool{}
+	for _, a := range cfg.Accounts {
+		listed[strings.ToLower(a.Email)] = true
+	}
+	accounts := slices.Clone(cfg.Accounts)
+	for _, u := range users {
+		if !listed[strings.ToLower(u)] {
+			accounts = append(accounts, config.Account{Email: u})
+		}
+	}
+	if len(accounts) == 0 {
+		return cfg, fmt.Errorf("no active users found in %s", cfg.WorkspaceDomain)
+	}
+	logrus.Infof("Found %d users in %s", len(users), cfg.WorkspaceDomain)
+	cfg.Accounts = accounts
+	return cfg, nil
+}
+
+// runAccounts backs up each account in turn, or ACCOUNT_WORKERS at a time,
+// each over its own connections. A failed account is logged and doesn't stop
+// the others; the returned error joins the failures. HEALTHCHECK_URL is pinged
+// once for the whole invocation.
+func runAccounts(ctx context.Context, cfg config.Config, process gmailSvc.MailboxFunc) ([]*gmailSvc.RunSummary, error) {
+	if cfg.HealthcheckURL != "" {
+		if pingErr := notifySvc.PingStart(cfg); pingErr != nil {
+			logrus.Warnf("Healthcheck start ping failed: %v", pingErr)
+		}
+	}
+
+	start := time.Now()
+	var errs []error
+	var accounts []config.Config
+	if domainCfg, err := withDomainUsers(ctx, cfg); err != nil {
+		logrus.Errorf("%v", err)
+		errs = append(errs, err)
+	} else {
+		cfg = domainCfg
+		accounts = accountConfigs(cfg)
+	}
+
+	// Accounts backed up side by side share one run log of the whole
+	// invocation, in BACKUP_DIR
+	multi := len(cfg.Accounts) > 0
+	workers := max(cfg.AccountWorkers, 1)
+	if multi && workers > 1 && cfg.RunLogs > 0 {
+		defer startRunLog(cfg)()
+		for i := range accounts {
+			accounts[i].RunLogs = 0
+		}
+	}
+
+	summaries := make([]*gmailSvc.RunSummary, len(accounts))
+	accountErrs := make([]error, len(accounts))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, acct := range accounts {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			summaries[i], accountErrs[i] = backupAccount(ctx, cfg, acct, multi, process)
+		}()
+	}
+	wg.Wait()
+	errs = append(errs, accountErrs...)
+	err := errors.Join(errs...)
+
+	if cfg.HealthcheckURL != "" {
+		if pingErr := notifySvc.PingResult(cfg, mergeSummaries(cfg, summaries, start), err); pingErr != nil {
+			logrus.Warnf("Healthcheck ping failed: %v", pingErr)
+		}
+	}
+	return summaries, err
+}
+
+// backupAccount backs up one account, prefixing errors with its email when
+// several accounts are backed up
+func backupAccount(ctx context.Context, cfg, acct config.Config, multi bool, process gmailSvc.MailboxFunc) (*gmailSvc.RunSummary, error) {
+	if multi {
+		logrus.Infof("Backing up account %s into %s", acct.Email, acct.BackupDir)
+		if cfg.UseKeyring {
+			if err := keyringSvc.ResolveSecrets(&acct); err != nil {
+				logrus.Errorf("Skipping account %s: keyring lookup failed: %v", acct.Email, err)
+				return nil, fmt.Errorf("%s: %w", acct.Email, err)
+			}
+		}
+	}
+
+	summary, err := runBackup(ctx, acct, accountLogger(acct, multi), process)
+	if err != nil && multi {
+		err = fmt.Errorf("%s: %w", acct.Email, err)
+	}
+	return summary, err
+}
+
+// accountLogger returns the logger of an account's backup: with several
+// accounts its lines carry an account field, so those of accounts backed up
+// side by side can be told apart
+func accountLogger(acct config.Config, multi bool) *logrus.Entry {
+	log := logrus.NewEntry(logrus.StandardLogger())
+	if multi {
+		log = log.WithField("account", acct.Email)
+	}
+	return log
+}
+
+// mergeSummaries combines the per-account summaries into one for the
+// healthcheck. With ACCOUNTS, mailbox names are prefixed with the account
+// they belong to.
+func mergeSummaries(cfg config.Config, summaries []*gmailSvc.RunSummary, start time.Time) *gmailSvc.RunSummary {
+	if len(summaries) == 1 && summaries[0] != nil {
+		return summaries[0]
+	}
+
+	merged := &gmailSvc.RunSummary{Started: start, Elapsed: time.Since(start)}
+	for i, s := range summaries {
+		if s == nil {
+			continue
+		}
+		merged.Downloaded += s.Downloaded
+		for _, m := range s.Mailboxes {
+			m.Name = cfg.Accounts[i].Email + "/" + m.Name
+			merged.Mailboxes = append(merged.Mailboxes, m)
+		}
+	}
+	return merged
+}
+
+// latestContinuation returns the latest time a paused account should resume
+// (see continuation), or the zero time if none should
+func latestContinuation(cfg config.Config, summaries []*gmailSvc.RunSummary) time.Time {
+	var latest time.Time
+	for _, s := range summaries {
+		if at := continuation(cfg, s); at.After(latest) {
+			latest = at
+		}
+	}
+	return latest
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	"github.com/redjax/archive-gmail/internal/imaptest"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// inbox returns an INBOX of n messages whose subjects name owner
+func inbox(owner string, n int) *imaptest.Mailbox {
+	box := &imaptest.Mailbox{Name: "INBOX", UidValidity: 7}
+	for uid := 1; uid <= n; uid++ {
+		box.Messages = append(box.Messages, &imaptest.Message{
+			UID:  uint32(uid),
+			Body: []byte(fmt.Sprintf("Message-ID: <%d@%s>\r\nSubject: %s %d\r\n\r\nbody\r\n", uid, owner, owner, uid)),
+		})
+	}
+	return box
+}
+
+func TestRunAccountsConcurrent(t *testing.T) {
+	// Both accounts must be listing their mailboxes at the same time
+	var mu sync.Mutex
+	listing := 0
+	bothListing := make(chan struct{})
+	srv := &imaptest.Server{Hook: func(s *imaptest.Session, cmd *imap.Command) bool {
+		if cmd.Name == "LIST" {
+			mu.Lock()
+			if listing++; listing == 2 {
+				close(bothListing)
+			}
+			mu.Unlock()
+			select {
+			case <-bothListing:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		return false
+	}}
+	srv.Start(t)
+	srv.AddUser("alice@example.com", "a-pass", inbox("alice", 3))
+	srv.AddUser("bob@example.com", "b-pass", inbox("bob", 2))
+
+	cfg := srv.Config(t, "", "")
+	cfg.Accounts = []config.Account{
+		{Email: "alice@example.com", Password: "a-pass"},
+		{Email: "bob@example.com", Password: "b-pass"},
+	}
+	cfg.AccountWorkers = 2
+
+	hook := test.NewGlobal()
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+
+	summaries, err := runAccounts(context.Background(), cfg, gmailSvc.ProcessMailbox)
+	if err != nil {
+		t.Fatalf("runAccounts: %v", err)
+	}
+	select {
+	case <-bothListing:
+	default:
+		t.Fatal("accounts were not backed up concurrently")
+	}
+
+	want := map[string]uint64{"alice@example.com": 3, "bob@example.com": 2}
+	for i, s := range summaries {
+		email := cfg.Accounts[i].Email
+		if s == nil {
+			t.Fatalf("%s: no summary", email)
+		}
+		if s.Downloaded != want[email] {
+			t.Errorf("%s: downloaded %d, want %d", email, s.Downloaded, want[email])
+		}
+		if len(s.Mailboxes) != 1 || s.Mailboxes[0].Name != "INBOX" || s.Mailboxes[0].Error != "" {
+			t.Errorf("%s: mailboxes %+v", email, s.Mailboxes)
+		}
+
+		dir := gmailSvc.MailboxDir(filepath.Join(cfg.BackupDir, email), "INBOX")
+		stored, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+		if uint64(len(stored)) != want[email] {
+			t.Errorf("%s: %d messages stored in %s, want %d", email, len(stored), dir, want[email])
+		}
+	}
+
+	// Every line of a mailbox run is attributed to its account
+	processing := map[string]bool{}
+	for _, e := range hook.AllEntries() {
+		if e.Message != "Processing: INBOX" {
+			continue
+		}
+		account, _ := e.Data["account"].(string)
+		if account == "" {
+			t.Errorf("%q logged without an account field", e.Message)
+		}
+		processing[account] = true
+	}
+	for email := range want {
+		if !processing[email] {
+			t.Errorf("no Processing line attributed to %s", email)
+		}
+	}
+}
+
+func TestAccountLogger(t *testing.T) {
+	acct := config.Config{Email: "alice@example.com"}
+	if _, ok := accountLogger(acct, false).Data["account"]; ok {
+		t.Error("single account logger has an account field")
+	}
+	if got := accountLogger(acct, true).Data["account"]; got != acct.Email {
+		t.Errorf("account field = %v, want %s", got, acct.Email)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// runAttachmentsIndexCommand writes an index of every attachment in
+// BACKUP_DIR, grouped by content hash, and reports the largest duplicates
+func runAttachmentsIndexCommand(cfg config.Config) {
+	index, err := archiveSvc.BuildAttachmentsIndex(cfg.BackupDir)
+	if err != nil {
+		logrus.Fatalf("Building attachments index failed: %v", err)
+	}
+
+	var total, wasted int64
+	for _, a := range index {
+		total += a.Size * int64(len(a.Messages))
+		wasted += a.Size * int64(len(a.Messages)-1)
+	}
+	for _, a := range index[:min(len(index), 10)] {
+		if len(a.Messages) > 1 {
+			logrus.Infof("  %s %v in %d messages", utils.FormatSize(a.Size), a.Filenames, len(a.Messages))
+		}
+	}
+
+	path := filepath.Join(cfg.BackupDir, archiveSvc.AttachmentsIndexFile)
+	if cfg.DryRun {
+		utils.DryRunWrite(path, -1)
+	} else if err := archiveSvc.WriteAttachmentsIndex(cfg.BackupDir, index); err != nil {
+		logrus.Fatalf("Failed writing %s: %v", path, err)
+	}
+	logrus.Infof("%d distinct attachments totalling %s, %s of it duplicated", len(index), utils.FormatSize(total), utils.FormatSize(wasted))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// runAuthCommand handles `archive-gmail auth login [--device]`, which runs the
+// OAuth2 login and saves a new token even when one is cached
+func runAuthCommand(ctx context.Context, cfg config.Config, args []string) {
+	if len(args) != 1 || args[0] != "login" {
+		logrus.Fatal("Usage: archive-gmail auth login [--device]")
+	}
+
+	tok, err := gmailSvc.LoginToken(ctx, cfg)
+	if err != nil {
+		logrus.Fatalf("OAuth2 login failed: %v", err)
+	}
+	logrus.Infof("OAuth2 login complete, access token valid until %s", tok.Expiry.Format(time.RFC1123))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// runDiffSummaryCommand reports what changed between two run summaries
+func runDiffSummaryCommand(args []string) {
+	if len(args) != 2 {
+		logrus.Fatalf("Usage: archive-gmail diff-summary <older.json> <newer.json>")
+	}
+
+	older, err := gmailSvc.LoadSummary(args[0])
+	if err != nil {
+		logrus.Fatalf("Failed reading summary: %v", err)
+	}
+	newer, err := gmailSvc.LoadSummary(args[1])
+	if err != nil {
+		logrus.Fatalf("Failed reading summary: %v", err)
+	}
+
+	d := gmailSvc.DiffSummaries(older, newer)
+	for _, name := range d.Added {
+		logrus.Infof("New mailbox: %s", name)
+	}
+	for _, name := range d.Removed {
+		logrus.Infof("Mailbox no longer in run: %s", name)
+	}
+	for _, name := range d.NewlyFailing {
+		logrus.Warnf("Newly failing: %s", name)
+	}
+	for _, name := range d.Recovered {
+		logrus.Infof("Recovered: %s", name)
+	}
+	for _, c := range d.Changed {
+		logrus.Infof("  %-30s downloaded %+d, skipped %+d", c.Name, c.Downloaded, c.Skipped)
+	}
+	logrus.Infof("Total downloaded %+d (%d -> %d), %d newly failing mailboxes", d.Downloaded, older.Downloaded, newer.Downloaded, len(d.NewlyFailing))
+}
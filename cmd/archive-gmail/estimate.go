@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// runEstimateCommand reports how much is left to download, per mailbox and
+// overall, without downloading anything
+func runEstimateCommand(ctx context.Context, cfg config.Config) {
+	summary, err := backup(ctx, cfg, logrus.NewEntry(logrus.StandardLogger()), gmailSvc.EstimateMailbox)
+	if err != nil {
+		logrus.Errorf("Estimate failed: %v", err)
+	}
+
+	boxes := summary.Mailboxes
+	sort.Slice(boxes, func(i, j int) bool { return boxes[i].Name < boxes[j].Name })
+
+	var count int
+	var bytes int64
+	for _, m := range boxes {
+		if m.Pending == 0 {
+			continue
+		}
+		logrus.Infof("  %-30s %7d messages  %10s", m.Name, m.Pending, utils.FormatSize(m.PendingBytes))
+		count += m.Pending
+		bytes += m.PendingBytes
+	}
+	logrus.Infof("Estimated download: %d messages, %s across %d mailboxes", count, utils.FormatSize(bytes), len(boxes))
+
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// runExportCommand converts archived mailboxes into mbox files for import
+// into other mail clients
+func runExportCommand(cfg config.Config, args []string) {
+	if len(args) < 2 || len(args) > 3 || args[0] != "mbox" {
+		logrus.Fatalf("Usage: archive-gmail export mbox <out-dir> [mailbox]")
+	}
+	if cfg.ExportSplit != "folder" && cfg.ExportSplit != "month" {
+		logrus.Fatalf("Invalid EXPORT_SPLIT %q: must be folder or month", cfg.ExportSplit)
+	}
+	out, byMonth := args[1], cfg.ExportSplit == "month"
+
+	var results []archiveSvc.ExportResult
+	var err error
+	if len(args) == 3 {
+		var res archiveSvc.ExportResult
+		res, err = archiveSvc.ExportMboxDir(cfg.BackupDir, gmailSvc.MailboxDir(cfg.BackupDir, args[2]), out, byMonth, cfg.DryRun)
+		results = append(results, res)
+	} else {
+		results, err = archiveSvc.ExportMbox(cfg.BackupDir, out, byMonth, cfg.DryRun)
+	}
+	if err != nil {
+		logrus.Fatalf("Export failed: %v", err)
+	}
+
+	var messages, skipped, files int
+	for _, r := range results {
+		logrus.Infof("%s: %d messages in %d mbox files, %d skipped", r.Dir, r.Messages, len(r.Files), r.Skipped)
+		messages += r.Messages
+		skipped += r.Skipped
+		files += len(r.Files)
+	}
+
+	if cfg.DryRun {
+		logrus.Infof("Dry run: nothing written")
+	}
+	logrus.Infof("Export to %s complete across %d mailboxes: %d messages in %d mbox files, %d skipped", out, len(results), messages, files, skipped)
+}
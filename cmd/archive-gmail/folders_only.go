@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// normalizeFolder lowercases a folder name and unifies hierarchy delimiters,
+// so near-misses like "inbox.work" or "INBOX/Work/" can be suggested
+func normalizeFolder(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.NewReplacer(".", "/", `\`, "/").Replace(name)
+	return strings.Trim(name, "/")
+}
+
+// folderHint suggests the listed mailbox a FOLDERS_ONLY entry probably meant:
+// the same name ignoring case and delimiters, or else a mailbox whose last
+// path element matches (i.e. "Work" for "INBOX/Work")
+func folderHint(want string, listed []string) string {
+	norm := normalizeFolder(want)
+	for _, box := range listed {
+		if normalizeFolder(box) == norm {
+			return box
+		}
+	}
+	for _, box := range listed {
+		if path.Base(normalizeFolder(box)) == path.Base(norm) {
+			return box
+		}
+	}
+	return ""
+}
+
+// replayNames returns a closed channel yielding names, for a listing that was
+// read in full up front
+func replayNames(names []string) <-chan string {
+	ch := make(chan string, len(names))
+	for _, n := range names {
+		ch <- n
+	}
+	close(ch)
+	return ch
+}
+
+// checkFoldersOnly logs every FOLDERS_ONLY entry that matched no listed
+// mailbox, with a suggestion when there is a near match. It returns an error
+// naming them, or nil when all matched.
+func checkFoldersOnly(only map[string]bool, listed []string) error {
+	have := make(map[string]bool, len(listed))
+	for _, box := range listed {
+		have[box] = true
+	}
+
+	var missing []string
+	for want := range only {
+		if have[want] {
+			continue
+		}
+		missing = append(missing, want)
+		if hint := folderHint(want, listed); hint != "" {
+			logrus.Warnf("FOLDERS_ONLY entry %q matches no mailbox, did you mean %q?", want, hint)
+		} else {
+			logrus.Warnf("FOLDERS_ONLY entry %q matches no mailbox", want)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("FOLDERS_ONLY entries match no mailbox: %s", strings.Join(missing, ", "))
+}
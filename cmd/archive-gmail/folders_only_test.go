@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+func TestFolderHint(t *testing.T) {
+	listed := []string{"INBOX", "INBOX/Work", "[Gmail]/Sent Mail", "Receipts"}
+	tests := map[string]string{
+		"inbox.work":        "INBOX/Work",
+		"INBOX/Work/":       "INBOX/Work",
+		"[gmail]/sent mail": "[Gmail]/Sent Mail",
+		"Work":              "INBOX/Work",
+		"Travel":            "",
+	}
+	for want, hint := range tests {
+		if got := folderHint(want, listed); got != hint {
+			t.Errorf("folderHint(%q) = %q, want %q", want, got, hint)
+		}
+	}
+}
+
+func TestFoldersOnlyMissing(t *testing.T) {
+	hook := test.NewGlobal()
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+	warnings := func() []string {
+		var out []string
+		for _, e := range hook.AllEntries() {
+			if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "FOLDERS_ONLY entry") {
+				out = append(out, e.Message)
+			}
+		}
+		return out
+	}
+	log := logrus.NewEntry(logrus.StandardLogger())
+
+	// warn: the matching mailbox is still backed up
+	cfg := twoMailboxes(t)
+	cfg.FoldersOnly = map[string]bool{"INBOX": true, "work": true}
+	summary, err := backup(context.Background(), cfg, log, gmailSvc.ProcessMailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Mailboxes) != 1 || summary.Mailboxes[0].Name != "INBOX" {
+		t.Errorf("backed up %+v, want only INBOX", summary.Mailboxes)
+	}
+	if got := warnings(); len(got) != 1 || got[0] != `FOLDERS_ONLY entry "work" matches no mailbox, did you mean "Work"?` {
+		t.Errorf("warnings %q", got)
+	}
+
+	// fail: nothing is downloaded
+	hook.Reset()
+	cfg = twoMailboxes(t)
+	cfg.FoldersOnly = map[string]bool{"INBOX": true, "Travel": true}
+	cfg.FoldersOnlyMissing = "fail"
+	summary, err = backup(context.Background(), cfg, log, gmailSvc.ProcessMailbox)
+	if err == nil || err.Error() != "FOLDERS_ONLY entries match no mailbox: Travel" {
+		t.Errorf("fail mode: %v", err)
+	}
+	if len(summary.Mailboxes) != 0 || summary.Downloaded != 0 {
+		t.Errorf("fail mode backed up %+v", summary.Mailboxes)
+	}
+	if got := warnings(); len(got) != 1 || got[0] != `FOLDERS_ONLY entry "Travel" matches no mailbox` {
+		t.Errorf("warnings %q", got)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// runImportCommand imports an mbox file or Maildir into a mailbox in BACKUP_DIR
+func runImportCommand(cfg config.Config, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		logrus.Fatalf("Usage: archive-gmail import <mbox-file|maildir> [mailbox]")
+	}
+
+	src := args[0]
+	box := strings.TrimSuffix(filepath.Base(filepath.Clean(src)), ".mbox")
+	if len(args) == 2 {
+		box = args[1]
+	}
+
+	dir := gmailSvc.MailboxDir(cfg.BackupDir, box)
+	res, err := archiveSvc.Import(src, dir, box, cfg.IdentityFallback, cfg.NormalizeEOL, cfg.DryRun)
+	if err != nil {
+		logrus.Fatalf("Import failed: %v", err)
+	}
+
+	if cfg.DryRun {
+		logrus.Infof("Dry run: nothing written")
+	}
+	logrus.Infof("Import into %s complete: %d imported, %d duplicates", dir, len(res.Imported), res.Duplicates)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	keyringSvc "github.com/redjax/archive-gmail/internal/services/keyringService"
+)
+
+// runKeyringCommand handles `archive-gmail keyring set <password|client-secret>`
+func runKeyringCommand(cfg config.Config, args []string) {
+	if len(args) != 2 || args[0] != "set" {
+		logrus.Fatal("Usage: archive-gmail keyring set <password|client-secret>")
+	}
+	if cfg.Email == "" {
+		logrus.Fatal("GMAIL_EMAIL is required")
+	}
+
+	var service string
+	switch args[1] {
+	case "password":
+		service = keyringSvc.PasswordService
+	case "client-secret":
+		service = keyringSvc.ClientSecretService
+	default:
+		logrus.Fatalf("Unknown secret %q, expected password or client-secret", args[1])
+	}
+
+	fmt.Printf("Enter %s for %s: ", args[1], cfg.Email)
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && secret == "" {
+		logrus.Fatalf("Failed to read secret: %v", err)
+	}
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		logrus.Fatal("Secret must not be empty")
+	}
+
+	if err := keyringSvc.Set(service, cfg.Email, secret); err != nil {
+		logrus.Fatalf("Failed to store secret in keyring: %v", err)
+	}
+	fmt.Printf("Stored %s for %s in the system keyring\n", args[1], cfg.Email)
+}
@@ -1,55 +1,278 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata" // CRON_TIMEZONE must resolve on hosts without a zoneinfo database
 
+	"github.com/emersion/go-imap/client"
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
 
 	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	gmailApiSvc "github.com/redjax/archive-gmail/internal/services/gmailApiService"
 	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+	keyringSvc "github.com/redjax/archive-gmail/internal/services/keyringService"
+	metricsSvc "github.com/redjax/archive-gmail/internal/services/metricsService"
+	notifySvc "github.com/redjax/archive-gmail/internal/services/notifyService"
+	"github.com/redjax/archive-gmail/internal/utils"
 )
 
-// runBackup executes the actual backup
-func runBackup(cfg config.Config) {
-	level, _ := logrus.ParseLevel(cfg.LogLevel)
-	logrus.SetLevel(level)
+// runBackup executes a backup of one account and sends the configured run
+// report. Cancelling ctx stops the run after the messages being written (see
+// backup).
+func runBackup(ctx context.Context, cfg config.Config, log *logrus.Entry, process gmailSvc.MailboxFunc) (*gmailSvc.RunSummary, error) {
+	if cfg.RunLogs > 0 {
+		defer startRunLog(cfg)()
+	}
+
+	var summary *gmailSvc.RunSummary
+	var err error
+	if cfg.Backend == "api" {
+		summary, err = gmailApiSvc.Backup(ctx, cfg, log, includeFolder(cfg))
+	} else {
+		summary, err = backup(ctx, cfg, log, process)
+	}
+	if err != nil {
+		log.Errorf("Backup failed: %v", err)
+	}
+	// Verify even after a failed backup; the exit code reports the first failure
+	if cfg.RunMode == "archive+verify" && ctx.Err() == nil {
+		if verifyErr := verifyArchive(cfg, summary); verifyErr != nil {
+			log.Errorf("%v", verifyErr)
+			if err == nil {
+				err = verifyErr
+			}
+		}
+	}
+	if cfg.ClientCompatCheck {
+		checkClientCompat(cfg)
+	}
+
+	if cfg.SummaryFile != "" && cfg.DryRun {
+		utils.DryRunWrite(cfg.SummaryFile, -1)
+	} else if cfg.SummaryFile != "" {
+		if saveErr := summary.Save(cfg.SummaryFile); saveErr != nil {
+			log.Warnf("Failed writing %s: %v", cfg.SummaryFile, saveErr)
+		}
+	}
+
+	if cfg.SMTPHost != "" && cfg.ReportTo != "" {
+		if sendErr := notifySvc.SendEmailReport(cfg, summary, err); sendErr != nil {
+			log.Warnf("Failed to send email report: %v", sendErr)
+		}
+	}
+
+	if err == nil {
+		metricsSvc.RunSucceeded(time.Now())
+	}
+	return summary, err
+}
+
+// startRunLog copies the log output of a run into a file in the backup dir
+// and prunes old run logs. The returned func restores the previous output.
+func startRunLog(cfg config.Config) func() {
+	if cfg.DryRun {
+		utils.DryRunWrite(filepath.Join(cfg.BackupDir, archiveSvc.RunLogsDir, "<timestamp>.log"), -1)
+		return func() {}
+	}
+
+	f, err := archiveSvc.CreateRunLog(cfg.BackupDir, time.Now())
+	if err != nil {
+		logrus.Warnf("Failed creating run log: %v", err)
+		return func() {}
+	}
+	if err := archiveSvc.PruneRunLogs(cfg.BackupDir, cfg.RunLogs); err != nil {
+		logrus.Warnf("Failed pruning run logs: %v", err)
+	}
+
+	out := logrus.StandardLogger().Out
+	logrus.SetOutput(io.MultiWriter(out, f))
+	return func() {
+		logrus.SetOutput(out)
+		_ = f.Close()
+	}
+}
+
+// checkClientCompat logs stored messages that mail clients may fail to open
+func checkClientCompat(cfg config.Config) {
+	problems, err := archiveSvc.CheckCompat(cfg.BackupDir)
+	if err != nil {
+		logrus.Warnf("Client compatibility check failed: %v", err)
+		return
+	}
+	for _, p := range problems {
+		logrus.Warnf("Client compatibility: %s: %s", p.Path, p.Reason)
+	}
+	logrus.Infof("Client compatibility check complete: %d problems", len(problems))
+}
+
+// continuation returns when a run paused by DAILY_BYTE_LIMIT should resume,
+// or the zero time if it shouldn't be continued automatically
+func continuation(cfg config.Config, summary *gmailSvc.RunSummary) time.Time {
+	if !cfg.ContinueAfterLimit || summary == nil || !summary.DailyLimitReached || summary.ResumeAt.IsZero() {
+		return time.Time{}
+	}
+	// Leave a little slack past the reset
+	return summary.ResumeAt.Add(time.Minute)
+}
+
+// runOnce runs a one-shot backup and returns the process exit code, so
+// scripts can detect a failed run. With CONTINUE_AFTER_LIMIT, a run paused by
+// the daily limit waits for the reset and continues.
+func runOnce(ctx context.Context, cfg config.Config, process gmailSvc.MailboxFunc) int {
+	for {
+		summaries, err := runAccounts(ctx, cfg, process)
+		if err != nil {
+			return 1
+		}
+
+		resume := latestContinuation(cfg, summaries)
+		if resume.IsZero() {
+			return 0
+		}
+		logrus.Infof("Continuing after the daily limit resets, at %s", resume.Format(time.RFC1123))
+		select {
+		case <-time.After(time.Until(resume)):
+		case <-ctx.Done():
+			return 0
+		}
+	}
+}
+
+// runScheduled runs a cron-triggered backup of each mailbox with process. A
+// failed or panicking run is logged and never ends the process, so the
+// scheduler keeps running. It returns when to continue a run paused by the
+// daily limit (see continuation).
+func runScheduled(ctx context.Context, cfg config.Config, process gmailSvc.MailboxFunc) (resume time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("Scheduled backup panicked: %v", r)
+		}
+	}()
 
-	useOAuth2 := cfg.ClientID != "" && cfg.ClientSecret != ""
+	summaries, err := runAccounts(ctx, cfg, process)
+	if err != nil {
+		logrus.Warnf("Scheduled backup failed, will try again at the next scheduled time")
+		return time.Time{}
+	}
+	return latestContinuation(cfg, summaries)
+}
+
+// backup runs process over every selected mailbox. Once ctx is cancelled no
+// further mailboxes are started, and those in progress stop after the message
+// being written and save their manifests.
+func backup(ctx context.Context, cfg config.Config, log *logrus.Entry, process gmailSvc.MailboxFunc) (*gmailSvc.RunSummary, error) {
+	start := time.Now()
+	summary := &gmailSvc.RunSummary{Started: start}
+
+	useOAuth2 := cfg.ServiceAccountFile != "" || (cfg.ClientID != "" && cfg.ClientSecret != "")
 	if cfg.Email == "" {
-		logrus.Fatal("GMAIL_EMAIL is required")
+		return summary, fmt.Errorf("GMAIL_EMAIL is required")
 	}
 	if !useOAuth2 && cfg.Password == "" {
-		logrus.Fatal("Either GMAIL_PASSWORD OR (GMAIL_CLIENT_ID + GMAIL_CLIENT_SECRET) required")
+		return summary, fmt.Errorf("either GMAIL_PASSWORD OR (GMAIL_CLIENT_ID + GMAIL_CLIENT_SECRET) required")
 	}
 
-	c, err := gmailSvc.Connect(cfg)
+	dailyLoc, err := loadLocation(cfg.DailyLimitTimezone)
 	if err != nil {
-		logrus.Fatalf("IMAP connect failed: %v", err)
+		return summary, fmt.Errorf("invalid DAILY_LIMIT_TIMEZONE %q: %w", cfg.DailyLimitTimezone, err)
 	}
-	defer c.Logout()
 
-	mailboxes, err := gmailSvc.ListMailboxes(c)
+	c, err := gmailSvc.Connect(cfg)
 	if err != nil {
-		logrus.Fatalf("Failed listing mailboxes: %v", err)
+		return summary, fmt.Errorf("IMAP connect failed: %w", err)
 	}
+	defer c.Logout()
 
-	start := time.Now()
-	var downloaded uint64
-	var mu sync.RWMutex
+	run := &gmailSvc.RunState{
+		Daily:         gmailSvc.NewDailyLimiter(cfg.BackupDir, cfg.DailyByteLimit, cfg.DryRun, dailyLoc),
+		ScanChunkSize: gmailSvc.TuneScanChunkSize(c, cfg.ScanChunkSize),
+		Writes:        gmailSvc.NewWriteLimit(cfg.MaxConcurrentWrites),
+		Rate:          gmailSvc.NewRateLimiter(cfg.RequestsPerSecond),
+		Log:           log,
+
+		GmailExtensions: gmailSvc.SupportsGmailExtensions(c, cfg),
+	}
+	if cfg.WriteChecksums && !cfg.DryRun {
+		sums, err := archiveSvc.LoadChecksums(cfg.BackupDir)
+		if err != nil {
+			return summary, fmt.Errorf("failed loading %s: %w", archiveSvc.ChecksumFile, err)
+		}
+		run.Checksums = sums
+	}
+	if cfg.Dedup {
+		seen, err := gmailSvc.LoadSeen(cfg.BackupDir)
+		if err != nil {
+			return summary, fmt.Errorf("failed indexing stored messages for DEDUP: %w", err)
+		}
+		run.Seen = seen
+	}
+	if run.Daily.Reached() {
+		log.Warnf("Daily download limit of %s already reached, resuming after %s",
+			utils.FormatSize(cfg.DailyByteLimit), run.Daily.ResumeAt().Format(time.RFC1123))
+		summary.DailyLimitReached = true
+		summary.ResumeAt = run.Daily.ResumeAt()
+		return summary, nil
+	}
 
+	// Each mailbox worker gets a connection of its own; c keeps streaming the
+	// mailbox list
+	pool := gmailSvc.NewConnPool(cfg)
 	sem := make(chan struct{}, cfg.MaxWorkers)
 	var wg sync.WaitGroup
+	results := make(chan gmailSvc.MailboxResult)
+	collected := make(chan struct{})
+	go func() {
+		for r := range results {
+			summary.Mailboxes = append(summary.Mailboxes, r)
+		}
+		close(collected)
+	}()
+
+	log.Infof("Starting backup with %d workers", cfg.MaxWorkers)
 
-	logrus.Infof("Starting backup with %d workers across %d mailboxes", cfg.MaxWorkers, len(mailboxes))
+	// Mailboxes are processed as the server lists them
+	mailboxes, listErr := gmailSvc.StreamMailboxes(c, cfg.MaxMailboxes)
+	checkOnly := len(cfg.FoldersOnly) > 0 && cfg.MaxMailboxes == 0
+	if checkOnly && cfg.FoldersOnlyMissing == "fail" {
+		// Check the whole listing before downloading anything
+		var names []string
+		for box := range mailboxes {
+			names = append(names, box)
+		}
+		if err := checkFoldersOnly(cfg.FoldersOnly, names); err != nil {
+			<-listErr
+			return summary, err
+		}
+		checkOnly = false
+		mailboxes = replayNames(names)
+	}
 
-	for _, box := range mailboxes {
+	var listed []string
+	for box := range mailboxes {
+		listed = append(listed, box)
 		if len(cfg.FoldersOnly) > 0 && !cfg.FoldersOnly[box] {
 			continue
 		}
+		if excludedFolder(box, cfg.FoldersExclude) {
+			log.Debugf("Skipping mailbox %s: excluded by FOLDERS_EXCLUDE", box)
+			continue
+		}
+		if run.Daily.Reached() || ctx.Err() != nil {
+			break
+		}
 
 		sem <- struct{}{}
 		wg.Add(1)
@@ -57,54 +280,412 @@ func runBackup(cfg config.Config) {
 		go func(boxName string) {
 			defer wg.Done()
 			defer func() { <-sem }()
-			gmailSvc.ProcessMailbox(c, boxName, cfg, &downloaded, &mu)
+			wc, err := pool.Get()
+			if err != nil {
+				log.Warnf("Skipping mailbox %s: IMAP connect failed: %v", boxName, err)
+				results <- gmailSvc.MailboxResult{Name: boxName, Error: fmt.Sprintf("connect failed: %v", err)}
+				return
+			}
+			defer pool.Put(wc)
+			// A panicking mailbox fails on its own instead of ending the
+			// process, which would stop a scheduler
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("Mailbox %s panicked: %v", boxName, r)
+					results <- gmailSvc.MailboxResult{Name: boxName, Error: fmt.Sprintf("panic: %v", r)}
+				}
+			}()
+			results <- process(ctx, wc, boxName, cfg, run)
 		}(box)
 	}
+	// Drain names left over after an early stop so the LIST can complete
+	for box := range mailboxes {
+		listed = append(listed, box)
+	}
 
 	wg.Wait()
+	close(results)
+	<-collected
+	pool.Close()
+
+	retryDeferred(ctx, c, cfg, run, process, summary)
+
+	// Mailboxes already processed are kept even if the listing failed part-way
+	var runErr error
+	if err := <-listErr; err != nil {
+		runErr = fmt.Errorf("failed listing mailboxes: %w", err)
+	} else if checkOnly {
+		_ = checkFoldersOnly(cfg.FoldersOnly, listed)
+	}
+	if failed := summary.FailedMailboxes(); len(failed) > 0 && runErr == nil {
+		names := make([]string, len(failed))
+		for i, m := range failed {
+			names[i] = m.Name
+		}
+		runErr = fmt.Errorf("%d mailboxes failed: %s", len(failed), strings.Join(names, ", "))
+	}
+	if ctx.Err() != nil {
+		summary.Interrupted = true
+		runErr = fmt.Errorf("backup interrupted by shutdown")
+	}
+
+	downloaded := run.Downloaded()
+	summary.Downloaded = downloaded
+	summary.Elapsed = time.Since(start)
+	summary.DailyLimitReached = run.Daily.Reached()
+	if summary.DailyLimitReached {
+		summary.ResumeAt = run.Daily.ResumeAt()
+	}
+	summary.Alerts = append(gmailSvc.ServerAlerts(c), pool.Alerts()...)
 
-	elapsed := time.Since(start).Seconds()
+	if cfg.WriteFolders {
+		snapshotFolders(c, cfg)
+	}
+
+	if cfg.SyncExcludeFile != "" && cfg.DryRun {
+		utils.DryRunWrite(filepath.Join(cfg.BackupDir, cfg.SyncExcludeFile), -1)
+	} else if cfg.SyncExcludeFile != "" {
+		if err := archiveSvc.WriteSyncExcludes(cfg.BackupDir, cfg.SyncExcludeFile); err != nil {
+			log.Warnf("Failed writing %s: %v", cfg.SyncExcludeFile, err)
+		}
+	}
+
+	if cfg.WriteFolderMap && cfg.DryRun {
+		utils.DryRunWrite(filepath.Join(cfg.BackupDir, archiveSvc.FolderMapFile), -1)
+	} else if cfg.WriteFolderMap {
+		if err := archiveSvc.WriteFolderMap(cfg.BackupDir); err != nil {
+			log.Warnf("Failed writing %s: %v", archiveSvc.FolderMapFile, err)
+		}
+	}
+
+	if run.Checksums != nil {
+		if err := run.Checksums.Update(); err != nil {
+			log.Warnf("Failed updating checksums: %v", err)
+		} else if err := run.Checksums.Save(); err != nil {
+			log.Warnf("Failed writing %s: %v", archiveSvc.ChecksumFile, err)
+		}
+	}
+
+	elapsed := summary.Elapsed.Seconds()
 	rate := float64(downloaded) / elapsed
-	logrus.Infof("Archive complete: %d messages in %.1fs (%.2f msg/sec)", downloaded, elapsed, rate)
+	log.Infof("Archive complete: %d messages in %.1fs (%.2f msg/sec)", downloaded, elapsed, rate)
+	if cfg.Dedup {
+		var deduplicated int
+		for _, m := range summary.Mailboxes {
+			deduplicated += m.Deduplicated
+		}
+		log.Infof("%d messages already stored in another mailbox were saved as references", deduplicated)
+	}
+	if cfg.Verify {
+		var repaired int
+		for _, m := range summary.Mailboxes {
+			repaired += m.Repaired
+		}
+		log.Infof("Size check complete: %d truncated messages downloaded again", repaired)
+	}
+	log.Info("Per-mailbox results:")
+	summary.LogResults(log)
+	log.Info("Per-mailbox timings:")
+	summary.LogTimings(log)
+	summary.LogFailed(log)
+
+	if summary.DailyLimitReached {
+		log.Warnf("Daily download limit reached (%s used), remaining messages will be fetched after %s",
+			utils.FormatSize(run.Daily.Used()), run.Daily.ResumeAt().Format(time.RFC1123))
+	}
+
+	return summary, runErr
+}
+
+// includeFolder returns whether FOLDERS_ONLY and FOLDERS_EXCLUDE select a
+// mailbox for backup
+func includeFolder(cfg config.Config) func(box string) bool {
+	return func(box string) bool {
+		if len(cfg.FoldersOnly) > 0 && !cfg.FoldersOnly[box] {
+			return false
+		}
+		return !excludedFolder(box, cfg.FoldersExclude)
+	}
+}
+
+// excludedFolder reports whether box matches a FOLDERS_EXCLUDE entry, either
+// exactly or by a trailing * prefix wildcard like "[Gmail]/*"
+func excludedFolder(box string, exclude map[string]bool) bool {
+	if exclude[box] {
+		return true
+	}
+	for pattern := range exclude {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(box, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDeferred processes mailboxes that were temporarily unavailable once
+// more, after every other mailbox, replacing their first-pass result
+func retryDeferred(ctx context.Context, c *client.Client, cfg config.Config, run *gmailSvc.RunState, process gmailSvc.MailboxFunc, summary *gmailSvc.RunSummary) {
+	log := run.Log
+	for i, m := range summary.Mailboxes {
+		if !m.Deferred {
+			continue
+		}
+		summary.Deferred = append(summary.Deferred, m.Name)
+		if run.Daily.Reached() || ctx.Err() != nil {
+			continue
+		}
+
+		log.Infof("Retrying deferred mailbox %s", m.Name)
+		r := process(ctx, c, m.Name, cfg, run)
+		if r.Deferred {
+			log.Warnf("Mailbox %s is still unavailable, skipping it this run", m.Name)
+		}
+		summary.Mailboxes[i] = r
+	}
+}
+
+// snapshotFolders writes folders.json and logs how the folder list changed
+// since the previous run
+func snapshotFolders(c *client.Client, cfg config.Config) {
+	snap, err := gmailSvc.SnapshotFolders(c)
+	if err != nil {
+		logrus.Warnf("Folder snapshot failed: %v", err)
+		return
+	}
+	prev, err := archiveSvc.LoadFolders(cfg.BackupDir)
+	if err != nil {
+		logrus.Warnf("Failed reading previous %s: %v", archiveSvc.FoldersFile, err)
+	}
+	for _, change := range archiveSvc.DiffFolders(prev, snap) {
+		logrus.Infof("Folder change: %s", change)
+	}
+
+	if cfg.DryRun {
+		utils.DryRunWrite(filepath.Join(cfg.BackupDir, archiveSvc.FoldersFile), -1)
+	} else if err := snap.Save(cfg.BackupDir); err != nil {
+		logrus.Warnf("Failed writing %s: %v", archiveSvc.FoldersFile, err)
+	}
+}
+
+// cronParser returns the parser for CRON_SCHEDULE. The same parser is used for
+// the logged next-run times and the scheduler itself, so they always agree.
+func cronParser(withSeconds bool) cron.Parser {
+	fields := cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow
+	if withSeconds {
+		fields |= cron.Second
+	}
+	return cron.NewParser(fields)
+}
+
+// loadLocation returns the timezone named tz, or the host's local time when
+// tz is empty
+func loadLocation(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(tz)
 }
 
 func main() {
-	cfg := config.LoadConfig()
+	// Every setting gets a flag from LoadConfig, which parses them
+	noOpAuth := flag.Bool("no-op-auth", false, "Verify the OAuth2 token can be refreshed, then exit (no IMAP connection)")
+	device := flag.Bool("device", false, "Log in with the OAuth2 device flow (same as OAUTH2_LOGIN=device)")
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		logrus.Fatalf("Invalid configuration: %v", err)
+	}
+	if *device {
+		cfg.OAuth2Login = gmailSvc.LoginDevice
+	}
+
+	level, _ := logrus.ParseLevel(cfg.LogLevel)
+	logrus.SetLevel(level)
+	if cfg.LogRedact {
+		logrus.AddHook(utils.RedactHook{})
+	}
+
+	gmailSvc.DirNameEncoding = cfg.MailboxDirEncoding
+	gmailSvc.MaxDirNameBytes = cfg.MaxDirNameBytes
 
-	flag.Parse()
+	// With ACCOUNTS, each account's secrets are looked up before its run
+	if cfg.UseKeyring && len(cfg.Accounts) == 0 {
+		if err := keyringSvc.ResolveSecrets(&cfg); err != nil {
+			logrus.Fatalf("Keyring lookup failed: %v", err)
+		}
+	}
+
+	// Catch a bad cert/key pair now rather than at the first scheduled run
+	if _, err := gmailSvc.ClientCertificates(cfg); err != nil {
+		logrus.Fatalf("Invalid TLS client certificate: %v", err)
+	}
+
+	if cfg.Since != "" {
+		if _, err := utils.ParseSince(cfg.Since, time.Now()); err != nil {
+			logrus.Fatalf("Invalid SINCE: %v", err)
+		}
+	}
+
+	if cfg.Backend != "imap" && cfg.Backend != "api" {
+		logrus.Fatalf("Invalid BACKEND %q: must be imap or api", cfg.Backend)
+	}
+	switch cfg.SASLMechanism {
+	case "auto", "xoauth2", "oauthbearer":
+	default:
+		logrus.Fatalf("Invalid SASL_MECHANISM %q: must be auto, xoauth2 or oauthbearer", cfg.SASLMechanism)
+	}
+	if cfg.OAuth2TokenStore != "file" && cfg.OAuth2TokenStore != "keyring" {
+		logrus.Fatalf("Invalid OAUTH2_TOKEN_STORE %q: must be file or keyring", cfg.OAuth2TokenStore)
+	}
+	if cfg.WorkspaceDomain != "" && (cfg.ServiceAccountFile == "" || cfg.WorkspaceAdmin == "") {
+		logrus.Fatal("WORKSPACE_DOMAIN requires GMAIL_SERVICE_ACCOUNT_FILE and WORKSPACE_ADMIN")
+	}
+	if cfg.Provider != "gmail" && (cfg.Backend == "api" || cfg.ServiceAccountFile != "" || cfg.WorkspaceDomain != "") {
+		logrus.Fatalf("BACKEND=api, GMAIL_SERVICE_ACCOUNT_FILE and WORKSPACE_DOMAIN need PROVIDER=gmail, not %s", cfg.Provider)
+	}
+	if cfg.ClientID != "" && cfg.ClientSecret != "" && (cfg.OAuth2AuthURL == "" || cfg.OAuth2TokenURL == "") {
+		logrus.Fatalf("PROVIDER=%s has no OAuth2 endpoints: use an app password, or set OAUTH2_AUTH_URL and OAUTH2_TOKEN_URL", cfg.Provider)
+	}
+	if cfg.Backend == "api" {
+		switch config.Arg(0) {
+		case "scan", "download", "estimate", "restore":
+			logrus.Fatalf("The %s command needs IMAP, unset BACKEND=api", config.Arg(0))
+		}
+	}
+
+	if *noOpAuth {
+		tok, err := gmailSvc.VerifyToken(cfg)
+		if err != nil {
+			logrus.Fatalf("OAuth2 credentials are not usable: %v", err)
+		}
+		logrus.Infof("OAuth2 credentials OK, access token valid until %s", tok.Expiry.Format(time.RFC1123))
+		return
+	}
+
+	// The first SIGINT/SIGTERM lets in-flight messages and manifests finish
+	// writing; after it the default handlers are restored, so a second signal
+	// exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+		logrus.Warn("Shutting down after the messages being written, signal again to exit immediately")
+	}()
+
+	switch config.Arg(0) {
+	case "", "backup":
+	case "keyring":
+		runKeyringCommand(cfg, config.Args()[1:])
+		return
+	case "auth":
+		runAuthCommand(ctx, cfg, config.Args()[1:])
+		return
+	case "token":
+		runTokenCommand(cfg, config.Args()[1:])
+		return
+	case "reindex":
+		runReindexCommand(cfg)
+		return
+	case "merge":
+		runMergeCommand(cfg, config.Args()[1:])
+		return
+	case "import":
+		runImportCommand(cfg, config.Args()[1:])
+		return
+	case "export":
+		runExportCommand(cfg, config.Args()[1:])
+		return
+	case "restore":
+		runRestoreCommand(ctx, cfg, config.Args()[1:])
+		return
+	case "attachments-index":
+		runAttachmentsIndexCommand(cfg)
+		return
+	case "diff-summary":
+		runDiffSummaryCommand(config.Args()[1:])
+		return
+	case "scan":
+		os.Exit(runOnce(ctx, cfg, gmailSvc.ScanMailbox))
+	case "download":
+		os.Exit(runOnce(ctx, cfg, gmailSvc.DownloadMailbox))
+	case "estimate":
+		runEstimateCommand(ctx, cfg)
+		return
+	default:
+		logrus.Fatalf("Unknown command: %s", config.Arg(0))
+	}
+
+	stopMetrics := func() {}
+	if cfg.MetricsAddr != "" {
+		if stopMetrics, err = metricsSvc.Serve(cfg.MetricsAddr); err != nil {
+			logrus.Fatalf("Failed to start metrics server on %s: %v", cfg.MetricsAddr, err)
+		}
+	}
 
 	if cfg.CronSchedule == "" {
 		// No schedule: run once and exit
-		runBackup(cfg)
-		return
+		code := runOnce(ctx, cfg, gmailSvc.ProcessMailbox)
+		stopMetrics()
+		os.Exit(code)
+	}
+
+	// Schedules fire in CRON_TIMEZONE, not the host's (often UTC) local time
+	loc, err := loadLocation(cfg.CronTimezone)
+	if err != nil {
+		logrus.Fatalf("Invalid CRON_TIMEZONE %q: %v", cfg.CronTimezone, err)
 	}
 
 	// Only print schedule info if CronSchedule has a value
-	logrus.Infof("Using schedule: %s", cfg.CronSchedule)
+	logrus.Infof("Using schedule: %s (timezone %s)", cfg.CronSchedule, loc)
 
 	var running int32
 
+	// A run paused by DAILY_BYTE_LIMIT continues once the limit resets,
+	// instead of waiting for the next tick
+	var continueAt func(time.Time)
+	continueAt = func(at time.Time) {
+		if at.IsZero() {
+			return
+		}
+		logrus.Infof("Continuing after the daily limit resets, at %s", at.Format(time.RFC1123))
+		time.AfterFunc(time.Until(at), func() {
+			if ctx.Err() != nil {
+				return
+			}
+			if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+				logrus.Info("Backup already running, skipping continuation")
+				return
+			}
+			defer atomic.StoreInt32(&running, 0)
+			logrus.Infof("Starting continued backup")
+			continueAt(runScheduled(ctx, cfg, gmailSvc.ProcessMailbox))
+		})
+	}
+
 	// Parse the cron spec to calculate next run before starting
-	parser := cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
+	parser := cronParser(cfg.CronWithSeconds)
 	sched, err := parser.Parse(cfg.CronSchedule)
 	if err != nil {
 		logrus.Fatalf("Invalid cron schedule: %v", err)
 	}
 
 	// Print first scheduled run
-	nextRun := sched.Next(time.Now())
+	nextRun := sched.Next(time.Now().In(loc))
 	logrus.Infof("First scheduled backup at %s", nextRun.Format(time.RFC1123))
 
 	// Create cron
-	c := cron.New(cron.WithParser(parser))
+	c := cron.New(cron.WithParser(parser), cron.WithLocation(loc))
 	var id cron.EntryID
 	id, err = c.AddFunc(cfg.CronSchedule, func() {
+		if ctx.Err() != nil {
+			return
+		}
 		if atomic.LoadInt32(&running) == 0 {
 			atomic.StoreInt32(&running, 1)
 			go func(localID cron.EntryID) {
 				defer atomic.StoreInt32(&running, 0)
 				logrus.Infof("Starting scheduled backup")
-				runBackup(cfg)
+				continueAt(runScheduled(ctx, cfg, gmailSvc.ProcessMailbox))
 
 				// Print next scheduled run
 				next := c.Entry(localID).Next
@@ -126,7 +707,7 @@ func main() {
 		go func() {
 			defer atomic.StoreInt32(&running, 0)
 			logrus.Infof("Starting initial backup immediately")
-			runBackup(cfg)
+			continueAt(runScheduled(ctx, cfg, gmailSvc.ProcessMailbox))
 
 			// Print next scheduled run after first execution
 			next := c.Entry(id).Next
@@ -134,6 +715,13 @@ func main() {
 		}()
 	}
 
-	// Keep program running
-	select {}
+	// Keep program running until a shutdown signal, then let the current
+	// backup save its progress before exiting
+	<-ctx.Done()
+	c.Stop()
+	for atomic.LoadInt32(&running) != 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	stopMetrics()
+	logrus.Info("Scheduler stopped")
 }
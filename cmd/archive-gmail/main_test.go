@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	"github.com/redjax/archive-gmail/internal/imaptest"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+func TestOutlookExportLayout(t *testing.T) {
+	lf := func(uid uint32) *imaptest.Message {
+		return &imaptest.Message{UID: uid, Body: []byte(fmt.Sprintf("Message-ID: <%d@example.com>\nSubject: lf\n\nline one\nline two\n", uid))}
+	}
+	srv := imaptest.NewServer(t)
+	srv.AddUser("user@example.com", "secret",
+		&imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: []*imaptest.Message{lf(1), lf(2)}},
+		&imaptest.Mailbox{Name: "Work/Projects", UidValidity: 1, Messages: []*imaptest.Message{lf(1)}},
+	)
+	cfg := srv.Config(t, "user@example.com", "secret")
+	// What EXPORT_PROFILE=outlook sets
+	cfg.ExportProfile, cfg.NormalizeEOL, cfg.WriteFolderMap = "outlook", utils.EOLCRLF, true
+
+	if _, err := backup(context.Background(), cfg, logrus.NewEntry(logrus.StandardLogger()), gmailSvc.ProcessMailbox); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"INBOX": 2, "Work/Projects": 1}
+	for box, n := range want {
+		files, _ := filepath.Glob(filepath.Join(gmailSvc.MailboxDir(cfg.BackupDir, box), "*.eml"))
+		if len(files) != n {
+			t.Errorf("%s: %d .eml files, want %d", box, len(files), n)
+		}
+		for _, f := range files {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Count(data, []byte("\n")) != bytes.Count(data, []byte("\r\n")) {
+				t.Errorf("%s has bare LF line endings", f)
+			}
+		}
+	}
+
+	f, err := os.Open(filepath.Join(cfg.BackupDir, archiveSvc.FolderMapFile))
+	if err != nil {
+		t.Fatalf("no folder map: %v", err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped := map[string]string{}
+	for _, row := range rows[1:] {
+		mapped[row[1]] = row[0]
+	}
+	for box := range want {
+		if dir := filepath.Base(gmailSvc.MailboxDir(cfg.BackupDir, box)); mapped[box] != dir {
+			t.Errorf("folder map has %q for %s, want %q", mapped[box], box, dir)
+		}
+	}
+}
+
+// failingProcess fails every mailbox
+func failingProcess(_ context.Context, _ *client.Client, box string, _ config.Config, _ *gmailSvc.RunState) gmailSvc.MailboxResult {
+	return gmailSvc.MailboxResult{Name: box, Error: "select failed"}
+}
+
+// panickingProcess panics on every mailbox
+func panickingProcess(context.Context, *client.Client, string, config.Config, *gmailSvc.RunState) gmailSvc.MailboxResult {
+	panic("boom")
+}
+
+// twoMailboxes returns the configuration of a backup of a server with two
+// mailboxes
+func twoMailboxes(t *testing.T) config.Config {
+	t.Helper()
+	srv := imaptest.NewServer(t)
+	srv.AddUser("user@example.com", "secret",
+		&imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: []*imaptest.Message{{UID: 1, Body: []byte("Subject: one\r\n\r\nbody\r\n")}}},
+		&imaptest.Mailbox{Name: "Work", UidValidity: 1},
+	)
+	return srv.Config(t, "user@example.com", "secret")
+}
+
+// failingConfig returns a configuration whose backup fails to log in
+func failingConfig(t *testing.T) config.Config {
+	cfg := twoMailboxes(t)
+	cfg.Password = "wrong"
+	return cfg
+}
+
+func TestRunOnceExitCode(t *testing.T) {
+	if code := runOnce(context.Background(), twoMailboxes(t), gmailSvc.ProcessMailbox); code != 0 {
+		t.Errorf("successful run exited with %d", code)
+	}
+	if code := runOnce(context.Background(), failingConfig(t), gmailSvc.ProcessMailbox); code != 1 {
+		t.Errorf("failed run exited with %d, want 1", code)
+	}
+	if code := runOnce(context.Background(), twoMailboxes(t), failingProcess); code != 1 {
+		t.Errorf("run with a failed mailbox exited with %d, want 1", code)
+	}
+	if code := runOnce(context.Background(), twoMailboxes(t), panickingProcess); code != 1 {
+		t.Errorf("panicking run exited with %d, want 1", code)
+	}
+}
+
+func TestRunScheduledSurvivesFailures(t *testing.T) {
+	hook := test.NewGlobal()
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+
+	runs := map[string]struct {
+		cfg     config.Config
+		process gmailSvc.MailboxFunc
+	}{
+		"login":     {failingConfig(t), gmailSvc.ProcessMailbox},
+		"failing":   {twoMailboxes(t), failingProcess},
+		"panicking": {twoMailboxes(t), panickingProcess},
+	}
+	for name, run := range runs {
+		hook.Reset()
+		if resume := runScheduled(context.Background(), run.cfg, run.process); !resume.IsZero() {
+			t.Errorf("%s run asks to resume at %s", name, resume)
+		}
+		failed := false
+		for _, e := range hook.AllEntries() {
+			failed = failed || strings.HasPrefix(e.Message, "Scheduled backup failed")
+		}
+		if !failed {
+			t.Errorf("%s run was not logged as failed", name)
+		}
+	}
+}
+
+func TestCronTimezoneNextRun(t *testing.T) {
+	loc, err := loadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched, err := cronParser(false).Parse("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 08:00 in New York; a 09:00 UTC schedule would have fired already
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	next := sched.Next(now.In(loc))
+	if want := time.Date(2024, 7, 1, 13, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Errorf("next run %s, want %s", next, want)
+	}
+	if next.Location() != loc {
+		t.Errorf("next run in %s, want %s", next.Location(), loc)
+	}
+
+	if loc, err := loadLocation(""); err != nil || loc != time.Local {
+		t.Errorf("empty CRON_TIMEZONE: %v %v", loc, err)
+	}
+	if _, err := loadLocation("Mars/Olympus_Mons"); err == nil {
+		t.Error("unknown CRON_TIMEZONE accepted")
+	}
+}
+
+func TestCronWithSeconds(t *testing.T) {
+	const spec = "*/15 * * * * *"
+	if _, err := cronParser(false).Parse(spec); err == nil {
+		t.Error("6-field schedule accepted without CRON_WITH_SECONDS")
+	}
+
+	parser := cronParser(true)
+	sched, err := parser.Parse(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 7, 1, 12, 0, 7, 0, time.UTC)
+	if next, want := sched.Next(now), now.Add(8*time.Second); !next.Equal(want) {
+		t.Errorf("next run %s, want %s", next, want)
+	}
+
+	// The scheduler accepts what the parser does
+	c := cron.New(cron.WithParser(parser))
+	if _, err := c.AddFunc(spec, func() {}); err != nil {
+		t.Errorf("scheduler rejected %q: %v", spec, err)
+	}
+}
+
+func TestDryRunWritesNothing(t *testing.T) {
+	cfg := twoMailboxes(t)
+	cfg.DryRun = true
+	// Every optional write
+	cfg.WriteChecksums, cfg.WriteStatus, cfg.WriteFolders, cfg.WriteFolderMap = true, true, true, true
+	cfg.SyncFlags, cfg.Dedup = true, true
+	cfg.SyncExcludeFile = ".stignore"
+	cfg.DailyByteLimit = 1 << 30
+	cfg.RunLogs = 5
+	cfg.SummaryFile = filepath.Join(cfg.BackupDir, "summary.json")
+
+	summaries, err := runAccounts(context.Background(), cfg, gmailSvc.ProcessMailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summaries[0].Downloaded != 0 {
+		t.Errorf("dry run downloaded %d messages", summaries[0].Downloaded)
+	}
+
+	var written []string
+	_ = filepath.WalkDir(cfg.BackupDir, func(path string, d os.DirEntry, err error) error {
+		if path != cfg.BackupDir {
+			written = append(written, path)
+		}
+		return err
+	})
+	if len(written) != 0 {
+		t.Errorf("dry run wrote %v", written)
+	}
+}
+
+func TestContinuationAfterDailyLimit(t *testing.T) {
+	var msgs []*imaptest.Message
+	for uid := uint32(1); uid <= 3; uid++ {
+		msgs = append(msgs, &imaptest.Message{UID: uid, Body: []byte(fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", uid))})
+	}
+	srv := imaptest.NewServer(t)
+	srv.AddUser("user@example.com", "secret", &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: msgs})
+	cfg := srv.Config(t, "user@example.com", "secret")
+	cfg.DailyByteLimit = 1
+	cfg.FetchBatchSize = 1
+	cfg.DailyLimitTimezone = "Pacific/Kiritimati"
+	cfg.ContinueAfterLimit = true
+
+	summary, err := backup(context.Background(), cfg, logrus.NewEntry(logrus.StandardLogger()), gmailSvc.ProcessMailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !summary.DailyLimitReached || summary.Downloaded >= 3 {
+		t.Fatalf("limit not reached: %+v", summary)
+	}
+
+	// Just after the next midnight in DAILY_LIMIT_TIMEZONE
+	loc, err := loadLocation(cfg.DailyLimitTimezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, m, d := time.Now().In(loc).Date()
+	want := time.Date(y, m, d+1, 0, 1, 0, 0, loc)
+	if got := continuation(cfg, summary); !got.Equal(want) {
+		t.Errorf("continuation at %s, want %s", got, want)
+	}
+	// With ACCOUNTS, an account that finished doesn't cancel the continuation
+	if got := latestContinuation(cfg, []*gmailSvc.RunSummary{{}, summary}); !got.Equal(want) {
+		t.Errorf("continuation of two accounts at %s, want %s", got, want)
+	}
+
+	cfg.ContinueAfterLimit = false
+	if got := continuation(cfg, summary); !got.IsZero() {
+		t.Errorf("continuation at %s without CONTINUE_AFTER_LIMIT", got)
+	}
+	cfg.ContinueAfterLimit = true
+	if got := continuation(cfg, &gmailSvc.RunSummary{}); !got.IsZero() {
+		t.Errorf("continuation at %s for a run that finished", got)
+	}
+
+	cfg.DailyLimitTimezone = "Mars/Olympus_Mons"
+	if _, err := backup(context.Background(), cfg, logrus.NewEntry(logrus.StandardLogger()), gmailSvc.ProcessMailbox); err == nil {
+		t.Error("unknown DAILY_LIMIT_TIMEZONE accepted")
+	}
+}
+
+func TestRunLogWritten(t *testing.T) {
+	cfg := twoMailboxes(t)
+	cfg.RunLogs = 2
+	// Two older run logs, one of which is pruned
+	dir := filepath.Join(cfg.BackupDir, archiveSvc.RunLogsDir)
+	for _, old := range []time.Time{time.Now().Add(-48 * time.Hour), time.Now().Add(-24 * time.Hour)} {
+		f, err := archiveSvc.CreateRunLog(cfg.BackupDir, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	out := logrus.StandardLogger().Out
+
+	if _, err := runBackup(context.Background(), cfg, logrus.NewEntry(logrus.StandardLogger()), gmailSvc.ProcessMailbox); err != nil {
+		t.Fatal(err)
+	}
+	if logrus.StandardLogger().Out != out {
+		t.Error("log output not restored after the run")
+	}
+
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(logs) != 2 {
+		t.Fatalf("run logs %v, want the newest 2", logs)
+	}
+	data, err := os.ReadFile(logs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "Processing: Work") {
+		t.Errorf("run log holds %q", data)
+	}
+}
+
+func TestDeferredMailboxRetried(t *testing.T) {
+	// Work is unavailable for the whole first pass (3 SELECT attempts)
+	var refused atomic.Int32
+	srv := &imaptest.Server{Hook: func(s *imaptest.Session, cmd *imap.Command) bool {
+		if (cmd.Name == "SELECT" || cmd.Name == "EXAMINE") && fmt.Sprint(cmd.Arguments[0]) == "Work" && refused.Add(1) <= 3 {
+			s.NO(cmd.Tag, "[UNAVAILABLE] Mailbox is being migrated")
+			return true
+		}
+		return false
+	}}
+	srv.Start(t)
+	work := inbox("work", 2)
+	work.Name = "Work"
+	srv.AddUser("user@example.com", "secret", inbox("user", 1), work)
+	cfg := srv.Config(t, "user@example.com", "secret")
+
+	summary, err := runBackup(context.Background(), cfg, logrus.NewEntry(logrus.StandardLogger()), gmailSvc.ProcessMailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Deferred) != 1 || summary.Deferred[0] != "Work" {
+		t.Errorf("deferred %q, want [Work]", summary.Deferred)
+	}
+	for _, m := range summary.Mailboxes {
+		if m.Name == "Work" && (m.Deferred || m.Error != "" || m.Downloaded != 2) {
+			t.Errorf("Work after the retry pass: %+v", m)
+		}
+	}
+	if summary.Downloaded != 3 {
+		t.Errorf("downloaded %d, want 3", summary.Downloaded)
+	}
+}
+
+func TestArchiveThenVerify(t *testing.T) {
+	// One message of Work has malformed MIME, which only VERIFY_DEPTH=parse sees
+	mailboxes := func(t *testing.T) config.Config {
+		srv := imaptest.NewServer(t)
+		work := &imaptest.Mailbox{Name: "Work", UidValidity: 1, Messages: []*imaptest.Message{
+			{UID: 1, Body: []byte("Message-ID: <bad@example.com>\r\nContent-Type: multipart/mixed\r\n\r\nno boundary\r\n")},
+		}}
+		srv.AddUser("user@example.com", "secret", inbox("user", 2), work)
+		cfg := srv.Config(t, "user@example.com", "secret")
+		cfg.RunMode = "archive+verify"
+		cfg.WriteChecksums = true
+		return cfg
+	}
+
+	cfg := mailboxes(t)
+	cfg.VerifyDepth = "checksum"
+	summary, err := runBackup(context.Background(), cfg, logrus.NewEntry(logrus.StandardLogger()), gmailSvc.ProcessMailbox)
+	if err != nil || !summary.Verified || summary.Downloaded != 3 || len(summary.VerifyProblems) != 0 {
+		t.Fatalf("checksum depth: %v, %+v", err, summary)
+	}
+
+	cfg = mailboxes(t)
+	cfg.VerifyDepth = "parse"
+	summary, err = runBackup(context.Background(), cfg, logrus.NewEntry(logrus.StandardLogger()), gmailSvc.ProcessMailbox)
+	if err == nil || !strings.Contains(err.Error(), "verification found 1 problems") {
+		t.Errorf("parse depth: %v", err)
+	}
+	// The backup phase still ran in full
+	if !summary.Verified || summary.Downloaded != 3 || len(summary.VerifyProblems) != 1 || !strings.HasPrefix(summary.VerifyProblems[0], "Work/1.eml: does not parse") {
+		t.Errorf("parse depth summary: %+v", summary)
+	}
+	if code := runOnce(context.Background(), cfg, gmailSvc.ProcessMailbox); code != 1 {
+		t.Errorf("run with a verify failure exited with %d, want 1", code)
+	}
+
+	// A stored file changed after the checksums were written
+	cfg.VerifyDepth = "checksum"
+	path := gmailSvc.MessagePath(cfg.BackupDir, "INBOX", 1)
+	if err := os.WriteFile(path, []byte("Subject: tampered\r\n\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyArchive(cfg, &gmailSvc.RunSummary{}); err == nil {
+		t.Error("changed file passed the checksum verification")
+	}
+}
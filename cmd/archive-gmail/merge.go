@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+// runMergeCommand merges another archive directory into BACKUP_DIR
+func runMergeCommand(cfg config.Config, args []string) {
+	if len(args) != 1 {
+		logrus.Fatalf("Usage: archive-gmail merge <other-backup-dir>")
+	}
+
+	results, err := archiveSvc.Merge(args[0], cfg.BackupDir, cfg.IdentityFallback, cfg.DryRun)
+	if err != nil {
+		logrus.Fatalf("Merge failed: %v", err)
+	}
+
+	var copied, duplicates, conflicts int
+	for _, r := range results {
+		for _, c := range r.Conflicts {
+			logrus.Warnf("%s: UID %d: %s, %s", r.Dir, c.UID, c.Reason, c.Resolution)
+		}
+		if len(r.Copied) > 0 {
+			logrus.Infof("%s: %d copied, %d duplicates", r.Dir, len(r.Copied), r.Duplicates)
+		}
+		copied += len(r.Copied)
+		duplicates += r.Duplicates
+		conflicts += len(r.Conflicts)
+	}
+
+	if cfg.DryRun {
+		logrus.Infof("Dry run: nothing written")
+	}
+	logrus.Infof("Merge complete across %d mailboxes: %d copied, %d duplicates, %d conflicts", len(results), copied, duplicates, conflicts)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+// runReindexCommand rebuilds every mailbox manifest from the files on disk
+func runReindexCommand(cfg config.Config) {
+	results, err := archiveSvc.Reindex(cfg.BackupDir, cfg.DryRun)
+	if err != nil {
+		logrus.Fatalf("Reindex failed: %v", err)
+	}
+
+	var added, removed, changed int
+	for _, r := range results {
+		if len(r.Added)+len(r.Removed)+len(r.Changed) == 0 {
+			continue
+		}
+		logrus.Infof("%s: %d added, %d removed, %d changed", r.Dir, len(r.Added), len(r.Removed), len(r.Changed))
+		logrus.Debugf("  added=%v removed=%v changed=%v", r.Added, r.Removed, r.Changed)
+		added += len(r.Added)
+		removed += len(r.Removed)
+		changed += len(r.Changed)
+	}
+
+	if cfg.DryRun {
+		logrus.Infof("Dry run: manifests not written")
+	}
+	logrus.Infof("Reindex complete across %d mailboxes: %d added, %d removed, %d changed", len(results), added, removed, changed)
+}
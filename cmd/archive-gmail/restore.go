@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// runRestoreCommand uploads archived mailboxes back to the IMAP account
+func runRestoreCommand(ctx context.Context, cfg config.Config, args []string) {
+	if len(cfg.Accounts) > 0 {
+		logrus.Fatalf("restore works on a single account: unset ACCOUNTS and set GMAIL_EMAIL and BACKUP_DIR to the account and archive to restore")
+	}
+	folderMap := map[string]string{}
+	for _, pair := range cfg.RestoreFolderMap {
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(from) == "" || strings.TrimSpace(to) == "" {
+			logrus.Fatalf("Invalid RESTORE_FOLDER_MAP entry %q: must be <archived>=<target>", pair)
+		}
+		folderMap[strings.TrimSpace(from)] = strings.TrimSpace(to)
+	}
+
+	dirs := restoreDirs(cfg, args)
+	if len(dirs) == 0 {
+		logrus.Fatalf("Nothing to restore in %s", cfg.BackupDir)
+	}
+
+	c, err := gmailSvc.Connect(cfg)
+	if err != nil {
+		logrus.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Logout()
+
+	var appended, existing, skipped, failed int
+	for _, dir := range dirs {
+		m, err := archiveSvc.LoadManifest(dir, filepath.Base(dir))
+		if err != nil {
+			logrus.Errorf("Skipping %s: %v", dir, err)
+			failed++
+			continue
+		}
+		target, ok := folderMap[m.Mailbox]
+		if !ok {
+			target = cfg.RestorePrefix + m.Mailbox
+		}
+
+		logrus.Infof("Restoring %s to %s", m.Mailbox, target)
+		res, err := gmailSvc.RestoreMailbox(ctx, c, cfg, dir, target)
+		logrus.Infof("%s -> %s: %d appended, %d already there, %d skipped, %d failed", m.Mailbox, target, res.Appended, res.Existing, res.Skipped, res.Failed)
+		appended += res.Appended
+		existing += res.Existing
+		skipped += res.Skipped
+		failed += res.Failed
+		if err != nil {
+			logrus.Errorf("Restore of %s stopped: %v", m.Mailbox, err)
+			failed++
+			break
+		}
+	}
+
+	if cfg.DryRun {
+		logrus.Infof("Dry run: nothing appended")
+	}
+	logrus.Infof("Restore complete across %d mailboxes: %d appended, %d already there, %d skipped, %d failed", len(dirs), appended, existing, skipped, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// restoreDirs returns the mailbox directories named in args, or every one
+// with a manifest under BACKUP_DIR
+func restoreDirs(cfg config.Config, args []string) []string {
+	var dirs []string
+	if len(args) > 0 {
+		for _, box := range args {
+			dir := gmailSvc.MailboxDir(cfg.BackupDir, box)
+			if !utils.Exists(filepath.Join(dir, archiveSvc.ManifestFile)) {
+				logrus.Fatalf("No archive of %s in %s", box, dir)
+			}
+			dirs = append(dirs, dir)
+		}
+		return dirs
+	}
+
+	entries, err := os.ReadDir(cfg.BackupDir)
+	if err != nil {
+		logrus.Fatalf("Reading %s failed: %v", cfg.BackupDir, err)
+	}
+	for _, e := range entries {
+		dir := filepath.Join(cfg.BackupDir, e.Name())
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") && utils.Exists(filepath.Join(dir, archiveSvc.ManifestFile)) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// runTokenCommand handles `archive-gmail token export [path]`, which refreshes
+// the OAuth2 token and prints it, or writes it to path, for use on another
+// machine
+func runTokenCommand(cfg config.Config, args []string) {
+	if len(args) < 1 || len(args) > 2 || args[0] != "export" {
+		logrus.Fatal("Usage: archive-gmail token export [path]")
+	}
+
+	data, err := gmailSvc.ExportToken(cfg)
+	if err != nil {
+		logrus.Fatalf("Failed to export token: %v", err)
+	}
+
+	logrus.Warn("The exported token grants full access to this Gmail account. Do not share it, commit it or leave it in logs; revoke it in your Google account if it leaks.")
+	if len(args) == 1 {
+		fmt.Println(string(data))
+		return
+	}
+
+	if cfg.DryRun {
+		utils.DryRunWrite(args[1], int64(len(data)))
+		return
+	}
+	if err := utils.WriteFileAtomic(args[1], data, 0600); err != nil {
+		logrus.Fatalf("Failed writing %s: %v", args[1], err)
+	}
+	logrus.Infof("Exported token to %s; copy it to OAUTH2_TOKEN_FILE on the other machine", args[1])
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// verifyArchive runs the verification phase of RUN_MODE=archive+verify at
+// VERIFY_DEPTH, records problems in the summary and returns an error if any
+// were found, so the run's exit code reflects both phases
+func verifyArchive(cfg config.Config, summary *gmailSvc.RunSummary) error {
+	logrus.Infof("Verifying archive (depth %s)", cfg.VerifyDepth)
+	if !cfg.WriteChecksums {
+		logrus.Warn("WRITE_CHECKSUMS is off, stored files can't be checked against their checksums")
+	}
+
+	problems, err := archiveSvc.VerifyArchive(cfg.BackupDir, cfg.VerifyDepth != "checksum")
+	if err != nil {
+		return fmt.Errorf("verification failed: %w", err)
+	}
+
+	if cfg.VerifyDepth == "server" {
+		c, err := gmailSvc.Connect(cfg)
+		if err != nil {
+			return fmt.Errorf("verification failed: IMAP connect failed: %w", err)
+		}
+		defer c.Logout()
+
+		spot, err := gmailSvc.SpotCheck(c, cfg.BackupDir, cfg.VerifySample)
+		problems = append(problems, spot...)
+		if err != nil {
+			return fmt.Errorf("verification failed: %w", err)
+		}
+	}
+
+	summary.Verified = true
+	for _, p := range problems {
+		logrus.Warnf("Verify: %s: %s", p.Path, p.Reason)
+		summary.VerifyProblems = append(summary.VerifyProblems, fmt.Sprintf("%s: %s", p.Path, p.Reason))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("verification found %d problems", len(problems))
+	}
+	logrus.Info("Verification complete: no problems found")
+	return nil
+}
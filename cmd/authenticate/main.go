@@ -5,13 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
 )
 
 func main() {
@@ -44,7 +47,7 @@ func main() {
 		fmt.Println("Loaded existing token. Attempting refresh if needed...")
 	} else {
 		fmt.Println("No valid token found, performing new OAuth2 login flow...")
-		token = loginFlow(conf)
+		token = loginFlow(ctx, conf)
 		saveToken(tokenFile, token)
 		fmt.Printf("Token saved to %s\n", tokenFile)
 	}
@@ -88,25 +91,15 @@ func saveToken(file string, token *oauth2.Token) {
 	}
 }
 
-// loginFlow runs the interactive OAuth2 login flow
-func loginFlow(conf *oauth2.Config) *oauth2.Token {
-	authURL := conf.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.ApprovalForce)
-	fmt.Println("\nOpen this URL in a browser, sign in, and copy the code from the redirect URL:")
-	fmt.Println(authURL)
-	fmt.Print("\nEnter code: ")
-
-	var rawCode string
-	fmt.Scanln(&rawCode)
-
-	code, err := url.QueryUnescape(rawCode)
-	if err != nil {
-		log.Fatalf("Failed to decode code: %v", err)
-	}
+// loginFlow runs the interactive OAuth2 login flow, receiving the redirect on
+// a local port unless OAUTH2_LOGIN=manual (see gmailService.Login)
+func loginFlow(ctx context.Context, conf *oauth2.Config) *oauth2.Token {
+	mode := strings.ToLower(os.Getenv("OAUTH2_LOGIN"))
+	port, _ := strconv.Atoi(os.Getenv("OAUTH2_REDIRECT_PORT"))
 
-	ctx := context.Background()
-	token, err := conf.Exchange(ctx, code)
+	token, err := gmailSvc.Login(ctx, conf, mode, port)
 	if err != nil {
-		log.Fatalf("Failed to exchange code for token: %v", err)
+		log.Fatalf("OAuth2 login failed: %v", err)
 	}
 
 	// Set expiry buffer in case of clock skew
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Account is one entry of ACCOUNTS: a Gmail account backed up in the same
+// invocation as the others, into its own directory under BACKUP_DIR. Empty
+// fields fall back to the top-level settings, except Password.
+type Account struct {
+	Email           string `json:"email"`
+	Password        string `json:"password,omitempty"`
+	ClientID        string `json:"client_id,omitempty"`
+	ClientSecret    string `json:"client_secret,omitempty"`
+	OAuth2TokenFile string `json:"oauth2_token_file,omitempty"`
+	BackupSubdir    string `json:"backup_subdir,omitempty"`
+
+	ServiceAccountFile string   `json:"service_account_file,omitempty"`
+	FoldersOnly        []string `json:"folders_only,omitempty"`
+	FoldersExclude     []string `json:"folders_exclude,omitempty"`
+	MaxWorkers         int      `json:"max_workers,omitempty"`
+}
+
+// parseAccounts reads ACCOUNTS, a JSON list of account objects (a native list
+// in the config file)
+func parseAccounts(v string) ([]Account, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+
+	var accounts []Account
+	dec := json.NewDecoder(strings.NewReader(v))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&accounts); err != nil {
+		return nil, fmt.Errorf("parsing ACCOUNTS: %w", err)
+	}
+
+	seen := map[string]bool{}
+	for i, a := range accounts {
+		if a.Email == "" {
+			return nil, fmt.Errorf("ACCOUNTS entry %d has no email", i+1)
+		}
+		if seen[a.Email] {
+			return nil, fmt.Errorf("ACCOUNTS lists %s twice", a.Email)
+		}
+		seen[a.Email] = true
+		if a.MaxWorkers < 0 {
+			return nil, fmt.Errorf("ACCOUNTS entry %s has a negative max_workers", a.Email)
+		}
+	}
+	return accounts, nil
+}
+
+// ForAccount returns the configuration for backing up one ACCOUNTS entry: its
+// email, credentials, folder filters and worker count,
+// BACKUP_DIR/<backup_subdir or email>, and a token file and SUMMARY_FILE of
+// its own
+func (c Config) ForAccount(a Account) Config {
+	subdir := a.BackupSubdir
+	if subdir == "" {
+		subdir = a.Email
+	}
+
+	c.Email = a.Email
+	c.Password = a.Password
+	if a.ClientID != "" {
+		c.ClientID = a.ClientID
+	}
+	if a.ClientSecret != "" {
+		c.ClientSecret = a.ClientSecret
+	}
+	tokenFile := a.OAuth2TokenFile
+	if tokenFile == "" {
+		tokenFile = filepath.Join(filepath.Dir(c.OAuth2TokenFile), "token-"+a.Email+".json")
+	}
+	c.OAuth2TokenFile = tokenFile
+	if a.ServiceAccountFile != "" {
+		c.ServiceAccountFile = a.ServiceAccountFile
+	}
+	if len(a.FoldersOnly) > 0 {
+		c.FoldersOnly = folderSet(a.FoldersOnly)
+	}
+	if len(a.FoldersExclude) > 0 {
+		c.FoldersExclude = folderSet(a.FoldersExclude)
+	}
+	if a.MaxWorkers > 0 {
+		c.MaxWorkers = a.MaxWorkers
+	}
+	c.BackupDir = filepath.Join(c.BackupDir, subdir)
+	if c.SummaryFile != "" {
+		ext := filepath.Ext(c.SummaryFile)
+		c.SummaryFile = strings.TrimSuffix(c.SummaryFile, ext) + "-" + subdir + ext
+	}
+	c.Accounts = nil
+	return c
+}
+
+// folderSet returns the set of the non-empty folder names in list
+func folderSet(list []string) map[string]bool {
+	set := map[string]bool{}
+	for _, f := range list {
+		if f = strings.TrimSpace(f); f != "" {
+			set[f] = true
+		}
+	}
+	return set
+}
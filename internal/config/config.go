@@ -2,47 +2,151 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/redjax/archive-gmail/internal/utils"
 )
 
 type Config struct {
-	Email         string
-	Password      string
-	BackupDir     string
-	ImapServer    string
-	ImapPort      int
-	FoldersOnly   map[string]bool
-	MaxWorkers    int
-	DryRun        bool
-	TLSSkipVerify bool
-	LogLevel      string
-
-	ClientID        string
-	ClientSecret    string
-	OAuth2TokenFile string
-
-	CronSchedule string
+	Email               string
+	Password            string
+	BackupDir           string
+	Provider            string
+	ImapServer          string
+	ImapPort            int
+	FoldersOnly         map[string]bool
+	FoldersExclude      map[string]bool
+	FoldersOnlyMissing  string
+	MaxMailboxes        int
+	MaxWorkers          int
+	DownloadWorkers     int
+	MaxConcurrentWrites int
+	PipelineDepth       int
+	MaxReconnects       int
+	FetchRetries        int
+	FetchBatchSize      int
+	MaxLoadAvg          float64
+	RequestsPerSecond   float64
+	ScanChunkSize       int
+	MaxScanChunks       int
+	AllMailChunkSize    int
+	DryRun              bool
+	TLSSkipVerify       bool
+	TLSClientCert       string
+	TLSClientKey        string
+	LogLevel            string
+	LogRedact           bool
+	RunLogs             int
+	RunMode             string
+	Backend             string
+	VerifyDepth         string
+	VerifySample        int
+	ProgressPercent     int
+
+	GmailExtensions bool
+	ThreadLayout    bool
+
+	DailyByteLimit     int64
+	DailyLimitTimezone string
+	ContinueAfterLimit bool
+	NormalizeEOL       string
+	MaxMessageSize     int64
+	StubSkipped        bool
+	StorageFormat      string
+	Compress           bool
+	Dedup              bool
+	Verify             bool
+	TextOnly           bool
+	TextOnlyHTML       bool
+	LowUidNext         string
+	MailboxDirEncoding string
+	MaxDirNameBytes    int
+	SampleMode         string
+	SampleSize         int
+	Since              string
+	WriteChecksums     bool
+	CheckMIME          bool
+	ClientCompatCheck  bool
+	WriteStatus        bool
+	SummaryFile        string
+	SyncExcludeFile    string
+	ExportProfile      string
+	ExportSplit        string
+	RestoreFolderMap   []string
+	RestorePrefix      string
+	WriteFolderMap     bool
+	WriteFolders       bool
+
+	MailboxChangeAction    string
+	BodyFetchMode          string
+	ForceResync            bool
+	IncrementalScan        bool
+	UidValidityAction      string
+	TransientMailboxAction string
+	SyncFlags              bool
+	QResync                bool
+	TrustServer            bool
+	OnConflict             string
+	FromFilter             []string
+	ToFilter               []string
+	IdentityFallback       []string
+
+	ClientID           string
+	ClientSecret       string
+	OAuth2TokenFile    string
+	OAuth2TokenStore   string
+	OAuth2Login        string
+	OAuth2RedirectPort int
+	UseKeyring         bool
+	ServiceAccountFile string
+	SASLMechanism      string
+	OAuth2AuthURL      string
+	OAuth2TokenURL     string
+	OAuth2DeviceURL    string
+	OAuth2Scopes       []string
+	WorkspaceDomain    string
+	WorkspaceAdmin     string
+
+	CronSchedule    string
+	CronTimezone    string
+	CronWithSeconds bool
+
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+	ReportTo     string
+
+	HealthcheckURL     string
+	HealthcheckFailURL string
+	MetricsAddr        string
+
+	Accounts       []Account
+	AccountWorkers int
 }
 
 func getenv(key, def string) string {
-	if v := os.Getenv(key); v != "" {
+	if v := lookup(key); v != "" {
 		return v
 	}
 	return def
 }
 
 func getenvBool(key string, def bool) bool {
-	if v := os.Getenv(key); v != "" {
+	boolKeys[key] = true
+	if v := lookup(key); v != "" {
 		return strings.ToLower(v) == "true"
 	}
 	return def
 }
 
 func getenvInt(key string, def int) int {
-	if v := os.Getenv(key); v != "" {
+	if v := lookup(key); v != "" {
 		if i, err := strconv.Atoi(v); err == nil {
 			return i
 		}
@@ -50,36 +154,234 @@ func getenvInt(key string, def int) int {
 	return def
 }
 
-func LoadConfig() Config {
+func getenvFloat(key string, def float64) float64 {
+	if v := lookup(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+func getenvSize(key string, def int64) int64 {
+	if v := lookup(key); v != "" {
+		if n, err := utils.ParseSize(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func getenvList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(lookup(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// LoadConfig reads the configuration from the command line, the environment
+// and the CONFIG_FILE (or -config) YAML file, or
+// ~/.config/archive_gmail/config.yaml when neither is set. Flags override the
+// environment, which overrides the file. Every setting has a flag (see
+// registerFlags); flags are parsed here, so flags of the caller must be
+// defined before.
+func LoadConfig() (Config, error) {
+	if path := configPath(os.Args[1:]); path != "" {
+		values, err := loadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		fileValues = values
+	}
+
+	// The first pass finds every setting, which gets a flag; the flags are then
+	// parsed and the configuration read again with them
+	if _, err := readConfig(); err != nil {
+		return Config{}, err
+	}
+	registerFlags(flag.CommandLine)
+	args = parseInterspersed(flag.CommandLine, os.Args[1:])
+	return readConfig()
+}
+
+// readConfig reads every setting (see lookup)
+func readConfig() (Config, error) {
+	if err := loadSecretFiles(); err != nil {
+		return Config{}, err
+	}
+
 	folders := map[string]bool{}
-	if v := os.Getenv("FOLDERS_ONLY"); v != "" {
+	if v := lookup("FOLDERS_ONLY"); v != "" {
 		for _, f := range strings.Split(v, ",") {
 			folders[strings.TrimSpace(f)] = true
 		}
 	}
 
+	providerName := strings.ToLower(getenv("PROVIDER", "gmail"))
+	provider, ok := providers[providerName]
+	if !ok {
+		return Config{}, fmt.Errorf("unknown PROVIDER %q: must be gmail, outlook, yahoo, icloud or fastmail", providerName)
+	}
+
+	excludeList := getenvList("FOLDERS_EXCLUDE")
+	if lookup("FOLDERS_EXCLUDE") == "" {
+		excludeList = provider.FoldersExclude
+	}
+	exclude := map[string]bool{}
+	for _, f := range excludeList {
+		exclude[f] = true
+	}
+
+	scopes := getenvList("OAUTH2_SCOPES")
+	if len(scopes) == 0 {
+		scopes = provider.Scopes
+	}
+
 	home, _ := os.UserHomeDir()
 	defaultTokenFile := filepath.Join(home, ".config", "archive_gmail", "token.json")
 
-	cronSchedule := os.Getenv("CRON_SCHEDULE")
-
-	// Define flag with env var as default
-	cronFlag := flag.String("schedule", cronSchedule, "Cron schedule (overrides CRON_SCHEDULE)")
-
-	return Config{
-		Email:           os.Getenv("GMAIL_EMAIL"),
-		Password:        os.Getenv("GMAIL_PASSWORD"),
-		BackupDir:       getenv("BACKUP_DIR", "./backups"),
-		ImapServer:      getenv("IMAP_SERVER", "imap.gmail.com"),
-		ImapPort:        getenvInt("IMAP_PORT", 993),
-		FoldersOnly:     folders,
-		MaxWorkers:      getenvInt("MAX_WORKERS", 1),
-		DryRun:          getenvBool("DRY_RUN", false),
-		TLSSkipVerify:   getenvBool("TLS_SKIP_VERIFY", false),
-		LogLevel:        getenv("LOG_LEVEL", "INFO"),
-		ClientID:        getenv("GMAIL_CLIENT_ID", ""),
-		ClientSecret:    getenv("GMAIL_CLIENT_SECRET", ""),
-		OAuth2TokenFile: getenv("OAUTH2_TOKEN_FILE", defaultTokenFile),
-		CronSchedule:    *cronFlag,
+	identityFallback := getenvList("MESSAGE_ID_FALLBACK")
+	if len(identityFallback) == 0 {
+		identityFallback = []string{"resent-message-id", "date-from"}
+	}
+
+	accounts, err := parseAccounts(lookup("ACCOUNTS"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	// Export profiles change the defaults of a group of options; explicitly set
+	// env vars still win
+	exportProfile := strings.ToLower(getenv("EXPORT_PROFILE", ""))
+	defaultEOL, defaultFolderMap := utils.EOLNone, false
+	if exportProfile == "outlook" {
+		defaultEOL, defaultFolderMap = utils.EOLCRLF, true
+	}
+
+	cfg := Config{
+		Email:               lookup("GMAIL_EMAIL"),
+		Password:            lookup("GMAIL_PASSWORD"),
+		BackupDir:           getenv("BACKUP_DIR", "./backups"),
+		Provider:            providerName,
+		ImapServer:          getenv("IMAP_SERVER", provider.ImapServer),
+		ImapPort:            getenvInt("IMAP_PORT", provider.ImapPort),
+		FoldersOnly:         folders,
+		FoldersExclude:      exclude,
+		FoldersOnlyMissing:  strings.ToLower(getenv("FOLDERS_ONLY_MISSING", "warn")),
+		MaxMailboxes:        getenvInt("MAX_MAILBOXES", 0),
+		MaxWorkers:          getenvInt("MAX_WORKERS", 1),
+		DownloadWorkers:     getenvInt("DOWNLOAD_WORKERS", 1),
+		MaxConcurrentWrites: getenvInt("MAX_CONCURRENT_WRITES", 0),
+		PipelineDepth:       getenvInt("PIPELINE_DEPTH", 0),
+		MaxReconnects:       getenvInt("MAX_RECONNECTS", 3),
+		FetchRetries:        getenvInt("FETCH_RETRIES", 2),
+		FetchBatchSize:      getenvInt("FETCH_BATCH_SIZE", 25),
+		MaxLoadAvg:          getenvFloat("MAX_LOAD_AVG", 0),
+		RequestsPerSecond:   getenvFloat("REQUESTS_PER_SECOND", 20),
+		ScanChunkSize:       getenvInt("SCAN_CHUNK_SIZE", 0),
+		MaxScanChunks:       getenvInt("MAX_SCAN_CHUNKS", 0),
+		AllMailChunkSize:    getenvInt("ALL_MAIL_CHUNK_SIZE", 0),
+		DryRun:              getenvBool("DRY_RUN", false),
+		TLSSkipVerify:       getenvBool("TLS_SKIP_VERIFY", false),
+		TLSClientCert:       getenv("TLS_CLIENT_CERT", ""),
+		TLSClientKey:        getenv("TLS_CLIENT_KEY", ""),
+		LogLevel:            getenv("LOG_LEVEL", "INFO"),
+		LogRedact:           getenvBool("LOG_REDACT", false),
+		RunLogs:             getenvInt("RUN_LOGS", 0),
+		RunMode:             strings.ToLower(getenv("RUN_MODE", "archive")),
+		Backend:             strings.ToLower(getenv("BACKEND", "imap")),
+		VerifyDepth:         strings.ToLower(getenv("VERIFY_DEPTH", "checksum")),
+		VerifySample:        getenvInt("VERIFY_SAMPLE", 20),
+		ProgressPercent:     getenvInt("PROGRESS_PERCENT", 5),
+
+		GmailExtensions: getenvBool("GMAIL_EXTENSIONS", provider.GmailExtensions),
+		ThreadLayout:    getenvBool("THREAD_LAYOUT", false),
+
+		DailyByteLimit:     getenvSize("DAILY_BYTE_LIMIT", 0),
+		DailyLimitTimezone: getenv("DAILY_LIMIT_TIMEZONE", ""),
+		ContinueAfterLimit: getenvBool("CONTINUE_AFTER_LIMIT", false),
+		NormalizeEOL:       strings.ToLower(getenv("NORMALIZE_EOL", defaultEOL)),
+		MaxMessageSize:     getenvSize("MAX_MESSAGE_SIZE", 0),
+		StubSkipped:        getenvBool("STUB_SKIPPED", false),
+		StorageFormat:      strings.ToLower(getenv("STORAGE_FORMAT", "eml")),
+		Compress:           getenvBool("COMPRESS", false),
+		Dedup:              getenvBool("DEDUP", false),
+		Verify:             getenvBool("VERIFY", false),
+		TextOnly:           getenvBool("TEXT_ONLY", false),
+		TextOnlyHTML:       getenvBool("TEXT_ONLY_HTML", false),
+		LowUidNext:         strings.ToLower(getenv("LOW_UIDNEXT", "skip")),
+		MailboxDirEncoding: strings.ToLower(getenv("MAILBOX_DIR_ENCODING", "utf8")),
+		MaxDirNameBytes:    getenvInt("MAX_DIR_NAME_BYTES", 255),
+		SampleMode:         strings.ToLower(getenv("SAMPLE_MODE", "")),
+		SampleSize:         getenvInt("SAMPLE_SIZE", 0),
+		Since:              getenv("SINCE", ""),
+		WriteChecksums:     getenvBool("WRITE_CHECKSUMS", false),
+		CheckMIME:          getenvBool("CHECK_MIME", false),
+		ClientCompatCheck:  getenvBool("CLIENT_COMPAT_CHECK", false),
+		WriteStatus:        getenvBool("WRITE_STATUS", false),
+		SummaryFile:        getenv("SUMMARY_FILE", ""),
+		SyncExcludeFile:    getenv("SYNC_EXCLUDE_FILE", ""),
+		ExportProfile:      exportProfile,
+		ExportSplit:        strings.ToLower(getenv("EXPORT_SPLIT", "folder")),
+		RestoreFolderMap:   getenvList("RESTORE_FOLDER_MAP"),
+		RestorePrefix:      getenv("RESTORE_PREFIX", ""),
+		WriteFolderMap:     getenvBool("WRITE_FOLDER_MAP", defaultFolderMap),
+		WriteFolders:       getenvBool("WRITE_FOLDERS", false),
+
+		MailboxChangeAction:    strings.ToLower(getenv("MAILBOX_CHANGE_ACTION", "log")),
+		BodyFetchMode:          strings.ToLower(getenv("BODY_FETCH_MODE", "body-peek")),
+		ForceResync:            getenvBool("FORCE_RESYNC", false),
+		IncrementalScan:        getenvBool("INCREMENTAL_SCAN", true),
+		UidValidityAction:      strings.ToLower(getenv("UIDVALIDITY_ACTION", "resync")),
+		TransientMailboxAction: strings.ToLower(getenv("TRANSIENT_MAILBOX_ACTION", "defer")),
+		SyncFlags:              getenvBool("SYNC_FLAGS", true),
+		QResync:                getenvBool("QRESYNC", true),
+		TrustServer:            getenvBool("TRUST_SERVER", false),
+		OnConflict:             strings.ToLower(getenv("ON_CONFLICT", "overwrite")),
+		FromFilter:             getenvList("FROM_FILTER"),
+		ToFilter:               getenvList("TO_FILTER"),
+		IdentityFallback:       identityFallback,
+
+		ClientID:           getenv("GMAIL_CLIENT_ID", ""),
+		ClientSecret:       getenv("GMAIL_CLIENT_SECRET", ""),
+		OAuth2TokenFile:    getenv("OAUTH2_TOKEN_FILE", defaultTokenFile),
+		OAuth2TokenStore:   strings.ToLower(getenv("OAUTH2_TOKEN_STORE", "file")),
+		OAuth2Login:        strings.ToLower(getenv("OAUTH2_LOGIN", "auto")),
+		OAuth2RedirectPort: getenvInt("OAUTH2_REDIRECT_PORT", 0),
+		UseKeyring:         getenvBool("USE_KEYRING", false),
+		ServiceAccountFile: getenv("GMAIL_SERVICE_ACCOUNT_FILE", ""),
+		SASLMechanism:      strings.ToLower(getenv("SASL_MECHANISM", "auto")),
+		OAuth2AuthURL:      getenv("OAUTH2_AUTH_URL", provider.AuthURL),
+		OAuth2TokenURL:     getenv("OAUTH2_TOKEN_URL", provider.TokenURL),
+		OAuth2DeviceURL:    getenv("OAUTH2_DEVICE_AUTH_URL", provider.DeviceAuthURL),
+		OAuth2Scopes:       scopes,
+		WorkspaceDomain:    getenv("WORKSPACE_DOMAIN", ""),
+		WorkspaceAdmin:     getenv("WORKSPACE_ADMIN", ""),
+
+		CronSchedule:    getenv("CRON_SCHEDULE", ""),
+		CronTimezone:    getenv("CRON_TIMEZONE", ""),
+		CronWithSeconds: getenvBool("CRON_WITH_SECONDS", false),
+
+		SMTPHost:     getenv("SMTP_HOST", ""),
+		SMTPPort:     getenvInt("SMTP_PORT", 587),
+		SMTPUsername: getenv("SMTP_USERNAME", ""),
+		SMTPPassword: getenv("SMTP_PASSWORD", ""),
+		SMTPFrom:     getenv("SMTP_FROM", ""),
+		ReportTo:     getenv("REPORT_TO", ""),
+
+		HealthcheckURL:     getenv("HEALTHCHECK_URL", ""),
+		HealthcheckFailURL: getenv("HEALTHCHECK_FAIL_URL", ""),
+		MetricsAddr:        getenv("METRICS_ADDR", ""),
+
+		Accounts:       accounts,
+		AccountWorkers: getenvInt("ACCOUNT_WORKERS", 1),
+	}
+
+	if unknown := unknownFileKeys(); len(unknown) > 0 {
+		return cfg, fmt.Errorf("unknown settings in config file: %s", strings.Join(unknown, ", "))
 	}
+	return cfg, nil
 }
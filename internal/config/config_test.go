@@ -0,0 +1,28 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+func TestOutlookExportProfile(t *testing.T) {
+	t.Setenv("EXPORT_PROFILE", "outlook")
+	cfg, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.NormalizeEOL != utils.EOLCRLF || !cfg.WriteFolderMap {
+		t.Errorf("outlook profile: NORMALIZE_EOL=%q WRITE_FOLDER_MAP=%t", cfg.NormalizeEOL, cfg.WriteFolderMap)
+	}
+
+	// Explicit settings win over the profile
+	t.Setenv("NORMALIZE_EOL", utils.EOLLF)
+	t.Setenv("WRITE_FOLDER_MAP", "false")
+	if cfg, err = readConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.NormalizeEOL != utils.EOLLF || cfg.WriteFolderMap {
+		t.Errorf("overridden profile: NORMALIZE_EOL=%q WRITE_FOLDER_MAP=%t", cfg.NormalizeEOL, cfg.WriteFolderMap)
+	}
+}
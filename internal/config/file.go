@@ -0,0 +1,140 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileValues holds the settings read from CONFIG_FILE, keyed by env var name.
+// The environment takes precedence over them.
+var fileValues = map[string]string{}
+
+// usedKeys records every setting LoadConfig looked up, so keys in the config
+// file that match none of them can be reported
+var usedKeys = map[string]bool{}
+
+// lookup returns the setting key given as a flag, or else the env var key or
+// the secret in its <key>_FILE (see loadSecretFiles), falling back to the
+// config file
+func lookup(key string) string {
+	usedKeys[key] = true
+	if v, ok := flagValues[key]; ok {
+		return v
+	}
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	if v, ok := secretValues[key]; ok {
+		return v
+	}
+	return fileValues[key]
+}
+
+// configPath returns the config file from -config/--config on the command
+// line or CONFIG_FILE, or the default config file when it exists. It is read
+// before flag.Parse, since every other setting depends on it.
+func configPath(args []string) string {
+	for i, a := range args {
+		switch {
+		case a == "-config" || a == "--config":
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+		case strings.HasPrefix(a, "-config=") || strings.HasPrefix(a, "--config="):
+			return a[strings.Index(a, "=")+1:]
+		case a == "--":
+			return envConfigPath()
+		}
+	}
+	return envConfigPath()
+}
+
+// envConfigPath returns CONFIG_FILE, or the first existing default config
+// file (config.yaml or config.yml in ~/.config/archive_gmail)
+func envConfigPath() string {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	for _, name := range []string{"config.yaml", "config.yml"} {
+		path := filepath.Join(home, ".config", "archive_gmail", name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// loadFile reads a YAML config file. Keys are the env var names in any case
+// (i.e. gmail_email or GMAIL_EMAIL); lists such as folders_only are written as
+// YAML lists.
+func loadFile(path string) (map[string]string, error) {
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		return nil, fmt.Errorf("%s: only YAML config files are supported", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&raw); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	for k, v := range raw {
+		key := strings.ToUpper(k)
+		switch v := v.(type) {
+		case nil:
+		case []interface{}:
+			// A list of objects (accounts) is passed on as JSON, the form the
+			// env var takes
+			if len(v) > 0 {
+				if _, ok := v[0].(map[string]interface{}); ok {
+					data, err := json.Marshal(v)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %s: %w", path, k, err)
+					}
+					values[key] = string(data)
+					continue
+				}
+			}
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("%s: %s must be a value or a list", path, k)
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// unknownFileKeys returns config file keys that LoadConfig never looked up
+func unknownFileKeys() []string {
+	var unknown []string
+	for key := range fileValues {
+		if !usedKeys[key] {
+			unknown = append(unknown, strings.ToLower(key))
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"flag"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// flagValues holds the settings given on the command line, keyed by env var
+// name. They take precedence over the environment.
+var flagValues = map[string]string{}
+
+// boolKeys records the settings read as booleans, whose flags can be given
+// without a value (--dry-run)
+var boolKeys = map[string]bool{}
+
+// args holds the command line arguments left after the flags
+var args []string
+
+// flagAliases are short flag names for common settings
+var flagAliases = map[string]string{
+	"email":    "GMAIL_EMAIL",
+	"password": "GMAIL_PASSWORD",
+	"folders":  "FOLDERS_ONLY",
+	"exclude":  "FOLDERS_EXCLUDE",
+	"workers":  "MAX_WORKERS",
+	"schedule": "CRON_SCHEDULE",
+}
+
+// settingFlag sets a setting from the command line
+type settingFlag struct {
+	key    string
+	isBool bool
+}
+
+func (f *settingFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return flagValues[f.key]
+}
+
+func (f *settingFlag) Set(v string) error {
+	flagValues[f.key] = v
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool { return f.isBool }
+
+// FlagName returns the flag of the setting key: the env var name in lower
+// case with dashes, i.e. --dry-run for DRY_RUN
+func FlagName(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+// registerFlags defines a flag on fs for every setting LoadConfig reads, the
+// aliases, and -config. Flags fs already has are left alone.
+func registerFlags(fs *flag.FlagSet) {
+	define := func(name, key, usage string) {
+		if fs.Lookup(name) == nil {
+			fs.Var(&settingFlag{key: key, isBool: boolKeys[key]}, name, usage)
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(usedKeys)) {
+		define(FlagName(key), key, "Overrides "+key)
+	}
+	for name, key := range flagAliases {
+		define(name, key, "Same as --"+FlagName(key))
+	}
+	if fs.Lookup("config") == nil {
+		fs.String("config", "", "YAML config file (overrides CONFIG_FILE)")
+	}
+}
+
+// parseInterspersed parses the flags in args with fs, also after the command
+// and other arguments (archive-gmail backup --dry-run), and returns the
+// arguments that aren't flags. Everything after "--" is an argument.
+func parseInterspersed(fs *flag.FlagSet, arguments []string) []string {
+	var rest, tail []string
+	if i := slices.Index(arguments, "--"); i >= 0 {
+		arguments, tail = arguments[:i], arguments[i+1:]
+	}
+	for {
+		// Parse exits on errors with the default ExitOnError
+		_ = fs.Parse(arguments)
+		if fs.NArg() == 0 {
+			break
+		}
+		rest = append(rest, fs.Arg(0))
+		arguments = fs.Args()[1:]
+	}
+	return append(rest, tail...)
+}
+
+// Args returns the command line arguments that aren't flags, like flag.Args
+func Args() []string {
+	return args
+}
+
+// Arg returns the i'th argument that isn't a flag, or "" like flag.Arg
+func Arg(i int) string {
+	if i < 0 || i >= len(args) {
+		return ""
+	}
+	return args[i]
+}
@@ -0,0 +1,55 @@
+package config
+
+// Provider is a PROVIDER preset: the defaults of the server, OAuth2 and folder
+// settings for a mail provider. Explicitly set env vars still win.
+type Provider struct {
+	ImapServer string
+	ImapPort   int
+
+	// OAuth2 endpoints and scopes; empty for providers that only allow app
+	// passwords for third-party IMAP clients
+	AuthURL       string
+	TokenURL      string
+	DeviceAuthURL string
+	Scopes        []string
+
+	// FoldersExclude lists folders that hold no mail of their own
+	FoldersExclude  []string
+	GmailExtensions bool
+}
+
+// providers are the PROVIDER presets
+var providers = map[string]Provider{
+	"gmail": {
+		ImapServer:      "imap.gmail.com",
+		ImapPort:        993,
+		AuthURL:         "https://accounts.google.com/o/oauth2/auth",
+		TokenURL:        "https://oauth2.googleapis.com/token",
+		DeviceAuthURL:   "https://oauth2.googleapis.com/device/code",
+		Scopes:          []string{"https://mail.google.com/"},
+		GmailExtensions: true,
+	},
+	"outlook": {
+		ImapServer:    "outlook.office365.com",
+		ImapPort:      993,
+		AuthURL:       "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+		TokenURL:      "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+		DeviceAuthURL: "https://login.microsoftonline.com/common/oauth2/v2.0/devicecode",
+		Scopes:        []string{"https://outlook.office.com/IMAP.AccessAsUser.All", "offline_access"},
+		// Outbox holds unsent drafts; Sync Issues holds Outlook's own conflict
+		// and failure reports
+		FoldersExclude: []string{"Outbox", "Sync Issues*"},
+	},
+	"yahoo": {
+		ImapServer: "imap.mail.yahoo.com",
+		ImapPort:   993,
+	},
+	"icloud": {
+		ImapServer: "imap.mail.me.com",
+		ImapPort:   993,
+	},
+	"fastmail": {
+		ImapServer: "imap.fastmail.com",
+		ImapPort:   993,
+	},
+}
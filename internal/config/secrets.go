@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// secretKeys are the settings that can also be read from the file named by
+// <key>_FILE, i.e. a mounted Docker or Kubernetes secret
+var secretKeys = []string{
+	"GMAIL_PASSWORD",
+	"GMAIL_CLIENT_ID",
+	"GMAIL_CLIENT_SECRET",
+	"SMTP_USERNAME",
+	"SMTP_PASSWORD",
+	"HEALTHCHECK_URL",
+	"HEALTHCHECK_FAIL_URL",
+}
+
+// secretValues holds the secrets read from their <key>_FILE
+var secretValues = map[string]string{}
+
+// loadSecretFiles reads the file of every secret whose <key>_FILE is set. A
+// trailing newline, as most editors and `echo` leave, is not part of the
+// secret.
+func loadSecretFiles() error {
+	secretValues = map[string]string{}
+	for _, key := range secretKeys {
+		path := lookup(key + "_FILE")
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading %s_FILE: %w", key, err)
+		}
+		secretValues[key] = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
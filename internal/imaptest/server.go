@@ -0,0 +1,855 @@
+package imaptest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/utf7"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// Message is a message stored on the fake server
+type Message struct {
+	UID      uint32
+	Body     []byte
+	Flags    []string
+	Date     time.Time
+	MsgID    uint64 // X-GM-MSGID
+	ThreadID uint64 // X-GM-THRID
+	Labels   []string
+	ModSeq   uint64
+
+	// Structure is written as-is for BODYSTRUCTURE; empty means a single
+	// text/plain part
+	Structure string
+	// Sections holds the bodies of BODY[<part>] sections by part number, e.g.
+	// "1" or "2.1", for messages with a Structure
+	Sections map[string][]byte
+}
+
+// Mailbox is a mailbox of a user of the fake server
+type Mailbox struct {
+	Name          string
+	Attributes    []string
+	UidValidity   uint32
+	UidNext       uint32 // 0 means the highest UID + 1
+	HighestModSeq uint64
+	Messages      []*Message
+}
+
+func (m *Mailbox) uidNext() uint32 {
+	if m.UidNext != 0 {
+		return m.UidNext
+	}
+	var next uint32 = 1
+	for _, msg := range m.Messages {
+		next = max(next, msg.UID+1)
+	}
+	return next
+}
+
+// Server is a scripted IMAP server over TLS. Fields are set before Start.
+type Server struct {
+	// Caps are advertised along with IMAP4rev1
+	Caps []string
+	// Hook sees every command before the server does, and returns true when
+	// it answered it
+	Hook func(s *Session, cmd *imap.Command) bool
+	// ClientCAs, when set, makes clients present a certificate signed by one
+	// of them
+	ClientCAs *x509.CertPool
+
+	ln    net.Listener
+	mu    sync.Mutex
+	users map[string]*user
+	cmds  []string
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+type user struct {
+	password string
+	boxes    []*Mailbox
+}
+
+// NewServer starts a server without capabilities or hooks
+func NewServer(t testing.TB) *Server {
+	s := &Server{}
+	s.Start(t)
+	return s
+}
+
+// Start listens on a local port until the test ends
+func (s *Server) Start(t testing.TB) {
+	t.Helper()
+	cert, err := selfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if s.ClientCAs != nil {
+		tlsCfg.ClientCAs = s.ClientCAs
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	s.ln, err = tls.Listen("tcp", "127.0.0.1:0", tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	if s.users == nil {
+		s.users = map[string]*user{}
+	}
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+}
+
+// Close stops the listener, drops open sessions and waits for them to end
+func (s *Server) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// AddUser adds an account holding boxes
+func (s *Server) AddUser(email, password string, boxes ...*Mailbox) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users == nil {
+		s.users = map[string]*user{}
+	}
+	s.users[email] = &user{password: password, boxes: boxes}
+}
+
+// Config returns the settings of a backup of email into a temporary
+// BACKUP_DIR over the server, with the defaults of LoadConfig otherwise and no
+// rate limit
+func (s *Server) Config(t testing.TB, email, password string) config.Config {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return config.Config{
+		Email:                  email,
+		Password:               password,
+		BackupDir:              t.TempDir(),
+		Provider:               "gmail",
+		ImapServer:             addr.IP.String(),
+		ImapPort:               addr.Port,
+		FoldersOnly:            map[string]bool{},
+		FoldersExclude:         map[string]bool{},
+		FoldersOnlyMissing:     "warn",
+		MaxWorkers:             1,
+		DownloadWorkers:        1,
+		MaxReconnects:          3,
+		FetchRetries:           2,
+		FetchBatchSize:         25,
+		TLSSkipVerify:          true,
+		LogLevel:               "INFO",
+		RunMode:                "archive",
+		Backend:                "imap",
+		VerifyDepth:            "checksum",
+		VerifySample:           20,
+		ProgressPercent:        5,
+		GmailExtensions:        true,
+		NormalizeEOL:           utils.EOLNone,
+		StorageFormat:          "eml",
+		LowUidNext:             "skip",
+		MailboxDirEncoding:     "utf8",
+		MaxDirNameBytes:        255,
+		ExportSplit:            "folder",
+		MailboxChangeAction:    "log",
+		BodyFetchMode:          "body-peek",
+		IncrementalScan:        true,
+		UidValidityAction:      "resync",
+		TransientMailboxAction: "defer",
+		SyncFlags:              true,
+		QResync:                true,
+		OnConflict:             "overwrite",
+		IdentityFallback:       []string{"resent-message-id", "date-from"},
+		OAuth2TokenStore:       "file",
+		OAuth2Login:            "auto",
+		SASLMechanism:          "auto",
+		AccountWorkers:         1,
+	}
+}
+
+// Commands returns every command received so far, without tags
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.cmds)
+}
+
+// Do runs fn with the mailboxes locked, for hooks that change them
+func (s *Server) Do(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.conns == nil {
+			s.conns = map[net.Conn]bool{}
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			newSession(s, conn).serve()
+		}()
+	}
+}
+
+// Session is one client connection
+type Session struct {
+	srv  *Server
+	conn net.Conn
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	user     *user
+	selected *Mailbox
+}
+
+func newSession(srv *Server, conn net.Conn) *Session {
+	return &Session{srv: srv, conn: conn, w: bufio.NewWriter(conn)}
+}
+
+// Server returns the server of the session
+func (s *Session) Server() *Server { return s.srv }
+
+// Selected returns the selected mailbox, or nil
+func (s *Session) Selected() *Mailbox { return s.selected }
+
+// Printf writes a response line
+func (s *Session) Printf(format string, args ...any) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	fmt.Fprintf(s.w, format+"\r\n", args...)
+	s.w.Flush()
+}
+
+// Close drops the connection, like a server timing out an idle client
+func (s *Session) Close() { s.conn.Close() }
+
+// OK completes a command
+func (s *Session) OK(tag, text string) { s.Printf("%s OK %s", tag, text) }
+
+// NO fails a command
+func (s *Session) NO(tag, text string) { s.Printf("%s NO %s", tag, text) }
+
+func (s *Session) serve() {
+	continues := make(chan bool)
+	defer close(continues)
+	go func() {
+		for range continues {
+			s.Printf("+ send literal")
+		}
+	}()
+	r := imap.NewServerReader(bufio.NewReader(s.conn), continues)
+
+	s.Printf("* OK imaptest ready")
+	for {
+		fields, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+		var cmd imap.Command
+		if err := cmd.Parse(fields); err != nil {
+			s.Printf("* BAD %v", err)
+			continue
+		}
+		s.srv.mu.Lock()
+		s.srv.cmds = append(s.srv.cmds, describe(&cmd))
+		s.srv.mu.Unlock()
+
+		if s.srv.Hook != nil && s.srv.Hook(s, &cmd) {
+			continue
+		}
+		if s.handle(&cmd) {
+			return
+		}
+	}
+}
+
+// describe formats a command as sent, without its tag or literals
+func describe(cmd *imap.Command) string {
+	parts := []string{cmd.Name}
+	for _, arg := range cmd.Arguments {
+		parts = append(parts, describeArg(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+func describeArg(arg any) string {
+	switch v := arg.(type) {
+	case []any:
+		parts := make([]string, len(v))
+		for i, a := range v {
+			parts[i] = describeArg(a)
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	case imap.Literal:
+		return fmt.Sprintf("{%d}", v.Len())
+	case nil:
+		return "NIL"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// handle answers cmd, returning true once the session is over
+func (s *Session) handle(cmd *imap.Command) bool {
+	args := cmd.Arguments
+	tag := cmd.Tag
+	switch cmd.Name {
+	case "CAPABILITY":
+		s.Printf("* CAPABILITY %s", strings.Join(append([]string{"IMAP4rev1", "AUTH=PLAIN"}, s.srv.Caps...), " "))
+		s.OK(tag, "CAPABILITY completed")
+	case "LOGIN":
+		name, _ := imap.ParseString(arg(args, 0))
+		pass, _ := imap.ParseString(arg(args, 1))
+		s.srv.mu.Lock()
+		u := s.srv.users[name]
+		s.srv.mu.Unlock()
+		if u == nil || u.password != pass {
+			s.NO(tag, "[AUTHENTICATIONFAILED] invalid credentials")
+			return false
+		}
+		s.user = u
+		s.OK(tag, "LOGIN completed")
+	case "NOOP", "CHECK":
+		s.OK(tag, cmd.Name+" completed")
+	case "ENABLE":
+		var caps []string
+		for _, a := range args {
+			caps = append(caps, fmt.Sprint(a))
+		}
+		s.Printf("* ENABLED %s", strings.Join(caps, " "))
+		s.OK(tag, "ENABLE completed")
+	case "LOGOUT":
+		s.Printf("* BYE logging out")
+		s.OK(tag, "LOGOUT completed")
+		return true
+	case "LIST":
+		s.list(tag)
+	case "STATUS":
+		s.status(tag, args)
+	case "SELECT", "EXAMINE":
+		s.examine(tag, args)
+	case "CREATE":
+		s.create(tag, args)
+	case "APPEND":
+		s.append(tag, args)
+	case "UID":
+		sub, _ := imap.ParseString(arg(args, 0))
+		switch strings.ToUpper(sub) {
+		case "FETCH":
+			s.fetch(tag, args[1:], true)
+		case "SEARCH":
+			s.search(tag, true)
+		default:
+			s.Printf("%s BAD unknown UID command", tag)
+		}
+	case "FETCH":
+		s.fetch(tag, args, false)
+	case "SEARCH":
+		s.search(tag, false)
+	default:
+		s.Printf("%s BAD unknown command", tag)
+	}
+	return false
+}
+
+func arg(args []any, i int) any {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func (s *Session) mailbox(name any) *Mailbox {
+	raw, _ := imap.ParseString(name)
+	decoded, err := utf7.Encoding.NewDecoder().String(raw)
+	if err != nil {
+		decoded = raw
+	}
+	if strings.EqualFold(decoded, "INBOX") {
+		decoded = "INBOX"
+	}
+	for _, m := range s.user.boxes {
+		if m.Name == decoded {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *Session) list(tag string) {
+	if s.user == nil {
+		s.NO(tag, "not logged in")
+		return
+	}
+	s.srv.mu.Lock()
+	var lines []string
+	for _, m := range s.user.boxes {
+		name, _ := utf7.Encoding.NewEncoder().String(m.Name)
+		lines = append(lines, fmt.Sprintf(`* LIST (%s) "/" %s`, strings.Join(m.Attributes, " "), quote(name)))
+	}
+	s.srv.mu.Unlock()
+	for _, l := range lines {
+		s.Printf("%s", l)
+	}
+	s.OK(tag, "LIST completed")
+}
+
+func (s *Session) status(tag string, args []any) {
+	if s.user == nil {
+		s.NO(tag, "not logged in")
+		return
+	}
+	s.srv.mu.Lock()
+	m := s.mailbox(arg(args, 0))
+	if m == nil {
+		s.srv.mu.Unlock()
+		s.NO(tag, "[NONEXISTENT] no such mailbox")
+		return
+	}
+	var unseen int
+	for _, msg := range m.Messages {
+		if !slices.Contains(msg.Flags, imap.SeenFlag) {
+			unseen++
+		}
+	}
+	name, _ := utf7.Encoding.NewEncoder().String(m.Name)
+	line := fmt.Sprintf("* STATUS %s (MESSAGES %d UIDNEXT %d UIDVALIDITY %d UNSEEN %d)",
+		quote(name), len(m.Messages), m.uidNext(), m.UidValidity, unseen)
+	s.srv.mu.Unlock()
+	s.Printf("%s", line)
+	s.OK(tag, "STATUS completed")
+}
+
+func (s *Session) examine(tag string, args []any) {
+	if s.user == nil {
+		s.NO(tag, "not logged in")
+		return
+	}
+	s.srv.mu.Lock()
+	m := s.mailbox(arg(args, 0))
+	if m == nil {
+		s.srv.mu.Unlock()
+		s.NO(tag, "[NONEXISTENT] no such mailbox")
+		return
+	}
+	s.selected = m
+	lines := []string{
+		`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`,
+		fmt.Sprintf("* %d EXISTS", len(m.Messages)),
+		"* 0 RECENT",
+		fmt.Sprintf("* OK [UIDVALIDITY %d] UIDs valid", m.UidValidity),
+		fmt.Sprintf("* OK [UIDNEXT %d] predicted next UID", m.uidNext()),
+	}
+	if m.HighestModSeq != 0 {
+		lines = append(lines, fmt.Sprintf("* OK [HIGHESTMODSEQ %d] highest", m.HighestModSeq))
+	}
+	s.srv.mu.Unlock()
+	for _, l := range lines {
+		s.Printf("%s", l)
+	}
+	s.OK(tag, "[READ-ONLY] EXAMINE completed")
+}
+
+func (s *Session) create(tag string, args []any) {
+	if s.user == nil {
+		s.NO(tag, "not logged in")
+		return
+	}
+	s.srv.mu.Lock()
+	defer s.srv.mu.Unlock()
+	if s.mailbox(arg(args, 0)) != nil {
+		s.NO(tag, "[ALREADYEXISTS] mailbox exists")
+		return
+	}
+	raw, _ := imap.ParseString(arg(args, 0))
+	name, err := utf7.Encoding.NewDecoder().String(raw)
+	if err != nil {
+		name = raw
+	}
+	s.user.boxes = append(s.user.boxes, &Mailbox{Name: name, UidValidity: 1})
+	s.OK(tag, "CREATE completed")
+}
+
+func (s *Session) append(tag string, args []any) {
+	if s.user == nil || len(args) < 2 {
+		s.NO(tag, "cannot append")
+		return
+	}
+	lit, ok := args[len(args)-1].(imap.Literal)
+	if !ok {
+		s.Printf("%s BAD missing message literal", tag)
+		return
+	}
+	body, err := io.ReadAll(lit)
+	if err != nil {
+		s.NO(tag, err.Error())
+		return
+	}
+	msg := &Message{Body: body, Date: time.Now()}
+	for _, a := range args[1 : len(args)-1] {
+		switch v := a.(type) {
+		case []any:
+			for _, f := range v {
+				msg.Flags = append(msg.Flags, fmt.Sprint(f))
+			}
+		case string:
+			if d, err := time.Parse(imap.DateTimeLayout, v); err == nil {
+				msg.Date = d
+			}
+		}
+	}
+
+	s.srv.mu.Lock()
+	defer s.srv.mu.Unlock()
+	m := s.mailbox(args[0])
+	if m == nil {
+		s.NO(tag, "[TRYCREATE] no such mailbox")
+		return
+	}
+	msg.UID = m.uidNext()
+	m.Messages = append(m.Messages, msg)
+	if m.UidNext != 0 {
+		m.UidNext++
+	}
+	s.OK(tag, fmt.Sprintf("[APPENDUID %d %d] APPEND completed", m.UidValidity, msg.UID))
+}
+
+// search returns every message of the selected mailbox; hooks answer
+// anything narrower
+func (s *Session) search(tag string, uid bool) {
+	if s.selected == nil {
+		s.NO(tag, "no mailbox selected")
+		return
+	}
+	s.srv.mu.Lock()
+	ids := make([]string, len(s.selected.Messages))
+	for i, msg := range s.selected.Messages {
+		if uid {
+			ids[i] = fmt.Sprint(msg.UID)
+		} else {
+			ids[i] = fmt.Sprint(i + 1)
+		}
+	}
+	s.srv.mu.Unlock()
+	s.Printf("%s", strings.TrimSpace("* SEARCH "+strings.Join(ids, " ")))
+	s.OK(tag, "SEARCH completed")
+}
+
+func (s *Session) fetch(tag string, args []any, uid bool) {
+	if s.selected == nil {
+		s.NO(tag, "no mailbox selected")
+		return
+	}
+	if len(args) < 2 {
+		s.Printf("%s BAD missing arguments", tag)
+		return
+	}
+	setStr, _ := imap.ParseString(args[0])
+	set, err := imap.ParseSeqSet(setStr)
+	if err != nil {
+		s.Printf("%s BAD %v", tag, err)
+		return
+	}
+	var items []string
+	switch v := args[1].(type) {
+	case []any:
+		for _, item := range v {
+			items = append(items, strings.ToUpper(fmt.Sprint(item)))
+		}
+	default:
+		items = []string{strings.ToUpper(fmt.Sprint(v))}
+	}
+	if uid && !slices.Contains(items, "UID") {
+		items = append([]string{"UID"}, items...)
+	}
+	// CHANGEDSINCE <modseq> [VANISHED]
+	var changedSince uint64
+	if mods, ok := arg(args, 2).([]any); ok && len(mods) >= 2 && strings.EqualFold(fmt.Sprint(mods[0]), "CHANGEDSINCE") {
+		changedSince, _ = strconv.ParseUint(fmt.Sprint(mods[1]), 10, 64)
+	}
+
+	s.srv.mu.Lock()
+	msgs := s.selected.Messages
+	var last uint32
+	if len(msgs) > 0 {
+		last = uint32(len(msgs))
+		if uid {
+			last = msgs[len(msgs)-1].UID
+		}
+	}
+	var lines []string
+	for i, msg := range msgs {
+		id := uint32(i + 1)
+		if uid {
+			id = msg.UID
+		}
+		if !contains(set, id, last) {
+			continue
+		}
+		if changedSince != 0 && msg.ModSeq <= changedSince {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("* %d FETCH (%s)", i+1, fetchAttrs(msg, items)))
+	}
+	s.srv.mu.Unlock()
+	for _, l := range lines {
+		s.Printf("%s", l)
+	}
+	s.OK(tag, "FETCH completed")
+}
+
+// contains reports whether set holds id, with "*" standing for last
+func contains(set *imap.SeqSet, id, last uint32) bool {
+	for _, seq := range set.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 {
+			start = last
+		}
+		if stop == 0 {
+			stop = last
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if id >= start && id <= stop {
+			return true
+		}
+	}
+	return false
+}
+
+func fetchAttrs(msg *Message, items []string) string {
+	var out []string
+	for _, item := range items {
+		switch item {
+		case "UID":
+			out = append(out, fmt.Sprintf("UID %d", msg.UID))
+		case "RFC822.SIZE":
+			out = append(out, fmt.Sprintf("RFC822.SIZE %d", len(msg.Body)))
+		case "FLAGS":
+			out = append(out, fmt.Sprintf("FLAGS (%s)", strings.Join(msg.Flags, " ")))
+		case "INTERNALDATE":
+			out = append(out, fmt.Sprintf("INTERNALDATE %s", quote(msg.Date.Format(imap.DateTimeLayout))))
+		case "X-GM-MSGID":
+			out = append(out, fmt.Sprintf("X-GM-MSGID %d", msg.MsgID))
+		case "X-GM-THRID":
+			out = append(out, fmt.Sprintf("X-GM-THRID %d", msg.ThreadID))
+		case "X-GM-LABELS":
+			labels := make([]string, len(msg.Labels))
+			for i, l := range msg.Labels {
+				labels[i] = quote(l)
+			}
+			out = append(out, fmt.Sprintf("X-GM-LABELS (%s)", strings.Join(labels, " ")))
+		case "MODSEQ":
+			out = append(out, fmt.Sprintf("MODSEQ (%d)", msg.ModSeq))
+		case "ENVELOPE":
+			out = append(out, "ENVELOPE "+envelope(msg.Body))
+		case "BODYSTRUCTURE", "BODY":
+			out = append(out, item+" "+structure(msg))
+		case "RFC822":
+			out = append(out, "RFC822 "+literal(msg.Body))
+		default:
+			if name, data, ok := section(msg, item); ok {
+				out = append(out, name+" "+literal(data))
+			}
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// section returns the response name and content of a BODY[...] item
+func section(msg *Message, item string) (string, []byte, bool) {
+	sec, err := imap.ParseBodySectionName(imap.FetchItem(item))
+	if err != nil {
+		return "", nil, false
+	}
+	header, text := splitMessage(msg.Body)
+
+	var data []byte
+	part := make([]string, len(sec.Path))
+	for i, p := range sec.Path {
+		part[i] = fmt.Sprint(p)
+	}
+	switch {
+	case len(sec.Path) > 0:
+		data = msg.Sections[strings.Join(part, ".")]
+		if data == nil && msg.Structure == "" && strings.Join(part, ".") == "1" {
+			data = text
+		}
+	case sec.Specifier == imap.HeaderSpecifier && len(sec.Fields) > 0:
+		data = headerFields(header, sec.Fields, sec.NotFields)
+	case sec.Specifier == imap.HeaderSpecifier:
+		data = header
+	case sec.Specifier == imap.TextSpecifier:
+		data = text
+	default:
+		data = msg.Body
+	}
+	if len(sec.Partial) > 0 {
+		start := min(sec.Partial[0], len(data))
+		end := len(data)
+		if len(sec.Partial) > 1 {
+			end = min(start+sec.Partial[1], len(data))
+		}
+		data = data[start:end]
+	}
+
+	name := strings.Replace(item, "BODY.PEEK[", "BODY[", 1)
+	if i := strings.LastIndex(name, "]<"); i >= 0 {
+		if len(sec.Partial) > 0 {
+			name = fmt.Sprintf("%s]<%d>", name[:i], sec.Partial[0])
+		} else {
+			name = name[:i+1]
+		}
+	}
+	return name, data, true
+}
+
+// splitMessage splits a message into its header, with the blank line that
+// ends it, and its text
+func splitMessage(body []byte) ([]byte, []byte) {
+	s := string(body)
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := strings.Index(s, sep); i >= 0 {
+			return body[:i+len(sep)], body[i+len(sep):]
+		}
+	}
+	return body, nil
+}
+
+func headerFields(header []byte, fields []string, not bool) []byte {
+	var out strings.Builder
+	keep := false
+	for _, line := range strings.SplitAfter(string(header), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			key, _, _ := strings.Cut(line, ":")
+			match := slices.ContainsFunc(fields, func(f string) bool { return strings.EqualFold(f, key) })
+			keep = match != not
+		}
+		if keep {
+			out.WriteString(line)
+		}
+	}
+	out.WriteString("\r\n")
+	return []byte(out.String())
+}
+
+func structure(msg *Message) string {
+	if msg.Structure != "" {
+		return msg.Structure
+	}
+	_, text := splitMessage(msg.Body)
+	lines := strings.Count(string(text), "\n")
+	return fmt.Sprintf(`("TEXT" "PLAIN" ("CHARSET" "UTF-8") NIL NIL "7BIT" %d %d)`, len(text), lines)
+}
+
+// envelope builds an ENVELOPE from the message's Date, Subject, From and
+// Message-ID headers
+func envelope(body []byte) string {
+	header, _ := splitMessage(body)
+	get := func(key string) string {
+		for _, line := range strings.Split(string(header), "\n") {
+			k, v, ok := strings.Cut(line, ":")
+			if ok && strings.EqualFold(k, key) {
+				return strings.TrimSpace(v)
+			}
+		}
+		return ""
+	}
+	nstring := func(v string) string {
+		if v == "" {
+			return "NIL"
+		}
+		return quote(v)
+	}
+	from := "NIL"
+	if addr := get("From"); addr != "" {
+		if i := strings.LastIndex(addr, "<"); i >= 0 {
+			addr = strings.TrimSuffix(addr[i+1:], ">")
+		}
+		mailbox, host, _ := strings.Cut(addr, "@")
+		from = fmt.Sprintf("((NIL NIL %s %s))", quote(mailbox), quote(host))
+	}
+	return fmt.Sprintf("(%s %s %s %s %s NIL NIL NIL NIL %s)",
+		nstring(get("Date")), nstring(get("Subject")), from, from, from, nstring(get("Message-ID")))
+}
+
+func literal(data []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(data), data)
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// selfSigned returns a certificate for 127.0.0.1
+func selfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "imaptest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,154 @@
+package archiveService
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// AttachmentsIndexFile lists every attachment in the archive by content hash
+const AttachmentsIndexFile = "attachments_index.json"
+
+// AttachmentInfo is one distinct attachment and every message it appears in
+type AttachmentInfo struct {
+	SHA256      string   `json:"sha256"`
+	Size        int64    `json:"size"`
+	ContentType string   `json:"content_type"`
+	Filenames   []string `json:"filenames"`
+	Messages    []string `json:"messages"`
+}
+
+// BuildAttachmentsIndex walks every .eml under backupDir and groups their
+// attachments by SHA-256 of the decoded content, largest total size first.
+// Messages whose MIME structure can't be parsed are skipped.
+func BuildAttachmentsIndex(backupDir string) ([]AttachmentInfo, error) {
+	byHash := map[string]*AttachmentInfo{}
+	err := filepath.WalkDir(backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !IsMessageFile(d.Name()) {
+			return nil
+		}
+		data, err := ReadMessageFile(path)
+		if err != nil {
+			return err
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(backupDir, path)
+		rel = filepath.ToSlash(rel)
+		header := textproto.MIMEHeader(msg.Header)
+		_ = walkAttachments(header, msg.Body, 0, func(name, contentType string, content []byte) {
+			sum := sha256.Sum256(content)
+			key := hex.EncodeToString(sum[:])
+			a, ok := byHash[key]
+			if !ok {
+				a = &AttachmentInfo{SHA256: key, Size: int64(len(content)), ContentType: contentType}
+				byHash[key] = a
+			}
+			if name != "" && !slices.Contains(a.Filenames, name) {
+				a.Filenames = append(a.Filenames, name)
+			}
+			if !slices.Contains(a.Messages, rel) {
+				a.Messages = append(a.Messages, rel)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	index := make([]AttachmentInfo, 0, len(byHash))
+	for _, a := range byHash {
+		sort.Strings(a.Filenames)
+		sort.Strings(a.Messages)
+		index = append(index, *a)
+	}
+	sort.Slice(index, func(i, j int) bool {
+		ti, tj := index[i].Size*int64(len(index[i].Messages)), index[j].Size*int64(len(index[j].Messages))
+		if ti != tj {
+			return ti > tj
+		}
+		return index[i].SHA256 < index[j].SHA256
+	})
+	return index, nil
+}
+
+// WriteAttachmentsIndex writes the index as attachments_index.json in backupDir
+func WriteAttachmentsIndex(backupDir string, index []AttachmentInfo) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filepath.Join(backupDir, AttachmentsIndexFile), data, 0644)
+}
+
+// walkAttachments calls fn with the decoded content of every part that is an
+// attachment: a Content-Disposition of attachment, or a filename on a
+// non-text part
+func walkAttachments(h textproto.MIMEHeader, body io.Reader, depth int, fn func(name, contentType string, content []byte)) error {
+	mediaType, params, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMIMEDepth || params["boundary"] == "" {
+			return nil
+		}
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := r.NextPart()
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			if err := walkAttachments(part.Header, part, depth+1, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	if disposition != "attachment" && (name == "" || strings.HasPrefix(mediaType, "text/")) {
+		return nil
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil
+	}
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	fn(decodeHeader(name), mediaType, content)
+	return nil
+}
@@ -0,0 +1,59 @@
+package archiveService
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// withAttachment returns a message with a text part and one attachment
+func withAttachment(name, contentType, encoded string) string {
+	return fmt.Sprintf("Subject: report\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n"+
+		"--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n"+
+		"--b\r\nContent-Type: %s; name=%q\r\nContent-Disposition: attachment; filename=%q\r\nContent-Transfer-Encoding: base64\r\n\r\n%s\r\n"+
+		"--b--\r\n", contentType, name, name, encoded)
+}
+
+func TestAttachmentsIndexGroupsDuplicates(t *testing.T) {
+	backup := t.TempDir()
+	inbox, sent := filepath.Join(backup, "INBOX"), filepath.Join(backup, "Sent")
+	for _, dir := range []string{inbox, sent} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pdf := []byte("%PDF-1.4 the same quarterly report")
+	encoded := base64.StdEncoding.EncodeToString(pdf)
+	// The same content under another name and with other line wrapping
+	wrapped := encoded[:20] + "\r\n" + encoded[20:]
+	writeFile(t, inbox, 1, withAttachment("report.pdf", "application/pdf", encoded))
+	writeFile(t, sent, 7, withAttachment("report (1).pdf", "application/pdf", wrapped))
+	writeFile(t, inbox, 2, withAttachment("photo.jpg", "image/jpeg", base64.StdEncoding.EncodeToString([]byte("jpeg"))))
+	writeFile(t, inbox, 3, "Subject: no attachments\r\n\r\nhi\r\n")
+
+	index, err := BuildAttachmentsIndex(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 2 {
+		t.Fatalf("index %+v, want the PDF and the photo", index)
+	}
+	// Duplicated content sorts first, as it takes the most space
+	dup := index[0]
+	if dup.Size != int64(len(pdf)) || dup.ContentType != "application/pdf" {
+		t.Errorf("duplicate %+v", dup)
+	}
+	if !slices.Equal(dup.Filenames, []string{"report (1).pdf", "report.pdf"}) {
+		t.Errorf("filenames %q", dup.Filenames)
+	}
+	if !slices.Equal(dup.Messages, []string{"INBOX/1.eml", "Sent/7.eml"}) {
+		t.Errorf("messages %q", dup.Messages)
+	}
+	if !slices.Equal(index[1].Messages, []string{"INBOX/2.eml"}) {
+		t.Errorf("photo appears in %q", index[1].Messages)
+	}
+}
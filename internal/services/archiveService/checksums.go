@@ -0,0 +1,173 @@
+package archiveService
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// ChecksumFile is the top-level checksum manifest, verifiable with `sha256sum -c`
+const ChecksumFile = "CHECKSUMS.sha256"
+
+// storedExts are the file types that hold archived message content
+var storedExts = []string{MessageExt, MessageExt + CompressedExt, ".skipped", TextExt, ".html", MboxExt, RefExt}
+
+// IsStoredFile reports whether a file name holds archived message content
+func IsStoredFile(name string) bool {
+	for _, ext := range storedExts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checksums tracks the SHA-256 of every stored file relative to the backup dir
+type Checksums struct {
+	base    string
+	mu      sync.Mutex
+	entries map[string]string
+}
+
+// LoadChecksums reads CHECKSUMS.sha256 from backupDir, if present
+func LoadChecksums(backupDir string) (*Checksums, error) {
+	c := &Checksums{base: backupDir, entries: map[string]string{}}
+
+	f, err := os.Open(filepath.Join(backupDir, ChecksumFile))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		sum, path, ok := strings.Cut(sc.Text(), "  ")
+		if !ok {
+			continue
+		}
+		c.entries[path] = sum
+	}
+	return c, sc.Err()
+}
+
+func (c *Checksums) rel(path string) string {
+	if r, err := filepath.Rel(c.base, path); err == nil {
+		return filepath.ToSlash(r)
+	}
+	return filepath.ToSlash(path)
+}
+
+// Add records the checksum of data just written to path
+func (c *Checksums) Add(path string, data []byte) {
+	if c == nil {
+		return
+	}
+	sum := sha256.Sum256(data)
+
+	c.mu.Lock()
+	c.entries[c.rel(path)] = hex.EncodeToString(sum[:])
+	c.mu.Unlock()
+}
+
+// Invalidate drops the checksum of a file that was modified in place (i.e. an
+// appended mbox), so the next Update hashes it again
+func (c *Checksums) Invalidate(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.entries, c.rel(path))
+	c.mu.Unlock()
+}
+
+// Update hashes stored files that are not yet listed and drops entries whose
+// file no longer exists
+func (c *Checksums) Update() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := map[string]bool{}
+	err := filepath.WalkDir(c.base, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !IsStoredFile(d.Name()) {
+			return nil
+		}
+
+		rel := c.rel(path)
+		seen[rel] = true
+		if _, ok := c.entries[rel]; ok {
+			return nil
+		}
+
+		sum, err := HashFile(path)
+		if err != nil {
+			return err
+		}
+		c.entries[rel] = sum
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for rel := range c.entries {
+		if !seen[rel] {
+			delete(c.entries, rel)
+		}
+	}
+	return nil
+}
+
+// Save writes CHECKSUMS.sha256 in `sha256sum` format, sorted by path
+func (c *Checksums) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	paths := make([]string, 0, len(c.entries))
+	for p := range c.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	for _, p := range paths {
+		fmt.Fprintf(&b, "%s  %s\n", c.entries[p], p)
+	}
+	return utils.WriteFileAtomic(filepath.Join(c.base, ChecksumFile), []byte(b.String()), 0644)
+}
+
+// HashFile returns the hex SHA-256 of a file
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,76 @@
+package archiveService
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	backupDir := t.TempDir()
+	inbox := filepath.Join(backupDir, "INBOX")
+	writeMessages(t, inbox, 1, 2, 3)
+
+	sums, err := LoadChecksums(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One recorded as written, the others found by Update
+	data, _ := os.ReadFile(filepath.Join(inbox, "1"+MessageExt))
+	sums.Add(filepath.Join(inbox, "1"+MessageExt), data)
+	if err := sums.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sums.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sha256sum, err := exec.LookPath("sha256sum"); err == nil {
+		cmd := exec.Command(sha256sum, "-c", "--quiet", ChecksumFile)
+		cmd.Dir = backupDir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("sha256sum -c failed: %v\n%s", err, out)
+		}
+	}
+
+	problems, err := VerifyArchive(backupDir, false)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("clean archive: %v, %v", problems, err)
+	}
+
+	// Tamper with one file and lose another
+	if err := os.WriteFile(filepath.Join(inbox, "2"+MessageExt), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(inbox, "3"+MessageExt)); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = VerifyArchive(backupDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []VerifyProblem{
+		{Path: "INBOX/2" + MessageExt, Reason: "checksum mismatch"},
+		{Path: "INBOX/3" + MessageExt, Reason: "listed in " + ChecksumFile + " but missing"},
+	}
+	if len(problems) != len(want) || problems[0] != want[0] || problems[1] != want[1] {
+		t.Errorf("problems %v, want %v", problems, want)
+	}
+
+	if sha256sum, err := exec.LookPath("sha256sum"); err == nil {
+		cmd := exec.Command(sha256sum, "-c", "--quiet", ChecksumFile)
+		cmd.Dir = backupDir
+		if err := cmd.Run(); err == nil {
+			t.Error("sha256sum -c accepted the tampered archive")
+		}
+	}
+
+	// Update forgets the lost file
+	if err := sums.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sums.entries["INBOX/3"+MessageExt]; ok {
+		t.Error("Update kept the checksum of a deleted file")
+	}
+}
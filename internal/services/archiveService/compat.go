@@ -0,0 +1,148 @@
+package archiveService
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CompatProblem is a stored message that common mail clients may fail to open
+type CompatProblem struct {
+	Path   string
+	Reason string
+}
+
+// CheckCompat checks every .eml and mbox file under backupDir for problems
+// that break importing into clients like Thunderbird or mutt. Maildir file
+// names and flag suffixes are not checked: the archive never writes a
+// Maildir, and one given to import is read, not stored.
+func CheckCompat(backupDir string) ([]CompatProblem, error) {
+	var problems []CompatProblem
+	err := filepath.WalkDir(backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		var reasons []string
+		switch {
+		case IsMessageFile(d.Name()):
+			data, err := ReadMessageFile(path)
+			if err != nil {
+				return err
+			}
+			reasons = compatProblems(data)
+		case strings.HasSuffix(d.Name(), MboxExt):
+			if reasons, err = mboxProblems(path); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		rel, _ := filepath.Rel(backupDir, path)
+		for _, reason := range reasons {
+			problems = append(problems, CompatProblem{Path: filepath.ToSlash(rel), Reason: reason})
+		}
+		return nil
+	})
+	return problems, err
+}
+
+func compatProblems(data []byte) []string {
+	var out []string
+	if len(data) == 0 {
+		return []string{"empty file"}
+	}
+	// Clients that sniff the format read a leading envelope line as mbox
+	if bytes.HasPrefix(data, []byte("From ")) {
+		out = append(out, `starts with an mbox "From " line`)
+	}
+	if _, err := mail.ReadMessage(bytes.NewReader(data)); err != nil {
+		out = append(out, "headers do not parse: "+err.Error())
+	}
+	crlf := bytes.Count(data, []byte("\r\n"))
+	if lf := bytes.Count(data, []byte("\n")); crlf > 0 && lf > crlf {
+		out = append(out, "mixed CRLF and LF line endings")
+	}
+	return out
+}
+
+// mboxProblems checks the "From " separators of the mbox at path, and the
+// headers and any Content-Length of each message in it. Separators are
+// "From " lines at the start of the file or after a blank line; a "From "
+// line anywhere else is one a client would split the message at.
+func mboxProblems(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []string
+	var msg bytes.Buffer
+	n := 0
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		// The blank line before the next separator belongs to the mbox format
+		data := bytes.TrimSuffix(msg.Bytes(), []byte("\n"))
+		data = bytes.TrimSuffix(data, []byte("\r"))
+		msg.Reset()
+		m, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			out = append(out, fmt.Sprintf("message %d: headers do not parse: %v", n, err))
+			return
+		}
+		if cl := m.Header.Get("Content-Length"); cl != "" {
+			body, _ := io.ReadAll(m.Body)
+			if want, err := strconv.Atoi(cl); err != nil || want != len(body) {
+				out = append(out, fmt.Sprintf("message %d: Content-Length %s does not match its %d byte body", n, cl, len(body)))
+			}
+		}
+	}
+
+	r := bufio.NewReader(f)
+	blank := true
+	for first := true; ; first = false {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")) && blank:
+				flush()
+				n++
+				// "From <sender> <date>"
+				if len(bytes.Fields(line)) < 3 {
+					out = append(out, fmt.Sprintf("message %d: separator line has no sender and date", n))
+				}
+			case first:
+				return []string{`does not start with a "From " line`}, nil
+			case bytes.HasPrefix(line, []byte("From ")):
+				out = append(out, fmt.Sprintf(`message %d: unquoted "From " line in the body`, n))
+				msg.Write(line)
+			default:
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				msg.Write(line)
+			}
+			blank = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+		if err == io.EOF {
+			flush()
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package archiveService
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckCompatMbox(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "INBOX", "INBOX"+MboxExt)
+	if err := os.MkdirAll(filepath.Dir(good), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Bodies with "From " lines are quoted by AppendMbox
+	for uid, body := range []string{"Subject: one\n\nFrom here on\n", "Subject: two\nContent-Length: 5\n\nbody\n"} {
+		if err := AppendMbox(good, uint32(uid+1), []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	date := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	bad := string(mboxMessage("a@example.com", date, "", []byte("Subject: ok\n\nok\n"))) +
+		"From \nSubject: no sender\n\nbody\n\n" +
+		"From b@example.com Fri Jan  2 03:04:05 2026\nSubject: long\nContent-Length: 100\n\nshort\nFrom the body, unquoted\n\n"
+	if err := os.WriteFile(filepath.Join(dir, "bad"+MboxExt), []byte(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "headless"+MboxExt), []byte("Subject: x\n\nx\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := CheckCompat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.Path+": "+p.Reason)
+	}
+	want := []string{
+		"bad.mbox: message 2: separator line has no sender and date",
+		`bad.mbox: message 3: unquoted "From " line in the body`,
+		"bad.mbox: message 3: Content-Length 100 does not match its 30 byte body",
+		`headless.mbox: does not start with a "From " line`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCheckCompatMessages(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, 1, "Subject: fine\r\n\r\nbody\r\n")
+	writeFile(t, dir, 2, "From a@example.com Fri Jan  2 03:04:05 2026\nSubject: x\n\nx\n")
+	writeFile(t, dir, 3, "Subject: mixed\r\n\nbody\n")
+
+	problems, err := CheckCompat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagged := map[string]int{}
+	for _, p := range problems {
+		flagged[p.Path]++
+	}
+	if flagged["1.eml"] != 0 || flagged["2.eml"] == 0 || flagged["3.eml"] == 0 {
+		t.Errorf("problems %+v", problems)
+	}
+}
@@ -0,0 +1,49 @@
+package archiveService
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+// MessageExt is the extension of a stored message
+const MessageExt = ".eml"
+
+// CompressedExt is appended to messages stored gzip-compressed (COMPRESS),
+// giving <uid>.eml.gz
+const CompressedExt = ".gz"
+
+// IsMessageFile reports whether name is a stored message, plain or compressed
+func IsMessageFile(name string) bool {
+	return strings.HasSuffix(name, MessageExt) || strings.HasSuffix(name, MessageExt+CompressedExt)
+}
+
+// ReadMessageFile reads a stored message, decompressing .eml.gz files
+func ReadMessageFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.HasSuffix(path, CompressedExt) {
+		return data, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// Compress gzips a message for storage. The gzip header carries no name or
+// timestamp, so the same message always compresses to the same bytes.
+func Compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,190 @@
+package archiveService
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// undatedMonth names the per-month mbox of messages without a usable Date
+const undatedMonth = "undated"
+
+// ExportResult summarizes exporting one mailbox directory to mbox
+type ExportResult struct {
+	Dir      string
+	Files    []string
+	Messages int
+	// Skipped counts messages stored as text only (TEXT_ONLY) or unreadable
+	Skipped int
+}
+
+// ExportMbox exports every mailbox directory under backupDir that has a
+// manifest into outDir, as ExportMboxDir does
+func ExportMbox(backupDir, outDir string, byMonth, dry bool) ([]ExportResult, error) {
+	dirs, err := os.ReadDir(backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ExportResult
+	for _, d := range dirs {
+		dir := filepath.Join(backupDir, d.Name())
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") || !utils.Exists(filepath.Join(dir, ManifestFile)) {
+			continue
+		}
+		res, err := ExportMboxDir(backupDir, dir, outDir, byMonth, dry)
+		if err != nil {
+			return results, fmt.Errorf("export %s: %w", d.Name(), err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// ExportMboxDir writes the messages of a mailbox directory, in UID order, to
+// <outDir>/<mailbox>.mbox, or to <outDir>/<mailbox>/<YYYY-MM>.mbox with
+// byMonth. References (DEDUP) are resolved to the stored copy, line endings
+// are converted to LF and lines starting with "From " are quoted mboxrd
+// style. Existing files are replaced; with dry set, nothing is written.
+func ExportMboxDir(backupDir, dir, outDir string, byMonth, dry bool) (ExportResult, error) {
+	res := ExportResult{Dir: dir}
+	name := filepath.Base(dir)
+
+	m, err := LoadManifest(dir, name)
+	if err != nil {
+		return res, err
+	}
+
+	files := map[string]*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	res.Skipped, err = EachStoredMessage(backupDir, dir, m, func(uid uint32, e ManifestEntry, data []byte) error {
+		date := e.Date
+		if date == nil {
+			date = ParseHeaders(bytes.NewReader(data)).Date
+		}
+		path := filepath.Join(outDir, name+MboxExt)
+		if byMonth {
+			month := undatedMonth
+			if date != nil {
+				month = date.UTC().Format("2006-01")
+			}
+			path = filepath.Join(outDir, name, month+MboxExt)
+		}
+		res.Messages++
+		if dry {
+			if !slices.Contains(res.Files, path) {
+				res.Files = append(res.Files, path)
+			}
+			return nil
+		}
+
+		f, ok := files[path]
+		if !ok {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if f, err = os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*"); err != nil {
+				return err
+			}
+			files[path] = f
+			res.Files = append(res.Files, path)
+		}
+
+		sender := "MAILER-DAEMON"
+		if e.From != "" && !strings.ContainsAny(e.From, " \t") {
+			sender = e.From
+		}
+		stamp := time.Unix(0, 0)
+		if date != nil {
+			stamp = *date
+		}
+		data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+		_, err := f.Write(mboxMessage(sender, stamp, "", data))
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+
+	for path, f := range files {
+		if err := f.Close(); err != nil {
+			return res, err
+		}
+		if err := os.Rename(f.Name(), path); err != nil {
+			return res, err
+		}
+		delete(files, path)
+	}
+	return res, nil
+}
+
+// EachStoredMessage calls fn with every message of a mailbox directory in UID
+// order, reading .eml, .eml.gz and mbox storage and resolving DEDUP
+// references to the stored copy. It returns how many entries were skipped
+// because they hold no full message (TEXT_ONLY) or couldn't be read.
+func EachStoredMessage(backupDir, dir string, m *Manifest, fn func(uid uint32, e ManifestEntry, data []byte) error) (int, error) {
+	var inMbox map[uint32][]byte
+	skipped := 0
+	for _, uid := range slices.Sorted(maps.Keys(m.Messages)) {
+		e := m.Messages[uid]
+
+		var data []byte
+		switch {
+		case strings.HasSuffix(e.File, MboxExt):
+			if inMbox == nil {
+				var err error
+				if inMbox, err = readMboxByUID(filepath.Join(dir, e.File)); err != nil {
+					return skipped, err
+				}
+			}
+			data = inMbox[uid]
+		case strings.HasSuffix(e.File, RefExt):
+			r, err := ReadRef(filepath.Join(dir, filepath.FromSlash(e.File)))
+			if err == nil {
+				data, _ = ReadMessageFile(filepath.Join(backupDir, filepath.FromSlash(r.Ref)))
+			}
+		case IsMessageFile(e.File):
+			data, _ = ReadMessageFile(filepath.Join(dir, filepath.FromSlash(e.File)))
+		}
+		if data == nil {
+			skipped++
+			continue
+		}
+		if err := fn(uid, e, data); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
+
+// readMboxByUID reads the messages of a mailbox stored as mbox, keyed by
+// their X-UID header
+func readMboxByUID(path string) (map[uint32][]byte, error) {
+	out := map[uint32][]byte{}
+	err := ReadMbox(path, func(data []byte) error {
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+		if uid, err := strconv.ParseUint(msg.Header.Get(mboxUIDHeader), 10, 32); err == nil {
+			out[uint32(uid)] = data
+		}
+		return nil
+	})
+	return out, err
+}
@@ -0,0 +1,44 @@
+package archiveService
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// FolderMapFile maps each mailbox directory back to its Gmail label
+const FolderMapFile = "folder_map.csv"
+
+// WriteFolderMap writes a CSV of directory,label pairs for every mailbox
+// directory under backupDir, so import tools can recreate the original label
+// names that were flattened into directory names
+func WriteFolderMap(backupDir string) error {
+	dirs, err := os.ReadDir(backupDir)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.UseCRLF = true
+	_ = w.Write([]string{"directory", "label"})
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") || d.Name() == RunLogsDir {
+			continue
+		}
+		m, err := LoadManifest(filepath.Join(backupDir, d.Name()), d.Name())
+		if err != nil {
+			return err
+		}
+		_ = w.Write([]string{d.Name(), m.Mailbox})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filepath.Join(backupDir, FolderMapFile), buf.Bytes(), 0644)
+}
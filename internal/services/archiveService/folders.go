@@ -0,0 +1,90 @@
+package archiveService
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// FoldersFile is the top-level snapshot of the account's folder list
+const FoldersFile = "folders.json"
+
+// FolderInfo describes one listed mailbox
+type FolderInfo struct {
+	Name        string   `json:"name"`
+	Attributes  []string `json:"attributes,omitempty"`
+	SpecialUse  string   `json:"special_use,omitempty"`
+	Messages    uint32   `json:"messages"`
+	UidValidity uint32   `json:"uid_validity,omitempty"`
+}
+
+// FolderSnapshot is the folder list as seen at the end of a run
+type FolderSnapshot struct {
+	Taken   time.Time    `json:"taken"`
+	Folders []FolderInfo `json:"folders"`
+}
+
+// LoadFolders reads the previous snapshot from backupDir. A missing file
+// returns nil.
+func LoadFolders(backupDir string) (*FolderSnapshot, error) {
+	data, err := os.ReadFile(filepath.Join(backupDir, FoldersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s FolderSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Save atomically writes the snapshot into backupDir
+func (s *FolderSnapshot) Save(backupDir string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filepath.Join(backupDir, FoldersFile), data, 0644)
+}
+
+// DiffFolders describes how the folder list changed from prev to cur: added
+// and deleted folders, and changed UIDVALIDITY or special-use role. A nil prev
+// yields no changes.
+func DiffFolders(prev, cur *FolderSnapshot) []string {
+	if prev == nil {
+		return nil
+	}
+
+	before := map[string]FolderInfo{}
+	for _, f := range prev.Folders {
+		before[f.Name] = f
+	}
+
+	var changes []string
+	for _, f := range cur.Folders {
+		old, ok := before[f.Name]
+		delete(before, f.Name)
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("added %s", f.Name))
+		case old.UidValidity != f.UidValidity:
+			changes = append(changes, fmt.Sprintf("UIDVALIDITY of %s changed (%d -> %d)", f.Name, old.UidValidity, f.UidValidity))
+		case old.SpecialUse != f.SpecialUse:
+			changes = append(changes, fmt.Sprintf("special use of %s changed (%q -> %q)", f.Name, old.SpecialUse, f.SpecialUse))
+		}
+	}
+	for _, f := range prev.Folders {
+		if _, ok := before[f.Name]; ok {
+			changes = append(changes, fmt.Sprintf("deleted %s", f.Name))
+		}
+	}
+	return changes
+}
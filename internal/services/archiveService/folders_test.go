@@ -0,0 +1,26 @@
+package archiveService
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiffFolders(t *testing.T) {
+	prev := &FolderSnapshot{Folders: []FolderInfo{
+		{Name: "INBOX", UidValidity: 1},
+		{Name: "Old"},
+		{Name: "Archive", SpecialUse: `\Archive`},
+	}}
+	cur := &FolderSnapshot{Folders: []FolderInfo{
+		{Name: "INBOX", UidValidity: 1},
+		{Name: "Archive"},
+		{Name: "New"},
+	}}
+	if changes := DiffFolders(nil, cur); changes != nil {
+		t.Errorf("first snapshot: %q", changes)
+	}
+	want := []string{`special use of Archive changed ("\\Archive" -> "")`, "added New", "deleted Old"}
+	if changes := DiffFolders(prev, cur); !slices.Equal(changes, want) {
+		t.Errorf("changes %q, want %q", changes, want)
+	}
+}
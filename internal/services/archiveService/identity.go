@@ -0,0 +1,35 @@
+package archiveService
+
+import (
+	"strings"
+	"time"
+)
+
+// Fallback sources for a message's identity when it has no Message-ID
+const (
+	IdentityResentMessageID = "resent-message-id"
+	IdentityDateFrom        = "date-from"
+)
+
+// Identity returns a stable key for a message: its Message-ID, or the first
+// source in chain that the message has. It returns "" when none apply, leaving
+// the caller to fall back to content or UID.
+func Identity(e ManifestEntry, chain []string) string {
+	if e.MessageID != "" {
+		return "id:" + e.MessageID
+	}
+
+	for _, src := range chain {
+		switch src {
+		case IdentityResentMessageID:
+			if e.ResentMessageID != "" {
+				return "resent-id:" + e.ResentMessageID
+			}
+		case IdentityDateFrom:
+			if e.Date != nil && e.From != "" {
+				return "date-from:" + e.Date.UTC().Format(time.RFC3339) + "|" + strings.ToLower(e.From)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,44 @@
+package archiveService
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIdentityFallback(t *testing.T) {
+	chain := []string{IdentityResentMessageID, IdentityDateFrom}
+	parse := func(headers string) ManifestEntry {
+		return ParseHeaders(strings.NewReader(headers + "\r\nbody\r\n"))
+	}
+
+	withID := parse("Message-ID: <a@example.com>\r\nResent-Message-ID: <r@example.com>\r\n")
+	resent := parse("Resent-Message-ID: <r@example.com>\r\nFrom: Alice <Alice@Example.com>\r\nDate: Mon, 02 Jan 2006 15:04:05 -0700\r\n")
+	dated := parse("From: Alice <Alice@Example.com>\r\nDate: Mon, 02 Jan 2006 15:04:05 -0700\r\n")
+	// Same instant and sender, written differently
+	datedAgain := parse("From: alice@example.com\r\nDate: Mon, 02 Jan 2006 22:04:05 +0000\r\n")
+	bare := parse("Subject: nothing to go by\r\n")
+
+	tests := []struct {
+		name  string
+		e     ManifestEntry
+		chain []string
+		want  string
+	}{
+		{"Message-ID wins", withID, chain, "id:<a@example.com>"},
+		{"Resent-Message-ID", resent, chain, "resent-id:<r@example.com>"},
+		{"chain order", resent, []string{IdentityDateFrom, IdentityResentMessageID}, "date-from:2006-01-02T22:04:05Z|alice@example.com"},
+		{"Date and From", dated, chain, "date-from:2006-01-02T22:04:05Z|alice@example.com"},
+		{"source not in chain", dated, []string{IdentityResentMessageID}, ""},
+		{"empty chain", resent, nil, ""},
+		{"nothing usable", bare, chain, ""},
+	}
+	for _, tt := range tests {
+		if got := Identity(tt.e, tt.chain); got != tt.want {
+			t.Errorf("%s: Identity = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if Identity(dated, chain) != Identity(datedAgain, chain) {
+		t.Errorf("same Date and From give %q and %q", Identity(dated, chain), Identity(datedAgain, chain))
+	}
+}
@@ -0,0 +1,182 @@
+package archiveService
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// ImportResult summarizes importing an mbox file or Maildir into a mailbox
+// directory
+type ImportResult struct {
+	Dir        string
+	Imported   []uint32
+	Duplicates int
+}
+
+// Import reads the messages of src, an mbox file or a Maildir, into the mailbox
+// directory dst. Imported messages get local UIDs after the highest one already
+// in dst, are deduplicated against dst like Merge does, and have their line
+// endings normalized to eol. With dry set, nothing is written.
+func Import(src, dst, box string, chain []string, eol string, dry bool) (ImportResult, error) {
+	res := ImportResult{Dir: dst}
+
+	read := ReadMbox
+	if info, err := os.Stat(src); err != nil {
+		return res, err
+	} else if info.IsDir() {
+		read = ReadMaildir
+	}
+
+	into := NewManifest(box)
+	if utils.Exists(dst) {
+		var err error
+		if into, err = ScanDir(dst, box); err != nil {
+			return res, err
+		}
+	}
+
+	byKey := map[string]bool{}
+	var next uint32
+	for uid, e := range into.Messages {
+		key, err := dedupKey(dst, e, chain)
+		if err != nil {
+			return res, err
+		}
+		byKey[key] = true
+		if uid > next {
+			next = uid
+		}
+	}
+
+	err := read(src, func(data []byte) error {
+		data = utils.NormalizeEOL(data, eol)
+		e := ParseHeaders(bytes.NewReader(data))
+		key := Identity(e, chain)
+		if key == "" {
+			sum := sha256.Sum256(data)
+			key = "sha256:" + hex.EncodeToString(sum[:])
+		}
+		if byKey[key] {
+			res.Duplicates++
+			return nil
+		}
+
+		next++
+		e.File = fmt.Sprintf("%d.eml", next)
+		e.Size = int64(len(data))
+		if dry {
+			utils.DryRunWrite(filepath.Join(dst, e.File), e.Size)
+		} else {
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+			if err := utils.WriteFileAtomic(filepath.Join(dst, e.File), data, 0644); err != nil {
+				return err
+			}
+		}
+		into.Messages[next] = e
+		byKey[key] = true
+		res.Imported = append(res.Imported, next)
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	if dry || len(res.Imported) == 0 {
+		return res, nil
+	}
+	return res, into.Save(dst)
+}
+
+// ReadMbox calls fn with each message of an mbox file, without its "From "
+// separator line and with mboxrd ">From " quoting undone
+func ReadMbox(path string, fn func([]byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var msg bytes.Buffer
+	started := false
+	flush := func() error {
+		if !started {
+			return nil
+		}
+		// The blank line before the next separator belongs to the mbox format
+		data := bytes.TrimSuffix(msg.Bytes(), []byte("\n"))
+		data = bytes.TrimSuffix(data, []byte("\r"))
+		msg.Reset()
+		return fn(append([]byte(nil), data...))
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if err := flush(); err != nil {
+					return err
+				}
+				started = true
+			case started:
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				msg.Write(line)
+			}
+		}
+		if err == io.EOF {
+			return flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadMaildir calls fn with each message in the cur and new subdirectories of
+// a Maildir, in file name order
+func ReadMaildir(dir string, fn func([]byte) error) error {
+	var paths []string
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				paths = append(paths, filepath.Join(dir, sub, e.Name()))
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("%s is not a Maildir (no messages in cur/ or new/)", dir)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package archiveService
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+const testMbox = `From alice@example.com Mon Jan  2 15:04:05 2006
+Message-ID: <1@example.com>
+Subject: one
+
+>From the start of a line
+body one
+
+From bob@example.com Mon Jan  2 16:04:05 2006
+Message-ID: <2@example.com>
+Subject: two
+
+body two
+
+From alice@example.com Mon Jan  2 17:04:05 2006
+Message-ID: <1@example.com>
+Subject: one again
+
+body one
+`
+
+// storedMessages returns the bodies of the .eml files in dir by name
+func storedMessages(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+MessageExt))
+	out := map[string]string{}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[filepath.Base(f)] = string(data)
+	}
+	return out
+}
+
+func TestImportMbox(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "export.mbox")
+	if err := os.WriteFile(src, []byte(testMbox), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "Imported")
+
+	res, err := Import(src, dst, "Imported", nil, utils.EOLCRLF, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.Imported, []uint32{1, 2}) || res.Duplicates != 1 {
+		t.Errorf("result %+v, want UIDs 1 and 2 and one duplicate", res)
+	}
+
+	stored := storedMessages(t, dst)
+	if len(stored) != 2 {
+		t.Fatalf("stored %v", stored)
+	}
+	one := stored["1.eml"]
+	if !strings.Contains(one, "\r\nFrom the start of a line\r\n") {
+		t.Errorf("mboxrd quoting not undone in %q", one)
+	}
+	if strings.Count(one, "\n") != strings.Count(one, "\r\n") || strings.HasPrefix(one, "From ") {
+		t.Errorf("1.eml not normalized: %q", one)
+	}
+
+	m, err := LoadManifest(dst, "Imported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Mailbox != "Imported" || m.Messages[2].MessageID != "<2@example.com>" {
+		t.Errorf("manifest %+v", m)
+	}
+
+	// Importing again adds nothing
+	if res, err := Import(src, dst, "Imported", nil, utils.EOLCRLF, false); err != nil || len(res.Imported) != 0 || res.Duplicates != 3 {
+		t.Errorf("second import: %+v %v", res, err)
+	}
+}
+
+func TestImportMaildir(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"cur/1700000000.1.host:2,S": "Message-ID: <a@example.com>\nSubject: a\n\nbody a\n",
+		"new/1700000001.2.host":     "Message-ID: <b@example.com>\nSubject: b\n\nbody b\n",
+		"tmp/1700000002.3.host":     "Message-ID: <c@example.com>\nSubject: still being delivered\n\n",
+	}
+	for name, body := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// dst already holds UID 5 and message b
+	dst := t.TempDir()
+	writeFile(t, dst, 5, "Message-ID: <old@example.com>\r\n\r\nold\r\n")
+	writeFile(t, dst, 6, "Message-ID: <b@example.com>\r\n\r\nbody b\r\n")
+
+	res, err := Import(src, dst, "INBOX", nil, utils.EOLNone, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.Imported, []uint32{7}) || res.Duplicates != 1 {
+		t.Errorf("result %+v, want message a as UID 7 and b a duplicate", res)
+	}
+	if got := storedMessages(t, dst)["7.eml"]; got != files["cur/1700000000.1.host:2,S"] {
+		t.Errorf("7.eml holds %q", got)
+	}
+}
+
+func TestImportNotMaildir(t *testing.T) {
+	if _, err := Import(t.TempDir(), t.TempDir(), "INBOX", nil, utils.EOLNone, false); err == nil {
+		t.Error("empty directory imported as a Maildir")
+	}
+}
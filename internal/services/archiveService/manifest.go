@@ -0,0 +1,149 @@
+package archiveService
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// ManifestFile is the name of the per-mailbox manifest
+const ManifestFile = "manifest.json"
+
+// ThreadsDir holds messages grouped by Gmail thread, one subdirectory per thread
+const ThreadsDir = "threads"
+
+// TextExt is the extension of messages stored as text only (TEXT_ONLY)
+const TextExt = ".txt"
+
+// BackendAPI marks a manifest written by BACKEND=api, whose messages are
+// numbered locally rather than by IMAP UID
+const BackendAPI = "api"
+
+// ManifestEntry describes a single stored message
+type ManifestEntry struct {
+	File            string     `json:"file"`
+	MessageID       string     `json:"message_id,omitempty"`
+	ResentMessageID string     `json:"resent_message_id,omitempty"`
+	From            string     `json:"from,omitempty"`
+	Subject         string     `json:"subject,omitempty"`
+	Date            *time.Time `json:"date,omitempty"`
+	Size            int64      `json:"size"`
+	ThreadID        string     `json:"thread_id,omitempty"`
+	Flags           []string   `json:"flags,omitempty"`
+	Labels          []string   `json:"labels,omitempty"`
+	ServerDeleted   bool       `json:"server_deleted,omitempty"`
+	GmMsgID         uint64     `json:"gm_msgid,omitempty"`
+}
+
+// Manifest indexes the messages stored in a mailbox directory by UID, or by
+// local number for a BackendAPI manifest
+type Manifest struct {
+	Mailbox       string                   `json:"mailbox"`
+	Backend       string                   `json:"backend,omitempty"` // BackendAPI, or empty for IMAP
+	UidValidity   uint32                   `json:"uid_validity,omitempty"`
+	HighestModSeq uint64                   `json:"highest_modseq,omitempty"`   // CONDSTORE checkpoint of the last flag sync
+	HighestMsgID  uint64                   `json:"highest_gm_msgid,omitempty"` // highest X-GM-MSGID downloaded
+	SyncedUID     uint32                   `json:"synced_uid,omitempty"`       // every message below this UID is stored; incremental scans start here
+	UidNext       uint32                   `json:"uid_next,omitempty"`         // UIDNEXT when SyncedUID was recorded
+	MessageCount  uint32                   `json:"message_count,omitempty"`    // messages in the mailbox when SyncedUID was recorded
+	HistoryID     uint64                   `json:"history_id,omitempty"`       // Gmail API historyId every change before which is stored (BACKEND=api)
+	NextNumber    uint32                   `json:"next_number,omitempty"`      // next local number to assign (BACKEND=api); numbers are never reused
+	Messages      map[uint32]ManifestEntry `json:"messages"`
+}
+
+// NewManifest returns an empty manifest for a mailbox
+func NewManifest(box string) *Manifest {
+	return &Manifest{Mailbox: box, Messages: map[uint32]ManifestEntry{}}
+}
+
+// LoadManifest reads the manifest in dir. A missing manifest returns an empty one.
+func LoadManifest(dir, box string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return NewManifest(box), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := NewManifest(box)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.Messages == nil {
+		m.Messages = map[uint32]ManifestEntry{}
+	}
+	if m.Mailbox == "" {
+		m.Mailbox = box
+	}
+	return m, nil
+}
+
+// Save atomically writes the manifest into dir
+func (m *Manifest) Save(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filepath.Join(dir, ManifestFile), data, 0644)
+}
+
+// StoredUIDs returns the UIDs of the entries stored in the flat layout, or
+// under threads/ when threads is set. Messages in an mbox count for both.
+func (m *Manifest) StoredUIDs(threads bool) map[uint32]struct{} {
+	set := make(map[uint32]struct{}, len(m.Messages))
+	for uid, e := range m.Messages {
+		if strings.HasSuffix(e.File, MboxExt) || strings.HasPrefix(e.File, ThreadsDir+"/") == threads {
+			set[uid] = struct{}{}
+		}
+	}
+	return set
+}
+
+// NewEntry builds a manifest entry from a raw message
+func NewEntry(file string, data []byte) ManifestEntry {
+	e := ParseHeaders(bytes.NewReader(data))
+	e.File = file
+	e.Size = int64(len(data))
+	return e
+}
+
+// ParseHeaders extracts Message-ID, Resent-Message-ID, From, Subject and Date
+// from a message. Parse failures leave the corresponding fields empty.
+func ParseHeaders(r io.Reader) ManifestEntry {
+	var e ManifestEntry
+
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return e
+	}
+
+	e.MessageID = msg.Header.Get("Message-Id")
+	e.ResentMessageID = msg.Header.Get("Resent-Message-Id")
+	if from, err := msg.Header.AddressList("From"); err == nil && len(from) > 0 {
+		e.From = from[0].Address
+	}
+	e.Subject = decodeHeader(msg.Header.Get("Subject"))
+	if d, err := msg.Header.Date(); err == nil {
+		e.Date = &d
+	}
+	return e
+}
+
+var wordDecoder = new(mime.WordDecoder)
+
+func decodeHeader(v string) string {
+	if dec, err := wordDecoder.DecodeHeader(v); err == nil {
+		return dec
+	}
+	return v
+}
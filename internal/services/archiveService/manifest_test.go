@@ -0,0 +1,36 @@
+package archiveService
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStoredUIDs(t *testing.T) {
+	m := NewManifest("INBOX")
+	m.Messages[1] = ManifestEntry{File: "1" + MessageExt}
+	m.Messages[2] = ManifestEntry{File: ThreadsDir + "/42/2" + MessageExt}
+	m.Messages[3] = ManifestEntry{File: "INBOX" + MboxExt}
+
+	flat, threads := m.StoredUIDs(false), m.StoredUIDs(true)
+	for uid, want := range map[uint32][2]bool{1: {true, false}, 2: {false, true}, 3: {true, true}, 4: {false, false}} {
+		_, inFlat := flat[uid]
+		_, inThreads := threads[uid]
+		if inFlat != want[0] || inThreads != want[1] {
+			t.Errorf("UID %d: flat %t threads %t, want %v", uid, inFlat, inThreads, want)
+		}
+	}
+}
+
+func BenchmarkStoredUIDs(b *testing.B) {
+	m := NewManifest("INBOX")
+	for uid := uint32(1); uid <= 100000; uid++ {
+		m.Messages[uid] = ManifestEntry{File: fmt.Sprintf("%d%s", uid, MessageExt)}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stored := m.StoredUIDs(false)
+		for uid := uint32(1); uid <= 100000; uid++ {
+			_ = stored[uid]
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package archiveService
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// MboxExt is the extension of a mailbox stored as a single mbox file
+const MboxExt = ".mbox"
+
+// mboxUIDHeader records each message's UID inside the mbox, as Dovecot does,
+// so the manifest can be rebuilt from the file
+const mboxUIDHeader = "X-UID"
+
+// MboxPath returns the mbox file of a mailbox directory, named after it
+func MboxPath(dir string) string {
+	return filepath.Join(dir, filepath.Base(dir)+MboxExt)
+}
+
+// AppendMbox appends a message to the mbox at path in mboxrd format, with an
+// X-UID header. The separator carries the message's Date, or the current time.
+func AppendMbox(path string, uid uint32, data []byte) error {
+	date := time.Now()
+	if e := ParseHeaders(bytes.NewReader(data)); e.Date != nil {
+		date = *e.Date
+	}
+	entry := mboxMessage("MAILER-DAEMON", date, fmt.Sprintf("%s: %d\n", mboxUIDHeader, uid), data)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(entry); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mboxMessage formats a message as an mboxrd entry (RFC 4155): a "From "
+// separator line with sender and date, the extra header lines, the message
+// with ">From " quoting, and a blank line
+func mboxMessage(sender string, date time.Time, header string, data []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From %s %s\n", sender, date.UTC().Format(time.ANSIC))
+	b.WriteString(header)
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			b.WriteByte('>')
+		}
+		b.Write(line)
+	}
+	if !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// scanMbox adds the messages of the mailbox's mbox file, if any, to m by
+// their X-UID header
+func scanMbox(dir string, m *Manifest) error {
+	path := MboxPath(dir)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	return ReadMbox(path, func(data []byte) error {
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+		uid, err := strconv.ParseUint(msg.Header.Get(mboxUIDHeader), 10, 32)
+		if err != nil {
+			return nil
+		}
+		e := NewEntry(filepath.Base(path), data)
+		m.Messages[uint32(uid)] = e
+		return nil
+	})
+}
@@ -0,0 +1,167 @@
+package archiveService
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// MergeConflict records a message that could not be merged as-is and how it
+// was resolved
+type MergeConflict struct {
+	UID        uint32
+	Reason     string
+	Resolution string
+}
+
+// MergeResult summarizes merging one mailbox directory into another
+type MergeResult struct {
+	Dir        string
+	Copied     []uint32
+	Duplicates int
+	Conflicts  []MergeConflict
+}
+
+// Merge copies every mailbox directory under srcDir into dstDir, skipping
+// messages dstDir already holds (by Identity using chain, or content hash when
+// a message has none) and rewriting each destination manifest. With dry set,
+// nothing is written.
+func Merge(srcDir, dstDir string, chain []string, dry bool) ([]MergeResult, error) {
+	dirs, err := os.ReadDir(srcDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []MergeResult
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		res, err := MergeDir(filepath.Join(srcDir, d.Name()), filepath.Join(dstDir, d.Name()), chain, dry)
+		if err != nil {
+			return results, fmt.Errorf("merge %s: %w", d.Name(), err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// MergeDir merges a single mailbox directory into dst. When both copies of a
+// message differ in size the larger, more complete one is kept; a UID held by
+// a different message in dst is left alone and reported.
+func MergeDir(src, dst string, chain []string, dry bool) (MergeResult, error) {
+	res := MergeResult{Dir: dst}
+
+	srcName, err := LoadManifest(src, filepath.Base(src))
+	if err != nil {
+		return res, err
+	}
+	from, err := ScanDir(src, srcName.Mailbox)
+	if err != nil {
+		return res, err
+	}
+
+	into := NewManifest(from.Mailbox)
+	if utils.Exists(dst) {
+		if into, err = ScanDir(dst, from.Mailbox); err != nil {
+			return res, err
+		}
+	}
+
+	byKey := map[string]uint32{}
+	for uid, e := range into.Messages {
+		key, err := dedupKey(dst, e, chain)
+		if err != nil {
+			return res, err
+		}
+		byKey[key] = uid
+	}
+
+	uids := make([]uint32, 0, len(from.Messages))
+	for uid := range from.Messages {
+		uids = append(uids, uid)
+	}
+	sortUIDs(uids)
+
+	for _, uid := range uids {
+		e := from.Messages[uid]
+		if strings.HasSuffix(e.File, MboxExt) {
+			res.Conflicts = append(res.Conflicts, MergeConflict{UID: uid, Reason: "stored in an mbox file", Resolution: "not merged"})
+			continue
+		}
+		key, err := dedupKey(src, e, chain)
+		if err != nil {
+			return res, err
+		}
+
+		if have, ok := byKey[key]; ok {
+			kept := into.Messages[have]
+			if e.Size <= kept.Size {
+				res.Duplicates++
+				continue
+			}
+			res.Conflicts = append(res.Conflicts, MergeConflict{
+				UID:        have,
+				Reason:     fmt.Sprintf("copies differ in size (%d vs %d bytes)", kept.Size, e.Size),
+				Resolution: "kept larger copy from source",
+			})
+			if !dry {
+				if err := copyFile(filepath.Join(src, e.File), filepath.Join(dst, kept.File)); err != nil {
+					return res, err
+				}
+			}
+			kept.Size = e.Size
+			into.Messages[have] = kept
+			continue
+		}
+
+		if other, ok := into.Messages[uid]; ok {
+			res.Conflicts = append(res.Conflicts, MergeConflict{
+				UID:        uid,
+				Reason:     fmt.Sprintf("UID holds a different message (%q vs %q)", other.MessageID, e.MessageID),
+				Resolution: "kept destination copy",
+			})
+			continue
+		}
+
+		if !dry {
+			if err := copyFile(filepath.Join(src, e.File), filepath.Join(dst, e.File)); err != nil {
+				return res, err
+			}
+		}
+		into.Messages[uid] = e
+		byKey[key] = uid
+		res.Copied = append(res.Copied, uid)
+	}
+
+	if dry || len(res.Copied)+len(res.Conflicts) == 0 {
+		return res, nil
+	}
+	return res, into.Save(dst)
+}
+
+// dedupKey identifies a message by Identity, falling back to a content hash
+func dedupKey(dir string, e ManifestEntry, chain []string) (string, error) {
+	if id := Identity(e, chain); id != "" {
+		return id, nil
+	}
+	sum, err := HashFile(filepath.Join(dir, e.File))
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + sum, nil
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(dst, data, 0644)
+}
@@ -0,0 +1,102 @@
+package archiveService
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeFile writes a message file named after uid into dir
+func writeFile(t *testing.T, dir string, uid uint32, body string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d%s", uid, MessageExt)), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeOverlappingArchives(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	src, dst := filepath.Join(srcDir, "INBOX"), filepath.Join(dstDir, "INBOX")
+
+	writeMessages(t, src, 1, 2, 3, 4, 7)
+	writeFile(t, src, 5, "Subject: no id\r\n\r\nsame content\r\n")
+
+	writeMessages(t, dst, 2)
+	// UID 1 is truncated in dst
+	writeFile(t, dst, 1, "Message-ID: <1@example.com>\r\n\r\n")
+	// src UID 3 is stored as UID 9, src UID 5 as UID 6
+	writeFile(t, dst, 9, "Message-ID: <3@example.com>\r\nSubject: 3\r\n\r\nbody\r\n")
+	writeFile(t, dst, 6, "Subject: no id\r\n\r\nsame content\r\n")
+	// UID 7 is another message in dst
+	writeFile(t, dst, 7, "Message-ID: <other@example.com>\r\n\r\nother\r\n")
+
+	results, err := Merge(srcDir, dstDir, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("results: %+v", results)
+	}
+	res := results[0]
+
+	if !slices.Equal(res.Copied, []uint32{4}) {
+		t.Errorf("copied %v, want [4]", res.Copied)
+	}
+	// UIDs 2, 3 (by Message-ID) and 5 (by content)
+	if res.Duplicates != 3 {
+		t.Errorf("%d duplicates, want 3", res.Duplicates)
+	}
+	var conflicts []uint32
+	for _, c := range res.Conflicts {
+		conflicts = append(conflicts, c.UID)
+	}
+	slices.Sort(conflicts)
+	if !slices.Equal(conflicts, []uint32{1, 7}) {
+		t.Errorf("conflicts %+v, want UIDs 1 and 7", res.Conflicts)
+	}
+
+	// The larger copy of UID 1 replaced the truncated one
+	want, _ := os.ReadFile(filepath.Join(src, "1"+MessageExt))
+	if got, _ := os.ReadFile(filepath.Join(dst, "1"+MessageExt)); !bytes.Equal(got, want) {
+		t.Errorf("UID 1 in dst is %q, want the source copy", got)
+	}
+	// dst keeps its own UID 7
+	if got, _ := os.ReadFile(filepath.Join(dst, "7"+MessageExt)); !bytes.Contains(got, []byte("<other@example.com>")) {
+		t.Errorf("UID 7 in dst was overwritten: %q", got)
+	}
+
+	m, err := LoadManifest(dst, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uids []uint32
+	for uid := range m.Messages {
+		uids = append(uids, uid)
+	}
+	slices.Sort(uids)
+	if !slices.Equal(uids, []uint32{1, 2, 4, 6, 7, 9}) {
+		t.Errorf("manifest holds %v", uids)
+	}
+	if m.Messages[1].Size != int64(len(want)) {
+		t.Errorf("manifest size of UID 1 = %d, want %d", m.Messages[1].Size, len(want))
+	}
+}
+
+func TestMergeDryRun(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeMessages(t, filepath.Join(srcDir, "INBOX"), 1, 2)
+
+	results, err := Merge(srcDir, dstDir, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || len(results[0].Copied) != 2 {
+		t.Errorf("results: %+v", results)
+	}
+	if entries, _ := os.ReadDir(dstDir); len(entries) != 0 {
+		t.Errorf("dry run wrote %d entries", len(entries))
+	}
+}
@@ -0,0 +1,61 @@
+package archiveService
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+)
+
+// maxMIMEDepth bounds how deeply nested multiparts are walked
+const maxMIMEDepth = 20
+
+// CheckMIME parses a raw message's headers and walks its MIME parts, returning
+// the first structural error found. It only reads the message; callers store
+// the raw bytes regardless of the result.
+func CheckMIME(data []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("headers: %w", err)
+	}
+	return checkPart(msg.Header.Get("Content-Type"), msg.Body, 0)
+}
+
+func checkPart(contentType string, body io.Reader, depth int) error {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("content type %q: %w", contentType, err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil
+	}
+	if depth >= maxMIMEDepth {
+		return fmt.Errorf("multipart nested deeper than %d levels", maxMIMEDepth)
+	}
+	if params["boundary"] == "" {
+		return fmt.Errorf("%s without a boundary", mediaType)
+	}
+
+	r := multipart.NewReader(body, params["boundary"])
+	for n := 0; ; n++ {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			if n == 0 {
+				return fmt.Errorf("%s has no parts", mediaType)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("part %d: %w", n+1, err)
+		}
+		if err := checkPart(part.Header.Get("Content-Type"), part, depth+1); err != nil {
+			return fmt.Errorf("part %d: %w", n+1, err)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package archiveService
+
+import "testing"
+
+func TestCheckMIME(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		ok   bool
+	}{
+		{"plain", "Subject: hi\r\n\r\nbody\r\n", true},
+		{"multipart", "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\none\r\n--b--\r\n", true},
+		{"bad headers", "not a header\r\n", false},
+		{"bad content type", "Content-Type: text/plain; charset\r\n\r\nbody\r\n", false},
+		{"no boundary", "Content-Type: multipart/mixed\r\n\r\nbody\r\n", false},
+		{"no parts", "Content-Type: multipart/mixed; boundary=b\r\n\r\nbody\r\n", false},
+		{"bad nested part", "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: multipart/alternative\r\n\r\nx\r\n--b--\r\n", false},
+	}
+	for _, tt := range tests {
+		if err := CheckMIME([]byte(tt.msg)); (err == nil) != tt.ok {
+			t.Errorf("%s: CheckMIME = %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package archiveService
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// RefExt is the extension of a reference stored in place of a message that
+// is already archived under another mailbox (DEDUP), giving <uid>.ref
+const RefExt = ".ref"
+
+// MessageRef points at the stored copy of a message by its path relative to
+// the backup dir
+type MessageRef struct {
+	MessageID string `json:"message_id"`
+	Mailbox   string `json:"mailbox"`
+	UID       uint32 `json:"uid"`
+	Ref       string `json:"ref"`
+}
+
+// Marshal encodes the reference as written to a .ref file
+func (r MessageRef) Marshal() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// ReadRef reads a .ref file
+func ReadRef(path string) (MessageRef, error) {
+	var r MessageRef
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return r, err
+	}
+	return r, json.Unmarshal(data, &r)
+}
+
+// entryFromRef builds a manifest entry from a .ref file. Size is that of the
+// reference, the message itself is accounted for where it is stored.
+func entryFromRef(path string) (ManifestEntry, error) {
+	r, err := ReadRef(path)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	return ManifestEntry{File: filepath.Base(path), MessageID: r.MessageID, Size: info.Size()}, nil
+}
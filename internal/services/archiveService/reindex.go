@@ -0,0 +1,192 @@
+package archiveService
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReindexResult lists the manifest drift repaired in one mailbox directory
+type ReindexResult struct {
+	Dir     string
+	Added   []uint32
+	Removed []uint32
+	Changed []uint32
+}
+
+// UIDFromFile parses the UID out of a stored message file name like "123.eml",
+// "123.eml.gz" or "123.ref"
+func UIDFromFile(name string) (uint32, bool) {
+	base, ok := strings.CutSuffix(strings.TrimSuffix(name, CompressedExt), MessageExt)
+	if !ok {
+		base, ok = strings.CutSuffix(name, RefExt)
+	}
+	if !ok {
+		return 0, false
+	}
+	uid, err := strconv.ParseUint(base, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(uid), true
+}
+
+// ScanDir builds a manifest purely from the message files in dir
+func ScanDir(dir, box string) (*Manifest, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := NewManifest(box)
+	for _, de := range entries {
+		if de.IsDir() {
+			continue
+		}
+		uid, ok := UIDFromFile(de.Name())
+		if !ok {
+			continue
+		}
+
+		e, err := entryFromFile(filepath.Join(dir, de.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m.Messages[uid] = e
+	}
+
+	if err := scanThreads(dir, m); err != nil {
+		return nil, err
+	}
+	if err := scanMbox(dir, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// scanThreads adds messages stored under threads/<thrid>/ to m
+func scanThreads(dir string, m *Manifest) error {
+	threadsDir := filepath.Join(dir, ThreadsDir)
+	threads, err := os.ReadDir(threadsDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, td := range threads {
+		if !td.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(threadsDir, td.Name()))
+		if err != nil {
+			return err
+		}
+		for _, de := range files {
+			uid, ok := UIDFromFile(de.Name())
+			if de.IsDir() || !ok {
+				continue
+			}
+			e, err := entryFromFile(filepath.Join(threadsDir, td.Name(), de.Name()))
+			if err != nil {
+				return err
+			}
+			e.File = ThreadsDir + "/" + td.Name() + "/" + de.Name()
+			e.ThreadID = td.Name()
+			m.Messages[uid] = e
+		}
+	}
+	return nil
+}
+
+// entryFromFile builds a manifest entry from a stored message. Size is that
+// of the message itself, also for compressed files.
+func entryFromFile(path string) (ManifestEntry, error) {
+	if strings.HasSuffix(path, RefExt) {
+		return entryFromRef(path)
+	}
+	data, err := ReadMessageFile(path)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	return NewEntry(filepath.Base(path), data), nil
+}
+
+// Reindex rebuilds the manifest of every mailbox directory under backupDir from
+// the files on disk. With dry set, drift is reported but nothing is written.
+func Reindex(backupDir string, dry bool) ([]ReindexResult, error) {
+	dirs, err := os.ReadDir(backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ReindexResult
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		res, err := ReindexDir(filepath.Join(backupDir, d.Name()), dry)
+		if err != nil {
+			return results, fmt.Errorf("reindex %s: %w", d.Name(), err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// ReindexDir rebuilds the manifest of a single mailbox directory
+func ReindexDir(dir string, dry bool) (ReindexResult, error) {
+	res := ReindexResult{Dir: dir}
+
+	old, err := LoadManifest(dir, filepath.Base(dir))
+	if err != nil {
+		return res, err
+	}
+	fresh, err := ScanDir(dir, old.Mailbox)
+	if err != nil {
+		return res, err
+	}
+	fresh.UidValidity, fresh.HighestMsgID = old.UidValidity, old.HighestMsgID
+	fresh.Backend, fresh.NextNumber = old.Backend, old.NextNumber
+
+	for uid, e := range fresh.Messages {
+		prev, ok := old.Messages[uid]
+		switch {
+		case !ok:
+			res.Added = append(res.Added, uid)
+		case prev.Size != e.Size || prev.MessageID != e.MessageID || prev.File != e.File || prev.ThreadID != e.ThreadID:
+			res.Changed = append(res.Changed, uid)
+		}
+		// Flags and Gmail IDs only come from the server, so carry them over
+		if ok {
+			e.Flags, e.Labels, e.GmMsgID = prev.Flags, prev.Labels, prev.GmMsgID
+			fresh.Messages[uid] = e
+		}
+	}
+	// Messages found on disk have no flags yet; a zero checkpoint makes the
+	// next run fetch them
+	if len(res.Added) == 0 {
+		fresh.HighestModSeq = old.HighestModSeq
+	}
+	for uid := range old.Messages {
+		if _, ok := fresh.Messages[uid]; !ok {
+			res.Removed = append(res.Removed, uid)
+		}
+	}
+	sortUIDs(res.Added)
+	sortUIDs(res.Removed)
+	sortUIDs(res.Changed)
+
+	if dry || len(res.Added)+len(res.Removed)+len(res.Changed) == 0 {
+		return res, nil
+	}
+	return res, fresh.Save(dir)
+}
+
+func sortUIDs(uids []uint32) {
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+}
@@ -0,0 +1,91 @@
+package archiveService
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeMessages stores a small message for each UID in dir
+func writeMessages(t *testing.T, dir string, uids ...uint32) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range uids {
+		body := fmt.Sprintf("Message-ID: <%d@example.com>\r\nSubject: %d\r\n\r\nbody\r\n", uid, uid)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d%s", uid, MessageExt)), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReindex(t *testing.T) {
+	backupDir := t.TempDir()
+	inbox := filepath.Join(backupDir, "INBOX")
+	writeMessages(t, inbox, 1, 2, 3)
+
+	m, err := ScanDir(inbox, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := m.Messages[1]
+	e.Flags = []string{`\Seen`}
+	m.Messages[1] = e
+	if err := m.Save(inbox); err != nil {
+		t.Fatal(err)
+	}
+
+	// One message deleted and one added behind the manifest's back
+	if err := os.Remove(filepath.Join(inbox, "2"+MessageExt)); err != nil {
+		t.Fatal(err)
+	}
+	writeMessages(t, inbox, 4)
+
+	// A dry run reports the drift without writing
+	results, err := Reindex(backupDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !slices.Equal(results[0].Added, []uint32{4}) || !slices.Equal(results[0].Removed, []uint32{2}) || len(results[0].Changed) != 0 {
+		t.Fatalf("dry run results %+v", results)
+	}
+	if before, _ := LoadManifest(inbox, "INBOX"); len(before.Messages) != 3 || before.Messages[2].File == "" {
+		t.Fatal("dry run rewrote the manifest")
+	}
+
+	results, err = Reindex(backupDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(results[0].Added, []uint32{4}) || !slices.Equal(results[0].Removed, []uint32{2}) {
+		t.Fatalf("results %+v", results)
+	}
+
+	after, err := LoadManifest(inbox, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uids []uint32
+	for uid := range after.Messages {
+		uids = append(uids, uid)
+	}
+	slices.Sort(uids)
+	if !slices.Equal(uids, []uint32{1, 3, 4}) {
+		t.Errorf("manifest holds %v, want [1 3 4]", uids)
+	}
+	if !slices.Equal(after.Messages[1].Flags, []string{`\Seen`}) {
+		t.Errorf("flags of UID 1 not carried over: %v", after.Messages[1].Flags)
+	}
+
+	// Nothing left to repair
+	results, err = Reindex(backupDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; len(r.Added)+len(r.Removed)+len(r.Changed) != 0 {
+		t.Errorf("second reindex found drift: %+v", r)
+	}
+}
@@ -0,0 +1,48 @@
+package archiveService
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RunLogsDir holds one log file per run inside the backup dir
+const RunLogsDir = "logs"
+
+// CreateRunLog creates the log file for a run started at start
+func CreateRunLog(backupDir string, start time.Time) (*os.File, error) {
+	dir := filepath.Join(backupDir, RunLogsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := start.UTC().Format("20060102T150405Z") + ".log"
+	return os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// PruneRunLogs removes all but the newest keep run logs. The timestamped
+// names sort chronologically.
+func PruneRunLogs(backupDir string, keep int) error {
+	dir := filepath.Join(backupDir, RunLogsDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var logs []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), ".log") {
+			logs = append(logs, e.Name())
+		}
+	}
+	sort.Strings(logs)
+
+	for len(logs) > keep {
+		if err := os.Remove(filepath.Join(dir, logs[0])); err != nil {
+			return err
+		}
+		logs = logs[1:]
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package archiveService
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRunLogsPruned(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		f, err := CreateRunLog(dir, start.Add(time.Duration(i)*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	// Other files in the logs dir are left alone
+	if err := os.WriteFile(filepath.Join(dir, RunLogsDir, "notes.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PruneRunLogs(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, RunLogsDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{"20260301T150000Z.log", "20260301T160000Z.log", "notes.txt"}
+	if !slices.Equal(names, want) {
+		t.Errorf("logs dir holds %v, want %v", names, want)
+	}
+}
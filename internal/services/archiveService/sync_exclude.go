@@ -0,0 +1,30 @@
+package archiveService
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// TransientPatterns are files in the backup dir that change every run or only
+// exist mid-write, and shouldn't be synced or committed. Message files are
+// named <uid>.<ext> so they stay stable across runs.
+var TransientPatterns = []string{
+	"*.tmp",
+	"*.lock",
+	"*.state.json",
+	"missing_uids.json",
+}
+
+// WriteSyncExcludes writes the transient patterns to name inside backupDir in
+// a format understood by both .gitignore and `rsync --exclude-from`
+func WriteSyncExcludes(backupDir, name string) error {
+	var b strings.Builder
+	b.WriteString("# Generated by archive-gmail: transient files that should not be synced\n")
+	for _, p := range TransientPatterns {
+		b.WriteString(p)
+		b.WriteString("\n")
+	}
+	return utils.WriteFileAtomic(filepath.Join(backupDir, name), []byte(b.String()), 0644)
+}
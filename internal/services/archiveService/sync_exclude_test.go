@@ -0,0 +1,51 @@
+package archiveService
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func excluded(name string) bool {
+	for _, p := range TransientPatterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTransientPatterns(t *testing.T) {
+	for _, name := range []string{".daily_limit.state.json", "missing_uids.json", ".manifest.json.123456.tmp", "run.lock"} {
+		if !excluded(name) {
+			t.Errorf("%s is not excluded", name)
+		}
+	}
+	for _, name := range []string{"1" + MessageExt, "2" + MessageExt + CompressedExt, ManifestFile, ChecksumFile, "7" + RefExt, "status.json"} {
+		if excluded(name) {
+			t.Errorf("%s is excluded", name)
+		}
+	}
+}
+
+func TestWriteSyncExcludes(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteSyncExcludes(dir, ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, ".stignore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var patterns []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	if strings.Join(patterns, ",") != strings.Join(TransientPatterns, ",") {
+		t.Errorf("wrote %q, want %q", patterns, TransientPatterns)
+	}
+}
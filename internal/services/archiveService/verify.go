@@ -0,0 +1,72 @@
+package archiveService
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// VerifyProblem is a stored file that failed verification
+type VerifyProblem struct {
+	Path   string
+	Reason string
+}
+
+// VerifyArchive checks every file listed in CHECKSUMS.sha256 still exists and
+// matches its checksum. With parse, every stored .eml is also parsed (headers
+// and MIME structure, see CheckMIME). Without a checksum file only the parse
+// check runs.
+func VerifyArchive(backupDir string, parse bool) ([]VerifyProblem, error) {
+	var problems []VerifyProblem
+
+	if _, err := os.Stat(filepath.Join(backupDir, ChecksumFile)); err == nil {
+		sums, err := LoadChecksums(backupDir)
+		if err != nil {
+			return nil, err
+		}
+		paths := make([]string, 0, len(sums.entries))
+		for p := range sums.entries {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+
+		for _, p := range paths {
+			sum, err := HashFile(filepath.Join(backupDir, filepath.FromSlash(p)))
+			switch {
+			case errors.Is(err, os.ErrNotExist):
+				problems = append(problems, VerifyProblem{Path: p, Reason: "listed in " + ChecksumFile + " but missing"})
+			case err != nil:
+				return problems, err
+			case sum != sums.entries[p]:
+				problems = append(problems, VerifyProblem{Path: p, Reason: "checksum mismatch"})
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if !parse {
+		return problems, nil
+	}
+	err := filepath.WalkDir(backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !IsMessageFile(d.Name()) {
+			return nil
+		}
+
+		data, err := ReadMessageFile(path)
+		if err != nil {
+			return err
+		}
+		if err := CheckMIME(data); err != nil {
+			rel, _ := filepath.Rel(backupDir, path)
+			problems = append(problems, VerifyProblem{Path: filepath.ToSlash(rel), Reason: "does not parse: " + err.Error()})
+		}
+		return nil
+	})
+	return problems, err
+}
@@ -0,0 +1,412 @@
+package gmailApiService
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+	metricsSvc "github.com/redjax/archive-gmail/internal/services/metricsService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// allMail is the mailbox every message is archived under, as in IMAP
+const allMail = "[Gmail]/All Mail"
+
+// systemMailboxes maps the system labels that IMAP exposes as mailboxes to
+// their IMAP names, so both backends archive into the same directories.
+// Others (UNREAD, CHAT, CATEGORY_*) are not mailboxes.
+var systemMailboxes = map[string]string{
+	"INBOX":     "INBOX",
+	"SENT":      "[Gmail]/Sent Mail",
+	"DRAFT":     "[Gmail]/Drafts",
+	"SPAM":      "[Gmail]/Spam",
+	"TRASH":     "[Gmail]/Trash",
+	"STARRED":   "[Gmail]/Starred",
+	"IMPORTANT": "[Gmail]/Important",
+}
+
+// systemLabels maps system labels to the names IMAP reports for them in
+// X-GM-LABELS, so manifests record the same labels with either backend
+var systemLabels = map[string]string{
+	"INBOX":     "\\Inbox",
+	"SENT":      "\\Sent",
+	"DRAFT":     "\\Draft",
+	"SPAM":      "\\Spam",
+	"TRASH":     "\\Trash",
+	"STARRED":   "\\Starred",
+	"IMPORTANT": "\\Important",
+}
+
+// manifestCheckpoint is how often the manifest is saved while downloading
+const manifestCheckpoint = 10 * time.Second
+
+// Backup archives every label selected by include through the Gmail API,
+// one mailbox directory per label as the IMAP backend lays them out. Messages
+// are identified by their Gmail message ID (X-GM-MSGID), so ones already
+// stored are never fetched again; new ones are numbered locally, in a
+// manifest marked BackendAPI that the IMAP backend refuses to use. With INCREMENTAL_SCAN, a label whose manifest has a historyId
+// only gets the changes since then. Once ctx is cancelled no further messages
+// are fetched. Progress is logged to log.
+func Backup(ctx context.Context, cfg config.Config, log *logrus.Entry, include func(box string) bool) (*gmailSvc.RunSummary, error) {
+	start := time.Now()
+	summary := &gmailSvc.RunSummary{Started: start}
+	if cfg.Email == "" {
+		return summary, fmt.Errorf("GMAIL_EMAIL is required")
+	}
+
+	c, err := NewClient(ctx, cfg)
+	if err != nil {
+		return summary, err
+	}
+	labels, err := c.Labels(ctx)
+	if err != nil {
+		return summary, fmt.Errorf("listing labels: %w", err)
+	}
+
+	names := map[string]string{}
+	boxes := map[string]string{"": allMail}
+	order := []string{""}
+	for _, l := range labels {
+		box := l.Name
+		if l.Type == "system" {
+			var ok bool
+			if box, ok = systemMailboxes[l.ID]; !ok {
+				continue
+			}
+		} else {
+			names[l.ID] = l.Name
+		}
+		boxes[l.ID] = box
+		order = append(order, l.ID)
+	}
+
+	log.Infof("Starting backup through the Gmail API (%d labels)", len(labels))
+	for _, id := range order {
+		box := boxes[id]
+		if !include(box) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		res := backupLabel(ctx, c, cfg, log, id, box, names)
+		summary.Mailboxes = append(summary.Mailboxes, res)
+		summary.Downloaded += uint64(res.Downloaded)
+	}
+
+	var runErr error
+	if failed := summary.FailedMailboxes(); len(failed) > 0 {
+		boxNames := make([]string, len(failed))
+		for i, m := range failed {
+			boxNames[i] = m.Name
+		}
+		runErr = fmt.Errorf("%d mailboxes failed: %s", len(failed), strings.Join(boxNames, ", "))
+	}
+	if ctx.Err() != nil {
+		summary.Interrupted = true
+		runErr = fmt.Errorf("backup interrupted by shutdown")
+	}
+
+	if cfg.WriteChecksums && !cfg.DryRun {
+		updateChecksums(log, cfg.BackupDir)
+	}
+
+	summary.Elapsed = time.Since(start)
+	log.Infof("Archive complete: %d messages in %.1fs", summary.Downloaded, summary.Elapsed.Seconds())
+	log.Info("Per-mailbox results:")
+	summary.LogResults(log)
+	summary.LogFailed(log)
+	return summary, runErr
+}
+
+// backupLabel downloads the messages of one label not yet in its mailbox
+// directory. names holds the names of user labels by ID.
+func backupLabel(ctx context.Context, c *Client, cfg config.Config, log *logrus.Entry, labelID, box string, names map[string]string) gmailSvc.MailboxResult {
+	log.Infof("Processing: %s", box)
+	res := gmailSvc.MailboxResult{Name: box}
+	metricsSvc.MailboxStarted(box)
+	defer metricsSvc.MailboxFinished(box)
+
+	dir := gmailSvc.MailboxDir(cfg.BackupDir, box)
+	if err := utils.EnsureDir(dir, cfg.DryRun); err != nil {
+		res.Error = fmt.Sprintf("creating mailbox dir: %v", err)
+		return res
+	}
+	m, err := archiveSvc.LoadManifest(dir, box)
+	if err != nil {
+		log.Warnf("Failed to load manifest for %s, starting a new one: %v", box, err)
+		m = archiveSvc.NewManifest(box)
+	}
+	// Local numbers would collide with the UIDs of an IMAP archive, so the
+	// two never share a directory
+	if m.Backend != archiveSvc.BackendAPI {
+		imap, err := imapArchive(dir, m)
+		if err != nil {
+			res.Error = fmt.Sprintf("scanning mailbox dir: %v", err)
+			return res
+		}
+		if imap {
+			res.Error = fmt.Sprintf("%s holds an IMAP archive; use a separate BACKUP_DIR for BACKEND=api", dir)
+			return res
+		}
+		m.Backend = archiveSvc.BackendAPI
+	}
+
+	stored := map[uint64]uint32{}
+	m.NextNumber = max(m.NextNumber, 1)
+	for n, e := range m.Messages {
+		if e.GmMsgID != 0 {
+			stored[e.GmMsgID] = n
+		}
+		m.NextNumber = max(m.NextNumber, n+1)
+	}
+
+	dirty := false
+	saved := time.Now()
+	save := func() {
+		if !dirty || cfg.DryRun {
+			return
+		}
+		if err := m.Save(dir); err != nil {
+			log.Warnf("Failed to save manifest for %s: %v", box, err)
+			return
+		}
+		dirty = false
+		saved = time.Now()
+	}
+	defer save()
+
+	scanStart := time.Now()
+	var ids, deleted []string
+	var latest uint64
+	if cfg.IncrementalScan && !cfg.ForceResync && m.HistoryID > 0 {
+		ids, deleted, latest, err = labelChanges(ctx, c, labelID, m.HistoryID)
+		if isNotFound(err) {
+			log.Infof("History of %s since the last run has expired, listing every message", box)
+			latest = 0
+		} else if err != nil {
+			res.Error = fmt.Sprintf("listing history: %v", err)
+			return res
+		}
+	}
+	if latest == 0 {
+		// Read the historyId first, so changes made while listing are picked up
+		// by the next run
+		if latest, err = c.HistoryID(ctx); err != nil {
+			res.Error = fmt.Sprintf("reading historyId: %v", err)
+			return res
+		}
+		if ids, err = listMessages(ctx, c, labelID); err != nil {
+			res.Error = fmt.Sprintf("listing messages: %v", err)
+			return res
+		}
+	}
+
+	var missing []string
+	for _, id := range ids {
+		msgID, err := parseID(id)
+		if err != nil {
+			continue
+		}
+		n, ok := stored[msgID]
+		if !ok {
+			missing = append(missing, id)
+		} else if e := m.Messages[n]; e.ServerDeleted && !cfg.DryRun {
+			e.ServerDeleted = false
+			m.Messages[n] = e
+			dirty = true
+		}
+	}
+	if n := markDeleted(m, stored, deleted, cfg.DryRun); n > 0 {
+		log.Infof("%s: %d messages deleted on the server since the last run", box, n)
+		dirty = true
+	}
+	res.Timings.Scan = time.Since(scanStart)
+	log.Debugf("%s: %d messages to download", box, len(missing))
+	if cfg.DryRun {
+		if len(missing) > 0 {
+			log.WithField("dry_run", true).Infof("DRY RUN: would download %d messages into %s", len(missing), box)
+		}
+		return res
+	}
+
+	downloadStart := time.Now()
+	for _, id := range missing {
+		if ctx.Err() != nil {
+			res.Interrupted = true
+			break
+		}
+
+		msg, data, err := c.RawMessage(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				res.Interrupted = true
+				break
+			}
+			log.Warnf("Failed to fetch message %s in %s, will retry next run: %v", id, box, err)
+			failMessage(&res, id, fmt.Sprintf("fetching message %s: %v", id, err))
+			continue
+		}
+		data = utils.NormalizeEOL(data, cfg.NormalizeEOL)
+
+		n := m.NextNumber
+		ext := archiveSvc.MessageExt
+		out := data
+		if cfg.Compress {
+			ext += archiveSvc.CompressedExt
+			if out, err = archiveSvc.Compress(data); err != nil {
+				log.Warnf("Failed to compress message %s in %s, will retry next run: %v", id, box, err)
+				failMessage(&res, id, fmt.Sprintf("compressing message %s: %v", id, err))
+				continue
+			}
+		}
+		path := gmailSvc.MessagePathExt(cfg.BackupDir, box, uint64(n), ext)
+		if err := utils.WriteFileAtomic(path, out, 0644); err != nil {
+			log.Warnf("Failed to write message %s in %s, will retry next run: %v", id, box, err)
+			failMessage(&res, id, fmt.Sprintf("writing message %s: %v", id, err))
+			continue
+		}
+		m.NextNumber++
+
+		e := archiveSvc.NewEntry(filepath.Base(path), data)
+		e.GmMsgID, _ = parseID(msg.ID)
+		if thrid, err := parseID(msg.ThreadID); err == nil {
+			e.ThreadID = strconv.FormatUint(thrid, 10)
+		}
+		e.Flags, e.Labels = flagsAndLabels(msg.LabelIDs, names)
+		m.Messages[n] = e
+		m.HighestMsgID = max(m.HighestMsgID, e.GmMsgID)
+		dirty = true
+		res.Downloaded++
+		metricsSvc.AddDownloaded()
+
+		if time.Since(saved) >= manifestCheckpoint {
+			save()
+		}
+	}
+	res.Timings.Download = time.Since(downloadStart)
+
+	// Changes up to latest are stored once nothing failed; otherwise the next
+	// run goes through them again and fetches what is still missing
+	if res.Error == "" && !res.Interrupted && latest != m.HistoryID {
+		m.HistoryID = latest
+		dirty = true
+	}
+	return res
+}
+
+// imapArchive reports whether dir, whose manifest m was not written by
+// BACKEND=api, already holds messages stored by IMAP UID
+func imapArchive(dir string, m *archiveSvc.Manifest) (bool, error) {
+	if len(m.Messages) > 0 {
+		return true, nil
+	}
+	if !utils.Exists(dir) {
+		return false, nil
+	}
+	scanned, err := archiveSvc.ScanDir(dir, m.Mailbox)
+	if err != nil {
+		return false, err
+	}
+	return len(scanned.Messages) > 0, nil
+}
+
+// failMessage records a message that could not be stored, for the next run
+// to retry, and fails the mailbox with the first such error
+func failMessage(res *gmailSvc.MailboxResult, id, reason string) {
+	res.FailedIDs = append(res.FailedIDs, id)
+	if res.Error == "" {
+		res.Error = reason
+	}
+}
+
+// listMessages returns the IDs of every message with labelID (all messages
+// for ""), oldest first so local numbers follow arrival
+func listMessages(ctx context.Context, c *Client, labelID string) ([]string, error) {
+	var ids []string
+	page := ""
+	for {
+		batch, next, err := c.ListMessages(ctx, labelID, page)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, batch...)
+		if next == "" {
+			break
+		}
+		page = next
+	}
+	slices.Reverse(ids)
+	return ids, nil
+}
+
+// markDeleted marks the stored messages among the deleted IDs as deleted on
+// the server, and returns how many it marked
+func markDeleted(m *archiveSvc.Manifest, stored map[uint64]uint32, deleted []string, dry bool) int {
+	n := 0
+	for _, id := range deleted {
+		msgID, err := parseID(id)
+		if err != nil {
+			continue
+		}
+		n, ok := stored[msgID]
+		if !ok || m.Messages[n].ServerDeleted {
+			continue
+		}
+		n++
+		if !dry {
+			e := m.Messages[n]
+			e.ServerDeleted = true
+			m.Messages[n] = e
+		}
+	}
+	return n
+}
+
+// flagsAndLabels derives the IMAP flags and X-GM-LABELS a message would have
+// from its label IDs
+func flagsAndLabels(ids []string, names map[string]string) (flags, labels []string) {
+	unread := false
+	for _, id := range ids {
+		switch id {
+		case "UNREAD":
+			unread = true
+		case "STARRED":
+			flags = append(flags, "\\Flagged")
+		case "DRAFT":
+			flags = append(flags, "\\Draft")
+		}
+		if name, ok := systemLabels[id]; ok {
+			labels = append(labels, name)
+		} else if name, ok := names[id]; ok {
+			labels = append(labels, name)
+		}
+	}
+	if !unread {
+		flags = append(flags, "\\Seen")
+	}
+	return flags, labels
+}
+
+// updateChecksums brings CHECKSUMS.sha256 up to date with the files written
+func updateChecksums(log *logrus.Entry, backupDir string) {
+	sums, err := archiveSvc.LoadChecksums(backupDir)
+	if err == nil {
+		err = sums.Update()
+	}
+	if err == nil {
+		err = sums.Save()
+	}
+	if err != nil {
+		log.Warnf("Failed updating %s: %v", archiveSvc.ChecksumFile, err)
+	}
+}
@@ -0,0 +1,168 @@
+package gmailApiService
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/oauth2"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// fakeAPI serves the parts of the Gmail API a backup uses, for a mailbox
+// holding ids (oldest first). Fetching a message in failing returns 404.
+type fakeAPI struct {
+	mu      sync.Mutex
+	ids     []string
+	failing map[string]bool
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var resp any
+	switch path := r.URL.Path; {
+	case path == "/profile":
+		resp = map[string]string{"historyId": "100"}
+	case path == "/messages":
+		var msgs []map[string]string
+		for _, id := range slices.Backward(f.ids) {
+			msgs = append(msgs, map[string]string{"id": id})
+		}
+		resp = map[string]any{"messages": msgs}
+	case strings.HasPrefix(path, "/messages/"):
+		id := strings.TrimPrefix(path, "/messages/")
+		if f.failing[id] || !slices.Contains(f.ids, id) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		raw := fmt.Sprintf("Message-ID: <%s@example.com>\r\nSubject: message %s\r\n\r\nbody\r\n", id, id)
+		resp = Message{ID: id, ThreadID: id, LabelIDs: []string{"INBOX"}, Raw: base64.RawURLEncoding.EncodeToString([]byte(raw))}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// testClient returns a client of api
+func testClient(t *testing.T, api *fakeAPI, cfg config.Config) *Client {
+	t.Helper()
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return newClient(context.Background(), cfg, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), srv.URL)
+}
+
+// testLabel backs up INBOX from api into cfg.BackupDir and returns the result
+// with the manifest written
+func testLabel(t *testing.T, api *fakeAPI, cfg config.Config) (gmailSvc.MailboxResult, *archiveSvc.Manifest) {
+	t.Helper()
+	logger, _ := test.NewNullLogger()
+	res := backupLabel(context.Background(), testClient(t, api, cfg), cfg, logger.WithField("mailbox", "INBOX"), "INBOX", "INBOX", nil)
+	m, err := archiveSvc.LoadManifest(gmailSvc.MailboxDir(cfg.BackupDir, "INBOX"), "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, m
+}
+
+func TestBackupLabelFailedMessage(t *testing.T) {
+	api := &fakeAPI{ids: []string{"a1", "b2", "c3"}, failing: map[string]bool{"b2": true}}
+	cfg := config.Config{BackupDir: t.TempDir()}
+
+	res, m := testLabel(t, api, cfg)
+	if res.Downloaded != 2 || !slices.Equal(res.FailedIDs, []string{"b2"}) || !strings.Contains(res.Error, "fetching message b2") {
+		t.Errorf("first run: %+v", res)
+	}
+	if m.HistoryID != 0 {
+		t.Errorf("historyId %d recorded with a message missing", m.HistoryID)
+	}
+
+	// The next run fetches what failed and only then records the historyId
+	api.failing = nil
+	res, m = testLabel(t, api, cfg)
+	if res.Downloaded != 1 || res.Error != "" || len(res.FailedIDs) != 0 {
+		t.Errorf("second run: %+v", res)
+	}
+	if m.HistoryID != 100 || len(m.Messages) != 3 {
+		t.Errorf("manifest: historyId %d, %d messages", m.HistoryID, len(m.Messages))
+	}
+}
+
+func TestBackupLabelDryRun(t *testing.T) {
+	api := &fakeAPI{ids: []string{"a1", "b2"}}
+	cfg := config.Config{BackupDir: t.TempDir(), DryRun: true}
+	logger, hook := test.NewNullLogger()
+	res := backupLabel(context.Background(), testClient(t, api, cfg), cfg, logger.WithField("mailbox", "INBOX"), "INBOX", "INBOX", nil)
+	if res.Downloaded != 0 || res.Error != "" {
+		t.Errorf("result: %+v", res)
+	}
+	if last := hook.LastEntry(); last == nil || last.Message != "DRY RUN: would download 2 messages into INBOX" {
+		t.Errorf("last log line: %v", last)
+	}
+	if _, err := os.Stat(gmailSvc.MailboxDir(cfg.BackupDir, "INBOX")); !os.IsNotExist(err) {
+		t.Errorf("mailbox dir written in a dry run: %v", err)
+	}
+}
+
+func TestBackupLabelRefusesIMAPArchive(t *testing.T) {
+	cfg := config.Config{BackupDir: t.TempDir()}
+	dir := gmailSvc.MailboxDir(cfg.BackupDir, "INBOX")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Stored by IMAP UID, without a manifest
+	if err := os.WriteFile(filepath.Join(dir, "7.eml"), []byte("Subject: imap\r\n\r\nbody\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, m := testLabel(t, &fakeAPI{ids: []string{"a1"}}, cfg)
+	if res.Downloaded != 0 || !strings.Contains(res.Error, "holds an IMAP archive") {
+		t.Errorf("result: %+v", res)
+	}
+	if m.Backend != "" || len(m.Messages) != 0 {
+		t.Errorf("manifest written: %+v", m)
+	}
+}
+
+func TestBackupLabelNumbersNotReused(t *testing.T) {
+	api := &fakeAPI{ids: []string{"a1", "b2"}}
+	cfg := config.Config{BackupDir: t.TempDir()}
+	dir := gmailSvc.MailboxDir(cfg.BackupDir, "INBOX")
+
+	if res, m := testLabel(t, api, cfg); res.Downloaded != 2 || m.Backend != archiveSvc.BackendAPI || m.NextNumber != 3 {
+		t.Fatalf("first run: %+v, manifest backend %q next %d", res, m.Backend, m.NextNumber)
+	}
+
+	// Losing the newest file and reindexing must not hand its number out again
+	if err := os.Remove(filepath.Join(dir, "2.eml")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := archiveSvc.ReindexDir(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	res, m := testLabel(t, api, cfg)
+	if res.Downloaded != 1 {
+		t.Fatalf("second run: %+v", res)
+	}
+	if e, ok := m.Messages[3]; !ok || e.MessageID != "<b2@example.com>" || m.NextNumber != 4 {
+		t.Errorf("refetched message stored as %+v (ok %v), next %d", e, ok, m.NextNumber)
+	}
+	if _, ok := m.Messages[2]; ok {
+		t.Error("number 2 reused")
+	}
+}
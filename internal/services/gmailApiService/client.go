@@ -0,0 +1,248 @@
+package gmailApiService
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// baseURL is the Gmail API endpoint for the authenticated user
+const baseURL = "https://gmail.googleapis.com/gmail/v1/users/me"
+
+// Client calls the Gmail REST API
+type Client struct {
+	http    *http.Client
+	base    string
+	retries int
+	rate    *gmailSvc.RateLimiter
+}
+
+// Label is a Gmail label as returned by users.labels.list
+type Label struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Message is a message fetched with format=RAW
+type Message struct {
+	ID           string   `json:"id"`
+	ThreadID     string   `json:"threadId"`
+	LabelIDs     []string `json:"labelIds"`
+	HistoryID    string   `json:"historyId"`
+	InternalDate string   `json:"internalDate"`
+	Raw          string   `json:"raw"`
+}
+
+// apiError is an error response of the API
+type apiError struct {
+	Code int
+	msg  string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+// isNotFound reports whether err is a 404 response, which history.list
+// returns for a startHistoryId too old to be available
+func isNotFound(err error) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.Code == http.StatusNotFound
+}
+
+// NewClient returns an API client authenticated with the OAuth2 token in
+// OAUTH2_TOKEN_FILE, or with GMAIL_SERVICE_ACCOUNT_FILE impersonating
+// GMAIL_EMAIL through domain-wide delegation
+func NewClient(ctx context.Context, cfg config.Config) (*Client, error) {
+	if cfg.ServiceAccountFile == "" && (cfg.ClientID == "" || cfg.ClientSecret == "") {
+		return nil, fmt.Errorf("BACKEND=api requires OAuth2 (GMAIL_CLIENT_ID + GMAIL_CLIENT_SECRET) or GMAIL_SERVICE_ACCOUNT_FILE")
+	}
+	ts, err := gmailSvc.TokenSource(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(ctx, cfg, ts, baseURL), nil
+}
+
+// newClient returns a client calling the API at base with tokens from ts
+func newClient(ctx context.Context, cfg config.Config, ts oauth2.TokenSource, base string) *Client {
+	return &Client{
+		http:    oauth2.NewClient(ctx, ts),
+		base:    base,
+		retries: max(cfg.FetchRetries, 0),
+		rate:    gmailSvc.NewRateLimiter(cfg.RequestsPerSecond),
+	}
+}
+
+// get calls the API at REQUESTS_PER_SECOND and decodes the JSON response into
+// out. Rate limit (429) and server errors are retried FETCH_RETRIES times
+// with exponential backoff.
+func (c *Client) get(ctx context.Context, path string, query url.Values, out any) error {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			wait := min(time.Duration(1<<(attempt-1))*time.Second, 30*time.Second)
+			logrus.Debugf("Gmail API %s failed (%v), retrying in %s", path, lastErr, wait)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		if err := c.rate.Wait(ctx); err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			return json.Unmarshal(body, out)
+		}
+		lastErr = &apiError{Code: resp.StatusCode, msg: fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(body)))}
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+// Labels lists the account's labels
+func (c *Client) Labels(ctx context.Context) ([]Label, error) {
+	var resp struct {
+		Labels []Label `json:"labels"`
+	}
+	err := c.get(ctx, "/labels", nil, &resp)
+	return resp.Labels, err
+}
+
+// ListMessages returns a page of the IDs of messages with labelID, or of
+// every message when labelID is empty, and the token of the next page ("" on
+// the last one)
+func (c *Client) ListMessages(ctx context.Context, labelID, pageToken string) ([]string, string, error) {
+	q := url.Values{"maxResults": {"500"}, "includeSpamTrash": {"true"}}
+	if labelID != "" {
+		q.Set("labelIds", labelID)
+	}
+	if pageToken != "" {
+		q.Set("pageToken", pageToken)
+	}
+
+	var resp struct {
+		Messages []struct {
+			ID string `json:"id"`
+		} `json:"messages"`
+		NextPageToken string `json:"nextPageToken"`
+	}
+	if err := c.get(ctx, "/messages", q, &resp); err != nil {
+		return nil, "", err
+	}
+	ids := make([]string, len(resp.Messages))
+	for i, m := range resp.Messages {
+		ids[i] = m.ID
+	}
+	return ids, resp.NextPageToken, nil
+}
+
+// HistoryID returns the mailbox's current historyId
+func (c *Client) HistoryID(ctx context.Context) (uint64, error) {
+	var resp struct {
+		HistoryID string `json:"historyId"`
+	}
+	if err := c.get(ctx, "/profile", nil, &resp); err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(resp.HistoryID, 10, 64)
+}
+
+// HistoryChange is a message added or deleted, or labels added to or removed
+// from a message, in a history record
+type HistoryChange struct {
+	Message struct {
+		ID       string   `json:"id"`
+		LabelIDs []string `json:"labelIds"`
+	} `json:"message"`
+	LabelIDs []string `json:"labelIds"`
+}
+
+// History is a users.history.list record
+type History struct {
+	MessagesAdded   []HistoryChange `json:"messagesAdded"`
+	MessagesDeleted []HistoryChange `json:"messagesDeleted"`
+	LabelsAdded     []HistoryChange `json:"labelsAdded"`
+	LabelsRemoved   []HistoryChange `json:"labelsRemoved"`
+}
+
+// ListHistory returns a page of the changes after startID, oldest first, the
+// token of the next page ("" on the last one) and the current historyId
+func (c *Client) ListHistory(ctx context.Context, startID uint64, pageToken string) ([]History, string, uint64, error) {
+	q := url.Values{
+		"startHistoryId": {strconv.FormatUint(startID, 10)},
+		"maxResults":     {"500"},
+		"historyTypes":   {"messageAdded", "messageDeleted", "labelAdded", "labelRemoved"},
+	}
+	if pageToken != "" {
+		q.Set("pageToken", pageToken)
+	}
+
+	var resp struct {
+		History       []History `json:"history"`
+		NextPageToken string    `json:"nextPageToken"`
+		HistoryID     string    `json:"historyId"`
+	}
+	if err := c.get(ctx, "/history", q, &resp); err != nil {
+		return nil, "", 0, err
+	}
+	latest, err := strconv.ParseUint(resp.HistoryID, 10, 64)
+	return resp.History, resp.NextPageToken, latest, err
+}
+
+// RawMessage fetches a message in RFC 822 form along with its labels
+func (c *Client) RawMessage(ctx context.Context, id string) (Message, []byte, error) {
+	var m Message
+	if err := c.get(ctx, "/messages/"+url.PathEscape(id), url.Values{"format": {"raw"}}, &m); err != nil {
+		return m, nil, err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(m.Raw, "="))
+	return m, data, err
+}
+
+// parseID converts a hex message or thread ID to the decimal X-GM-MSGID /
+// X-GM-THRID IMAP reports for the same message
+func parseID(id string) (uint64, error) {
+	return strconv.ParseUint(id, 16, 64)
+}
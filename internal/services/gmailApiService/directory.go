@@ -0,0 +1,59 @@
+package gmailApiService
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// directoryURL is the Admin SDK Directory API endpoint
+const directoryURL = "https://admin.googleapis.com/admin/directory/v1"
+
+// directoryScope allows listing the users of a Workspace domain
+const directoryScope = "https://www.googleapis.com/auth/admin.directory.user.readonly"
+
+// DomainUsers returns the primary emails of the users of WORKSPACE_DOMAIN,
+// listed with the Admin SDK Directory API by the service account acting as
+// WORKSPACE_ADMIN. Suspended and archived users are left out.
+func DomainUsers(ctx context.Context, cfg config.Config) ([]string, error) {
+	if cfg.ServiceAccountFile == "" || cfg.WorkspaceAdmin == "" {
+		return nil, fmt.Errorf("WORKSPACE_DOMAIN requires GMAIL_SERVICE_ACCOUNT_FILE and WORKSPACE_ADMIN")
+	}
+	ts, err := gmailSvc.ServiceAccountTokenSource(cfg, cfg.WorkspaceAdmin, directoryScope)
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(ctx, cfg, ts, directoryURL)
+
+	var users []string
+	page := ""
+	for {
+		q := url.Values{"domain": {cfg.WorkspaceDomain}, "maxResults": {"500"}, "orderBy": {"email"}}
+		if page != "" {
+			q.Set("pageToken", page)
+		}
+		var resp struct {
+			Users []struct {
+				PrimaryEmail string `json:"primaryEmail"`
+				Suspended    bool   `json:"suspended"`
+				Archived     bool   `json:"archived"`
+			} `json:"users"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := c.get(ctx, "/users", q, &resp); err != nil {
+			return nil, fmt.Errorf("listing users of %s: %w", cfg.WorkspaceDomain, err)
+		}
+		for _, u := range resp.Users {
+			if !u.Suspended && !u.Archived {
+				users = append(users, u.PrimaryEmail)
+			}
+		}
+		if resp.NextPageToken == "" {
+			return users, nil
+		}
+		page = resp.NextPageToken
+	}
+}
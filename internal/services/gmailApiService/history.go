@@ -0,0 +1,68 @@
+package gmailApiService
+
+import (
+	"context"
+	"slices"
+)
+
+// labelChanges returns the messages that entered and left a label's mailbox
+// after the historyId since, each oldest first, and the current historyId. A
+// message enters a label's mailbox when it is added with the label or gets
+// the label, and leaves it when it is deleted or loses the label; for All Mail
+// (labelID "") only additions and deletions count. Only a message's last
+// change is kept.
+func labelChanges(ctx context.Context, c *Client, labelID string, since uint64) (added, deleted []string, latest uint64, err error) {
+	present := map[string]bool{}
+	var order []string
+	set := func(id string, in bool) {
+		if _, ok := present[id]; !ok {
+			order = append(order, id)
+		}
+		present[id] = in
+	}
+
+	page := ""
+	for {
+		records, next, id, err := c.ListHistory(ctx, since, page)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		latest = max(latest, id)
+		for _, h := range records {
+			for _, ch := range h.MessagesAdded {
+				if labelID == "" || slices.Contains(ch.Message.LabelIDs, labelID) {
+					set(ch.Message.ID, true)
+				}
+			}
+			for _, ch := range h.MessagesDeleted {
+				set(ch.Message.ID, false)
+			}
+			if labelID == "" {
+				continue
+			}
+			for _, ch := range h.LabelsAdded {
+				if slices.Contains(ch.LabelIDs, labelID) {
+					set(ch.Message.ID, true)
+				}
+			}
+			for _, ch := range h.LabelsRemoved {
+				if slices.Contains(ch.LabelIDs, labelID) {
+					set(ch.Message.ID, false)
+				}
+			}
+		}
+		if next == "" {
+			break
+		}
+		page = next
+	}
+
+	for _, id := range order {
+		if present[id] {
+			added = append(added, id)
+		} else {
+			deleted = append(deleted, id)
+		}
+	}
+	return added, deleted, latest, nil
+}
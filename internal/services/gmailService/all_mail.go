@@ -0,0 +1,48 @@
+package gmailService
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// allMailName is Gmail's All Mail folder, used when the server doesn't
+// advertise SPECIAL-USE attributes
+const allMailName = "[Gmail]/All Mail"
+
+// allMailChunkTimeout is the per-chunk scan timeout for All Mail, which is
+// usually far larger and slower to FETCH than any other folder
+const allMailChunkTimeout = 3 * time.Minute
+
+// allMailProgressEvery is how many All Mail chunks pass between progress logs
+const allMailProgressEvery = 10
+
+// allMailboxes holds names of mailboxes listed with the \All attribute
+var allMailboxes sync.Map
+
+// noteSpecialUse records a listed mailbox's special-use attributes
+func noteSpecialUse(m *imap.MailboxInfo) {
+	for _, a := range m.Attributes {
+		if a == imap.AllAttr {
+			allMailboxes.Store(m.Name, true)
+		}
+	}
+}
+
+// IsAllMail reports whether box is the \All folder holding every message
+func IsAllMail(box string) bool {
+	if _, ok := allMailboxes.Load(box); ok {
+		return true
+	}
+	return box == allMailName
+}
+
+// AllMailChunkSize returns the scan chunk size for All Mail: the configured
+// override, or a quarter of the regular chunk size (at least 100)
+func AllMailChunkSize(override, regular int) int {
+	if override > 0 {
+		return override
+	}
+	return max(regular/4, 100)
+}
@@ -0,0 +1,66 @@
+package gmailService
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+)
+
+func TestAllMailChunkSize(t *testing.T) {
+	tests := []struct{ override, regular, want int }{
+		{0, 5000, 1250},
+		{0, 1000, 250},
+		{0, 200, 100},
+		{300, 5000, 300},
+	}
+	for _, tt := range tests {
+		if got := AllMailChunkSize(tt.override, tt.regular); got != tt.want {
+			t.Errorf("AllMailChunkSize(%d, %d) = %d, want %d", tt.override, tt.regular, got, tt.want)
+		}
+	}
+}
+
+func TestIsAllMail(t *testing.T) {
+	t.Cleanup(func() { allMailboxes.Delete("[Google Mail]/Alle Nachrichten") })
+
+	if !IsAllMail("[Gmail]/All Mail") {
+		t.Error("[Gmail]/All Mail not recognized")
+	}
+	if IsAllMail("INBOX") || IsAllMail("[Google Mail]/Alle Nachrichten") {
+		t.Error("regular mailbox taken for All Mail")
+	}
+
+	// A localized name is recognized by its \All attribute once listed
+	srv := &imaptest.Server{}
+	cfg := testServer(t, srv,
+		&imaptest.Mailbox{Name: "INBOX", UidValidity: 1},
+		&imaptest.Mailbox{Name: "[Google Mail]/Alle Nachrichten", Attributes: []string{imap.AllAttr}, UidValidity: 1, Messages: testMessages(250)},
+	)
+	c, run := testConnect(t, cfg)
+	names, errc := StreamMailboxes(c, 0)
+	for range names {
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !IsAllMail("[Google Mail]/Alle Nachrichten") || IsAllMail("INBOX") {
+		t.Error("\\All attribute not recognized")
+	}
+
+	// and scanned in All Mail sized chunks
+	cfg.ScanChunkSize, cfg.AllMailChunkSize = 1000, 100
+	run.ScanChunkSize = 1000
+	mb := openMailbox(context.Background(), c, "[Google Mail]/Alle Nachrichten", cfg, run.logger(), &MailboxResult{})
+	if mb == nil {
+		t.Fatal("mailbox not opened")
+	}
+	if res := scanMailbox(c, mb, cfg, run, nil); len(res.Missing) != 250 {
+		t.Errorf("%d messages found, want 250", len(res.Missing))
+	}
+	if got := scanFetches(srv); got != 3 {
+		t.Errorf("%d scan fetches, want 3 chunks of 100", got)
+	}
+}
@@ -0,0 +1,62 @@
+package gmailService
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+)
+
+// fetchItems returns the items of a UID FETCH command, or nil for any other
+func fetchItems(cmd *imap.Command) []string {
+	if cmd.Name != "UID" || len(cmd.Arguments) < 3 || !strings.EqualFold(fmt.Sprint(cmd.Arguments[0]), "FETCH") {
+		return nil
+	}
+	return strings.Fields(strings.NewReplacer("[", " ", "]", " ").Replace(fmt.Sprint(cmd.Arguments[2:])))
+}
+
+func TestBodyFetchItem(t *testing.T) {
+	if got := bodyFetchItem("body-peek"); got != "BODY.PEEK[]" {
+		t.Errorf("body-peek: %s", got)
+	}
+	if got := bodyFetchItem("rfc822-peek"); got != imap.FetchRFC822 {
+		t.Errorf("rfc822-peek: %s", got)
+	}
+}
+
+func TestBodyFetchMode(t *testing.T) {
+	// Each server refuses the other form
+	refusing := func(item string) *imaptest.Server {
+		return &imaptest.Server{Hook: func(s *imaptest.Session, cmd *imap.Command) bool {
+			if slices.Contains(fetchItems(cmd), item) {
+				s.NO(cmd.Tag, "UID FETCH failed")
+				return true
+			}
+			return false
+		}}
+	}
+	servers := map[string]*imaptest.Server{
+		"body-peek":   refusing("RFC822"),
+		"rfc822-peek": refusing("BODY.PEEK"),
+	}
+
+	for server, srv := range servers {
+		cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(2)})
+		cfg.FetchRetries = 0
+		for _, mode := range []string{"body-peek", "rfc822-peek"} {
+			cfg.BodyFetchMode = mode
+			cfg.BackupDir = t.TempDir()
+			res := testProcess(t, cfg, "INBOX")
+			if mode == server && (res.Downloaded != 2 || len(res.Failed) != 0) {
+				t.Errorf("%s on a %s server: %+v", mode, server, res)
+			}
+			if mode != server && res.Downloaded != 0 {
+				t.Errorf("%s on a %s server downloaded %d messages", mode, server, res.Downloaded)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package gmailService
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+// fetchLabels is Gmail's per-message label list fetch attribute
+const fetchLabels imap.FetchItem = "X-GM-LABELS"
+
+// changedSinceCommand is a UID FETCH with the CHANGEDSINCE modifier (RFC 7162),
+// which go-imap can't express. Vanished adds the QRESYNC VANISHED modifier.
+type changedSinceCommand struct {
+	SeqSet   *imap.SeqSet
+	Items    []imap.FetchItem
+	ModSeq   uint64
+	Vanished bool
+}
+
+func (cmd *changedSinceCommand) Command() *imap.Command {
+	items := make([]interface{}, len(cmd.Items))
+	for i, item := range cmd.Items {
+		items[i] = imap.RawString(item)
+	}
+	modifier := []interface{}{imap.RawString("CHANGEDSINCE"), imap.RawString(strconv.FormatUint(cmd.ModSeq, 10))}
+	if cmd.Vanished {
+		modifier = append(modifier, imap.RawString("VANISHED"))
+	}
+	return &imap.Command{
+		Name:      "UID",
+		Arguments: []interface{}{imap.RawString("FETCH"), cmd.SeqSet, items, modifier},
+	}
+}
+
+// changedSinceHandler extends go-imap's FETCH handler with the VANISHED
+// (EARLIER) responses of a QRESYNC fetch, which the library doesn't know
+type changedSinceHandler struct {
+	*responses.Fetch
+	Vanished *imap.SeqSet
+}
+
+func (h *changedSinceHandler) Handle(resp imap.Resp) error {
+	if name, fields, ok := imap.ParseNamedResp(resp); ok && name == "VANISHED" && len(fields) > 0 {
+		if set, err := imap.ParseSeqSet(fmt.Sprint(fields[len(fields)-1])); err == nil {
+			h.Vanished.AddSet(set)
+		}
+		return nil
+	}
+	return h.Fetch.Handle(resp)
+}
+
+// fetchChangedSince calls fn for every message in seq whose metadata changed
+// after modSeq. With vanished (QRESYNC enabled) it also returns the UIDs in
+// seq expunged since then.
+func fetchChangedSince(c *client.Client, seq *imap.SeqSet, items []imap.FetchItem, modSeq uint64, vanished bool, fn func(*imap.Message)) (*imap.SeqSet, error) {
+	msgs := make(chan *imap.Message, 100)
+	done := make(chan struct{})
+	go func() {
+		for msg := range msgs {
+			fn(msg)
+		}
+		close(done)
+	}()
+
+	h := &changedSinceHandler{Fetch: &responses.Fetch{Messages: msgs, SeqSet: seq, Uid: true}, Vanished: new(imap.SeqSet)}
+	status, err := c.Execute(&changedSinceCommand{SeqSet: seq, Items: items, ModSeq: modSeq, Vanished: vanished}, h)
+	close(msgs)
+	<-done
+
+	if err != nil {
+		return nil, err
+	}
+	return h.Vanished, status.Err()
+}
+
+// syncFlags refreshes the flags (and Gmail labels) recorded in the manifest
+// for stored messages that changed since the manifest's HIGHESTMODSEQ
+// checkpoint, then advances the checkpoint. With QRESYNC enabled, stored
+// messages expunged since the checkpoint are marked server_deleted. It is a
+// no-op on servers without CONDSTORE.
+func syncFlags(c *client.Client, mb *openedMailbox, cfg config.Config, run *RunState) {
+	if !cfg.SyncFlags || cfg.DryRun || mb.modSeq == 0 || mb.manifest.HighestModSeq == mb.modSeq {
+		return
+	}
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags}
+	if run.GmailExtensions {
+		items = append(items, fetchLabels)
+	}
+
+	since := mb.manifest.HighestModSeq
+	qresync := since > 0 && qresyncEnabled(c)
+	changed, vanished := 0, 0
+	for _, seq := range scanChunks(1, mb.status.UidNext, run.ScanChunkSize, mb.scanAll) {
+		gone, err := fetchChangedSince(c, seq, items, since, qresync, func(msg *imap.Message) {
+			e, ok := mb.manifest.Messages[msg.Uid]
+			if !ok {
+				return
+			}
+			e.Flags = msg.Flags
+			if run.GmailExtensions {
+				e.Labels = labels(msg)
+			}
+			mb.manifest.Messages[msg.Uid] = e
+			changed++
+		})
+		if err != nil {
+			// Keep the old checkpoint so the next run retries from it
+			mb.log.Warnf("Flag sync of %s failed, will retry next run: %v", mb.box, err)
+			return
+		}
+		vanished += markVanished(mb, gone)
+	}
+
+	if vanished > 0 {
+		mb.log.Infof("%d stored messages in %s were expunged on the server since the last run, marked server_deleted", vanished, mb.box)
+	}
+	mb.log.Debugf("Updated flags of %d messages in %s (modseq %d -> %d)", changed, mb.box, since, mb.modSeq)
+	mb.manifest.HighestModSeq = mb.modSeq
+	mb.manifestDirty = true
+}
+
+// markVanished marks the stored messages in gone as deleted on the server and
+// returns how many were newly marked
+func markVanished(mb *openedMailbox, gone *imap.SeqSet) int {
+	if gone == nil || gone.Empty() {
+		return 0
+	}
+	n := 0
+	for uid, e := range mb.manifest.Messages {
+		if !e.ServerDeleted && gone.Contains(uid) {
+			e.ServerDeleted = true
+			mb.manifest.Messages[uid] = e
+			n++
+		}
+	}
+	return n
+}
+
+// labels returns a message's X-GM-LABELS, decoded from modified UTF-7
+func labels(msg *imap.Message) []string {
+	raw, _ := msg.Items[fetchLabels].([]interface{})
+	out := make([]string, 0, len(raw))
+	for _, l := range raw {
+		s := fmt.Sprint(l)
+		if dec, err := utf7.Encoding.NewDecoder().String(s); err == nil {
+			s = dec
+		}
+		out = append(out, s)
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package gmailService
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+func TestSyncFlagsChangedSince(t *testing.T) {
+	msgs := testMessages(3)
+	for _, msg := range msgs {
+		msg.ModSeq = 5
+	}
+	srv := &imaptest.Server{Caps: []string{"CONDSTORE"}}
+	box := &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, HighestModSeq: 10, Messages: msgs}
+	cfg := testServer(t, srv, box)
+	cfg.SyncFlags = true
+
+	if res := testProcess(t, cfg, "INBOX"); res.Error != "" || res.Downloaded != 3 {
+		t.Fatalf("first run: %+v", res)
+	}
+	dir := MailboxDir(cfg.BackupDir, "INBOX")
+	m, err := archiveSvc.LoadManifest(dir, "INBOX")
+	if err != nil || m.HighestModSeq != 10 {
+		t.Fatalf("checkpoint after first run: %d %v", m.HighestModSeq, err)
+	}
+
+	// UID 2 is read on the server
+	srv.Do(func() {
+		msgs[1].Flags = []string{imap.SeenFlag}
+		msgs[1].ModSeq = 12
+		box.HighestModSeq = 12
+	})
+	if res := testProcess(t, cfg, "INBOX"); res.Error != "" || res.Downloaded != 0 {
+		t.Fatalf("second run: %+v", res)
+	}
+
+	// The second run asks only for changes since the first run's checkpoint
+	var last string
+	for _, cmd := range uidFetches(srv) {
+		if strings.Contains(cmd, "CHANGEDSINCE") {
+			last = cmd
+		}
+	}
+	if !strings.Contains(last, "(CHANGEDSINCE 10)") {
+		t.Errorf("last flag sync %q, want one CHANGEDSINCE 10", last)
+	}
+
+	if m, err = archiveSvc.LoadManifest(dir, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	if m.HighestModSeq != 12 {
+		t.Errorf("checkpoint %d, want 12", m.HighestModSeq)
+	}
+	if !slices.Contains(m.Messages[2].Flags, imap.SeenFlag) || slices.Contains(m.Messages[1].Flags, imap.SeenFlag) {
+		t.Errorf("flags not synced: UID 1 %v, UID 2 %v", m.Messages[1].Flags, m.Messages[2].Flags)
+	}
+}
+
+func TestSyncFlagsWithoutCondstore(t *testing.T) {
+	srv := &imaptest.Server{}
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(2)})
+	cfg.SyncFlags = true
+
+	for i := 0; i < 2; i++ {
+		if res := testProcess(t, cfg, "INBOX"); res.Error != "" {
+			t.Fatalf("run %d: %+v", i+1, res)
+		}
+	}
+	for _, cmd := range uidFetches(srv) {
+		if strings.Contains(cmd, "CHANGEDSINCE") {
+			t.Errorf("CHANGEDSINCE sent to a server without CONDSTORE: %s", cmd)
+		}
+	}
+	if stored, _ := filepath.Glob(filepath.Join(MailboxDir(cfg.BackupDir, "INBOX"), "*.eml")); len(stored) != 2 {
+		t.Errorf("%d messages stored, want 2", len(stored))
+	}
+}
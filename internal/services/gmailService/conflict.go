@@ -0,0 +1,91 @@
+package gmailService
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// ON_CONFLICT modes for a re-downloaded message whose body differs from the
+// copy already on disk
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictKeepBoth  = "keep-both"
+	ConflictSkip      = "skip"
+)
+
+// writeMessage atomically stores data at path, so an interrupted run never
+// leaves a truncated message. If a different file is already there it is
+// resolved according to mode. It returns the path actually written ("" if
+// nothing was) and a description of the conflict, if there was one.
+func writeMessage(path string, data []byte, mode string) (string, string, error) {
+	existing, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return path, "", utils.WriteFileAtomic(path, data, 0644)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if bytes.Equal(existing, data) {
+		return "", "", nil
+	}
+
+	name := filepath.Base(path)
+	switch mode {
+	case ConflictSkip:
+		return "", fmt.Sprintf("%s changed on server, kept existing copy", name), nil
+	case ConflictKeepBoth:
+		vpath, same, err := nextVersionPath(path, data)
+		if err != nil || same {
+			return "", "", err
+		}
+		return vpath, fmt.Sprintf("%s changed on server, stored new copy as %s", name, filepath.Base(vpath)),
+			utils.WriteFileAtomic(vpath, data, 0644)
+	default:
+		return path, fmt.Sprintf("%s changed on server, overwritten", name), utils.WriteFileAtomic(path, data, 0644)
+	}
+}
+
+// nextVersionPath returns the first free <uid>.vN.eml (or .eml.gz) beside
+// path. same is set if an existing version already holds data.
+func nextVersionPath(path string, data []byte) (string, bool, error) {
+	ext := archiveSvc.MessageExt
+	if strings.HasSuffix(path, archiveSvc.CompressedExt) {
+		ext += archiveSvc.CompressedExt
+	}
+	base := strings.TrimSuffix(path, ext)
+	for n := 2; ; n++ {
+		vpath := fmt.Sprintf("%s.v%d%s", base, n, ext)
+		existing, err := os.ReadFile(vpath)
+		if errors.Is(err, os.ErrNotExist) {
+			return vpath, false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if bytes.Equal(existing, data) {
+			return vpath, true, nil
+		}
+	}
+}
+
+// removeOtherForm deletes the plain copy of a message just stored compressed,
+// or the compressed copy of one stored plain, after COMPRESS was switched and
+// the message re-downloaded
+func removeOtherForm(path string) {
+	other := path + archiveSvc.CompressedExt
+	if plain, ok := strings.CutSuffix(path, archiveSvc.CompressedExt); ok {
+		other = plain
+	}
+	if err := os.Remove(other); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.Warnf("Failed to remove %s: %v", other, err)
+	}
+}
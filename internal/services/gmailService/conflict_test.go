@@ -0,0 +1,91 @@
+package gmailService
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteMessageConflicts(t *testing.T) {
+	tests := []struct {
+		mode     string
+		wantPath string // relative to the mailbox dir, "" if nothing is written
+		wantKept string // content of 7.eml afterwards
+		conflict bool
+	}{
+		{ConflictOverwrite, "7.eml", "new", true},
+		{ConflictSkip, "", "old", true},
+		{ConflictKeepBoth, "7.v2.eml", "old", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "7.eml")
+			if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, conflict, err := writeMessage(path, []byte("new"), tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := ""
+			if tt.wantPath != "" {
+				want = filepath.Join(dir, tt.wantPath)
+			}
+			if got != want {
+				t.Errorf("wrote %q, want %q", got, want)
+			}
+			if (conflict != "") != tt.conflict {
+				t.Errorf("conflict %q", conflict)
+			}
+			if data, _ := os.ReadFile(path); string(data) != tt.wantKept {
+				t.Errorf("7.eml holds %q, want %q", data, tt.wantKept)
+			}
+			if got != "" {
+				if data, _ := os.ReadFile(got); string(data) != "new" {
+					t.Errorf("%s holds %q", got, data)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteMessageUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "7.eml")
+
+	got, conflict, err := writeMessage(path, []byte("body"), ConflictOverwrite)
+	if err != nil || got != path || conflict != "" {
+		t.Fatalf("new file: %q %q %v", got, conflict, err)
+	}
+	// The same body again is neither written nor a conflict, in any mode
+	for _, mode := range []string{ConflictOverwrite, ConflictSkip, ConflictKeepBoth} {
+		if got, conflict, err := writeMessage(path, []byte("body"), mode); err != nil || got != "" || conflict != "" {
+			t.Errorf("%s: unchanged body gave %q %q %v", mode, got, conflict, err)
+		}
+	}
+}
+
+func TestWriteMessageKeepBothVersions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "7.eml")
+	if err := os.WriteFile(path, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"v2", "v3", "v2"} {
+		if _, _, err := writeMessage(path, []byte(body), ConflictKeepBoth); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// v2 seen again is not stored a second time
+	for name, want := range map[string]string{"7.v2.eml": "v2", "7.v3.eml": "v3"} {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != want {
+			t.Errorf("%s: %q %v", name, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "7.v4.eml")); err == nil {
+		t.Error("a repeated version was stored again")
+	}
+}
@@ -0,0 +1,96 @@
+package gmailService
+
+import (
+	"sync"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+// ConnPool hands each mailbox worker a connection of its own. A go-imap
+// client has a single selected mailbox, so workers sharing one would select
+// over each other. Connections are dialled as needed, checked before reuse
+// and replaced when the server dropped them.
+type ConnPool struct {
+	cfg config.Config
+
+	mu     sync.Mutex
+	idle   []*client.Client
+	alerts []string
+}
+
+// NewConnPool returns an empty pool. The connection the run opened is never
+// pooled, even with a single worker: it is still streaming the LIST while the
+// first mailboxes are processed.
+func NewConnPool(cfg config.Config) *ConnPool {
+	return &ConnPool{cfg: cfg}
+}
+
+// Get returns a healthy connection for a worker, dialling a new one when none
+// is idle. Return it with Put.
+func (p *ConnPool) Get() (*client.Client, error) {
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if healthy(c) {
+			return c, nil
+		}
+		logrus.Warn("Pooled IMAP connection is no longer usable, replacing it")
+		p.discard(c)
+	}
+
+	return Connect(p.cfg)
+}
+
+// Put returns a connection taken with Get
+func (p *ConnPool) Put(c *client.Client) {
+	p.mu.Lock()
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+}
+
+// healthy reports whether c is still logged in and answering
+func healthy(c *client.Client) bool {
+	select {
+	case <-c.LoggedOut():
+		return false
+	default:
+	}
+	return c.Noop() == nil
+}
+
+// discard drops a connection, keeping the [ALERT]s it received
+func (p *ConnPool) discard(c *client.Client) {
+	p.mu.Lock()
+	p.alerts = append(p.alerts, ServerAlerts(c)...)
+	p.mu.Unlock()
+	_ = c.Logout()
+}
+
+// Close logs out every connection the pool dialled
+func (p *ConnPool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, c := range idle {
+		p.discard(c)
+	}
+}
+
+// Alerts returns the [ALERT]s received on the pool's own connections. Call it
+// after Close.
+func (p *ConnPool) Alerts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.alerts...)
+}
@@ -0,0 +1,129 @@
+package gmailService
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DailyLimitStateFile is the name of the persisted daily usage file in the backup dir
+const DailyLimitStateFile = ".daily_limit.state.json"
+
+type dailyUsage struct {
+	Date  string `json:"date"`
+	Bytes int64  `json:"bytes"`
+}
+
+// DailyLimiter tracks bytes downloaded per calendar day across runs, so a large
+// initial backup stays under Gmail's ~2500MB/day download soft-limit
+type DailyLimiter struct {
+	Limit int64
+
+	path  string
+	dry   bool
+	loc   *time.Location
+	mu    sync.Mutex
+	usage dailyUsage
+}
+
+// NewDailyLimiter loads the usage state for today from the backup dir. Days
+// start at midnight in loc, or in local time when loc is nil. A limit <= 0
+// disables tracking and returns nil.
+func NewDailyLimiter(backupDir string, limit int64, dry bool, loc *time.Location) *DailyLimiter {
+	if limit <= 0 {
+		return nil
+	}
+
+	d := &DailyLimiter{
+		Limit: limit,
+		path:  filepath.Join(backupDir, DailyLimitStateFile),
+		dry:   dry,
+		loc:   loc,
+	}
+	if d.loc == nil {
+		d.loc = time.Local
+	}
+
+	if data, err := os.ReadFile(d.path); err == nil {
+		if err := json.Unmarshal(data, &d.usage); err != nil {
+			logrus.Warnf("Ignoring unreadable daily limit state %s: %v", d.path, err)
+		}
+	}
+	d.rollover()
+
+	return d
+}
+
+func (d *DailyLimiter) today() string {
+	return time.Now().In(d.loc).Format("2006-01-02")
+}
+
+// rollover resets the counter when the date has changed. Caller must hold mu
+// (or be the constructor).
+func (d *DailyLimiter) rollover() {
+	if today := d.today(); d.usage.Date != today {
+		d.usage = dailyUsage{Date: today}
+	}
+}
+
+// Reached reports whether today's budget has been used up
+func (d *DailyLimiter) Reached() bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rollover()
+	return d.usage.Bytes >= d.Limit
+}
+
+// Used returns the bytes downloaded today
+func (d *DailyLimiter) Used() int64 {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rollover()
+	return d.usage.Bytes
+}
+
+// Add records downloaded bytes and persists the new total
+func (d *DailyLimiter) Add(n int64) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rollover()
+	d.usage.Bytes += n
+
+	if d.dry {
+		return
+	}
+	if err := d.save(); err != nil {
+		logrus.Warnf("Failed to save daily limit state: %v", err)
+	}
+}
+
+func (d *DailyLimiter) save() error {
+	data, err := json.MarshalIndent(d.usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(d.path, data, 0644)
+}
+
+// ResumeAt returns when the daily budget resets: the next midnight in the
+// limiter's timezone
+func (d *DailyLimiter) ResumeAt() time.Time {
+	y, m, day := time.Now().In(d.loc).Date()
+	return time.Date(y, m, day+1, 0, 0, 0, 0, d.loc)
+}
@@ -0,0 +1,94 @@
+package gmailService
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDailyLimiterReached(t *testing.T) {
+	dir := t.TempDir()
+	d := NewDailyLimiter(dir, 100, false, nil)
+	if d.Reached() {
+		t.Fatal("limit reached before anything was downloaded")
+	}
+
+	d.Add(60)
+	if d.Reached() {
+		t.Fatal("limit reached at 60 of 100 bytes")
+	}
+	d.Add(50)
+	if !d.Reached() || d.Used() != 110 {
+		t.Fatalf("Reached() = %v, Used() = %d after 110 bytes", d.Reached(), d.Used())
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, DailyLimitStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var usage dailyUsage
+	if err := json.Unmarshal(data, &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Date != d.today() || usage.Bytes != 110 {
+		t.Errorf("persisted %+v, want %s with 110 bytes", usage, d.today())
+	}
+
+	// The next run of the day picks the usage up
+	if !NewDailyLimiter(dir, 100, false, nil).Reached() {
+		t.Error("a new limiter forgot today's usage")
+	}
+}
+
+func TestDailyLimiterRollsOver(t *testing.T) {
+	dir := t.TempDir()
+	stale := dailyUsage{Date: time.Now().AddDate(0, 0, -1).Format("2006-01-02"), Bytes: 500}
+	data, _ := json.Marshal(stale)
+	if err := os.WriteFile(filepath.Join(dir, DailyLimitStateFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDailyLimiter(dir, 100, false, nil)
+	if d.Reached() || d.Used() != 0 {
+		t.Errorf("yesterday's usage still counts: Reached() = %v, Used() = %d", d.Reached(), d.Used())
+	}
+}
+
+func TestDailyLimiterTimezone(t *testing.T) {
+	// Far enough from UTC that its date often differs from the host's
+	loc := time.FixedZone("UTC+14", 14*60*60)
+	d := NewDailyLimiter(t.TempDir(), 100, false, loc)
+
+	if want := time.Now().In(loc).Format("2006-01-02"); d.today() != want {
+		t.Errorf("today %s, want %s", d.today(), want)
+	}
+	resume := d.ResumeAt()
+	if h, m, s := resume.In(loc).Clock(); h != 0 || m != 0 || s != 0 {
+		t.Errorf("resume at %s, want midnight in %s", resume, loc)
+	}
+	if wait := time.Until(resume); wait <= 0 || wait > 24*time.Hour {
+		t.Errorf("resume at %s, %s from now", resume, wait)
+	}
+}
+
+func TestDailyLimiterDryRun(t *testing.T) {
+	dir := t.TempDir()
+	d := NewDailyLimiter(dir, 100, true, nil)
+	d.Add(200)
+	if !d.Reached() {
+		t.Error("dry run doesn't count usage")
+	}
+	if _, err := os.Stat(filepath.Join(dir, DailyLimitStateFile)); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote %s: %v", DailyLimitStateFile, err)
+	}
+}
+
+func TestDailyLimiterDisabled(t *testing.T) {
+	d := NewDailyLimiter(t.TempDir(), 0, false, nil)
+	d.Add(1 << 40)
+	if d != nil || d.Reached() {
+		t.Error("a zero limit should disable the limiter")
+	}
+}
@@ -0,0 +1,140 @@
+package gmailService
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// SeenMessages maps the Message-ID of every message stored so far to its path
+// relative to the backup dir, so DEDUP stores each message once across all
+// mailboxes. It is shared by the mailbox workers.
+type SeenMessages struct {
+	mu    sync.Mutex
+	paths map[string]string
+}
+
+// LoadSeen indexes the messages already stored under backupDir, from the
+// manifests of its mailbox directories
+func LoadSeen(backupDir string) (*SeenMessages, error) {
+	s := &SeenMessages{paths: map[string]string{}}
+
+	dirs, err := os.ReadDir(backupDir)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") || d.Name() == archiveSvc.RunLogsDir {
+			continue
+		}
+		m, err := archiveSvc.LoadManifest(filepath.Join(backupDir, d.Name()), "")
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range m.Messages {
+			if id := trimMessageID(e.MessageID); id != "" && archiveSvc.IsMessageFile(e.File) {
+				s.paths[id] = d.Name() + "/" + e.File
+			}
+		}
+	}
+	return s, nil
+}
+
+// claim returns the stored path of the message with Message-ID id, or records
+// path as its path and returns "" if it has not been stored yet
+func (s *SeenMessages) claim(id, path string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.paths[id]; ok {
+		return stored
+	}
+	s.paths[id] = path
+	return ""
+}
+
+// release drops a claim whose message could not be written
+func (s *SeenMessages) release(id string) {
+	s.mu.Lock()
+	delete(s.paths, id)
+	s.mu.Unlock()
+}
+
+// dedupMessage looks up the Message-ID of a pending message. If the message is
+// already stored under another path, a reference to it is written in place of
+// the message and done is true. Otherwise the Message-ID is claimed for path
+// and returned, so a failed write can release it.
+func dedupMessage(c *client.Client, mb *openedMailbox, cfg config.Config, run *RunState, res *MailboxResult, m pendingMessage, path string) (id string, done bool) {
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags}
+	if run.GmailExtensions {
+		items = append(items, fetchLabels, fetchMsgID)
+	}
+	// Without a Message-ID the message is simply downloaded in full
+	msg, err := fetchOne(mb.ctx, c, m.UID, items)
+	if err != nil || msg.Envelope == nil {
+		return "", false
+	}
+	if id = trimMessageID(msg.Envelope.MessageId); id == "" {
+		return "", false
+	}
+
+	rel, _ := filepath.Rel(cfg.BackupDir, path)
+	stored := run.Seen.claim(id, filepath.ToSlash(rel))
+	if stored == "" {
+		return id, false
+	}
+
+	refPath := storedPath(cfg.BackupDir, mb.box, m.UID, m.Thread, archiveSvc.RefExt)
+	ref := archiveSvc.MessageRef{MessageID: msg.Envelope.MessageId, Mailbox: mb.box, UID: m.UID, Ref: stored}
+	data, err := ref.Marshal()
+	if err == nil && cfg.DryRun {
+		utils.DryRunWrite(refPath, int64(len(data)))
+		return "", true
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(refPath), 0755)
+	}
+	if err == nil {
+		err = utils.WriteFileAtomic(refPath, data, 0644)
+	}
+	if err != nil {
+		mb.log.Warnf("Failed to write reference for UID %d in %s: %v", m.UID, mb.box, err)
+		return "", true
+	}
+	mb.log.Debugf("UID %d in %s is already stored as %s, wrote a reference", m.UID, mb.box, stored)
+
+	relRef, _ := filepath.Rel(mb.dir, refPath)
+	entry := archiveSvc.ManifestEntry{
+		File:      filepath.ToSlash(relRef),
+		MessageID: msg.Envelope.MessageId,
+		Subject:   msg.Envelope.Subject,
+		Size:      int64(len(data)),
+		ThreadID:  m.Thread,
+		Flags:     msg.Flags,
+	}
+	if len(msg.Envelope.From) > 0 {
+		entry.From = msg.Envelope.From[0].Address()
+	}
+	if !msg.Envelope.Date.IsZero() {
+		date := msg.Envelope.Date
+		entry.Date = &date
+	}
+	if run.GmailExtensions {
+		entry.Labels = labels(msg)
+		entry.GmMsgID = gmMsgID(msg)
+	}
+	mb.recordEntry(m.UID, entry)
+	run.Checksums.Add(refPath, data)
+	res.Deduplicated++
+	return "", true
+}
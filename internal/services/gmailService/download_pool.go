@@ -0,0 +1,126 @@
+package gmailService
+
+import (
+	"fmt"
+	"sync"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+// openWorker opens an extra connection with mb selected, for a download
+// worker. A go-imap client runs one command at a time, so parallel fetches
+// need their own connections.
+func openWorker(cfg config.Config, mb *openedMailbox) (*openedMailbox, error) {
+	c, status, err := connectSelected(cfg, mb.box)
+	if err != nil {
+		return nil, err
+	}
+	if status.UidValidity != mb.status.UidValidity {
+		_ = c.Logout()
+		return nil, fmt.Errorf("UIDVALIDITY changed (%d -> %d)", mb.status.UidValidity, status.UidValidity)
+	}
+	return &openedMailbox{
+		parent:     mb.root(),
+		ctx:        mb.ctx,
+		client:     c,
+		ownsClient: true,
+		log:        mb.log,
+		box:        mb.box,
+		dir:        mb.dir,
+		status:     mb.status,
+		manifest:   mb.manifest,
+	}, nil
+}
+
+// root returns the mailbox m was opened from, or m itself
+func (m *openedMailbox) root() *openedMailbox {
+	if m.parent != nil {
+		return m.parent
+	}
+	return m
+}
+
+// recordEntry stores a downloaded message's manifest entry. Workers share
+// the manifest of the mailbox they were opened from.
+func (m *openedMailbox) recordEntry(uid uint32, e archiveSvc.ManifestEntry) {
+	root := m.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	if e.GmMsgID > root.manifest.HighestMsgID {
+		root.manifest.HighestMsgID = e.GmMsgID
+	}
+	root.manifest.Messages[uid] = e
+	root.manifestDirty = true
+	root.checkpointManifest()
+}
+
+// downloadPool downloads the messages from queue with DOWNLOAD_WORKERS
+// workers, the first on mb's connection and the others on their own. It
+// returns the workers' combined result and the UIDs that were handled; after
+// a worker stops (daily limit, lost connection) it keeps draining queue
+// without handling, so senders never block. Handled messages are counted in
+// progress.
+func downloadPool(mb *openedMailbox, cfg config.Config, run *RunState, queue <-chan pendingMessage, progress *downloadProgress) (MailboxResult, map[uint32]bool) {
+	workers := []*openedMailbox{mb}
+	for i := 1; i < cfg.DownloadWorkers; i++ {
+		w, err := openWorker(cfg, mb)
+		if err != nil {
+			mb.log.Warnf("Download worker %d for %s unavailable, continuing with %d: %v", i+1, mb.box, len(workers), err)
+			break
+		}
+		defer w.close()
+		workers = append(workers, w)
+	}
+
+	var mu sync.Mutex
+	var total MailboxResult
+	handled := map[uint32]bool{}
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *openedMailbox) {
+			defer wg.Done()
+			var res MailboxResult
+			stopped := false
+			done := func(uid uint32) {
+				mu.Lock()
+				handled[uid] = true
+				mu.Unlock()
+				progress.add()
+			}
+			for m := range queue {
+				if stopped {
+					continue
+				}
+				batch := nextBatch(queue, m, cfg.FetchBatchSize)
+				stopped = !ensureConnected(cfg, w, &res) || !downloadBatch(w.client, w, cfg, run, &res, batch, done)
+			}
+			mu.Lock()
+			total.add(res)
+			mu.Unlock()
+		}(w)
+	}
+	wg.Wait()
+	return total, handled
+}
+
+// nextBatch adds to first up to size-1 more messages that are already queued,
+// without waiting for more to arrive
+func nextBatch(queue <-chan pendingMessage, first pendingMessage, size int) []pendingMessage {
+	batch := []pendingMessage{first}
+	for len(batch) < size {
+		select {
+		case m, ok := <-queue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, m)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
@@ -0,0 +1,184 @@
+package gmailService
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/sirupsen/logrus"
+)
+
+// fetchTimeout is the per-message timeout: how long a fetch may go without
+// the server delivering a message
+const fetchTimeout = 15 * time.Second
+
+// fetchOne runs a UID FETCH for a single message with the per-message timeout.
+// It returns an error if the server sent nothing in time, the FETCH failed or
+// ctx was cancelled.
+func fetchOne(ctx context.Context, c *client.Client, uid uint32, items []imap.FetchItem) (*imap.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	seq := new(imap.SeqSet)
+	seq.AddNum(uid)
+	msgs := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() { done <- c.UidFetch(seq, items, msgs) }()
+
+	var msg *imap.Message
+	select {
+	case msg = <-msgs:
+	case <-ctx.Done():
+		DrainChannel(msgs, 5*time.Second)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errors.New("no response before the fetch timeout")
+		}
+		return nil, ctx.Err()
+	}
+
+	// c must not be used again before the command completes
+	select {
+	case err := <-done:
+		if msg != nil {
+			return msg, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New("no message in the fetch response")
+	case <-ctx.Done():
+		DrainChannel(msgs, 5*time.Second)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errors.New("no response before the fetch timeout")
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// fetchBatch fetches the bodies of uids in a single UID FETCH and calls fn
+// with each message and its body as it arrives. The fetch is abandoned when
+// no message arrives for fetchTimeout or ctx is cancelled; messages delivered
+// until then are kept. It returns the UIDs that were not delivered.
+func fetchBatch(ctx context.Context, c *client.Client, uids []uint32, items []imap.FetchItem, section *imap.BodySectionName, fn func(*imap.Message, []byte)) ([]uint32, error) {
+	pending := make(map[uint32]bool, len(uids))
+	seq := new(imap.SeqSet)
+	for _, uid := range uids {
+		pending[uid] = true
+		seq.AddNum(uid)
+	}
+	notDelivered := func() []uint32 {
+		var left []uint32
+		for _, uid := range uids {
+			if pending[uid] {
+				left = append(left, uid)
+			}
+		}
+		return left
+	}
+
+	msgs := make(chan *imap.Message, len(uids))
+	done := make(chan error, 1)
+	go func() { done <- c.UidFetch(seq, items, msgs) }()
+
+	idle := time.NewTimer(fetchTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return notDelivered(), <-done
+			}
+			// Unsolicited FETCH responses (flag changes) carry no body
+			body := msg.GetBody(section)
+			if !pending[msg.Uid] || body == nil {
+				continue
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				logrus.Debugf("Reading body of UID %d failed, fetching it again: %v", msg.Uid, err)
+				continue
+			}
+			pending[msg.Uid] = false
+			fn(msg, data)
+			idle.Reset(fetchTimeout)
+		case <-idle.C:
+			DrainChannel(msgs, 5*time.Second)
+			return notDelivered(), errors.New("no response before the fetch timeout")
+		case <-ctx.Done():
+			DrainChannel(msgs, 5*time.Second)
+			return notDelivered(), ctx.Err()
+		}
+	}
+}
+
+// loggedOut reports whether c's connection has been closed
+func loggedOut(c *client.Client) bool {
+	select {
+	case <-c.LoggedOut():
+		return true
+	default:
+		return false
+	}
+}
+
+// maxFetchBackoff caps the wait between re-fetches of a message
+const maxFetchBackoff = 30 * time.Second
+
+// fetchBackoff returns the wait before re-fetch attempt n (1-based): 1s, 2s,
+// 4s, ... up to maxFetchBackoff
+func fetchBackoff(n int) time.Duration {
+	if n > 5 {
+		return maxFetchBackoff
+	}
+	return min(time.Second<<(n-1), maxFetchBackoff)
+}
+
+// fetchBody fetches a message and reads its body section in full. A timed out
+// fetch or a failed read triggers a full re-fetch after an exponential
+// backoff, up to retries times, since Gmail throttling is usually brief.
+// Retries stop once ctx is cancelled or the connection is gone. Throttling
+// responses slow down rl.
+func fetchBody(ctx context.Context, c *client.Client, uid uint32, items []imap.FetchItem, section *imap.BodySectionName, retries int, rl *RateLimiter) (*imap.Message, []byte, error) {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			wait := fetchBackoff(attempt)
+			logrus.Debugf("Re-fetching UID %d after %s (attempt %d/%d): %v", uid, wait, attempt+1, retries+1, err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+
+		msg, fetchErr := fetchOne(ctx, c, uid, items)
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if fetchErr != nil {
+			rl.observe(fetchErr)
+			err = fetchErr
+			if loggedOut(c) {
+				// Re-fetching on a dropped connection can't succeed
+				break
+			}
+			continue
+		}
+		body := msg.GetBody(section)
+		if body == nil {
+			err = errors.New("response has no message body")
+			continue
+		}
+		data, readErr := io.ReadAll(body)
+		if readErr != nil {
+			err = fmt.Errorf("reading body: %w", readErr)
+			continue
+		}
+		return msg, data, nil
+	}
+	return nil, nil, err
+}
@@ -0,0 +1,105 @@
+package gmailService
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+)
+
+func TestFetchBackoff(t *testing.T) {
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, maxFetchBackoff, maxFetchBackoff}
+	for n, w := range want {
+		if got := fetchBackoff(n + 1); got != w {
+			t.Errorf("fetchBackoff(%d) = %s, want %s", n+1, got, w)
+		}
+	}
+}
+
+// bodylessFetches returns a server whose first n body fetches answer without
+// the body, as when reading it failed
+func bodylessFetches(n int32) *imaptest.Server {
+	var left atomic.Int32
+	left.Store(n)
+	return &imaptest.Server{Hook: func(s *imaptest.Session, cmd *imap.Command) bool {
+		if !slices.Contains(fetchItems(cmd), "BODY.PEEK") || left.Add(-1) < 0 {
+			return false
+		}
+		s.Printf("* 1 FETCH (UID 1)")
+		s.OK(cmd.Tag, "FETCH completed")
+		return true
+	}}
+}
+
+// bodyFetches returns the number of body fetches the server received
+func bodyFetches(srv *imaptest.Server) int {
+	n := 0
+	for _, cmd := range uidFetches(srv) {
+		if bytes.Contains([]byte(cmd), []byte("BODY.PEEK[]")) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestFetchBodyRetries(t *testing.T) {
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, section.FetchItem()}
+	msgs := testMessages(1)
+
+	tests := []struct {
+		name     string
+		failures int32
+		retries  int
+		ok       bool
+		fetches  int
+	}{
+		{"re-fetch succeeds", 1, 2, true, 2},
+		{"retries exhausted", 5, 0, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := bodylessFetches(tt.failures)
+			cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: msgs})
+			c, _ := testConnect(t, cfg)
+			if _, err := c.Select("INBOX", true); err != nil {
+				t.Fatal(err)
+			}
+
+			_, data, err := fetchBody(context.Background(), c, 1, items, section, tt.retries, nil)
+			if (err == nil) != tt.ok {
+				t.Fatalf("fetchBody: %v", err)
+			}
+			if tt.ok && !bytes.Equal(data, msgs[0].Body) {
+				t.Errorf("body %q", data)
+			}
+			if got := bodyFetches(srv); got != tt.fetches {
+				t.Errorf("%d body fetches, want %d", got, tt.fetches)
+			}
+		})
+	}
+}
+
+func TestFetchBodyStopsOnDroppedConnection(t *testing.T) {
+	section := &imap.BodySectionName{Peek: true}
+	srv := dropOnFetch(1, func() {})
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(1)})
+	c, _ := testConnect(t, cfg)
+	if _, err := c.Select("INBOX", true); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, _, err := fetchBody(context.Background(), c, 1, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, section, 3, nil); err == nil {
+		t.Fatal("fetch on a dropped connection succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %s, want no backoff on a dropped connection", elapsed)
+	}
+}
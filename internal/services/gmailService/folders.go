@@ -0,0 +1,60 @@
+package gmailService
+
+import (
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/sirupsen/logrus"
+
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+// specialUseAttrs are the RFC 6154 roles, plus Gmail's \Important
+var specialUseAttrs = map[string]bool{
+	imap.AllAttr:     true,
+	imap.ArchiveAttr: true,
+	imap.DraftsAttr:  true,
+	imap.FlaggedAttr: true,
+	imap.JunkAttr:    true,
+	imap.SentAttr:    true,
+	imap.TrashAttr:   true,
+	`\Important`:     true,
+}
+
+// SnapshotFolders lists every mailbox with its attributes, special-use role
+// and, for selectable ones, message count and UIDVALIDITY
+func SnapshotFolders(c *client.Client) (*archiveSvc.FolderSnapshot, error) {
+	ch := make(chan *imap.MailboxInfo, 50)
+	done := make(chan error, 1)
+	go func() { done <- c.List("", "*", ch) }()
+
+	var listed []*imap.MailboxInfo
+	for m := range ch {
+		listed = append(listed, m)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	snap := &archiveSvc.FolderSnapshot{Taken: time.Now()}
+	for _, m := range listed {
+		f := archiveSvc.FolderInfo{Name: m.Name, Attributes: m.Attributes}
+		for _, a := range m.Attributes {
+			if specialUseAttrs[a] {
+				f.SpecialUse = a
+				break
+			}
+		}
+		if isSelectable(m) {
+			st, err := c.Status(m.Name, []imap.StatusItem{imap.StatusMessages, imap.StatusUidValidity})
+			if err != nil {
+				logrus.Warnf("STATUS of %s failed: %v", m.Name, err)
+			} else {
+				f.Messages, f.UidValidity = st.Messages, st.UidValidity
+			}
+		}
+		snap.Folders = append(snap.Folders, f)
+	}
+	return snap, nil
+}
@@ -0,0 +1,59 @@
+package gmailService
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+func TestSnapshotFolders(t *testing.T) {
+	srv := &imaptest.Server{}
+	inbox := &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(3)}
+	sent := &imaptest.Mailbox{Name: "[Gmail]/Sent Mail", Attributes: []string{imap.SentAttr}, UidValidity: 7, Messages: testMessages(1)}
+	parent := &imaptest.Mailbox{Name: "[Gmail]", Attributes: []string{imap.NoSelectAttr}}
+	work := &imaptest.Mailbox{Name: "Work", UidValidity: 9}
+	cfg := testServer(t, srv, inbox, sent, parent, work)
+
+	c, _ := testConnect(t, cfg)
+	snap, err := SnapshotFolders(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []archiveSvc.FolderInfo{
+		{Name: "INBOX", Messages: 3, UidValidity: 1},
+		{Name: "[Gmail]/Sent Mail", Attributes: []string{imap.SentAttr}, SpecialUse: imap.SentAttr, Messages: 1, UidValidity: 7},
+		{Name: "[Gmail]", Attributes: []string{imap.NoSelectAttr}},
+		{Name: "Work", UidValidity: 9},
+	}
+	if !slices.EqualFunc(snap.Folders, want, func(a, b archiveSvc.FolderInfo) bool {
+		return a.Name == b.Name && slices.Equal(a.Attributes, b.Attributes) && a.SpecialUse == b.SpecialUse &&
+			a.Messages == b.Messages && a.UidValidity == b.UidValidity
+	}) {
+		t.Errorf("snapshot %+v, want %+v", snap.Folders, want)
+	}
+
+	if err := snap.Save(cfg.BackupDir); err != nil {
+		t.Fatal(err)
+	}
+	prev, err := archiveSvc.LoadFolders(cfg.BackupDir)
+	if err != nil || prev == nil {
+		t.Fatalf("LoadFolders: %v, %v", prev, err)
+	}
+
+	// Work is deleted and INBOX recreated
+	inbox.UidValidity = 2
+	srv.AddUser(testEmail, testPassword, inbox, sent, parent)
+	c2, _ := testConnect(t, cfg)
+	cur, err := SnapshotFolders(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := archiveSvc.DiffFolders(prev, cur)
+	if want := []string{"UIDVALIDITY of INBOX changed (1 -> 2)", "deleted Work"}; !slices.Equal(changes, want) {
+		t.Errorf("changes %q, want %q", changes, want)
+	}
+}
@@ -0,0 +1,60 @@
+package gmailService
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+// fetchThreadID is Gmail's conversation ID fetch attribute
+const fetchThreadID imap.FetchItem = "X-GM-THRID"
+
+// fetchMsgID is Gmail's account-wide message ID fetch attribute. Unlike UIDs it
+// never changes for a message and increases for newer messages.
+const fetchMsgID imap.FetchItem = "X-GM-MSGID"
+
+// SupportsGmailExtensions reports whether Gmail's X-GM-* IMAP extensions are
+// enabled in config and advertised by the server
+func SupportsGmailExtensions(c *client.Client, cfg config.Config) bool {
+	if !cfg.GmailExtensions {
+		return false
+	}
+	ok, err := c.Support("X-GM-EXT-1")
+	return err == nil && ok
+}
+
+// threadID returns a message's X-GM-THRID, or "" if it wasn't fetched
+func threadID(msg *imap.Message) string {
+	v, ok := msg.Items[fetchThreadID]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// gmMsgID returns a message's X-GM-MSGID, or 0 if it wasn't fetched
+func gmMsgID(msg *imap.Message) uint64 {
+	id, _ := strconv.ParseUint(fmt.Sprint(msg.Items[fetchMsgID]), 10, 64)
+	return id
+}
+
+// ThreadMessagePath returns the path for a message stored under its thread,
+// with extension ext
+func ThreadMessagePath(base, box, thrid string, uid uint64, ext string) string {
+	return filepath.Join(MailboxDir(base, box), archiveSvc.ThreadsDir, thrid, fmt.Sprintf("%d%s", uid, ext))
+}
+
+// storedPath returns where a message with extension ext lives, honoring the
+// thread layout
+func storedPath(base, box string, uid uint32, thrid, ext string) string {
+	if thrid != "" {
+		return ThreadMessagePath(base, box, thrid, uint64(uid), ext)
+	}
+	return MessagePathExt(base, box, uint64(uid), ext)
+}
@@ -0,0 +1,111 @@
+package gmailService
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+func TestStoredPath(t *testing.T) {
+	if got, want := storedPath("/b", "INBOX", 7, "", ".eml"), MessagePathExt("/b", "INBOX", 7, ".eml"); got != want {
+		t.Errorf("without thread: %s, want %s", got, want)
+	}
+	want := filepath.Join(MailboxDir("/b", "INBOX"), archiveSvc.ThreadsDir, "42", "7.eml")
+	if got := storedPath("/b", "INBOX", 7, "42", ".eml"); got != want {
+		t.Errorf("with thread: %s, want %s", got, want)
+	}
+}
+
+func TestThreadLayoutGroupsByThread(t *testing.T) {
+	msgs := testMessages(3)
+	msgs[0].ThreadID, msgs[1].ThreadID, msgs[2].ThreadID = 900, 900, 901
+	srv := &imaptest.Server{Caps: []string{"X-GM-EXT-1"}}
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: msgs})
+	cfg.ThreadLayout = true
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 3 {
+		t.Fatalf("result: %+v", res)
+	}
+	for _, msg := range msgs {
+		path := ThreadMessagePath(cfg.BackupDir, "INBOX", fmt.Sprint(msg.ThreadID), uint64(msg.UID), archiveSvc.MessageExt)
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("UID %d not stored under its thread: %v", msg.UID, err)
+		}
+	}
+	dir := filepath.Join(MailboxDir(cfg.BackupDir, "INBOX"), archiveSvc.ThreadsDir, "900")
+	if stored, _ := filepath.Glob(filepath.Join(dir, "*"+archiveSvc.MessageExt)); len(stored) != 2 {
+		t.Errorf("thread 900 holds %v, want UIDs 1 and 2", stored)
+	}
+
+	// The stored thread layout is recognized on the next run
+	if res := testProcess(t, cfg, "INBOX"); res.Error != "" || res.Downloaded != 0 {
+		t.Errorf("second run: %+v", res)
+	}
+}
+
+func TestMsgIDWatermark(t *testing.T) {
+	tests := []struct {
+		name   string
+		caps   []string
+		stored []uint32 // UIDs in the manifest after the second run
+	}{
+		{"gmail", []string{"X-GM-EXT-1"}, []uint32{1, 2, 3, 5}},
+		{"without extensions", nil, []uint32{1, 2, 3, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			box := &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(3)}
+			srv := &imaptest.Server{Caps: tt.caps}
+			cfg := testServer(t, srv, box)
+			// A reused UID is only seen by a scan that covers stored UIDs
+			cfg.IncrementalScan = false
+			if res := testProcess(t, cfg, "INBOX"); res.Error != "" || res.Downloaded != 3 {
+				t.Fatalf("first run: %+v", res)
+			}
+
+			// After a label reorganization UID 2 holds another message, UID 4
+			// is message 1 again and only UID 5 is new
+			srv.Do(func() {
+				box.Messages[1] = &imaptest.Message{UID: 2, Body: []byte("Message-ID: <reused@example.com>\r\n\r\nreused\r\n"), MsgID: 2000}
+				again := *box.Messages[0]
+				again.UID = 4
+				box.Messages = append(box.Messages, &again, &imaptest.Message{UID: 5, Body: []byte("Message-ID: <new@example.com>\r\n\r\nnew\r\n"), MsgID: 2001})
+			})
+			res := testProcess(t, cfg, "INBOX")
+			if res.Error != "" {
+				t.Fatalf("second run: %+v", res)
+			}
+
+			m, err := archiveSvc.LoadManifest(MailboxDir(cfg.BackupDir, "INBOX"), "INBOX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stored []uint32
+			for uid := range m.Messages {
+				stored = append(stored, uid)
+			}
+			slices.Sort(stored)
+			if !slices.Equal(stored, tt.stored) {
+				t.Errorf("stored UIDs %v, want %v", stored, tt.stored)
+			}
+			if tt.caps == nil {
+				return
+			}
+			if res.Downloaded != 2 {
+				t.Errorf("downloaded %d, want reused UID 2 and new UID 5", res.Downloaded)
+			}
+			if got := m.Messages[2].GmMsgID; got != 2000 {
+				t.Errorf("UID 2 stored with X-GM-MSGID %d, want 2000", got)
+			}
+			if m.HighestMsgID != 2001 {
+				t.Errorf("highest X-GM-MSGID %d, want 2001", m.HighestMsgID)
+			}
+		})
+	}
+}
@@ -2,24 +2,29 @@ package gmailService
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/utf7"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 
 	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	metricsSvc "github.com/redjax/archive-gmail/internal/services/metricsService"
 	"github.com/redjax/archive-gmail/internal/utils"
 )
 
@@ -44,47 +49,166 @@ func DrainChannel[T any](ch <-chan T, maxWait time.Duration) {
 	}
 }
 
-// ListMailboxes returns all selectable mailboxes
+// ListMailboxes returns all selectable mailboxes. go-imap decodes IMAP modified
+// UTF-7 names to UTF-8 while listing and re-encodes them on SELECT, so the
+// returned names are human-readable and can be passed straight to Select.
 func ListMailboxes(c *client.Client) ([]string, error) {
+	names, errc := StreamMailboxes(c, 0)
+
+	var boxes []string
+	for name := range names {
+		boxes = append(boxes, name)
+	}
+
+	return boxes, <-errc
+}
+
+// StreamMailboxes sends selectable mailbox names as the server lists them, so
+// processing can start before a huge LIST completes. With limit > 0 only the
+// first limit mailboxes are sent. The error channel yields the LIST result
+// once the names channel is closed.
+func StreamMailboxes(c *client.Client, limit int) (<-chan string, <-chan error) {
+	out := make(chan string)
+	errc := make(chan error, 1)
+
 	ch := make(chan *imap.MailboxInfo, 50)
 	done := make(chan error, 1)
-
 	go func() { done <- c.List("", "*", ch) }()
 
-	var boxes []string
-	for m := range ch {
-		skip := false
-		for _, a := range m.Attributes {
-			if a == imap.NoSelectAttr {
-				skip = true
-				break
+	go func() {
+		defer close(out)
+
+		// Keep reading LIST responses while the consumer is busy: blocking here
+		// would stall the client's reader and any SELECT issued meanwhile
+		var pending []string
+		accepted := 0
+		in := ch
+		for in != nil || len(pending) > 0 {
+			var send chan<- string
+			var next string
+			if len(pending) > 0 {
+				send = out
+				next = pending[0]
+			}
+
+			select {
+			case m, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				noteSpecialUse(m)
+				if isSelectable(m) && (limit <= 0 || accepted < limit) {
+					pending = append(pending, m.Name)
+					accepted++
+				}
+			case send <- next:
+				pending = pending[1:]
 			}
 		}
-		if !skip {
-			boxes = append(boxes, m.Name)
+
+		errc <- <-done
+	}()
+
+	return out, errc
+}
+
+func isSelectable(m *imap.MailboxInfo) bool {
+	for _, a := range m.Attributes {
+		if a == imap.NoSelectAttr {
+			return false
 		}
 	}
-
-	return boxes, <-done
+	return true
 }
 
+// DirNameEncoding controls how mailbox names become directory names: "utf8"
+// keeps the decoded name, "utf7" uses the ASCII-only modified UTF-7 form for
+// filesystems or sync tools that mangle non-ASCII names
+var DirNameEncoding = "utf8"
+
 // MailboxDir returns the filesystem-safe path for a mailbox
 func MailboxDir(base, box string) string {
-	safe := strings.ReplaceAll(box, "/", "_")
-	return filepath.Join(base, safe)
+	name := box
+	if DirNameEncoding == "utf7" {
+		if enc, err := utf7.Encoding.NewEncoder().String(box); err == nil {
+			name = enc
+		}
+	}
+	safe := strings.ReplaceAll(name, "/", "_")
+	return filepath.Join(base, shortenDirName(safe, MaxDirNameBytes))
+}
+
+// MaxDirNameBytes caps the length of a mailbox directory name. Most
+// filesystems limit a path component to 255 bytes; long nested labels can
+// exceed that.
+var MaxDirNameBytes = 255
+
+// shortenDirName keeps names within limit bytes by truncating them (on a rune
+// boundary) and appending a hash of the full name, so distinct long names
+// stay distinct and the same name always maps to the same directory. The
+// manifest keeps the full mailbox name.
+func shortenDirName(name string, limit int) string {
+	if limit <= 0 || len(name) <= limit {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:8])
+
+	keep := max(limit-len(suffix), 0)
+	for keep > 0 && !utf8.RuneStart(name[keep]) {
+		keep--
+	}
+	return name[:keep] + suffix
 }
 
 // MessagePath returns the path for a message file
 func MessagePath(base, box string, msgID uint64) string {
-	return filepath.Join(MailboxDir(base, box), fmt.Sprintf("%d.eml", msgID))
+	return MessagePathExt(base, box, msgID, archiveSvc.MessageExt)
+}
+
+// MessagePathExt returns the path for a message file with extension ext,
+// i.e. ".eml.gz" for compressed messages
+func MessagePathExt(base, box string, msgID uint64, ext string) string {
+	return filepath.Join(MailboxDir(base, box), fmt.Sprintf("%d%s", msgID, ext))
+}
+
+// messageExt returns the extension new message files are stored with
+func messageExt(cfg config.Config) string {
+	if cfg.Compress {
+		return archiveSvc.MessageExt + archiveSvc.CompressedExt
+	}
+	return archiveSvc.MessageExt
+}
+
+// ClientCertificates loads the TLS client certificate for mutual TLS, if one
+// is configured
+func ClientCertificates(cfg config.Config) ([]tls.Certificate, error) {
+	if cfg.TLSClientCert == "" && cfg.TLSClientKey == "" {
+		return nil, nil
+	}
+	if cfg.TLSClientCert == "" || cfg.TLSClientKey == "" {
+		return nil, fmt.Errorf("TLS_CLIENT_CERT and TLS_CLIENT_KEY must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSClientCert, cfg.TLSClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS client certificate: %w", err)
+	}
+	return []tls.Certificate{cert}, nil
 }
 
 // Connect connects to IMAP using either password or OAuth2
 func Connect(cfg config.Config) (*client.Client, error) {
+	certs, err := ClientCertificates(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	addr := fmt.Sprintf("%s:%d", cfg.ImapServer, cfg.ImapPort)
 	tlsCfg := &tls.Config{
 		ServerName:         cfg.ImapServer,
 		InsecureSkipVerify: cfg.TLSSkipVerify,
+		Certificates:       certs,
 	}
 
 	c, err := client.DialTLS(addr, tlsCfg)
@@ -98,12 +222,18 @@ func Connect(cfg config.Config) (*client.Client, error) {
 	}()
 
 	c.Timeout = 5 * time.Minute
+	watchUpdates(c)
 
-	if cfg.ClientID != "" && cfg.ClientSecret != "" {
-		logrus.Info("Using OAuth2")
+	if cfg.ServiceAccountFile != "" || (cfg.ClientID != "" && cfg.ClientSecret != "") {
+		if cfg.ServiceAccountFile != "" {
+			logrus.Info("Using service account")
+		} else {
+			logrus.Info("Using OAuth2")
+		}
 		if err := authenticateOAuth2(c, cfg); err != nil {
 			return nil, err
 		}
+		enableQResync(c, cfg)
 		return c, nil
 	}
 
@@ -112,181 +242,643 @@ func Connect(cfg config.Config) (*client.Client, error) {
 		return nil, err
 	}
 
+	enableQResync(c, cfg)
 	return c, nil
 }
 
-// ProcessMailbox downloads missing messages from a mailbox
-func ProcessMailbox(c *client.Client, box string, cfg config.Config, downloaded *uint64, mu *sync.RWMutex) {
-	logrus.Infof("Processing: %s", box)
+// bodyFetchItem returns the FETCH item used to download a full message.
+// "rfc822-peek" asks for RFC822, which doesn't set \Seen here because
+// mailboxes are opened read-only with EXAMINE; either response is read back
+// with GetBody on an empty section.
+func bodyFetchItem(mode string) imap.FetchItem {
+	if mode == "rfc822-peek" {
+		return imap.FetchRFC822
+	}
+	section := &imap.BodySectionName{Peek: true}
+	return section.FetchItem()
+}
+
+// MailboxFunc processes one mailbox during a run
+type MailboxFunc func(ctx context.Context, c *client.Client, box string, cfg config.Config, run *RunState) MailboxResult
+
+// openedMailbox is a selected mailbox together with its on-disk state
+type openedMailbox struct {
+	// client is the connection the mailbox is selected on; it is replaced if
+	// the connection drops mid-mailbox
+	client     *client.Client
+	ownsClient bool
+	reconnects int
+
+	// log is the run's logger (see RunState.Log)
+	log *logrus.Entry
+
+	// parent is the mailbox a download worker was opened from; workers
+	// share its manifest, guarded by mu
+	parent *openedMailbox
+	mu     sync.Mutex
+
+	// ctx is cancelled on shutdown; downloads stop between messages
+	ctx context.Context
+
+	box     string
+	dir     string
+	status  *imap.MailboxStatus
+	modSeq  uint64
+	scanAll bool
+	resync  bool
+	scanned []uint32 // every UID returned by the last scan
+	// partialScan is set when the scan only covered messages since SINCE
+	partialScan bool
+	// scanGaps is set when scan chunks failed or were skipped
+	scanGaps bool
+	// pending are the messages the scan found missing, before filters and
+	// sampling, with their sizes; the synced UID only advances past those
+	// stored
+	pending      []uint32
+	pendingSizes map[uint32]uint32
+
+	manifest      *archiveSvc.Manifest
+	manifestDirty bool
+	manifestSaved time.Time
+}
 
+// saveManifest writes the manifest if anything changed
+func (m *openedMailbox) saveManifest() {
+	if !m.manifestDirty {
+		return
+	}
+	if err := m.manifest.Save(m.dir); err != nil {
+		m.log.Warnf("Failed to save manifest for %s: %v", m.box, err)
+		return
+	}
+	m.manifestDirty = false
+	m.manifestSaved = time.Now()
+}
+
+// manifestCheckpoint is how often the manifest is saved while downloading.
+// Rewriting it after every message would be quadratic on large mailboxes;
+// messages stored after the last checkpoint of a crashed run are simply
+// downloaded again.
+const manifestCheckpoint = 10 * time.Second
+
+// checkpointManifest saves the manifest if the last save is older than
+// manifestCheckpoint
+func (m *openedMailbox) checkpointManifest() {
+	if time.Since(m.manifestSaved) >= manifestCheckpoint {
+		m.saveManifest()
+	}
+}
+
+// ProcessMailbox downloads missing messages from a mailbox. When ctx is
+// cancelled it stops after the message being written and saves the manifest.
+func ProcessMailbox(ctx context.Context, c *client.Client, box string, cfg config.Config, run *RunState) MailboxResult {
+	run.logger().Infof("Processing: %s", box)
+	res := MailboxResult{Name: box}
+	metricsSvc.MailboxStarted(box)
+	defer metricsSvc.MailboxFinished(box)
+
+	mb := openMailbox(ctx, c, box, cfg, run.logger(), &res)
+	if mb == nil {
+		return res
+	}
+	defer mb.close()
+	defer mb.saveManifest()
+
+	if !canPipeline(cfg) || !pipelineMailbox(mb, cfg, run, &res) {
+		pending, ok := findMissing(c, mb, cfg, run, &res)
+		if !ok {
+			return res
+		}
+		downloadMessages(mb, cfg, run, &res, pending)
+	}
+	// A partial scan can't tell which stored messages left the server
+	if ctx.Err() != nil {
+		res.Interrupted = true
+		return res
+	}
+	mb.recordSynced(cfg)
+	if cfg.TrustServer {
+		reconcileStored(mb.client, mb, cfg, &res)
+	}
+	syncFlags(mb.client, mb, cfg, run)
+	return res
+}
+
+// openMailbox selects box and prepares its directory and manifest. It returns
+// nil when the mailbox should be skipped.
+func openMailbox(ctx context.Context, c *client.Client, box string, cfg config.Config, log *logrus.Entry, res *MailboxResult) *openedMailbox {
+	// STATUS must be issued before SELECT; only needed for the snapshot
+	var unseen uint32
+	if cfg.WriteStatus {
+		unseen = unseenCount(c, box)
+	}
+
+	selectStart := time.Now()
 	var mboxStatus *imap.MailboxStatus
+	var highestModSeq uint64
 	var selectErr error
 	for retry := 0; retry < 3; retry++ {
-		mboxStatus, selectErr = c.Select(box, true)
+		mboxStatus, highestModSeq, selectErr = SelectMailbox(c, box)
 		if selectErr == nil {
+			updatesFor(c).Take()
 			break
 		}
 		time.Sleep(time.Duration(retry+1) * time.Second)
 	}
+	res.Timings.Select = time.Since(selectStart)
+
+	if selectErr != nil || mboxStatus == nil {
+		res.Error = fmt.Sprintf("select failed: %v", selectErr)
+		if cfg.TransientMailboxAction == "defer" && IsTransientSelectError(selectErr) {
+			log.Warnf("Deferring mailbox %s to the end of the run: %v", box, selectErr)
+			res.Deferred = true
+			return nil
+		}
+		log.Infof("Skipping mailbox %s: select failed", box)
+		return nil
+	}
 
-	if selectErr != nil || mboxStatus == nil || mboxStatus.Messages == 0 {
-		logrus.Infof("Skipping mailbox %s: empty or select failed", box)
-		return
+	// UIDNEXT of 0 (not reported) or 1 (nothing ever assigned) would make the
+	// 1:UidNext-1 range underflow, so decide explicitly how to treat it
+	mb := &openedMailbox{ctx: ctx, client: c, log: log, box: box, status: mboxStatus, modSeq: highestModSeq, manifestSaved: time.Now()}
+	if mboxStatus.Messages == 0 || (mboxStatus.UidNext <= 1 && cfg.LowUidNext != "scan") {
+		log.Infof("Skipping mailbox %s: empty (messages=%d, uidnext=%d)", box, mboxStatus.Messages, mboxStatus.UidNext)
+		res.Empty = true
+		return nil
+	}
+	if mboxStatus.UidNext <= 1 {
+		log.Warnf("Mailbox %s reports %d messages but UIDNEXT=%d, scanning 1:*", box, mboxStatus.Messages, mboxStatus.UidNext)
+		mb.scanAll = true
 	}
 
-	if err := utils.EnsureDir(MailboxDir(cfg.BackupDir, box), cfg.DryRun); err != nil {
-		logrus.Warnf("Failed to create mailbox dir: %v", err)
-		return
+	mb.dir = MailboxDir(cfg.BackupDir, box)
+	if err := utils.EnsureDir(mb.dir, cfg.DryRun); err != nil {
+		log.Warnf("Failed to create mailbox dir: %v", err)
+		res.Error = fmt.Sprintf("creating mailbox dir: %v", err)
+		return nil
 	}
 
-	uidSeq := new(imap.SeqSet)
-	uidSeq.AddRange(1, mboxStatus.UidNext-1)
-	uidMsgs := make(chan *imap.Message, 1000)
+	manifest, err := archiveSvc.LoadManifest(mb.dir, box)
+	if err != nil {
+		log.Warnf("Failed to load manifest for %s, starting a new one: %v", box, err)
+		manifest = archiveSvc.NewManifest(box)
+	}
+	// BACKEND=api numbers messages locally, so its files aren't IMAP UIDs
+	if manifest.Backend == archiveSvc.BackendAPI {
+		log.Warnf("Skipping mailbox %s: %s holds a BACKEND=api archive", box, mb.dir)
+		res.Error = fmt.Sprintf("%s holds a BACKEND=api archive; use a separate BACKUP_DIR", mb.dir)
+		return nil
+	}
+	mb.manifest = manifest
 
-	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
-	defer cancel()
+	if cfg.WriteStatus && cfg.DryRun {
+		utils.DryRunWrite(filepath.Join(mb.dir, StatusFile), -1)
+	} else if cfg.WriteStatus {
+		if err := writeStatusSnapshot(mb.dir, mboxStatus, unseen, highestModSeq); err != nil {
+			log.Warnf("Failed to write status snapshot for %s: %v", box, err)
+		}
+	}
 
-	fetchErr := make(chan error, 1)
-	go func() { fetchErr <- c.UidFetch(uidSeq, []imap.FetchItem{imap.FetchUid}, uidMsgs) }()
+	// Scans trust the manifest, so one missing (or unreadable) is rebuilt
+	// from the files on disk first
+	if len(manifest.Messages) == 0 && utils.Exists(mb.dir) {
+		if rebuilt, err := archiveSvc.ScanDir(mb.dir, box); err != nil {
+			log.Warnf("Failed to rebuild manifest for %s from disk: %v", box, err)
+		} else if len(rebuilt.Messages) > 0 {
+			log.Infof("Rebuilt manifest for %s from %d stored messages", box, len(rebuilt.Messages))
+			manifest.Messages = rebuilt.Messages
+		}
+	}
 
-	missingUIDs := make([]uint32, 0)
-loop:
-	for {
-		select {
-		case msg, ok := <-uidMsgs:
-			if !ok {
-				break loop
+	// A new UIDVALIDITY means the server renumbered the mailbox, so stored
+	// <uid>.eml files may no longer match the message with that UID
+	mb.resync = cfg.ForceResync
+	if manifest.UidValidity != 0 && manifest.UidValidity != mboxStatus.UidValidity {
+		if cfg.UidValidityAction == "new-dir" {
+			if !renumberedToNewDir(mb, cfg, res) {
+				return nil
 			}
-			path := MessagePath(cfg.BackupDir, box, uint64(msg.Uid))
-			if !utils.Exists(path) {
-				missingUIDs = append(missingUIDs, msg.Uid)
+		} else if cfg.UidValidityAction == "remap" && remapByMessageID(mb, cfg, res) {
+			mb.manifestDirty = !cfg.DryRun
+		} else {
+			issue := fmt.Sprintf("UIDVALIDITY changed (%d -> %d), re-downloading all messages", manifest.UidValidity, mboxStatus.UidValidity)
+			log.Warnf("Mailbox %s: %s", box, issue)
+			res.Issues = append(res.Issues, issue)
+			mb.resync = true
+			// The old UIDs no longer identify anything on the server
+			manifest.Messages = map[uint32]archiveSvc.ManifestEntry{}
+			manifest.HighestModSeq = 0
+			manifest.SyncedUID = 0
+			mb.manifestDirty = !cfg.DryRun
+		}
+		manifest = mb.manifest
+	}
+	if manifest.UidValidity != mboxStatus.UidValidity && !cfg.DryRun {
+		manifest.UidValidity = mboxStatus.UidValidity
+		mb.manifestDirty = true
+	}
+
+	return mb
+}
+
+// findMissing scans an opened mailbox and returns the messages to download,
+// after filters and sampling. ok is false if downloads should be skipped.
+func findMissing(c *client.Client, mb *openedMailbox, cfg config.Config, run *RunState, res *MailboxResult) (*MissingUIDs, bool) {
+	box := mb.box
+	scanStart := time.Now()
+
+	scan := scanMailbox(c, mb, cfg, run, nil)
+
+	// Expunges or new arrivals during a long scan can leave our UID view stale
+	if expunged, grew := updatesFor(c).Take(); expunged > 0 || grew {
+		switch cfg.MailboxChangeAction {
+		case "ignore":
+		case "rescan":
+			mb.log.Warnf("Mailbox %s changed during scan (%d expunged, new messages: %t), rescanning", box, expunged, grew)
+			if st, _, err := SelectMailbox(c, box); err == nil {
+				mb.status = st
+				scan = scanMailbox(c, mb, cfg, run, nil)
+			} else {
+				mb.log.Warnf("Re-select of %s failed, keeping first scan: %v", box, err)
 			}
-		case <-fetchErr:
-			DrainChannel(uidMsgs, 5*time.Second)
-			break loop
-		case <-ctx.Done():
-			DrainChannel(uidMsgs, 5*time.Second)
-			break loop
+		default:
+			mb.log.Warnf("Mailbox %s changed during scan (%d expunged, new messages: %t); changes will be picked up next run", box, expunged, grew)
+		}
+	}
+	missingUIDs, allUIDs := scan.Missing, scan.All
+	mb.scanned = allUIDs
+	// Messages left out by a filter or sample hold back the synced UID, so a
+	// later run without them still downloads them
+	mb.pending, mb.pendingSizes = scan.Missing, scan.Sizes
+	res.Timings.Scan = time.Since(scanStart)
+
+	if crit := BuildSearchCriteria(cfg); crit != nil {
+		matched, err := c.UidSearch(crit)
+		if err != nil {
+			mb.log.Warnf("Search failed in %s, skipping downloads: %v", box, err)
+			res.Error = fmt.Sprintf("search failed: %v", err)
+			return nil, false
 		}
+		missingUIDs = filterUIDs(missingUIDs, uidSet(matched))
+		mb.log.Infof("Filters matched %d messages in %s, %d not yet downloaded", len(matched), box, len(missingUIDs))
 	}
 
-	for _, uid := range missingUIDs {
-		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	if sample := SampleUIDs(allUIDs, cfg.SampleMode, cfg.SampleSize); sample != nil {
+		missingUIDs = filterUIDs(missingUIDs, sample)
+		mb.log.Infof("Sampling %s: %s %d of %d messages, %d not yet downloaded", box, cfg.SampleMode, len(sample), len(allUIDs), len(missingUIDs))
+	}
 
-		seq := new(imap.SeqSet)
-		seq.AddNum(uid)
-		section := &imap.BodySectionName{Peek: true}
-		msgs := make(chan *imap.Message, 1)
+	return &MissingUIDs{
+		Mailbox:     box,
+		UidValidity: mb.status.UidValidity,
+		UIDs:        missingUIDs,
+		Sizes:       scan.Sizes,
+		Threads:     scan.Threads,
+		Repair:      scan.Repair,
+	}, true
+}
 
-		go func() { _ = c.UidFetch(seq, []imap.FetchItem{section.FetchItem()}, msgs) }()
+// downloadMessages fetches and stores the pending messages of an opened
+// mailbox. It returns the UIDs left unhandled after stopping early.
+func downloadMessages(mb *openedMailbox, cfg config.Config, run *RunState, res *MailboxResult, pending *MissingUIDs) []uint32 {
+	repair := map[uint32]bool{}
+	for _, uid := range pending.Repair {
+		repair[uid] = true
+	}
+	queue := make(chan pendingMessage, len(pending.UIDs))
+	for _, uid := range pending.UIDs {
+		queue <- pendingMessage{UID: uid, Size: pending.Sizes[uid], Thread: pending.Threads[uid], Repair: repair[uid]}
+	}
+	close(queue)
 
-		select {
-		case msg := <-msgs:
-			if msg == nil {
-				break
-			}
-			body := msg.GetBody(section)
-			if body == nil {
-				break
-			}
-			data, err := io.ReadAll(body)
-			if err == nil && !cfg.DryRun {
-				path := MessagePath(cfg.BackupDir, box, uint64(uid))
-				_ = os.WriteFile(path, data, 0644)
-				mu.Lock()
-				*downloaded++
-				mu.Unlock()
-			}
-		case <-ctx.Done():
+	progress := newDownloadProgress(mb.log, mb.box, cfg.ProgressPercent, len(pending.UIDs))
+	done, handled := downloadPool(mb, cfg, run, queue, progress)
+	progress.finish()
+	res.add(done)
+
+	var left []uint32
+	for _, uid := range pending.UIDs {
+		if !handled[uid] {
+			left = append(left, uid)
 		}
+	}
+	return left
+}
+
+// downloadBatch downloads a batch of messages taken from the queue. The
+// bodies of those that pass prepareMessage are fetched in a single UID FETCH
+// and stored as they arrive; any the batch fetch didn't deliver are fetched
+// one by one with FETCH_RETRIES. done is called for each message handled. It
+// returns false when the daily limit or a shutdown stops further downloads.
+func downloadBatch(c *client.Client, mb *openedMailbox, cfg config.Config, run *RunState, res *MailboxResult, batch []pendingMessage, done func(uint32)) bool {
+	ok := true
+	byUID := map[uint32]pendingMessage{}
+	releases := map[uint32]func(){}
+	var uids []uint32
+	for _, m := range batch {
+		fetch, release, cont := prepareMessage(c, mb, cfg, run, res, m)
+		if !cont {
+			ok = false
+			break
+		}
+		if !fetch {
+			done(m.UID)
+			continue
+		}
+		byUID[m.UID] = m
+		releases[m.UID] = release
+		uids = append(uids, m.UID)
+	}
 
-		cancel()
-		time.Sleep(50 * time.Millisecond)
+	left := uids
+	if len(uids) > 1 {
+		if err := run.Rate.Wait(mb.ctx); err != nil {
+			releaseAll(releases, uids)
+			return false
+		}
+		fetchStart, last := time.Now(), time.Now()
+		writeBefore := res.Timings.Write
+		var err error
+		left, err = fetchBatch(mb.ctx, c, uids, bodyItems(cfg, run), bodySection(), func(msg *imap.Message, data []byte) {
+			metricsSvc.ObserveFetch(time.Since(last))
+			storeMessage(mb, cfg, run, res, byUID[msg.Uid], msg, data, releases[msg.Uid])
+			done(msg.Uid)
+			last = time.Now()
+		})
+		// Messages are written while the batch streams in
+		res.Timings.Download += time.Since(fetchStart) - (res.Timings.Write - writeBefore)
+		if err != nil && mb.ctx.Err() == nil {
+			run.Rate.observe(err)
+			mb.log.Debugf("Batch fetch in %s delivered %d of %d messages, fetching the rest one by one: %v", mb.box, len(uids)-len(left), len(uids), err)
+		}
+	}
+
+	for i, uid := range left {
+		if !fetchMessage(c, mb, cfg, run, res, byUID[uid], releases[uid]) {
+			releaseAll(releases, left[i+1:])
+			return false
+		}
+		done(uid)
 	}
+	return ok
 }
 
-// ----------------------
-// OAuth2 + Token Handling
-// ----------------------
+func releaseAll(releases map[uint32]func(), uids []uint32) {
+	for _, uid := range uids {
+		releases[uid]()
+	}
+}
 
-func authenticateOAuth2(c *client.Client, cfg config.Config) error {
-	if cfg.OAuth2TokenFile == "" {
-		return fmt.Errorf("OAUTH2_TOKEN_FILE is not set")
+// prepareMessage runs the checks before a message's body is fetched, and
+// stores the messages that need no body fetch (oversized stubs, TEXT_ONLY,
+// DEDUP references). fetch is set when the body is still to be fetched, with
+// release undoing its DEDUP claim if it isn't stored after all. ok is false
+// when the daily limit or a shutdown stops further downloads.
+func prepareMessage(c *client.Client, mb *openedMailbox, cfg config.Config, run *RunState, res *MailboxResult, m pendingMessage) (fetch bool, release func(), ok bool) {
+	box, uid := mb.box, m.UID
+	release = func() {}
+
+	if mb.ctx.Err() != nil {
+		return false, release, false
 	}
 
-	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(cfg.OAuth2TokenFile), 0700); err != nil {
-		return fmt.Errorf("cannot create token dir: %w", err)
+	if run.Daily.Reached() {
+		mb.log.Warnf("Daily download limit reached, pausing %s until %s", box, run.Daily.ResumeAt().Format(time.RFC1123))
+		res.Paused = true
+		return false, release, false
+	}
+	waitForLoad(mb.log, cfg.MaxLoadAvg, box)
+
+	if cfg.MaxMessageSize > 0 && int64(m.Size) > cfg.MaxMessageSize {
+		res.Skipped++
+		mb.log.Debugf("Skipping UID %d in %s: %d bytes exceeds MAX_MESSAGE_SIZE", uid, box, m.Size)
+		stub := StubPath(cfg.BackupDir, box, uint64(uid))
+		if cfg.StubSkipped && cfg.DryRun {
+			utils.DryRunWrite(stub, -1)
+		} else if cfg.StubSkipped && !utils.Exists(stub) {
+			if err := writeSkippedStub(c, stub, box, uid, m.Size, cfg.MaxMessageSize); err != nil {
+				mb.log.Warnf("Failed to write stub for UID %d in %s: %v", uid, box, err)
+			}
+		}
+		return false, release, true
 	}
 
-	conf := &oauth2.Config{
-		ClientID:     cfg.ClientID,
-		ClientSecret: cfg.ClientSecret,
-		Scopes:       []string{"https://mail.google.com/"},
-		RedirectURL:  "http://localhost",
-		Endpoint:     google.Endpoint,
+	if cfg.TextOnly {
+		if err := run.Rate.Wait(mb.ctx); err != nil {
+			return false, release, false
+		}
+		downloadText(c, mb, cfg, run, res, m)
+		return false, release, mb.ctx.Err() == nil
 	}
 
-	ctx := context.Background()
+	// With DEDUP, a message already stored under another mailbox only gets a
+	// reference; otherwise its Message-ID is claimed until it is written. A
+	// repaired message is already the stored copy.
+	if run.Seen != nil && cfg.StorageFormat != "mbox" && !m.Repair {
+		if err := run.Rate.Wait(mb.ctx); err != nil {
+			return false, release, false
+		}
+		id, done := dedupMessage(c, mb, cfg, run, res, m, messagePath(mb, cfg, m))
+		if done {
+			return false, release, mb.ctx.Err() == nil
+		}
+		if id != "" {
+			release = func() { run.Seen.release(id) }
+		}
+	}
+	return true, release, true
+}
 
-	var token *oauth2.Token
-	if t, err := loadTokenFromFile(cfg.OAuth2TokenFile); err == nil && t.Valid() {
-		logrus.Infof("Loaded cached token from %s", cfg.OAuth2TokenFile)
-		token = t
+// messagePath returns where a message is stored
+func messagePath(mb *openedMailbox, cfg config.Config, m pendingMessage) string {
+	if cfg.StorageFormat == "mbox" {
+		return archiveSvc.MboxPath(mb.dir)
 	}
+	return storedPath(cfg.BackupDir, mb.box, m.UID, m.Thread, messageExt(cfg))
+}
 
-	// First-time login
-	if token == nil || !token.Valid() {
-		authURL := conf.AuthCodeURL("state", oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"))
-		fmt.Printf("Open this URL in a browser:\n%s\n\nCopy the code below:\nEnter code: ", authURL)
+// bodySection is the part of a message that is stored: all of it, without
+// setting \Seen
+func bodySection() *imap.BodySectionName {
+	return &imap.BodySectionName{Peek: true}
+}
 
-		var rawCode string
-		fmt.Scanln(&rawCode)
+// bodyItems returns the FETCH items for a message body and the attributes
+// stored with it
+func bodyItems(cfg config.Config, run *RunState) []imap.FetchItem {
+	items := []imap.FetchItem{bodyFetchItem(cfg.BodyFetchMode), imap.FetchFlags}
+	if run.GmailExtensions {
+		items = append(items, fetchLabels, fetchMsgID)
+	}
+	return items
+}
 
-		code, err := url.QueryUnescape(rawCode)
-		if err != nil {
-			return fmt.Errorf("invalid auth code: %w", err)
-		}
+// fetchMessage fetches and stores a single message, retrying per
+// FETCH_RETRIES. It returns false when a shutdown cancelled the fetch; a
+// message already fetched is written in full.
+func fetchMessage(c *client.Client, mb *openedMailbox, cfg config.Config, run *RunState, res *MailboxResult, m pendingMessage, release func()) bool {
+	box, uid := mb.box, m.UID
 
-		tok, err := conf.Exchange(ctx, code)
-		if err != nil {
-			return fmt.Errorf("OAuth2 code exchange failed: %w", err)
+	if err := run.Rate.Wait(mb.ctx); err != nil {
+		release()
+		return false
+	}
+
+	fetchStart := time.Now()
+	msg, data, err := fetchBody(mb.ctx, c, uid, bodyItems(cfg, run), bodySection(), cfg.FetchRetries, run.Rate)
+	res.Timings.Download += time.Since(fetchStart)
+	if mb.ctx.Err() != nil {
+		mb.log.Debugf("Fetch of UID %d in %s cancelled by shutdown", uid, box)
+		release()
+		return false
+	}
+	if err != nil {
+		mb.log.Warnf("Failed to fetch UID %d in %s, will retry next run: %v", uid, box, err)
+		res.Failed = append(res.Failed, uid)
+		release()
+		return true
+	}
+	metricsSvc.ObserveFetch(time.Since(fetchStart))
+
+	storeMessage(mb, cfg, run, res, m, msg, data, release)
+	return true
+}
+
+// storeMessage writes a fetched message and records it in the manifest
+func storeMessage(mb *openedMailbox, cfg config.Config, run *RunState, res *MailboxResult, m pendingMessage, msg *imap.Message, data []byte, release func()) {
+	box, uid := mb.box, m.UID
+	path := messagePath(mb, cfg, m)
+	mbox := cfg.StorageFormat == "mbox"
+
+	run.Daily.Add(int64(len(data)))
+	if cfg.DryRun {
+		utils.DryRunWrite(path, int64(len(data)))
+		return
+	}
+
+	run.AcquireWrite()
+	defer run.ReleaseWrite()
+	writeStart := time.Now()
+	defer func() { res.Timings.Write += time.Since(writeStart) }()
+
+	data = utils.NormalizeEOL(data, cfg.NormalizeEOL)
+	stored, written, conflict := data, "", ""
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil && cfg.Compress && !mbox {
+		stored, err = archiveSvc.Compress(data)
+	}
+	if err == nil && mbox {
+		if err = archiveSvc.AppendMbox(path, uid, data); err == nil {
+			written = path
+		}
+	} else if err == nil {
+		// A truncated copy is replaced, whatever ON_CONFLICT says
+		mode := cfg.OnConflict
+		if m.Repair {
+			mode = ConflictOverwrite
+		}
+		written, conflict, err = writeMessage(path, stored, mode)
+	}
+	if conflict != "" {
+		mb.log.Warnf("Conflict in %s: %s", box, conflict)
+		res.Issues = append(res.Issues, conflict)
+	}
+	if err != nil {
+		mb.log.Warnf("Failed to write UID %d in %s, will retry next run: %v", uid, box, err)
+		res.Failed = append(res.Failed, uid)
+		// Unlike a failed fetch, a failed write (full disk, permissions) won't
+		// go away by itself, so it fails the mailbox
+		if res.Error == "" {
+			res.Error = fmt.Sprintf("writing UID %d: %v", uid, err)
 		}
-		token = tok
+		release()
+		return
+	}
+	// Nothing new was stored: the copy on disk is identical, or ON_CONFLICT
+	// kept it
+	if written == "" {
+		return
+	}
 
-		if err := saveTokenToFile(cfg.OAuth2TokenFile, token); err != nil {
-			logrus.Warnf("Failed to save token: %v", err)
-		} else {
-			logrus.Infof("Saved token to %s", cfg.OAuth2TokenFile)
+	if written == path && !mbox {
+		removeOtherForm(path)
+	}
+	if written == path && m.Repair {
+		res.Repaired++
+	}
+	if written == path {
+		rel, _ := filepath.Rel(mb.dir, path)
+		entry := archiveSvc.NewEntry(filepath.ToSlash(rel), data)
+		entry.ThreadID = m.Thread
+		entry.Flags = msg.Flags
+		if run.GmailExtensions {
+			entry.Labels = labels(msg)
+			entry.GmMsgID = gmMsgID(msg)
+		}
+		mb.recordEntry(uid, entry)
+	}
+	if mbox {
+		run.Checksums.Invalidate(written)
+	} else {
+		run.Checksums.Add(written, stored)
+	}
+	// The message is kept either way; a parse failure is only reported
+	if cfg.CheckMIME {
+		if mimeErr := archiveSvc.CheckMIME(data); mimeErr != nil {
+			issue := fmt.Sprintf("UID %d stored but has malformed MIME: %v", uid, mimeErr)
+			mb.log.Warnf("Mailbox %s: %s", box, issue)
+			res.Issues = append(res.Issues, issue)
 		}
 	}
+	run.AddDownloaded()
+	res.Downloaded++
+}
 
-	// TokenSource auto-refresh
-	ts := oauth2.ReuseTokenSource(token, conf.TokenSource(ctx, token))
+// ----------------------
+// OAuth2 + Token Handling
+// ----------------------
+
+func authenticateOAuth2(c *client.Client, cfg config.Config) error {
+	ts, err := TokenSource(cfg)
+	if err != nil {
+		return err
+	}
 
 	getAccessToken := func() (string, error) {
 		tok, err := ts.Token()
 		if err != nil {
 			return "", fmt.Errorf("failed to refresh token: %w", err)
 		}
-		if err := saveTokenToFile(cfg.OAuth2TokenFile, tok); err != nil {
-			logrus.Warnf("Failed to save refreshed token: %v", err)
-		}
 		return tok.AccessToken, nil
 	}
 
-	// SASL XOAUTH2 client
-	saslClient := &SASLOAuth2Client{
-		Username: cfg.Email,
-		TokenFn:  getAccessToken,
-	}
-
-	if err := c.Authenticate(saslClient); err != nil {
-		return fmt.Errorf("XOAUTH2 IMAP authentication failed: %w", err)
+	// A failed AUTHENTICATE leaves the connection unauthenticated, so the next
+	// mechanism can be tried on it
+	var errs []error
+	for _, mech := range oauthMechanisms(c, cfg) {
+		var err error
+		if mech == mechOAuthBearer {
+			err = c.Authenticate(&SASLOAuthBearerClient{
+				Username: cfg.Email,
+				Host:     cfg.ImapServer,
+				Port:     cfg.ImapPort,
+				TokenFn:  getAccessToken,
+			})
+		} else {
+			err = c.Authenticate(&SASLOAuth2Client{
+				Username: cfg.Email,
+				TokenFn:  getAccessToken,
+			})
+		}
+		if err != nil {
+			logrus.Debugf("%s IMAP authentication failed: %v", mech, err)
+			errs = append(errs, fmt.Errorf("%s IMAP authentication failed: %w", mech, err))
+			continue
+		}
+		logrus.Infof("OAuth2 IMAP authentication successful (%s)", mech)
+		return nil
 	}
-
-	logrus.Info("OAuth2 IMAP authentication successful")
-	return nil
+	return errors.Join(errs...)
 }
 
 // SASLOAuth2Client implements go-sasl.Client for Gmail
@@ -0,0 +1,370 @@
+package gmailService
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	"github.com/redjax/archive-gmail/internal/imaptest"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+const (
+	testEmail    = "user@example.com"
+	testPassword = "secret"
+)
+
+// testMessages returns n small messages with UIDs 1 to n
+func testMessages(n int) []*imaptest.Message {
+	msgs := make([]*imaptest.Message, n)
+	for i := range msgs {
+		uid := i + 1
+		msgs[i] = &imaptest.Message{
+			UID:   uint32(uid),
+			Body:  []byte(fmt.Sprintf("Message-ID: <%d@example.com>\r\nFrom: a@example.com\r\nSubject: message %d\r\n\r\nbody %d\r\n", uid, uid, uid)),
+			MsgID: uint64(1000 + uid),
+		}
+	}
+	return msgs
+}
+
+// testServer starts a server holding boxes for testEmail, and returns it with
+// the configuration of a backup over it
+func testServer(t *testing.T, srv *imaptest.Server, boxes ...*imaptest.Mailbox) config.Config {
+	t.Helper()
+	if srv == nil {
+		srv = &imaptest.Server{}
+	}
+	srv.Start(t)
+	srv.AddUser(testEmail, testPassword, boxes...)
+	return srv.Config(t, testEmail, testPassword)
+}
+
+// testConnect logs into the server of cfg and returns the connection with
+// the state of a run
+func testConnect(t *testing.T, cfg config.Config) (*client.Client, *RunState) {
+	t.Helper()
+	c, err := Connect(cfg)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	run := &RunState{
+		Daily:           NewDailyLimiter(cfg.BackupDir, cfg.DailyByteLimit, cfg.DryRun, nil),
+		ScanChunkSize:   TuneScanChunkSize(c, cfg.ScanChunkSize),
+		GmailExtensions: SupportsGmailExtensions(c, cfg),
+	}
+	return c, run
+}
+
+// testResult is the outcome of backing up a mailbox in a test
+type testResult struct {
+	MailboxResult
+	Downloaded uint64
+}
+
+// testProcess backs up one mailbox of the server of cfg
+func testProcess(t *testing.T, cfg config.Config, box string) testResult {
+	t.Helper()
+	c, run := testConnect(t, cfg)
+	res := ProcessMailbox(context.Background(), c, box, cfg, run)
+	return testResult{MailboxResult: res, Downloaded: run.Downloaded()}
+}
+
+func TestProcessMailbox(t *testing.T) {
+	cfg := testServer(t, nil, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(3)})
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 3 || len(res.Failed) != 0 {
+		t.Fatalf("first run: %+v", res)
+	}
+
+	res = testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 0 {
+		t.Errorf("second run downloaded again: %+v", res)
+	}
+}
+
+func TestProcessMailboxRefusesAPIArchive(t *testing.T) {
+	cfg := testServer(t, nil, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(3)})
+	dir := MailboxDir(cfg.BackupDir, "INBOX")
+	m := archiveSvc.NewManifest("INBOX")
+	m.Backend = archiveSvc.BackendAPI
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Downloaded != 0 || !strings.Contains(res.Error, "BACKEND=api archive") {
+		t.Errorf("result: %+v", res)
+	}
+}
+
+func TestListMailboxesDecodesUTF7(t *testing.T) {
+	cfg := testServer(t, nil,
+		&imaptest.Mailbox{Name: "INBOX", UidValidity: 1},
+		&imaptest.Mailbox{Name: "Entwürfe", UidValidity: 1, Messages: testMessages(1)},
+		&imaptest.Mailbox{Name: "日本語/メモ", UidValidity: 1},
+	)
+	c, _ := testConnect(t, cfg)
+
+	got, err := ListMailboxes(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"INBOX", "Entwürfe", "日本語/メモ"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("listed %q, want %q", got, want)
+	}
+
+	// The decoded name selects the mailbox again
+	if res := testProcess(t, cfg, "Entwürfe"); res.Downloaded != 1 {
+		t.Errorf("processing Entwürfe: %+v", res)
+	}
+}
+
+func TestMailboxDirEncoding(t *testing.T) {
+	t.Cleanup(func() { DirNameEncoding = "utf8" })
+
+	DirNameEncoding = "utf8"
+	if got := MailboxDir("/b", "Entwürfe/Alt"); got != filepath.Join("/b", "Entwürfe_Alt") {
+		t.Errorf("utf8: %s", got)
+	}
+	DirNameEncoding = "utf7"
+	if got := MailboxDir("/b", "Entwürfe/Alt"); got != filepath.Join("/b", "Entw&APw-rfe_Alt") {
+		t.Errorf("utf7: %s", got)
+	}
+	if got := MailboxDir("/b", "INBOX"); got != filepath.Join("/b", "INBOX") {
+		t.Errorf("utf7 changed an ASCII name: %s", got)
+	}
+}
+
+func TestShortenDirName(t *testing.T) {
+	if got := shortenDirName("INBOX", 255); got != "INBOX" {
+		t.Errorf("short name changed: %s", got)
+	}
+	long := strings.Repeat("ü", 200) // 400 bytes
+	short := shortenDirName(long, 255)
+	if len(short) > 255 || !utf8.ValidString(short) || !strings.HasPrefix(long, strings.Split(short, "~")[0]) {
+		t.Errorf("shortened to %q (%d bytes)", short, len(short))
+	}
+	if shortenDirName(long, 255) != short {
+		t.Error("same name shortened differently")
+	}
+	if other := shortenDirName(long+"x", 255); other == short {
+		t.Error("distinct long names share a directory")
+	}
+}
+
+func TestLongMailboxName(t *testing.T) {
+	box := strings.Repeat("Projects/Clients/", 20) + "Acme"
+	msgs := testMessages(2)
+	cfg := testServer(t, nil, &imaptest.Mailbox{Name: box, UidValidity: 1, Messages: msgs})
+
+	if res := testProcess(t, cfg, box); res.Error != "" || res.Downloaded != 2 {
+		t.Fatalf("result: %+v", res)
+	}
+	dir := MailboxDir(cfg.BackupDir, box)
+	if name := filepath.Base(dir); len(name) > MaxDirNameBytes || !strings.Contains(name, "~") {
+		t.Errorf("directory %q (%d bytes) not shortened", name, len(name))
+	}
+	if _, err := os.Stat(MessagePath(cfg.BackupDir, box, 2)); err != nil {
+		t.Error(err)
+	}
+
+	// The manifest and folder map keep the full name
+	if m, err := archiveSvc.LoadManifest(dir, filepath.Base(dir)); err != nil || m.Mailbox != box {
+		t.Errorf("manifest names %q, %v", m.Mailbox, err)
+	}
+	if err := archiveSvc.WriteFolderMap(cfg.BackupDir); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(cfg.BackupDir, archiveSvc.FolderMapFile))
+	if want := filepath.Base(dir) + "," + box; !strings.Contains(string(data), want) {
+		t.Errorf("folder map %q lacks %q", data, want)
+	}
+}
+
+func TestStreamMailboxesBeforeListCompletes(t *testing.T) {
+	// The LIST stalls after its first response until the test let it go
+	release := make(chan struct{})
+	srv := &imaptest.Server{Hook: func(s *imaptest.Session, cmd *imap.Command) bool {
+		if cmd.Name != "LIST" {
+			return false
+		}
+		s.Printf(`* LIST (\HasNoChildren) "/" "INBOX"`)
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		s.Printf(`* LIST (\Noselect \HasChildren) "/" "[Gmail]"`)
+		s.Printf(`* LIST (\HasNoChildren \Sent) "/" "[Gmail]/Sent Mail"`)
+		s.Printf(`* LIST (\HasNoChildren) "/" "Work"`)
+		s.OK(cmd.Tag, "LIST completed")
+		return true
+	}}
+	cfg := testServer(t, srv)
+	c, _ := testConnect(t, cfg)
+
+	names, errc := StreamMailboxes(c, 0)
+	select {
+	case first := <-names:
+		if first != "INBOX" {
+			t.Errorf("first mailbox %q", first)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no mailbox before the LIST completed")
+	}
+	close(release)
+
+	var rest []string
+	for name := range names {
+		rest = append(rest, name)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"[Gmail]/Sent Mail", "Work"}; !slices.Equal(rest, want) {
+		t.Errorf("then listed %q, want %q", rest, want)
+	}
+}
+
+func TestStreamMailboxesLimit(t *testing.T) {
+	cfg := testServer(t, nil,
+		&imaptest.Mailbox{Name: "INBOX", UidValidity: 1},
+		&imaptest.Mailbox{Name: "[Gmail]", Attributes: []string{imap.NoSelectAttr}},
+		&imaptest.Mailbox{Name: "A", UidValidity: 1},
+		&imaptest.Mailbox{Name: "B", UidValidity: 1},
+	)
+	c, _ := testConnect(t, cfg)
+
+	names, errc := StreamMailboxes(c, 2)
+	var got []string
+	for name := range names {
+		got = append(got, name)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"INBOX", "A"}; !slices.Equal(got, want) {
+		t.Errorf("listed %q, want %q", got, want)
+	}
+}
+
+// clientCert writes a self-signed client certificate and its key as PEM files
+// in dir, and returns their paths with the parsed certificate
+func clientCert(t *testing.T, dir, name string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestClientCertificateHandshake(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := clientCert(t, dir, "client")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	cfg := testServer(t, &imaptest.Server{ClientCAs: pool}, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1})
+
+	// The server refuses clients without a certificate
+	if c, err := Connect(cfg); err == nil {
+		c.Logout()
+		t.Fatal("connected without a client certificate")
+	}
+
+	cfg.TLSClientCert, cfg.TLSClientKey = certFile, keyFile
+	c, err := Connect(cfg)
+	if err != nil {
+		t.Fatalf("Connect with client certificate: %v", err)
+	}
+	c.Logout()
+}
+
+func TestClientCertificatesMismatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, _, _ := clientCert(t, dir, "one")
+	_, otherKey, _ := clientCert(t, dir, "two")
+
+	if _, err := ClientCertificates(config.Config{TLSClientCert: certFile, TLSClientKey: otherKey}); err == nil {
+		t.Error("certificate loaded with another certificate's key")
+	}
+	if _, err := ClientCertificates(config.Config{TLSClientCert: certFile, TLSClientKey: ""}); err == nil {
+		t.Error("certificate loaded without a key")
+	}
+	if certs, err := ClientCertificates(config.Config{TLSClientCert: "", TLSClientKey: ""}); err != nil || certs != nil {
+		t.Errorf("no certificate configured: %v, %v", certs, err)
+	}
+}
+
+func TestMalformedMIMEStored(t *testing.T) {
+	msgs := testMessages(2)
+	msgs[1].Body = []byte("Message-ID: <2@example.com>\r\nContent-Type: multipart/mixed\r\n\r\nno boundary\r\n")
+	cfg := testServer(t, nil, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: msgs})
+	cfg.CheckMIME = true
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 2 {
+		t.Fatalf("result: %+v", res)
+	}
+	data, err := os.ReadFile(MessagePath(cfg.BackupDir, "INBOX", 2))
+	if err != nil || !bytes.Equal(data, msgs[1].Body) {
+		t.Errorf("malformed message not stored as is: %q, %v", data, err)
+	}
+	if len(res.Issues) != 1 || !strings.Contains(res.Issues[0], "UID 2 stored but has malformed MIME") {
+		t.Errorf("issues %q, want the parse error of UID 2", res.Issues)
+	}
+}
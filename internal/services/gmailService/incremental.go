@@ -0,0 +1,60 @@
+package gmailService
+
+import (
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+// incrementalStart returns the UID an incremental scan of an opened mailbox
+// starts from, or 0 when it needs a full scan. IMAP assigns UIDs in
+// ascending order (a Gmail label applied to an old message gets a new UID),
+// so messages below the manifest's synced UID are already stored.
+func incrementalStart(mb *openedMailbox, cfg config.Config, threadLayout bool) uint32 {
+	m := mb.manifest
+	if !cfg.IncrementalScan || m.SyncedUID == 0 || mb.resync || mb.scanAll {
+		return 0
+	}
+	// VERIFY and TRUST_SERVER check stored messages, which needs all of them
+	if cfg.Verify || cfg.TrustServer {
+		return 0
+	}
+	// Messages stored in the other layout are downloaded again by a full scan
+	if len(m.StoredUIDs(threadLayout)) != len(m.Messages) {
+		mb.log.Infof("Layout of %s changed since the last scan, scanning every UID", mb.box)
+		return 0
+	}
+	return m.SyncedUID
+}
+
+// recordSynced advances the manifest's synced UID after a complete scan: to
+// UIDNEXT, or to the lowest message the scan found that still isn't stored
+// (a failed download, the daily limit, or one a filter or sample left out).
+// Messages skipped for MAX_MESSAGE_SIZE don't hold it back. It runs once
+// every download of the mailbox has finished, so downloads completing out of
+// order can't move it past a message still in flight.
+func (m *openedMailbox) recordSynced(cfg config.Config) {
+	if cfg.DryRun || m.scanAll || m.scanGaps || m.partialScan {
+		return
+	}
+
+	synced := m.status.UidNext
+	for _, uid := range m.pending {
+		if uid >= synced {
+			continue
+		}
+		if cfg.MaxMessageSize > 0 && int64(m.pendingSizes[uid]) > cfg.MaxMessageSize {
+			continue
+		}
+		if _, ok := m.manifest.Messages[uid]; !ok {
+			synced = uid
+		}
+	}
+
+	if synced == m.manifest.SyncedUID && m.status.UidNext == m.manifest.UidNext && m.status.Messages == m.manifest.MessageCount {
+		return
+	}
+	m.log.Debugf("Mailbox %s synced below UID %d (UIDNEXT %d, %d messages)", m.box, synced, m.status.UidNext, m.status.Messages)
+	m.manifest.SyncedUID = synced
+	m.manifest.UidNext = m.status.UidNext
+	m.manifest.MessageCount = m.status.Messages
+	m.manifestDirty = true
+}
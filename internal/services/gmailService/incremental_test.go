@@ -0,0 +1,130 @@
+package gmailService
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	"github.com/redjax/archive-gmail/internal/imaptest"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+// syncedMailbox returns a mailbox whose scan found pending, with stored
+// already in its manifest
+func syncedMailbox(pending, stored []uint32) *openedMailbox {
+	m := archiveSvc.NewManifest("INBOX")
+	for _, uid := range stored {
+		m.Messages[uid] = archiveSvc.ManifestEntry{File: "x.eml"}
+	}
+	return &openedMailbox{
+		log:      logrus.NewEntry(logrus.StandardLogger()),
+		box:      "INBOX",
+		status:   &imap.MailboxStatus{UidNext: 11, Messages: 10},
+		pending:  pending,
+		manifest: m,
+	}
+}
+
+func TestRecordSyncedOutOfOrder(t *testing.T) {
+	pending := []uint32{3, 5, 7, 9}
+	tests := []struct {
+		name   string
+		stored []uint32
+		want   uint32
+	}{
+		{"none stored", nil, 3},
+		{"higher UIDs finished first", []uint32{5, 7, 9}, 3},
+		{"gap in the middle", []uint32{3, 7, 9}, 5},
+		{"only the last in flight", []uint32{3, 5, 7}, 9},
+		{"all stored", []uint32{9, 3, 7, 5}, 11},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb := syncedMailbox(pending, tt.stored)
+			mb.recordSynced(config.Config{})
+			if mb.manifest.SyncedUID != tt.want {
+				t.Errorf("SyncedUID = %d, want %d", mb.manifest.SyncedUID, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordSyncedAdvancesAsDownloadsComplete(t *testing.T) {
+	mb := syncedMailbox([]uint32{3, 5, 7, 9}, nil)
+	var last uint32
+	// Completions arrive out of UID order; the watermark never passes a
+	// lower UID that isn't stored yet
+	for _, uid := range []uint32{9, 5, 3, 7} {
+		mb.manifest.Messages[uid] = archiveSvc.ManifestEntry{File: "x.eml"}
+		mb.recordSynced(config.Config{})
+		got := mb.manifest.SyncedUID
+		if got < last {
+			t.Fatalf("SyncedUID went back from %d to %d", last, got)
+		}
+		for _, p := range mb.pending {
+			if _, ok := mb.manifest.Messages[p]; !ok && p < got {
+				t.Fatalf("SyncedUID %d passes unstored UID %d", got, p)
+			}
+		}
+		last = got
+	}
+	if last != 11 {
+		t.Errorf("SyncedUID = %d after every download, want UIDNEXT 11", last)
+	}
+}
+
+func TestRecordSyncedSkipsIncompleteScans(t *testing.T) {
+	tests := map[string]func(mb *openedMailbox, cfg *config.Config){
+		"scan gaps":    func(mb *openedMailbox, _ *config.Config) { mb.scanGaps = true },
+		"partial scan": func(mb *openedMailbox, _ *config.Config) { mb.partialScan = true },
+		"scan all":     func(mb *openedMailbox, _ *config.Config) { mb.scanAll = true },
+		"dry run":      func(_ *openedMailbox, cfg *config.Config) { cfg.DryRun = true },
+	}
+	for name, setup := range tests {
+		mb := syncedMailbox([]uint32{3}, []uint32{3})
+		var cfg config.Config
+		setup(mb, &cfg)
+		mb.recordSynced(cfg)
+		if mb.manifest.SyncedUID != 0 || mb.manifestDirty {
+			t.Errorf("%s: SyncedUID = %d, want it left alone", name, mb.manifest.SyncedUID)
+		}
+	}
+}
+
+func TestFilteredRunHoldsSyncedUID(t *testing.T) {
+	// Alice sent the newest two messages
+	var msgs []*imaptest.Message
+	for uid, from := range []string{"carol@example.com", "carol@example.com", "alice@example.com", "alice@example.com"} {
+		msgs = append(msgs, &imaptest.Message{UID: uint32(uid + 1), Body: []byte(fmt.Sprintf("From: %s\r\nSubject: %d\r\n\r\nbody\r\n", from, uid+1))})
+	}
+	tests := map[string]func(cfg *config.Config){
+		"sample": func(cfg *config.Config) { cfg.SampleMode, cfg.SampleSize = "tail", 2 },
+		"filter": func(cfg *config.Config) { cfg.FromFilter = []string{"alice@example.com"} },
+	}
+	for name, limit := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := &imaptest.Server{Hook: headerSearch}
+			cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: msgs})
+
+			limited := cfg
+			limit(&limited)
+			if res := testProcess(t, limited, "INBOX"); res.Error != "" || res.Downloaded != 2 {
+				t.Fatalf("%s run: %+v", name, res)
+			}
+
+			// The messages left out are still below the synced UID
+			if res := testProcess(t, cfg, "INBOX"); res.Error != "" || res.Downloaded != 2 {
+				t.Errorf("full run: %+v", res)
+			}
+			for uid := uint64(1); uid <= 4; uid++ {
+				if _, err := os.Stat(MessagePath(cfg.BackupDir, "INBOX", uid)); err != nil {
+					t.Errorf("UID %d not stored: %v", uid, err)
+				}
+			}
+		})
+	}
+}
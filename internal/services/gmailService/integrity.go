@@ -0,0 +1,48 @@
+package gmailService
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// maxEOLShare bounds how much NORMALIZE_EOL may change a message's size: one
+// byte per line, and lines are rarely shorter than 20 bytes
+const maxEOLShare = 0.05
+
+// storedSize returns the size of the stored copy of e: the file size for
+// plain messages, or the size recorded in the manifest for compressed ones,
+// which would need decompressing. ok is false for entries that are not full
+// messages (references, text-only, mbox, stubs).
+func storedSize(dir string, e archiveSvc.ManifestEntry) (size int64, ok bool) {
+	if !archiveSvc.IsMessageFile(e.File) {
+		return 0, false
+	}
+	if strings.HasSuffix(e.File, archiveSvc.CompressedExt) {
+		return e.Size, true
+	}
+	info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(e.File)))
+	if err != nil {
+		// A vanished file needs downloading just as much
+		return 0, true
+	}
+	return info.Size(), true
+}
+
+// sizeMatches reports whether a stored copy of stored bytes can be the
+// server's message of size bytes after NORMALIZE_EOL (VERIFY)
+func sizeMatches(stored int64, size uint32, eol string) bool {
+	server := int64(size)
+	slack := int64(float64(server) * maxEOLShare)
+	switch eol {
+	case utils.EOLLF:
+		return stored <= server && stored >= server-slack
+	case utils.EOLCRLF:
+		return stored >= server && stored <= server+slack
+	default:
+		return stored == server
+	}
+}
@@ -0,0 +1,39 @@
+package gmailService
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// loadCheckInterval is how often the load average is rechecked while paused
+var loadCheckInterval = 30 * time.Second
+
+// loadAverage reads the system load average; replaced in tests
+var loadAverage = utils.LoadAverage
+
+// waitForLoad blocks while the system load average is above limit, so
+// downloads don't starve interactive work. It returns immediately when limit
+// is 0 or the load can't be read on this platform.
+func waitForLoad(log *logrus.Entry, limit float64, box string) {
+	if limit <= 0 {
+		return
+	}
+	logged := false
+	for {
+		load, ok := loadAverage()
+		if !ok || load <= limit {
+			if logged {
+				log.Infof("Load average back to %.2f, resuming %s", load, box)
+			}
+			return
+		}
+		if !logged {
+			log.Infof("Load average %.2f above MAX_LOAD_AVG %.2f, pausing %s", load, limit, box)
+			logged = true
+		}
+		time.Sleep(loadCheckInterval)
+	}
+}
@@ -0,0 +1,77 @@
+package gmailService
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+)
+
+func TestWaitForLoad(t *testing.T) {
+	interval, read := loadCheckInterval, loadAverage
+	t.Cleanup(func() { loadCheckInterval, loadAverage = interval, read })
+	loadCheckInterval = time.Millisecond
+	log := logrus.NewEntry(logrus.StandardLogger())
+
+	tests := []struct {
+		name   string
+		limit  float64
+		loads  []float64 // returned by successive reads
+		ok     bool
+		checks int
+	}{
+		{"disabled", 0, []float64{9}, true, 0},
+		{"below the limit", 2, []float64{1.5}, true, 1},
+		{"pauses while above", 2, []float64{3, 2.5, 4, 1}, true, 4},
+		{"unsupported platform", 2, []float64{9}, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checks := 0
+			loadAverage = func() (float64, bool) {
+				load := tt.loads[min(checks, len(tt.loads)-1)]
+				checks++
+				return load, tt.ok
+			}
+			waitForLoad(log, tt.limit, "INBOX")
+			if checks != tt.checks {
+				t.Errorf("load read %d times, want %d", checks, tt.checks)
+			}
+		})
+	}
+}
+
+func TestDownloadsPauseUnderLoad(t *testing.T) {
+	interval, read := loadCheckInterval, loadAverage
+	t.Cleanup(func() { loadCheckInterval, loadAverage = interval, read })
+	loadCheckInterval = time.Millisecond
+
+	srv := &imaptest.Server{}
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(2)})
+	cfg.MaxLoadAvg = 1
+	cfg.FetchBatchSize = 1
+
+	// The load stays high for the first 3 reads
+	reads, fetchedWhileHigh := 0, 0
+	loadAverage = func() (float64, bool) {
+		reads++
+		if reads <= 3 {
+			fetchedWhileHigh += bodyFetches(srv)
+			return 5, true
+		}
+		return 0.5, true
+	}
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 2 {
+		t.Fatalf("result: %+v", res)
+	}
+	if fetchedWhileHigh != 0 {
+		t.Error("bodies fetched while the load was above MAX_LOAD_AVG")
+	}
+	if reads < 4 {
+		t.Errorf("load read %d times, want a pause before the first download", reads)
+	}
+}
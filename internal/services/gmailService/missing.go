@@ -0,0 +1,166 @@
+package gmailService
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// MissingFile lists the UIDs a scan found not yet stored in a mailbox
+const MissingFile = "missing_uids.json"
+
+// MissingUIDs is the result of scanning a mailbox: the messages to download,
+// with the sizes and thread IDs learned during the scan
+type MissingUIDs struct {
+	Mailbox     string            `json:"mailbox"`
+	UidValidity uint32            `json:"uid_validity"`
+	Scanned     time.Time         `json:"scanned"`
+	UIDs        []uint32          `json:"uids"`
+	Sizes       map[uint32]uint32 `json:"sizes,omitempty"`
+	Threads     map[uint32]string `json:"threads,omitempty"`
+	Repair      []uint32          `json:"repair,omitempty"`
+}
+
+// LoadMissing reads the scan results in dir; nil if there are none
+func LoadMissing(dir string) (*MissingUIDs, error) {
+	data, err := os.ReadFile(filepath.Join(dir, MissingFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m MissingUIDs
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Save atomically writes the scan results into dir, or removes the file when
+// nothing is left to download
+func (m *MissingUIDs) Save(dir string) error {
+	path := filepath.Join(dir, MissingFile)
+	if len(m.UIDs) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path, data, 0644)
+}
+
+// ScanMailbox scans a mailbox and records the messages to download in its
+// missing_uids.json, without downloading anything
+func ScanMailbox(ctx context.Context, c *client.Client, box string, cfg config.Config, run *RunState) MailboxResult {
+	log := run.logger()
+	log.Infof("Scanning: %s", box)
+	res := MailboxResult{Name: box}
+
+	mb := openMailbox(ctx, c, box, cfg, log, &res)
+	if mb == nil {
+		return res
+	}
+	defer mb.saveManifest()
+
+	pending, ok := findMissing(c, mb, cfg, run, &res)
+	if !ok {
+		return res
+	}
+	if ctx.Err() != nil {
+		// Keep the previous scan rather than a partial one
+		res.Interrupted = true
+		return res
+	}
+	pending.Scanned = time.Now()
+
+	log.Infof("%s: %d messages to download", box, len(pending.UIDs))
+	if cfg.DryRun {
+		utils.DryRunWrite(filepath.Join(mb.dir, MissingFile), -1)
+		return res
+	}
+	if err := pending.Save(mb.dir); err != nil {
+		log.Warnf("Failed writing %s for %s: %v", MissingFile, box, err)
+	}
+	return res
+}
+
+// DownloadMailbox downloads the messages listed by a previous ScanMailbox,
+// then rewrites missing_uids.json with whatever is left
+func DownloadMailbox(ctx context.Context, c *client.Client, box string, cfg config.Config, run *RunState) MailboxResult {
+	log := run.logger()
+	res := MailboxResult{Name: box}
+
+	pending, err := LoadMissing(MailboxDir(cfg.BackupDir, box))
+	if err != nil {
+		log.Warnf("Failed reading %s for %s: %v", MissingFile, box, err)
+		res.Error = fmt.Sprintf("reading %s: %v", MissingFile, err)
+		return res
+	}
+	if pending == nil || len(pending.UIDs) == 0 {
+		log.Debugf("Nothing to download in %s, run scan first", box)
+		return res
+	}
+
+	log.Infof("Downloading: %s (%d messages scanned %s)", box, len(pending.UIDs), pending.Scanned.Format(time.RFC1123))
+	mb := openMailbox(ctx, c, box, cfg, log, &res)
+	if mb == nil {
+		return res
+	}
+	defer mb.close()
+	defer mb.saveManifest()
+
+	// Renumbered UIDs no longer point at the scanned messages
+	if mb.status.UidValidity != pending.UidValidity {
+		log.Warnf("UIDVALIDITY of %s changed since the scan, run scan again", box)
+		res.Error = fmt.Sprintf("UIDVALIDITY changed since the scan (%d -> %d), run scan again", pending.UidValidity, mb.status.UidValidity)
+		return res
+	}
+
+	left := downloadMessages(mb, cfg, run, &res, pending)
+	if cfg.DryRun {
+		return res
+	}
+	pending.UIDs = left
+	if err := pending.Save(mb.dir); err != nil {
+		log.Warnf("Failed updating %s for %s: %v", MissingFile, box, err)
+	}
+	return res
+}
+
+// EstimateMailbox scans a mailbox and records how many messages, and how many
+// bytes by RFC822.SIZE, are still to be downloaded. Nothing is written.
+func EstimateMailbox(ctx context.Context, c *client.Client, box string, cfg config.Config, run *RunState) MailboxResult {
+	res := MailboxResult{Name: box}
+	cfg.DryRun = true
+
+	mb := openMailbox(ctx, c, box, cfg, run.logger(), &res)
+	if mb == nil {
+		return res
+	}
+
+	pending, ok := findMissing(c, mb, cfg, run, &res)
+	if !ok {
+		return res
+	}
+	res.Pending = len(pending.UIDs)
+	for _, uid := range pending.UIDs {
+		res.PendingBytes += int64(pending.Sizes[uid])
+	}
+	return res
+}
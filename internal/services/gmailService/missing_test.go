@@ -0,0 +1,129 @@
+package gmailService
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+)
+
+func TestMissingUIDsSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	if m, err := LoadMissing(dir); m != nil || err != nil {
+		t.Fatalf("no scan yet: %+v %v", m, err)
+	}
+
+	want := &MissingUIDs{
+		Mailbox:     "INBOX",
+		UidValidity: 7,
+		Scanned:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		UIDs:        []uint32{3, 5},
+		Sizes:       map[uint32]uint32{3: 100, 5: 200},
+		Threads:     map[uint32]string{3: "42"},
+		Repair:      []uint32{5},
+	}
+	if err := want.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadMissing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+
+	// Nothing left to download removes the file
+	want.UIDs = nil
+	if err := want.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, MissingFile)); !os.IsNotExist(err) {
+		t.Errorf("%s kept with nothing to download: %v", MissingFile, err)
+	}
+}
+
+func TestScanThenDownload(t *testing.T) {
+	srv := &imaptest.Server{}
+	box := &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(3)}
+	cfg := testServer(t, srv, box)
+	dir := MailboxDir(cfg.BackupDir, "INBOX")
+	c, run := testConnect(t, cfg)
+
+	if res := ScanMailbox(context.Background(), c, "INBOX", cfg, run); res.Error != "" || res.Downloaded != 0 {
+		t.Fatalf("scan: %+v", res)
+	}
+	pending, err := LoadMissing(dir)
+	if err != nil || pending == nil {
+		t.Fatalf("scan wrote no %s: %v", MissingFile, err)
+	}
+	if !slices.Equal(pending.UIDs, []uint32{1, 2, 3}) || pending.UidValidity != 1 {
+		t.Errorf("scan recorded %+v", pending)
+	}
+	if stored, _ := filepath.Glob(filepath.Join(dir, "*.eml")); len(stored) != 0 {
+		t.Errorf("scan downloaded %v", stored)
+	}
+
+	res := DownloadMailbox(context.Background(), c, "INBOX", cfg, run)
+	if res.Error != "" || res.Downloaded != 3 {
+		t.Fatalf("download: %+v", res)
+	}
+	if stored, _ := filepath.Glob(filepath.Join(dir, "*.eml")); len(stored) != 3 {
+		t.Errorf("%d messages stored, want 3", len(stored))
+	}
+	if pending, _ := LoadMissing(dir); pending != nil {
+		t.Errorf("%s left after downloading everything: %+v", MissingFile, pending)
+	}
+}
+
+func TestDownloadAfterUidValidityChange(t *testing.T) {
+	srv := &imaptest.Server{}
+	box := &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(2)}
+	cfg := testServer(t, srv, box)
+	c, run := testConnect(t, cfg)
+
+	ScanMailbox(context.Background(), c, "INBOX", cfg, run)
+	srv.Do(func() { box.UidValidity = 2 })
+
+	res := DownloadMailbox(context.Background(), c, "INBOX", cfg, run)
+	if res.Error == "" || res.Downloaded != 0 {
+		t.Errorf("download after UIDVALIDITY change: %+v", res)
+	}
+	if pending, _ := LoadMissing(MailboxDir(cfg.BackupDir, "INBOX")); pending == nil || len(pending.UIDs) != 2 {
+		t.Errorf("scan results not kept: %+v", pending)
+	}
+}
+
+func TestEstimateMailbox(t *testing.T) {
+	srv := &imaptest.Server{}
+	msgs := testMessages(5)
+	box := &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: msgs[:2]}
+	cfg := testServer(t, srv, box)
+	if res := testProcess(t, cfg, "INBOX"); res.Downloaded != 2 {
+		t.Fatalf("first run: %+v", res)
+	}
+	srv.Do(func() { box.Messages = msgs })
+
+	var want int64
+	for _, msg := range msgs[2:] {
+		want += int64(len(msg.Body))
+	}
+	c, run := testConnect(t, cfg)
+	res := EstimateMailbox(context.Background(), c, "INBOX", cfg, run)
+	if res.Pending != 3 || res.PendingBytes != want {
+		t.Errorf("estimate %d messages, %d bytes; want 3, %d", res.Pending, res.PendingBytes, want)
+	}
+
+	dir := MailboxDir(cfg.BackupDir, "INBOX")
+	if stored, _ := filepath.Glob(filepath.Join(dir, "*.eml")); len(stored) != 2 {
+		t.Errorf("estimate changed the stored messages: %v", stored)
+	}
+	if pending, _ := LoadMissing(dir); pending != nil {
+		t.Errorf("estimate wrote %s", MissingFile)
+	}
+}
@@ -0,0 +1,221 @@
+package gmailService
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// OAUTH2_LOGIN modes
+const (
+	LoginAuto   = "auto"
+	LoginManual = "manual"
+	LoginDevice = "device"
+)
+
+// loginTimeout bounds the wait for the browser to come back to the local
+// redirect listener
+const loginTimeout = 5 * time.Minute
+
+// Login runs the interactive OAuth2 consent flow. In auto mode a temporary
+// server on localhost receives the redirect, so the code never has to be
+// copied by hand; if the port can't be bound, or in manual mode, the user
+// pastes the code (or the whole redirect URL) instead. port 0 picks a free
+// port. Device mode uses the device authorization flow (see deviceLogin).
+func Login(ctx context.Context, conf *oauth2.Config, mode string, port int) (*oauth2.Token, error) {
+	if mode == LoginDevice {
+		return deviceLogin(ctx, conf)
+	}
+	if mode != LoginManual {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			return listenerLogin(ctx, conf, ln)
+		}
+		logrus.Warnf("Cannot listen for the OAuth2 redirect, falling back to pasting the code: %v", err)
+	}
+	return manualLogin(ctx, conf)
+}
+
+// listenerLogin redirects the browser to ln and exchanges the code it brings
+// back. The state parameter ties the callback to this login, so another page
+// can't feed in a code of its own.
+func listenerLogin(ctx context.Context, conf *oauth2.Config, ln net.Listener) (*oauth2.Token, error) {
+	state, err := randomState()
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	local := *conf
+	local.RedirectURL = "http://" + ln.Addr().String()
+
+	codes := make(chan string, 1)
+	denied := make(chan error, 1)
+	srv := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			if q.Get("state") != state {
+				http.Error(w, "Invalid or missing state parameter", http.StatusBadRequest)
+				return
+			}
+			if e := q.Get("error"); e != "" {
+				writeLoginPage(w, "Authorization failed ("+e+"). You can close this tab.")
+				select {
+				case denied <- fmt.Errorf("authorization failed: %s", e):
+				default:
+				}
+				return
+			}
+			code := q.Get("code")
+			if code == "" {
+				http.Error(w, "Missing code parameter", http.StatusBadRequest)
+				return
+			}
+			writeLoginPage(w, "Authorization complete. You can close this tab and return to archive-gmail.")
+			select {
+			case codes <- code:
+			default:
+			}
+		}),
+	}
+	go func() { _ = srv.Serve(ln) }()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	authURL := local.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"))
+	fmt.Printf("Open this URL in a browser on this machine:\n%s\n\nWaiting for the redirect to %s ...\n", authURL, local.RedirectURL)
+
+	select {
+	case code := <-codes:
+		tok, err := local.Exchange(ctx, code)
+		if err != nil {
+			return nil, fmt.Errorf("OAuth2 code exchange failed: %w", err)
+		}
+		return tok, nil
+	case err := <-denied:
+		return nil, err
+	case <-time.After(loginTimeout):
+		return nil, fmt.Errorf("no OAuth2 redirect within %s; set OAUTH2_LOGIN=manual to paste the code instead", loginTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// deviceLogin runs the OAuth2 device authorization flow (RFC 8628) for
+// machines without a browser: the user enters a short code at a verification
+// URL on any other device while the token endpoint is polled.
+func deviceLogin(ctx context.Context, conf *oauth2.Config) (*oauth2.Token, error) {
+	resp, err := conf.DeviceAuth(ctx, oauth2.AccessTypeOffline)
+	if err != nil {
+		return nil, fmt.Errorf("OAuth2 device authorization failed: %w", err)
+	}
+
+	if resp.VerificationURIComplete != "" {
+		fmt.Printf("On any device, open:\n%s\n\nor open %s and enter the code %s\n", resp.VerificationURIComplete, resp.VerificationURI, resp.UserCode)
+	} else {
+		fmt.Printf("On any device, open %s and enter the code:\n\n    %s\n\n", resp.VerificationURI, resp.UserCode)
+	}
+	if !resp.Expiry.IsZero() {
+		fmt.Printf("Waiting for approval (the code expires at %s) ...\n", resp.Expiry.Format(time.Kitchen))
+	}
+
+	tok, err := conf.DeviceAccessToken(ctx, resp)
+	if err != nil {
+		return nil, fmt.Errorf("OAuth2 device login failed: %w", err)
+	}
+	return tok, nil
+}
+
+// loginPage is shown in the browser once the redirect arrives. It tries to
+// close the tab; browsers only allow that for tabs opened by a script, so the
+// message says to close it otherwise.
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>archive-gmail</title></head>
+<body style="font-family: sans-serif; margin: 3em">
+<p>{{.}}</p>
+<script>window.close()</script>
+</body>
+</html>
+`))
+
+// writeLoginPage answers the redirect with msg on loginPage
+func writeLoginPage(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = loginPage.Execute(w, msg)
+}
+
+// manualLogin prints the auth URL and reads the code pasted back
+func manualLogin(ctx context.Context, conf *oauth2.Config) (*oauth2.Token, error) {
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	authURL := conf.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"))
+	fmt.Printf("Open this URL in a browser:\n%s\n\nCopy the code (or the whole URL) the browser is redirected to:\nEnter code: ", authURL)
+
+	var raw string
+	fmt.Scanln(&raw)
+	code, gotState, err := parseAuthCode(raw)
+	if err != nil {
+		return nil, err
+	}
+	if gotState != "" && gotState != state {
+		return nil, errors.New("the pasted URL is from a different login attempt (state mismatch)")
+	}
+
+	tok, err := conf.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("OAuth2 code exchange failed: %w", err)
+	}
+	return tok, nil
+}
+
+// parseAuthCode accepts a bare (possibly URL-escaped) code or the full
+// redirect URL, returning the code and, for a URL, its state
+func parseAuthCode(raw string) (code, state string, err error) {
+	raw = strings.TrimSpace(raw)
+	if strings.Contains(raw, "code=") {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid redirect URL: %w", err)
+		}
+		q := u.Query()
+		if u.RawQuery == "" {
+			// Only the query string was pasted
+			q, _ = url.ParseQuery(strings.TrimPrefix(raw, "?"))
+		}
+		if q.Get("code") == "" {
+			return "", "", errors.New("no code in the pasted URL")
+		}
+		return q.Get("code"), q.Get("state"), nil
+	}
+
+	code, err = url.QueryUnescape(raw)
+	if err != nil || code == "" {
+		return "", "", fmt.Errorf("invalid auth code %q", raw)
+	}
+	return code, "", nil
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating OAuth2 state: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,99 @@
+package gmailService
+
+import (
+	"time"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+// pendingMessage is a message found by the scan that still has to be downloaded
+type pendingMessage struct {
+	UID    uint32
+	Size   uint32
+	Thread string
+	Repair bool // stored copy failed the VERIFY size check
+}
+
+// canPipeline reports whether downloads may start before the scan finishes.
+// Filters and sampling need the complete UID list first.
+func canPipeline(cfg config.Config) bool {
+	return cfg.PipelineDepth > 0 && BuildSearchCriteria(cfg) == nil && cfg.SampleMode == ""
+}
+
+// pipelineMailbox scans an opened mailbox and downloads missing messages as
+// each scan chunk returns, instead of waiting for the whole scan. The scan
+// keeps mb's connection busy and a go-imap client runs one command at a time,
+// so the downloads get connections of their own. It returns false, having
+// done nothing, when no download connection can be opened.
+func pipelineMailbox(mb *openedMailbox, cfg config.Config, run *RunState, res *MailboxResult) bool {
+	w, err := openWorker(cfg, mb)
+	if err != nil {
+		mb.log.Warnf("No download connection for %s, downloading after the scan: %v", mb.box, err)
+		return false
+	}
+	defer w.close()
+
+	c := mb.client
+	found := make(chan pendingMessage)
+	queue := make(chan pendingMessage, cfg.PipelineDepth)
+	go feedQueue(found, queue)
+
+	// The total is only known once the scan finishes
+	progress := newDownloadProgress(mb.log, mb.box, cfg.ProgressPercent, 0)
+
+	// The pool keeps draining the queue after stopping, so the scan is never
+	// blocked
+	var done MailboxResult
+	downloaded := make(chan struct{})
+	go func() {
+		defer close(downloaded)
+		done, _ = downloadPool(w, cfg, run, queue, progress)
+	}()
+
+	scanStart := time.Now()
+	scan := scanMailbox(c, mb, cfg, run, func(m pendingMessage) { found <- m })
+	close(found)
+	mb.scanned = scan.All
+	mb.pending, mb.pendingSizes = scan.Missing, scan.Sizes
+	res.Timings.Scan = time.Since(scanStart)
+	progress.setTotal(len(scan.Missing))
+	mb.log.Debugf("Scan of %s finished with %d messages to download", mb.box, len(scan.Missing))
+
+	// Downloads are already under way, so a rescan isn't possible here
+	if expunged, grew := updatesFor(c).Take(); (expunged > 0 || grew) && cfg.MailboxChangeAction != "ignore" {
+		mb.log.Warnf("Mailbox %s changed during scan (%d expunged, new messages: %t); changes will be picked up next run", mb.box, expunged, grew)
+	}
+
+	<-downloaded
+	progress.finish()
+	res.add(done)
+	return true
+}
+
+// feedQueue moves messages from in to the bounded out queue. Messages wait in
+// an internal buffer while out is full, so the sender (the scan, which runs on
+// the client's reader) never blocks on slow downloads.
+func feedQueue(in <-chan pendingMessage, out chan<- pendingMessage) {
+	defer close(out)
+
+	var pending []pendingMessage
+	for in != nil || len(pending) > 0 {
+		var send chan<- pendingMessage
+		var next pendingMessage
+		if len(pending) > 0 {
+			send = out
+			next = pending[0]
+		}
+
+		select {
+		case m, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			pending = append(pending, m)
+		case send <- next:
+			pending = pending[1:]
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package gmailService
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+func TestPipelineDownloadsDuringScan(t *testing.T) {
+	// The last scan chunk doesn't return until a body has been fetched
+	var once sync.Once
+	bodyFetched := make(chan struct{})
+	var overlapped atomic.Bool
+	srv := &imaptest.Server{}
+	srv.Hook = func(s *imaptest.Session, cmd *imap.Command) bool {
+		items := fetchItems(cmd)
+		if slices.Contains(items, "BODY.PEEK") {
+			once.Do(func() { close(bodyFetched) })
+		}
+		if items != nil && !slices.Contains(items, "BODY.PEEK") && fmt.Sprint(cmd.Arguments[1]) == "5:6" {
+			select {
+			case <-bodyFetched:
+				overlapped.Store(true)
+			case <-time.After(5 * time.Second):
+			}
+		}
+		return false
+	}
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(6)})
+	cfg.ScanChunkSize = 2
+	cfg.PipelineDepth = 2
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 6 || len(res.Failed) != 0 {
+		t.Fatalf("result: %+v", res)
+	}
+	if !overlapped.Load() {
+		t.Error("no download started before the scan finished")
+	}
+}
+
+func TestPipelineWithDownloadWorkers(t *testing.T) {
+	cfg := testServer(t, nil, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(40)})
+	cfg.ScanChunkSize = 10
+	cfg.PipelineDepth = 5
+	cfg.DownloadWorkers = 3
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 40 || len(res.Failed) != 0 {
+		t.Fatalf("result: %+v", res)
+	}
+	m, err := archiveSvc.LoadManifest(MailboxDir(cfg.BackupDir, "INBOX"), "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Messages) != 40 {
+		t.Errorf("manifest holds %d messages, want 40", len(m.Messages))
+	}
+}
+
+func TestFeedQueueKeepsOrder(t *testing.T) {
+	in := make(chan pendingMessage)
+	out := make(chan pendingMessage, 1)
+	go feedQueue(in, out)
+
+	// The sender never blocks, even with the queue full and nobody reading
+	sent := make(chan struct{})
+	go func() {
+		for uid := uint32(1); uid <= 10; uid++ {
+			in <- pendingMessage{UID: uid}
+		}
+		close(in)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender blocked on a full queue")
+	}
+
+	var got []uint32
+	for m := range out {
+		got = append(got, m.UID)
+	}
+	if want := []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}; !slices.Equal(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+}
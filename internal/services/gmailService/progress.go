@@ -0,0 +1,64 @@
+package gmailService
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// downloadProgress logs a mailbox's download progress at percentage
+// milestones (PROGRESS_PERCENT), so the number of lines stays bounded however
+// large the mailbox is. It is shared by the mailbox's download workers.
+type downloadProgress struct {
+	mu     sync.Mutex
+	log    *logrus.Entry
+	box    string
+	step   int // percent between log lines, 0 disables them
+	total  int // 0 while unknown (pipelined scan still running)
+	done   int
+	logged int // last milestone logged, in percent
+}
+
+func newDownloadProgress(log *logrus.Entry, box string, step, total int) *downloadProgress {
+	return &downloadProgress{log: log, box: box, step: step, total: total}
+}
+
+// setTotal sets the number of messages to download once the scan knows it
+func (p *downloadProgress) setTotal(total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total = total
+	p.logMilestone()
+}
+
+// add counts a handled message
+func (p *downloadProgress) add() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.logMilestone()
+}
+
+// logMilestone logs the highest milestone reached since the last line. The
+// last milestone (100%) is left to finish.
+func (p *downloadProgress) logMilestone() {
+	if p.step <= 0 || p.total <= 0 || p.done >= p.total {
+		return
+	}
+	pct := p.done * 100 / p.total
+	if pct < p.logged+p.step {
+		return
+	}
+	p.logged = pct - pct%p.step
+	p.log.Infof("Downloading %s: %d%% (%d/%d messages)", p.box, p.logged, p.done, p.total)
+}
+
+// finish logs the final line
+func (p *downloadProgress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.step <= 0 || p.total == 0 {
+		return
+	}
+	p.log.Infof("Downloading %s: finished %d/%d messages", p.box, p.done, p.total)
+}
@@ -0,0 +1,58 @@
+package gmailService
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestDownloadProgressBounded(t *testing.T) {
+	const total = 250_000
+	tests := []struct {
+		step, max int
+	}{
+		{0, 0},
+		{1, 100},
+		{5, 20},
+		{25, 4},
+	}
+	for _, tt := range tests {
+		logger, hook := test.NewNullLogger()
+		p := newDownloadProgress(logger.WithField("mailbox", "[Gmail]/All Mail"), "[Gmail]/All Mail", tt.step, total)
+		for range total {
+			p.add()
+		}
+		p.finish()
+
+		lines := len(hook.AllEntries())
+		if lines > tt.max {
+			t.Errorf("step %d%%: %d progress lines, want at most %d", tt.step, lines, tt.max)
+		}
+		if tt.step > 0 && (lines < 2 || hook.LastEntry().Message != "Downloading [Gmail]/All Mail: finished 250000/250000 messages") {
+			t.Errorf("step %d%%: %d lines, last %q", tt.step, lines, hook.LastEntry().Message)
+		}
+	}
+}
+
+func TestDownloadProgressTotalSetLate(t *testing.T) {
+	// A pipelined scan learns the total after downloads started
+	logger, hook := test.NewNullLogger()
+	p := newDownloadProgress(logger.WithField("mailbox", "INBOX"), "INBOX", 10, 0)
+	for range 40 {
+		p.add()
+	}
+	if n := len(hook.AllEntries()); n != 0 {
+		t.Errorf("%d lines logged before the total was known", n)
+	}
+	p.setTotal(100)
+	if last := hook.LastEntry(); last == nil || last.Message != "Downloading INBOX: 40% (40/100 messages)" {
+		t.Errorf("after setTotal: %v", last)
+	}
+	for range 60 {
+		p.add()
+	}
+	p.finish()
+	if n := len(hook.AllEntries()); n != 7 {
+		t.Errorf("%d lines, want milestones 40%% to 90%% and the final line", n)
+	}
+}
@@ -0,0 +1,86 @@
+package gmailService
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+// enableCommand is an ENABLE (RFC 5161), which go-imap doesn't implement
+type enableCommand struct {
+	Caps []string
+}
+
+func (cmd *enableCommand) Command() *imap.Command {
+	args := make([]interface{}, len(cmd.Caps))
+	for i, c := range cmd.Caps {
+		args[i] = imap.RawString(c)
+	}
+	return &imap.Command{Name: "ENABLE", Arguments: args}
+}
+
+// enabledHandler collects the capabilities listed in ENABLED responses
+type enabledHandler struct {
+	Enabled map[string]bool
+}
+
+func (h *enabledHandler) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "ENABLED" {
+		return responses.ErrUnhandled
+	}
+	for _, f := range fields {
+		if s, ok := f.(string); ok {
+			h.Enabled[strings.ToUpper(s)] = true
+		}
+	}
+	return nil
+}
+
+var qresyncConns sync.Map // *client.Client -> struct{}
+
+// enableQResync turns on QRESYNC (RFC 7162) for an authenticated connection
+// when the server advertises it, so flag syncs also learn which stored
+// messages were expunged. Once enabled, the server reports expunges as
+// VANISHED, which MAILBOX_CHANGE_ACTION doesn't see.
+func enableQResync(c *client.Client, cfg config.Config) {
+	if !cfg.SyncFlags || !cfg.QResync {
+		return
+	}
+	if ok, _ := c.Support("QRESYNC"); !ok {
+		return
+	}
+
+	h := &enabledHandler{Enabled: map[string]bool{}}
+	status, err := c.Execute(&enableCommand{Caps: []string{"QRESYNC"}}, h)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		logrus.Warnf("Failed to enable QRESYNC, syncing flags with CONDSTORE only: %v", err)
+		return
+	}
+	if !h.Enabled["QRESYNC"] {
+		logrus.Debug("Server did not enable QRESYNC, syncing flags with CONDSTORE only")
+		return
+	}
+
+	logrus.Debug("QRESYNC enabled")
+	qresyncConns.Store(c, struct{}{})
+	go func() {
+		<-c.LoggedOut()
+		qresyncConns.Delete(c)
+	}()
+}
+
+// qresyncEnabled reports whether enableQResync succeeded on c
+func qresyncEnabled(c *client.Client) bool {
+	_, ok := qresyncConns.Load(c)
+	return ok
+}
@@ -0,0 +1,65 @@
+package gmailService
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// minRequestsPerSecond is the floor throttling backs off to
+const minRequestsPerSecond = 1
+
+// RateLimiter paces fetches across all of a run's workers at
+// REQUESTS_PER_SECOND. When the server reports throttling the rate is halved
+// for the rest of the run.
+type RateLimiter struct {
+	mu  sync.Mutex
+	lim *rate.Limiter
+}
+
+// NewRateLimiter returns a limiter for rps requests per second, or nil
+// (unlimited) if rps <= 0
+func NewRateLimiter(rps float64) *RateLimiter {
+	if rps <= 0 {
+		return nil
+	}
+	return &RateLimiter{lim: rate.NewLimiter(rate.Limit(rps), 1)}
+}
+
+// Wait blocks until the next request may be sent or ctx is cancelled
+func (r *RateLimiter) Wait(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	return r.lim.Wait(ctx)
+}
+
+// observe halves the rate if err is a throttling response
+func (r *RateLimiter) observe(err error) {
+	if r == nil || !isThrottled(err) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur := r.lim.Limit()
+	next := max(cur/2, minRequestsPerSecond)
+	if next < cur {
+		r.lim.SetLimit(next)
+		logrus.Warnf("Server is throttling requests, slowing down to %.1f requests/sec for the rest of the run", float64(next))
+	}
+}
+
+// isThrottled reports whether err is Gmail's response to too many requests
+func isThrottled(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToUpper(err.Error())
+	return strings.Contains(msg, "THROTTLED") ||
+		strings.Contains(msg, "OVERQUOTA") ||
+		strings.Contains(msg, "EXCEEDED COMMAND OR BANDWIDTH LIMITS")
+}
@@ -0,0 +1,84 @@
+package gmailService
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+// reconcileBatch is how many UIDs are checked per targeted FETCH
+const reconcileBatch = 500
+
+// reconcileStored double-checks stored messages the last scan didn't return.
+// A targeted UID FETCH tells a message deleted on the server (marked in the
+// manifest) apart from one the bulk scan missed (kept as is), so nothing
+// downstream mistakes a flaky scan for a deletion.
+func reconcileStored(c *client.Client, mb *openedMailbox, cfg config.Config, res *MailboxResult) {
+	if cfg.MaxScanChunks > 0 {
+		mb.log.Debugf("Skipping reconciliation of %s: scan truncated by MAX_SCAN_CHUNKS", mb.box)
+		return
+	}
+	if mb.partialScan {
+		mb.log.Debugf("Skipping reconciliation of %s: scan limited by SINCE", mb.box)
+		return
+	}
+
+	seen := uidSet(mb.scanned)
+	var unseen []uint32
+	for uid, e := range mb.manifest.Messages {
+		switch {
+		case !seen[uid]:
+			unseen = append(unseen, uid)
+		case e.ServerDeleted && !cfg.DryRun:
+			// Back on the server (or never gone)
+			e.ServerDeleted = false
+			mb.manifest.Messages[uid] = e
+			mb.manifestDirty = true
+		}
+	}
+	if len(unseen) == 0 {
+		return
+	}
+	sort.Slice(unseen, func(i, j int) bool { return unseen[i] < unseen[j] })
+
+	present := map[uint32]bool{}
+	for lo := 0; lo < len(unseen); lo += reconcileBatch {
+		batch := unseen[lo:min(lo+reconcileBatch, len(unseen))]
+		seq := new(imap.SeqSet)
+		seq.AddNum(batch...)
+		err := scanChunk(mb.ctx, c, seq, []imap.FetchItem{imap.FetchUid}, scanChunkTimeout, func(msg *imap.Message) {
+			present[msg.Uid] = true
+		})
+		if err != nil {
+			mb.log.Warnf("Reconciliation of %s failed, leaving stored messages as they are: %v", mb.box, err)
+			return
+		}
+	}
+
+	var missed, deleted int
+	for _, uid := range unseen {
+		if present[uid] {
+			missed++
+			continue
+		}
+		e := mb.manifest.Messages[uid]
+		if e.ServerDeleted {
+			continue
+		}
+		deleted++
+		if !cfg.DryRun {
+			e.ServerDeleted = true
+			mb.manifest.Messages[uid] = e
+			mb.manifestDirty = true
+		}
+	}
+
+	mb.log.Infof("Reconciled %s: %d stored messages not in scan, %d still on server, %d deleted on server", mb.box, len(unseen), missed, deleted)
+	if missed > 0 {
+		res.Issues = append(res.Issues, fmt.Sprintf("%d stored messages were missing from the scan but still exist on the server", missed))
+	}
+}
@@ -0,0 +1,63 @@
+package gmailService
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+func TestReconcileKeepsMessagesTheScanMissed(t *testing.T) {
+	msgs := testMessages(4)
+	box := &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, UidNext: 5, Messages: msgs}
+
+	// Once armed, the bulk scan leaves out UID 2, which is still there
+	var dropUID2 atomic.Bool
+	srv := &imaptest.Server{}
+	srv.Hook = func(s *imaptest.Session, cmd *imap.Command) bool {
+		if !dropUID2.Load() || !slices.Contains(fetchItems(cmd), "RFC822.SIZE") {
+			return false
+		}
+		for i, msg := range []*imaptest.Message{msgs[0], msgs[2]} {
+			s.Printf("* %d FETCH (UID %d RFC822.SIZE %d)", i+1, msg.UID, len(msg.Body))
+		}
+		s.OK(cmd.Tag, "UID FETCH completed")
+		return true
+	}
+	cfg := testServer(t, srv, box)
+	cfg.TrustServer = true
+
+	if res := testProcess(t, cfg, "INBOX"); res.Downloaded != 4 {
+		t.Fatalf("first run: %+v", res)
+	}
+
+	// UID 4 is deleted on the server
+	srv.Do(func() { box.Messages = msgs[:3] })
+	dropUID2.Store(true)
+	if res := testProcess(t, cfg, "INBOX"); res.Error != "" {
+		t.Fatalf("second run: %+v", res)
+	}
+
+	if fetches := uidFetches(srv); !slices.Contains(fetches, "UID FETCH 2,4 (UID)") {
+		t.Errorf("no targeted fetch of UIDs 2 and 4 in %q", fetches)
+	}
+
+	m, err := archiveSvc.LoadManifest(MailboxDir(cfg.BackupDir, "INBOX"), "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for uid, deleted := range map[uint32]bool{1: false, 2: false, 3: false, 4: true} {
+		e, ok := m.Messages[uid]
+		if !ok {
+			t.Errorf("UID %d dropped from the manifest", uid)
+			continue
+		}
+		if e.ServerDeleted != deleted {
+			t.Errorf("UID %d: server_deleted = %t, want %t", uid, e.ServerDeleted, deleted)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package gmailService
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+// ensureConnected checks mb's connection before the next message. If the
+// server dropped it (idle timeout, network blip), a new connection is opened
+// and the mailbox re-selected read-only; it is only resumed if UIDVALIDITY is
+// unchanged, since otherwise the pending UIDs may name different messages.
+// It returns false when the mailbox can't be continued.
+func ensureConnected(cfg config.Config, mb *openedMailbox, res *MailboxResult) bool {
+	select {
+	case <-mb.client.LoggedOut():
+	default:
+		return true
+	}
+
+	if mb.reconnects >= cfg.MaxReconnects {
+		mb.log.Warnf("Connection lost while processing %s, giving up after %d reconnects", mb.box, mb.reconnects)
+		res.Error = fmt.Sprintf("connection lost, gave up after %d reconnects", mb.reconnects)
+		return false
+	}
+	mb.reconnects++
+	mb.log.Warnf("Connection lost while processing %s, reconnecting (%d/%d)", mb.box, mb.reconnects, cfg.MaxReconnects)
+
+	c, status, err := connectSelected(cfg, mb.box)
+	if err != nil {
+		mb.log.Warnf("Reconnect for %s failed: %v", mb.box, err)
+		res.Error = fmt.Sprintf("reconnect failed: %v", err)
+		return false
+	}
+
+	if status.UidValidity != mb.status.UidValidity {
+		issue := fmt.Sprintf("UIDVALIDITY changed during reconnect (%d -> %d), stopped; the next run will pick it up", mb.status.UidValidity, status.UidValidity)
+		mb.log.Warnf("Mailbox %s: %s", mb.box, issue)
+		res.Issues = append(res.Issues, issue)
+		_ = c.Logout()
+		return false
+	}
+
+	if mb.ownsClient {
+		_ = mb.client.Logout()
+	}
+	mb.client, mb.ownsClient = c, true
+	mb.log.Infof("Reconnected and re-selected %s, resuming", mb.box)
+	return true
+}
+
+// connectSelected opens a new connection with box selected read-only
+func connectSelected(cfg config.Config, box string) (*client.Client, *imap.MailboxStatus, error) {
+	c, err := Connect(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	status, _, err := SelectMailbox(c, box)
+	if err != nil {
+		_ = c.Logout()
+		return nil, nil, fmt.Errorf("select: %w", err)
+	}
+	updatesFor(c).Take()
+	return c, status, nil
+}
+
+// close logs out of a connection opened by ensureConnected
+func (m *openedMailbox) close() {
+	if m.ownsClient {
+		_ = m.client.Logout()
+	}
+}
@@ -0,0 +1,74 @@
+package gmailService
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+)
+
+// dropOnFetch returns a server that drops the connection on the first body
+// fetch of uid, calling dropped first
+func dropOnFetch(uid uint32, dropped func()) *imaptest.Server {
+	var done atomic.Bool
+	return &imaptest.Server{Hook: func(s *imaptest.Session, cmd *imap.Command) bool {
+		if !slices.Contains(fetchItems(cmd), "BODY.PEEK") || fmt.Sprint(cmd.Arguments[1]) != fmt.Sprint(uid) || done.Swap(true) {
+			return false
+		}
+		dropped()
+		s.Close()
+		return true
+	}}
+}
+
+// selects returns the EXAMINE and SELECT commands the server received
+func selects(srv *imaptest.Server) int {
+	n := 0
+	for _, cmd := range srv.Commands() {
+		if strings.HasPrefix(cmd, "EXAMINE") || strings.HasPrefix(cmd, "SELECT") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestReconnectResumes(t *testing.T) {
+	srv := dropOnFetch(2, func() {})
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(3)})
+	cfg.FetchBatchSize = 1
+
+	// The message being fetched is left for the next run; the rest are
+	// downloaded over the new connection
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 2 || !slices.Equal(res.Failed, []uint32{2}) {
+		t.Fatalf("result: %+v", res)
+	}
+	if got := selects(srv); got != 2 {
+		t.Errorf("mailbox selected %d times, want again after the reconnect", got)
+	}
+
+	if res := testProcess(t, cfg, "INBOX"); res.Downloaded != 1 || len(res.Failed) != 0 {
+		t.Errorf("next run: %+v", res)
+	}
+}
+
+func TestReconnectUidValidityChanged(t *testing.T) {
+	box := &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(3)}
+	var srv *imaptest.Server
+	srv = dropOnFetch(2, func() { srv.Do(func() { box.UidValidity = 2 }) })
+	cfg := testServer(t, srv, box)
+	cfg.FetchBatchSize = 1
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Downloaded != 1 {
+		t.Errorf("downloaded %d messages, want only the one before the reconnect", res.Downloaded)
+	}
+	if len(res.Issues) == 0 || !strings.Contains(res.Issues[0], "UIDVALIDITY changed") {
+		t.Errorf("issues %q, want the UIDVALIDITY change", res.Issues)
+	}
+}
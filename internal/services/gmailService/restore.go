@@ -0,0 +1,114 @@
+package gmailService
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+// RestoreResult summarizes restoring one archived mailbox
+type RestoreResult struct {
+	Dir      string
+	Target   string
+	Appended int
+	// Existing counts messages skipped because their Message-ID is already in
+	// the target mailbox
+	Existing int
+	// Skipped counts entries holding no full message (TEXT_ONLY) or unreadable
+	Skipped int
+	Failed  int
+}
+
+// RestoreMailbox uploads the messages archived in dir to the target mailbox
+// with APPEND, in UID order, creating the mailbox if needed. Each message
+// keeps its recorded flags and gets its Date header as INTERNALDATE; messages
+// whose Message-ID the target already holds are skipped, so an interrupted
+// restore can be run again. With DRY_RUN, nothing is created or appended.
+func RestoreMailbox(ctx context.Context, c *client.Client, cfg config.Config, dir, target string) (RestoreResult, error) {
+	res := RestoreResult{Dir: dir, Target: target}
+
+	m, err := archiveSvc.LoadManifest(dir, filepath.Base(dir))
+	if err != nil {
+		return res, err
+	}
+
+	existing, err := targetMessageIDs(ctx, c, cfg, target)
+	if err != nil {
+		return res, err
+	}
+
+	res.Skipped, err = archiveSvc.EachStoredMessage(cfg.BackupDir, dir, m, func(uid uint32, e archiveSvc.ManifestEntry, data []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		id := normalizeMessageID(e.MessageID)
+		if id != "" && existing[id] {
+			res.Existing++
+			return nil
+		}
+		if cfg.DryRun {
+			res.Appended++
+			return nil
+		}
+
+		var date time.Time
+		if e.Date != nil {
+			date = *e.Date
+		}
+		flags := slices.DeleteFunc(slices.Clone(e.Flags), func(f string) bool { return f == imap.RecentFlag })
+		if err := c.Append(target, flags, date, bytes.NewBuffer(data)); err != nil {
+			logrus.Warnf("Failed to restore UID %d of %s to %s: %v", uid, dir, target, err)
+			res.Failed++
+			return nil
+		}
+		if id != "" {
+			existing[id] = true
+		}
+		res.Appended++
+		return nil
+	})
+	return res, err
+}
+
+// targetMessageIDs returns the Message-IDs already in the target mailbox,
+// creating it when it doesn't exist
+func targetMessageIDs(ctx context.Context, c *client.Client, cfg config.Config, target string) (map[string]bool, error) {
+	ids := map[string]bool{}
+
+	status, _, err := SelectMailbox(c, target)
+	if err != nil {
+		logrus.Infof("Creating mailbox %s", target)
+		if cfg.DryRun {
+			return ids, nil
+		}
+		return ids, c.Create(target)
+	}
+	if status.Messages == 0 {
+		return ids, nil
+	}
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}
+	scanAll := status.UidNext <= 1
+	for _, seq := range scanChunks(1, status.UidNext, messageIDChunkSize, scanAll) {
+		err := scanChunk(ctx, c, seq, items, scanChunkTimeout, func(msg *imap.Message) {
+			if msg.Envelope != nil {
+				if id := normalizeMessageID(msg.Envelope.MessageId); id != "" {
+					ids[id] = true
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
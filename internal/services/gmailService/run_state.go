@@ -0,0 +1,78 @@
+package gmailService
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	metricsSvc "github.com/redjax/archive-gmail/internal/services/metricsService"
+)
+
+// RunState holds state shared by all mailbox workers during a run
+type RunState struct {
+	Daily     *DailyLimiter
+	Checksums *archiveSvc.Checksums
+
+	// ScanChunkSize is the number of UIDs per scan FETCH
+	ScanChunkSize int
+	// GmailExtensions is set when X-GM-* attributes can be fetched
+	GmailExtensions bool
+	// Writes bounds concurrent message writes; nil means unbounded
+	Writes chan struct{}
+	// Rate paces fetches and scan chunks; nil means unlimited
+	Rate *RateLimiter
+	// Seen indexes stored messages by Message-ID for DEDUP; nil disables it
+	Seen *SeenMessages
+	// Log is the logger of the run, tagged with the account when several are
+	// backed up side by side; nil logs to the standard logger
+	Log *logrus.Entry
+
+	mu         sync.Mutex
+	downloaded uint64
+}
+
+// logger returns the run's logger
+func (r *RunState) logger() *logrus.Entry {
+	if r == nil || r.Log == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return r.Log
+}
+
+// AddDownloaded increments the downloaded message counter
+func (r *RunState) AddDownloaded() {
+	r.mu.Lock()
+	r.downloaded++
+	r.mu.Unlock()
+	metricsSvc.AddDownloaded()
+}
+
+// Downloaded returns the number of messages downloaded so far
+func (r *RunState) Downloaded() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.downloaded
+}
+
+// NewWriteLimit returns a write semaphore for n concurrent writes, or nil if n <= 0
+func NewWriteLimit(n int) chan struct{} {
+	if n <= 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// AcquireWrite blocks until a write slot is free
+func (r *RunState) AcquireWrite() {
+	if r.Writes != nil {
+		r.Writes <- struct{}{}
+	}
+}
+
+// ReleaseWrite frees a slot taken by AcquireWrite
+func (r *RunState) ReleaseWrite() {
+	if r.Writes != nil {
+		<-r.Writes
+	}
+}
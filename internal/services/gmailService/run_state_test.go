@@ -0,0 +1,53 @@
+package gmailService
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteLimitBoundsConcurrency(t *testing.T) {
+	const limit = 3
+	run := &RunState{Writes: NewWriteLimit(limit)}
+
+	var active, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run.AcquireWrite()
+			defer run.ReleaseWrite()
+			n := active.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			active.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got > limit {
+		t.Errorf("%d concurrent writes, limit %d", got, limit)
+	}
+	if got := peak.Load(); got < 2 {
+		t.Errorf("peak of %d concurrent writes, writes were serialized", got)
+	}
+}
+
+func TestWriteLimitUnlimited(t *testing.T) {
+	if NewWriteLimit(0) != nil {
+		t.Fatal("NewWriteLimit(0) is not unlimited")
+	}
+	// Without a limit acquiring never blocks
+	run := &RunState{}
+	for i := 0; i < 100; i++ {
+		run.AcquireWrite()
+	}
+	run.ReleaseWrite()
+}
@@ -0,0 +1,43 @@
+package gmailService
+
+import (
+	"sort"
+)
+
+// SampleUIDs picks the n lowest ("head", oldest) or highest ("tail", newest)
+// UIDs. Any other mode, or n <= 0, returns nil meaning "no sampling".
+func SampleUIDs(uids []uint32, mode string, n int) map[uint32]bool {
+	if n <= 0 || (mode != "head" && mode != "tail") {
+		return nil
+	}
+
+	sorted := append([]uint32(nil), uids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	if n > len(sorted) {
+		n = len(sorted)
+	}
+	if mode == "head" {
+		sorted = sorted[:n]
+	} else {
+		sorted = sorted[len(sorted)-n:]
+	}
+
+	sample := make(map[uint32]bool, n)
+	for _, uid := range sorted {
+		sample[uid] = true
+	}
+	return sample
+}
+
+// filterUIDs returns the UIDs present in keep, preserving order. uids is left
+// unchanged.
+func filterUIDs(uids []uint32, keep map[uint32]bool) []uint32 {
+	out := make([]uint32, 0, len(uids))
+	for _, uid := range uids {
+		if keep[uid] {
+			out = append(out, uid)
+		}
+	}
+	return out
+}
@@ -0,0 +1,48 @@
+package gmailService
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func sampled(sample map[uint32]bool) []uint32 {
+	return slices.Sorted(maps.Keys(sample))
+}
+
+func TestSampleUIDs(t *testing.T) {
+	uids := []uint32{40, 3, 17, 99, 5, 62}
+	tests := []struct {
+		mode string
+		n    int
+		want []uint32
+	}{
+		{"tail", 3, []uint32{40, 62, 99}},
+		{"head", 2, []uint32{3, 5}},
+		{"tail", 10, []uint32{3, 5, 17, 40, 62, 99}},
+	}
+	for _, tt := range tests {
+		if got := sampled(SampleUIDs(uids, tt.mode, tt.n)); !slices.Equal(got, tt.want) {
+			t.Errorf("SampleUIDs(%s, %d) = %v, want %v", tt.mode, tt.n, got, tt.want)
+		}
+	}
+	if !slices.Equal(uids, []uint32{40, 3, 17, 99, 5, 62}) {
+		t.Errorf("input reordered: %v", uids)
+	}
+
+	for _, off := range []struct {
+		mode string
+		n    int
+	}{{"tail", 0}, {"", 5}, {"random", 5}} {
+		if got := SampleUIDs(uids, off.mode, off.n); got != nil {
+			t.Errorf("SampleUIDs(%q, %d) = %v, want no sampling", off.mode, off.n, got)
+		}
+	}
+}
+
+func TestFilterUIDs(t *testing.T) {
+	got := filterUIDs([]uint32{9, 1, 5, 3}, map[uint32]bool{3: true, 9: true})
+	if !slices.Equal(got, []uint32{9, 3}) {
+		t.Errorf("filterUIDs = %v, want [9 3]", got)
+	}
+}
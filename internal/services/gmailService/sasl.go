@@ -0,0 +1,73 @@
+package gmailService
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/emersion/go-imap/client"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+// SASL mechanisms for OAuth2 access tokens
+const (
+	mechXOAuth2     = "XOAUTH2"
+	mechOAuthBearer = "OAUTHBEARER"
+)
+
+// SASLOAuthBearerClient implements go-sasl.Client for the standard
+// OAUTHBEARER mechanism (RFC 7628), for servers that accept OAuth2 tokens but
+// not Google's XOAUTH2
+type SASLOAuthBearerClient struct {
+	Username string
+	Host     string
+	Port     int
+	TokenFn  func() (string, error)
+	stepDone bool
+}
+
+func (c *SASLOAuthBearerClient) Start() (mech string, ir []byte, err error) {
+	token, err := c.TokenFn()
+	if err != nil {
+		return "", nil, err
+	}
+	payload := fmt.Sprintf("n,a=%s,\x01host=%s\x01port=%d\x01auth=Bearer %s\x01\x01", c.Username, c.Host, c.Port, token)
+	return mechOAuthBearer, []byte(payload), nil
+}
+
+// Next answers the error challenge a server sends on failure with the dummy
+// response RFC 7628 requires, so the server completes with its NO
+func (c *SASLOAuthBearerClient) Next(challenge []byte) ([]byte, error) {
+	if c.stepDone {
+		return nil, io.EOF
+	}
+	c.stepDone = true
+	return []byte{0x01}, nil
+}
+
+func (c *SASLOAuthBearerClient) Completed() bool {
+	return c.stepDone
+}
+
+// oauthMechanisms returns the SASL mechanisms to try, in order, for
+// SASL_MECHANISM. auto tries those the server advertises, XOAUTH2 first, and
+// XOAUTH2 alone when it advertises neither.
+func oauthMechanisms(c *client.Client, cfg config.Config) []string {
+	switch cfg.SASLMechanism {
+	case "xoauth2":
+		return []string{mechXOAuth2}
+	case "oauthbearer":
+		return []string{mechOAuthBearer}
+	}
+
+	var mechs []string
+	for _, mech := range []string{mechXOAuth2, mechOAuthBearer} {
+		if ok, _ := c.SupportAuth(mech); ok {
+			mechs = append(mechs, mech)
+		}
+	}
+	if len(mechs) == 0 {
+		mechs = []string{mechXOAuth2}
+	}
+	return mechs
+}
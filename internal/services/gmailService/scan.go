@@ -0,0 +1,326 @@
+package gmailService
+
+import (
+	"context"
+	"maps"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/sirupsen/logrus"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// DefaultScanChunkSize is used when latency can't be measured
+const DefaultScanChunkSize = 1000
+
+// scanChunkTimeout bounds a single chunk's UID FETCH
+const scanChunkTimeout = 90 * time.Second
+
+// MeasureLatency returns the median round trip of a few NOOPs
+func MeasureLatency(c *client.Client, samples int) (time.Duration, error) {
+	rtts := make([]time.Duration, 0, samples)
+	for i := 0; i < samples; i++ {
+		start := time.Now()
+		if err := c.Noop(); err != nil {
+			return 0, err
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	return rtts[len(rtts)/2], nil
+}
+
+// ChunkSizeForLatency picks larger scan chunks for fast links and smaller ones
+// for slow or flaky links, where a big chunk is more likely to time out
+func ChunkSizeForLatency(rtt time.Duration) int {
+	switch {
+	case rtt < 50*time.Millisecond:
+		return 5000
+	case rtt < 150*time.Millisecond:
+		return 2000
+	case rtt < 400*time.Millisecond:
+		return DefaultScanChunkSize
+	default:
+		return 500
+	}
+}
+
+// TuneScanChunkSize returns the configured chunk size, or one derived from the
+// measured latency when override is 0
+func TuneScanChunkSize(c *client.Client, override int) int {
+	if override > 0 {
+		return override
+	}
+
+	rtt, err := MeasureLatency(c, 3)
+	if err != nil {
+		logrus.Warnf("Latency measurement failed, using scan chunk size %d: %v", DefaultScanChunkSize, err)
+		return DefaultScanChunkSize
+	}
+
+	size := ChunkSizeForLatency(rtt)
+	logrus.Infof("Measured server latency %s, using scan chunk size %d", rtt.Round(time.Millisecond), size)
+	return size
+}
+
+// scanChunks splits from..uidNext-1 into UID ranges of at most size. With
+// scanAll (UIDNEXT unknown) a single from:* range is returned.
+func scanChunks(from, uidNext uint32, size int, scanAll bool) []*imap.SeqSet {
+	if scanAll {
+		seq := new(imap.SeqSet)
+		seq.AddRange(from, 0)
+		return []*imap.SeqSet{seq}
+	}
+	if from >= uidNext {
+		return nil
+	}
+	if size <= 0 {
+		seq := new(imap.SeqSet)
+		seq.AddRange(from, uidNext-1)
+		return []*imap.SeqSet{seq}
+	}
+
+	var chunks []*imap.SeqSet
+	for lo := from; lo < uidNext; lo += uint32(size) {
+		hi := lo + uint32(size) - 1
+		if hi >= uidNext {
+			hi = uidNext - 1
+		}
+		seq := new(imap.SeqSet)
+		seq.AddRange(lo, hi)
+		chunks = append(chunks, seq)
+	}
+	return chunks
+}
+
+// sinceUIDs searches the selected mailbox for messages whose INTERNALDATE
+// (when the server received them, not the Date header) is on or after the
+// SINCE cutoff. IMAP SEARCH SINCE compares dates only, in the server's time
+// zone, so the cutoff is rounded down to its day.
+func sinceUIDs(c *client.Client, since string) ([]uint32, error) {
+	cutoff, err := utils.ParseSince(since, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	crit := imap.NewSearchCriteria()
+	crit.Since = cutoff
+	uids, err := c.UidSearch(crit)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, nil
+}
+
+// uidChunks splits a sorted UID list into sets of at most size UIDs
+func uidChunks(uids []uint32, size int) []*imap.SeqSet {
+	if size <= 0 {
+		size = len(uids)
+	}
+	var chunks []*imap.SeqSet
+	for lo := 0; lo < len(uids); lo += size {
+		seq := new(imap.SeqSet)
+		seq.AddNum(uids[lo:min(lo+size, len(uids))]...)
+		chunks = append(chunks, seq)
+	}
+	return chunks
+}
+
+// scanChunk fetches items for a UID range and calls fn for each message. It
+// gives up after timeout or when ctx is cancelled.
+func scanChunk(ctx context.Context, c *client.Client, seq *imap.SeqSet, items []imap.FetchItem, timeout time.Duration, fn func(*imap.Message)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	msgs := make(chan *imap.Message, 1000)
+	done := make(chan error, 1)
+	go func() { done <- c.UidFetch(seq, items, msgs) }()
+
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return <-done
+			}
+			fn(msg)
+		case <-ctx.Done():
+			DrainChannel(msgs, 5*time.Second)
+			return ctx.Err()
+		}
+	}
+}
+
+// scanResult is the outcome of scanning a mailbox's UID range
+type scanResult struct {
+	All     []uint32
+	Missing []uint32
+	Sizes   map[uint32]uint32
+	Threads map[uint32]string
+
+	// Repair lists stored messages whose size doesn't match the server's
+	// (VERIFY); they are also in Missing
+	Repair []uint32
+}
+
+// scanMailbox walks the selected mailbox's UIDs in chunks and collects the ones
+// not yet stored on disk, or every UID when resync is set. If found is not nil
+// it is also called for each missing message as its chunk returns.
+func scanMailbox(c *client.Client, mb *openedMailbox, cfg config.Config, run *RunState, found func(pendingMessage)) scanResult {
+	box := mb.box
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}
+
+	threadLayout := cfg.ThreadLayout && run.GmailExtensions
+	if threadLayout {
+		items = append(items, fetchThreadID)
+	}
+	if run.GmailExtensions {
+		items = append(items, fetchMsgID)
+	}
+
+	res := scanResult{Sizes: make(map[uint32]uint32), Threads: make(map[uint32]string)}
+
+	// Diff against the manifest in memory instead of a stat per UID. Copied
+	// because pipelined downloads add entries during the scan.
+	stored := mb.manifest.StoredUIDs(threadLayout)
+	isStored := func(uid uint32) bool {
+		_, ok := stored[uid]
+		return ok
+	}
+
+	// X-GM-MSGIDs are stable, so they catch UIDs reused for a different
+	// message and messages already stored under another UID. Snapshotted
+	// because pipelined downloads update the manifest during the scan.
+	watermark := mb.manifest.HighestMsgID
+	storedIDs := map[uint32]uint64{}
+	byMsgID := map[uint64]uint32{}
+	if run.GmailExtensions {
+		for uid, e := range mb.manifest.Messages {
+			if e.GmMsgID != 0 {
+				storedIDs[uid] = e.GmMsgID
+				byMsgID[e.GmMsgID] = uid
+			}
+		}
+	}
+	// VERIFY compares stored sizes with RFC822.SIZE to catch truncated files
+	var entries map[uint32]archiveSvc.ManifestEntry
+	if cfg.Verify {
+		entries = maps.Clone(mb.manifest.Messages)
+	}
+	needsRepair := func(uid, size uint32) bool {
+		e, ok := entries[uid]
+		if !ok {
+			return false
+		}
+		stored, ok := storedSize(mb.dir, e)
+		if !ok || sizeMatches(stored, size, cfg.NormalizeEOL) {
+			return false
+		}
+		mb.log.Warnf("UID %d in %s is stored with %d bytes but is %d bytes on the server, downloading again", uid, box, stored, size)
+		return true
+	}
+
+	var reused, known, backfilled int
+	isMissing := func(uid uint32, msgid uint64) bool {
+		if mb.resync {
+			return true
+		}
+		if !isStored(uid) {
+			if other, ok := byMsgID[msgid]; ok && msgid != 0 {
+				mb.log.Debugf("UID %d in %s is already stored as UID %d (X-GM-MSGID %d), skipping", uid, box, other, msgid)
+				known++
+				return false
+			}
+			if msgid != 0 && msgid <= watermark {
+				backfilled++
+			}
+			return true
+		}
+		if have, ok := storedIDs[uid]; ok && msgid != 0 && have != msgid {
+			mb.log.Warnf("UID %d in %s now holds a different message (X-GM-MSGID %d, stored %d), downloading again", uid, box, msgid, have)
+			reused++
+			return true
+		}
+		return false
+	}
+
+	// All Mail holds every message in the account, so it gets smaller chunks,
+	// a longer timeout and periodic progress logs
+	size, timeout := run.ScanChunkSize, scanChunkTimeout
+	allMail := IsAllMail(box)
+	if allMail {
+		size = AllMailChunkSize(cfg.AllMailChunkSize, size)
+		timeout = allMailChunkTimeout
+		mb.log.Infof("Scanning %s as All Mail with chunk size %d", box, size)
+	}
+
+	var chunks []*imap.SeqSet
+	mb.scanGaps = false
+	if cfg.Since != "" {
+		uids, err := sinceUIDs(c, cfg.Since)
+		if err != nil {
+			mb.log.Warnf("SINCE search failed in %s, scanning the full UID range: %v", box, err)
+			chunks = scanChunks(1, mb.status.UidNext, size, mb.scanAll)
+		} else {
+			mb.log.Debugf("SINCE %s matched %d messages in %s", cfg.Since, len(uids), box)
+			chunks = uidChunks(uids, size)
+			mb.partialScan = true
+		}
+	} else if from := incrementalStart(mb, cfg, threadLayout); from > 1 {
+		mb.log.Infof("Scanning %s from UID %d, everything below is stored (UIDNEXT %d)", box, from, mb.status.UidNext)
+		chunks = scanChunks(from, mb.status.UidNext, size, false)
+	} else {
+		chunks = scanChunks(1, mb.status.UidNext, size, mb.scanAll)
+	}
+	if cfg.MaxScanChunks > 0 && len(chunks) > cfg.MaxScanChunks {
+		mb.log.Warnf("Scan of %s truncated to the first %d of %d chunks (MAX_SCAN_CHUNKS)", box, cfg.MaxScanChunks, len(chunks))
+		chunks = chunks[:cfg.MaxScanChunks]
+		mb.scanGaps = true
+	}
+	for i, seq := range chunks {
+		if run.Rate.Wait(mb.ctx) != nil {
+			mb.log.Infof("Scan of %s interrupted after %d/%d chunks", box, i, len(chunks))
+			mb.scanGaps = true
+			break
+		}
+		err := scanChunk(mb.ctx, c, seq, items, timeout, func(msg *imap.Message) {
+			res.All = append(res.All, msg.Uid)
+			thrid := ""
+			if threadLayout {
+				thrid = threadID(msg)
+			}
+			missing := isMissing(msg.Uid, gmMsgID(msg))
+			repair := !missing && needsRepair(msg.Uid, msg.Size)
+			if missing || repair {
+				res.Missing = append(res.Missing, msg.Uid)
+				res.Sizes[msg.Uid] = msg.Size
+				res.Threads[msg.Uid] = thrid
+				if repair {
+					res.Repair = append(res.Repair, msg.Uid)
+				}
+				if found != nil {
+					found(pendingMessage{UID: msg.Uid, Size: msg.Size, Thread: thrid, Repair: repair})
+				}
+			}
+		})
+		if err != nil {
+			mb.log.Warnf("Scan of %s chunk %d/%d (%s) failed: %v", box, i+1, len(chunks), seq, err)
+			mb.scanGaps = true
+		}
+		if allMail && (i+1)%allMailProgressEvery == 0 {
+			mb.log.Infof("Scanning %s: %d/%d chunks, %d messages seen, %d to download", box, i+1, len(chunks), len(res.All), len(res.Missing))
+		}
+	}
+
+	if len(res.Repair) > 0 {
+		mb.log.Warnf("Scan of %s: %d stored messages failed the size check and will be downloaded again", box, len(res.Repair))
+	}
+	if reused+known+backfilled > 0 {
+		mb.log.Infof("Scan of %s: %d reused UIDs, %d messages already stored under another UID, %d older messages newly in this mailbox (X-GM-MSGID watermark %d)", box, reused, known, backfilled, watermark)
+	}
+	return res
+}
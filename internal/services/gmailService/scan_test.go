@@ -0,0 +1,187 @@
+package gmailService
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+func TestScanChunks(t *testing.T) {
+	tests := []struct {
+		from, uidNext uint32
+		size          int
+		scanAll       bool
+		want          []string
+	}{
+		{1, 1, 100, false, nil},
+		{1, 0, 100, false, nil},
+		{5, 5, 100, false, nil},
+		{1, 11, 0, false, []string{"1:10"}},
+		{1, 11, 4, false, []string{"1:4", "5:8", "9:10"}},
+		{3, 7, 10, false, []string{"3:6"}},
+		{1, 1, 100, true, []string{"1:*"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, seq := range scanChunks(tt.from, tt.uidNext, tt.size, tt.scanAll) {
+			got = append(got, seq.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("scanChunks(%d, %d, %d, %v) = %v, want %v", tt.from, tt.uidNext, tt.size, tt.scanAll, got, tt.want)
+		}
+	}
+}
+
+// uidFetches returns the UID FETCH commands the server received
+func uidFetches(srv *imaptest.Server) []string {
+	var fetches []string
+	for _, cmd := range srv.Commands() {
+		if strings.HasPrefix(cmd, "UID FETCH") {
+			fetches = append(fetches, cmd)
+		}
+	}
+	return fetches
+}
+
+// isScanFetch reports whether items, the items of a UID FETCH, are the ones
+// of a mailbox scan
+func isScanFetch(items string) bool {
+	return !strings.Contains(items, "BODY") && !strings.Contains(items, "ENVELOPE")
+}
+
+// scanFetches returns the scan UID FETCHes the server received
+func scanFetches(srv *imaptest.Server) int {
+	n := 0
+	for _, cmd := range uidFetches(srv) {
+		if isScanFetch(cmd) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLowUidNextIsEmpty(t *testing.T) {
+	srv := &imaptest.Server{}
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, UidNext: 1, Messages: testMessages(2)})
+
+	res := testProcess(t, cfg, "INBOX")
+	if !res.Empty || res.Error != "" || res.Downloaded != 0 {
+		t.Errorf("result: %+v", res)
+	}
+	if fetches := uidFetches(srv); len(fetches) != 0 {
+		t.Errorf("UIDNEXT 1 mailbox was fetched: %v", fetches)
+	}
+}
+
+func TestLowUidNextScan(t *testing.T) {
+	srv := &imaptest.Server{}
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, UidNext: 1, Messages: testMessages(2)})
+	cfg.LowUidNext = "scan"
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Empty || res.Error != "" || res.Downloaded != 2 {
+		t.Errorf("result: %+v", res)
+	}
+	if fetches := uidFetches(srv); len(fetches) == 0 || !strings.HasPrefix(fetches[0], "UID FETCH 1:*") {
+		t.Errorf("expected a 1:* scan, got %v", fetches)
+	}
+}
+
+func TestChunkSizeForLatency(t *testing.T) {
+	prev := ChunkSizeForLatency(0)
+	for _, rtt := range []time.Duration{10 * time.Millisecond, 80 * time.Millisecond, 200 * time.Millisecond, time.Second, 5 * time.Second} {
+		size := ChunkSizeForLatency(rtt)
+		if size > prev {
+			t.Errorf("latency %s gives a larger chunk (%d) than a faster link (%d)", rtt, size, prev)
+		}
+		prev = size
+	}
+	if fast, slow := ChunkSizeForLatency(10*time.Millisecond), ChunkSizeForLatency(time.Second); fast <= slow {
+		t.Errorf("fast link chunk %d, slow link chunk %d", fast, slow)
+	}
+}
+
+func TestTuneScanChunkSize(t *testing.T) {
+	// NOOPs take 60ms
+	srv := &imaptest.Server{Hook: func(s *imaptest.Session, cmd *imap.Command) bool {
+		if cmd.Name == "NOOP" {
+			time.Sleep(60 * time.Millisecond)
+		}
+		return false
+	}}
+	cfg := testServer(t, srv)
+	c, err := Connect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout()
+
+	if got := TuneScanChunkSize(c, 300); got != 300 {
+		t.Errorf("override: %d", got)
+	}
+	if got, want := TuneScanChunkSize(c, 0), ChunkSizeForLatency(60*time.Millisecond); got != want {
+		t.Errorf("measured: %d, want %d", got, want)
+	}
+}
+
+func TestMaxScanChunksTruncates(t *testing.T) {
+	srv := &imaptest.Server{}
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(6)})
+	cfg.ScanChunkSize = 2
+	cfg.MaxScanChunks = 2
+
+	c, run := testConnect(t, cfg)
+	mb := openMailbox(context.Background(), c, "INBOX", cfg, run.logger(), &MailboxResult{})
+	if mb == nil {
+		t.Fatal("INBOX not opened")
+	}
+	res := scanMailbox(c, mb, cfg, run, nil)
+
+	if got := scanFetches(srv); got != 2 {
+		t.Errorf("%d scan fetches, want 2", got)
+	}
+	if !slices.Equal(res.Missing, []uint32{1, 2, 3, 4}) {
+		t.Errorf("missing %v, want UIDs of the first 2 chunks", res.Missing)
+	}
+	if !mb.scanGaps {
+		t.Error("truncated scan did not set scanGaps")
+	}
+}
+
+func TestScanUsesManifestNotFiles(t *testing.T) {
+	cfg := testServer(t, nil, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(5)})
+
+	// The manifest lists UIDs 1 to 3 whose files don't exist: only a scan that
+	// reads the directory would find them missing
+	dir := MailboxDir(cfg.BackupDir, "INBOX")
+	m := archiveSvc.NewManifest("INBOX")
+	m.UidValidity = 1
+	for uid := uint32(1); uid <= 3; uid++ {
+		m.Messages[uid] = archiveSvc.ManifestEntry{File: fmt.Sprintf("%d%s", uid, archiveSvc.MessageExt)}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	c, run := testConnect(t, cfg)
+	mb := openMailbox(context.Background(), c, "INBOX", cfg, run.logger(), &MailboxResult{})
+	if mb == nil {
+		t.Fatal("INBOX not opened")
+	}
+	res := scanMailbox(c, mb, cfg, run, nil)
+	if !slices.Equal(res.Missing, []uint32{4, 5}) {
+		t.Errorf("missing %v, want [4 5]", res.Missing)
+	}
+}
@@ -0,0 +1,56 @@
+package gmailService
+
+import (
+	"github.com/emersion/go-imap"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+// anyHeader builds criteria matching if the header contains any of the values
+func anyHeader(header string, values []string) *imap.SearchCriteria {
+	var crit *imap.SearchCriteria
+	for _, v := range values {
+		c := imap.NewSearchCriteria()
+		c.Header.Add(header, v)
+		if crit == nil {
+			crit = c
+			continue
+		}
+		or := imap.NewSearchCriteria()
+		or.Or = [][2]*imap.SearchCriteria{{crit, c}}
+		crit = or
+	}
+	return crit
+}
+
+// BuildSearchCriteria translates the message filters in cfg into a server-side
+// search. Returns nil when no filter is configured.
+//
+// FROM_FILTER and TO_FILTER are a correspondent allowlist: a message matches
+// when its From contains any FROM_FILTER entry OR its To contains any
+// TO_FILTER entry. Entries are substring matches, so a bare domain works.
+func BuildSearchCriteria(cfg config.Config) *imap.SearchCriteria {
+	from := anyHeader("From", cfg.FromFilter)
+	to := anyHeader("To", cfg.ToFilter)
+
+	switch {
+	case from != nil && to != nil:
+		crit := imap.NewSearchCriteria()
+		crit.Or = [][2]*imap.SearchCriteria{{from, to}}
+		return crit
+	case from != nil:
+		return from
+	case to != nil:
+		return to
+	}
+	return nil
+}
+
+// uidSet converts a UID slice to a lookup set
+func uidSet(uids []uint32) map[uint32]bool {
+	set := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		set[uid] = true
+	}
+	return set
+}
@@ -0,0 +1,103 @@
+package gmailService
+
+import (
+	"fmt"
+	"net/mail"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	"github.com/redjax/archive-gmail/internal/imaptest"
+)
+
+func TestBuildSearchCriteria(t *testing.T) {
+	if crit := BuildSearchCriteria(config.Config{}); crit != nil {
+		t.Errorf("no filters: %v", crit.Format())
+	}
+
+	crit := BuildSearchCriteria(config.Config{FromFilter: []string{"alice@example.com", "corp.example"}, ToFilter: []string{"me@example.com"}})
+	got := fmt.Sprint(crit.Format())
+	for _, want := range []string{"FROM alice@example.com", "FROM corp.example", "TO me@example.com"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("criteria %s lack %q", got, want)
+		}
+	}
+	if strings.Count(got, "OR") != 2 {
+		t.Errorf("criteria %s should OR the three entries", got)
+	}
+}
+
+// headerSearch answers UID SEARCH on the selected mailbox with the messages
+// whose header contains any FROM, TO or HEADER value of the criteria
+func headerSearch(s *imaptest.Session, cmd *imap.Command) bool {
+	if cmd.Name != "UID" || !strings.EqualFold(fmt.Sprint(cmd.Arguments[0]), "SEARCH") {
+		return false
+	}
+	var terms [][2]string
+	var walk func(args []any)
+	walk = func(args []any) {
+		for i := 0; i < len(args); i++ {
+			if list, ok := args[i].([]any); ok {
+				walk(list)
+				continue
+			}
+			switch key := strings.ToUpper(fmt.Sprint(args[i])); {
+			case (key == "FROM" || key == "TO") && i+1 < len(args):
+				terms = append(terms, [2]string{key, fmt.Sprint(args[i+1])})
+				i++
+			case key == "HEADER" && i+2 < len(args):
+				terms = append(terms, [2]string{fmt.Sprint(args[i+1]), fmt.Sprint(args[i+2])})
+				i += 2
+			}
+		}
+	}
+	walk(cmd.Arguments[1:])
+
+	var uids []string
+	s.Server().Do(func() {
+		for _, msg := range s.Selected().Messages {
+			m, err := mail.ReadMessage(strings.NewReader(string(msg.Body)))
+			if err != nil {
+				continue
+			}
+			for _, term := range terms {
+				if strings.Contains(m.Header.Get(term[0]), term[1]) {
+					uids = append(uids, fmt.Sprint(msg.UID))
+					break
+				}
+			}
+		}
+	})
+	s.Printf("* SEARCH %s", strings.Join(uids, " "))
+	s.OK(cmd.Tag, "SEARCH completed")
+	return true
+}
+
+func TestFromFilterKeepsAllowlistedSenders(t *testing.T) {
+	from := []string{"alice@example.com", "Bob <bob@corp.example>", "spam@junk.example", "carol@example.com"}
+	msgs := make([]*imaptest.Message, len(from))
+	for i, f := range from {
+		msgs[i] = &imaptest.Message{UID: uint32(i + 1), Body: []byte(fmt.Sprintf("From: %s\r\nTo: me@example.com\r\nSubject: %d\r\n\r\nbody\r\n", f, i+1))}
+	}
+	srv := &imaptest.Server{Hook: headerSearch}
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: msgs})
+	cfg.FromFilter = []string{"alice@example.com", "corp.example"}
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 2 {
+		t.Fatalf("result: %+v", res)
+	}
+	stored, _ := filepath.Glob(filepath.Join(MailboxDir(cfg.BackupDir, "INBOX"), "*.eml"))
+	var names []string
+	for _, p := range stored {
+		names = append(names, filepath.Base(p))
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"1.eml", "2.eml"}) {
+		t.Errorf("stored %v, want 1.eml and 2.eml", names)
+	}
+}
@@ -0,0 +1,147 @@
+package gmailService
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// StatusFile is the per-mailbox SELECT snapshot written with WRITE_STATUS
+const StatusFile = "status.json"
+
+// examineCommand is a read-only SELECT that can request CONDSTORE (RFC 7162)
+type examineCommand struct {
+	Mailbox   string
+	CondStore bool
+}
+
+func (cmd *examineCommand) Command() *imap.Command {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+	args := []interface{}{imap.FormatMailboxName(mailbox)}
+	if cmd.CondStore {
+		args = append(args, []interface{}{imap.RawString("CONDSTORE")})
+	}
+	return &imap.Command{Name: "EXAMINE", Arguments: args}
+}
+
+// selectHandler extends go-imap's SELECT handler with HIGHESTMODSEQ, which the
+// library leaves unparsed, and with EXISTS and RECENT, which it only applies
+// to the client's currently selected mailbox
+type selectHandler struct {
+	responses.Select
+	HighestModSeq uint64
+}
+
+func (h *selectHandler) Handle(resp imap.Resp) error {
+	if name, fields, ok := imap.ParseNamedResp(resp); ok && (name == "EXISTS" || name == "RECENT") && len(fields) > 0 {
+		n, err := imap.ParseNumber(fields[0])
+		if err != nil {
+			return err
+		}
+		if name == "EXISTS" {
+			h.Mailbox.Messages = n
+		} else {
+			h.Mailbox.Recent = n
+		}
+		return nil
+	}
+	if st, ok := resp.(*imap.StatusResp); ok && st.Code == "HIGHESTMODSEQ" && len(st.Arguments) > 0 {
+		if n, err := strconv.ParseUint(fmt.Sprint(st.Arguments[0]), 10, 64); err == nil {
+			h.HighestModSeq = n
+		}
+		return nil
+	}
+	return h.Select.Handle(resp)
+}
+
+// SelectMailbox opens a mailbox read-only and returns its status along with the
+// HIGHESTMODSEQ when the server supports CONDSTORE (0 otherwise)
+func SelectMailbox(c *client.Client, box string) (*imap.MailboxStatus, uint64, error) {
+	condstore, _ := c.Support("CONDSTORE")
+
+	mbox := &imap.MailboxStatus{Name: box, Items: make(map[imap.StatusItem]interface{})}
+	h := &selectHandler{Select: responses.Select{Mailbox: mbox}}
+
+	status, err := c.Execute(&examineCommand{Mailbox: box, CondStore: condstore}, h)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Keep the response code, which status.Err() drops, for
+	// IsTransientSelectError
+	if status.Type == imap.StatusRespNo || status.Type == imap.StatusRespBad {
+		return nil, 0, &imap.ErrStatusResp{Resp: status}
+	}
+
+	mbox.ReadOnly = true
+	c.SetState(imap.SelectedState, mbox)
+	return mbox, h.HighestModSeq, nil
+}
+
+// transientCodes are response codes meaning the mailbox is temporarily
+// unavailable (maintenance, locked by another session) rather than gone
+var transientCodes = map[imap.StatusRespCode]bool{
+	"UNAVAILABLE": true, // RFC 5530
+	"INUSE":       true, // RFC 5530
+}
+
+// IsTransientSelectError reports whether a SELECT failure is likely to clear
+// up later in the run
+func IsTransientSelectError(err error) bool {
+	var statusErr *imap.ErrStatusResp
+	if errors.As(err, &statusErr) && statusErr.Resp != nil {
+		return transientCodes[statusErr.Resp.Code]
+	}
+	return false
+}
+
+// MailboxSnapshot is the server's view of a mailbox at archive time
+type MailboxSnapshot struct {
+	Mailbox       string    `json:"mailbox"`
+	Taken         time.Time `json:"taken"`
+	Messages      uint32    `json:"messages"`
+	Recent        uint32    `json:"recent"`
+	Unseen        uint32    `json:"unseen"`
+	UidNext       uint32    `json:"uid_next"`
+	UidValidity   uint32    `json:"uid_validity"`
+	HighestModSeq uint64    `json:"highest_modseq,omitempty"`
+}
+
+// unseenCount asks the server how many messages are unseen. SELECT only
+// reports the first unseen sequence number, so this needs a STATUS call.
+func unseenCount(c *client.Client, box string) uint32 {
+	st, err := c.Status(box, []imap.StatusItem{imap.StatusUnseen})
+	if err != nil {
+		return 0
+	}
+	return st.Unseen
+}
+
+// writeStatusSnapshot writes <box>/status.json
+func writeStatusSnapshot(dir string, status *imap.MailboxStatus, unseen uint32, modseq uint64) error {
+	snap := MailboxSnapshot{
+		Mailbox:       status.Name,
+		Taken:         time.Now(),
+		Messages:      status.Messages,
+		Recent:        status.Recent,
+		Unseen:        unseen,
+		UidNext:       status.UidNext,
+		UidValidity:   status.UidValidity,
+		HighestModSeq: modseq,
+	}
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filepath.Join(dir, StatusFile), data, 0644)
+}
@@ -0,0 +1,99 @@
+package gmailService
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+)
+
+func readStatusSnapshot(t *testing.T, dir string) MailboxSnapshot {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, StatusFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap MailboxSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	return snap
+}
+
+func TestWriteStatusSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	status := &imap.MailboxStatus{Name: "INBOX", Messages: 12, Recent: 2, UidNext: 40, UidValidity: 7}
+	before := time.Now()
+	if err := writeStatusSnapshot(dir, status, 5, 991); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := readStatusSnapshot(t, dir)
+	if snap.Taken.Before(before.Add(-time.Second)) {
+		t.Errorf("taken %s, before the snapshot was written", snap.Taken)
+	}
+	snap.Taken = time.Time{}
+	want := MailboxSnapshot{Mailbox: "INBOX", Messages: 12, Recent: 2, Unseen: 5, UidNext: 40, UidValidity: 7, HighestModSeq: 991}
+	if snap != want {
+		t.Errorf("snapshot %+v, want %+v", snap, want)
+	}
+}
+
+func TestWriteStatusDuringBackup(t *testing.T) {
+	msgs := testMessages(3)
+	msgs[0].Flags = []string{imap.SeenFlag}
+	srv := &imaptest.Server{Caps: []string{"CONDSTORE"}}
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 9, HighestModSeq: 77, Messages: msgs})
+	cfg.WriteStatus = true
+
+	if res := testProcess(t, cfg, "INBOX"); res.Error != "" || res.Downloaded != 3 {
+		t.Fatalf("result: %+v", res)
+	}
+	snap := readStatusSnapshot(t, MailboxDir(cfg.BackupDir, "INBOX"))
+	snap.Taken = time.Time{}
+	want := MailboxSnapshot{Mailbox: "INBOX", Messages: 3, Unseen: 2, UidNext: 4, UidValidity: 9, HighestModSeq: 77}
+	if snap != want {
+		t.Errorf("snapshot %+v, want %+v", snap, want)
+	}
+}
+
+func TestIsTransientSelectError(t *testing.T) {
+	srv := &imaptest.Server{Hook: func(s *imaptest.Session, cmd *imap.Command) bool {
+		if cmd.Name != "SELECT" && cmd.Name != "EXAMINE" {
+			return false
+		}
+		switch box := fmt.Sprint(cmd.Arguments[0]); box {
+		case "Busy":
+			s.NO(cmd.Tag, "[UNAVAILABLE] Mailbox is being migrated")
+		case "InUse":
+			s.NO(cmd.Tag, "[INUSE] Mailbox in use")
+		case "Gone":
+			s.NO(cmd.Tag, "[NONEXISTENT] No such mailbox")
+		default:
+			s.NO(cmd.Tag, "Invalid mailbox")
+		}
+		return true
+	}}
+	cfg := testServer(t, srv)
+	c, _ := testConnect(t, cfg)
+
+	for box, transient := range map[string]bool{"Busy": true, "InUse": true, "Gone": false, "Other": false} {
+		_, _, err := SelectMailbox(c, box)
+		if err == nil {
+			t.Fatalf("SELECT %s succeeded", box)
+		}
+		if got := IsTransientSelectError(err); got != transient {
+			t.Errorf("%s: IsTransientSelectError(%v) = %v, want %v", box, err, got, transient)
+		}
+	}
+	if IsTransientSelectError(errors.New("connection reset")) {
+		t.Error("plain error reported as transient")
+	}
+}
@@ -0,0 +1,81 @@
+package gmailService
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/sirupsen/logrus"
+
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+// SpotCheck compares up to n randomly chosen stored messages per mailbox with
+// the server, by Message-ID, to catch files stored under the wrong UID.
+// Messages deleted on the server since they were stored are not a problem.
+func SpotCheck(c *client.Client, backupDir string, n int) ([]archiveSvc.VerifyProblem, error) {
+	dirs, err := os.ReadDir(backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []archiveSvc.VerifyProblem
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") || d.Name() == archiveSvc.RunLogsDir {
+			continue
+		}
+		dir := filepath.Join(backupDir, d.Name())
+		m, err := archiveSvc.LoadManifest(dir, "")
+		if err != nil {
+			return problems, fmt.Errorf("reading manifest of %s: %w", d.Name(), err)
+		}
+		if m.Mailbox == "" || len(m.Messages) == 0 {
+			continue
+		}
+
+		var uids []uint32
+		for uid, e := range m.Messages {
+			if e.MessageID != "" && !e.ServerDeleted && !strings.HasSuffix(e.File, archiveSvc.MboxExt) {
+				uids = append(uids, uid)
+			}
+		}
+		if len(uids) == 0 {
+			continue
+		}
+
+		status, _, err := SelectMailbox(c, m.Mailbox)
+		if err != nil {
+			logrus.Warnf("Spot check: skipping %s, select failed: %v", m.Mailbox, err)
+			continue
+		}
+		if status.UidValidity != m.UidValidity {
+			logrus.Warnf("Spot check: skipping %s, UIDVALIDITY changed since it was stored", m.Mailbox)
+			continue
+		}
+
+		rand.Shuffle(len(uids), func(i, j int) { uids[i], uids[j] = uids[j], uids[i] })
+		for _, uid := range uids[:min(n, len(uids))] {
+			env, err := fetchEnvelope(c, uid)
+			if err != nil {
+				logrus.Debugf("Spot check: UID %d in %s not fetched: %v", uid, m.Mailbox, err)
+				continue
+			}
+			e := m.Messages[uid]
+			if trimMessageID(env.MessageId) != trimMessageID(e.MessageID) {
+				path := filepath.ToSlash(filepath.Join(d.Name(), e.File))
+				problems = append(problems, archiveSvc.VerifyProblem{
+					Path:   path,
+					Reason: fmt.Sprintf("UID %d on the server is %s, stored copy is %s", uid, env.MessageId, e.MessageID),
+				})
+			}
+		}
+	}
+	return problems, nil
+}
+
+func trimMessageID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
@@ -0,0 +1,78 @@
+package gmailService
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// SkippedStub records a message that exists on the server but was not archived
+type SkippedStub struct {
+	UID       uint32    `json:"uid"`
+	Mailbox   string    `json:"mailbox"`
+	Size      uint32    `json:"size"`
+	Limit     int64     `json:"limit"`
+	Reason    string    `json:"reason"`
+	MessageID string    `json:"message_id,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	From      []string  `json:"from,omitempty"`
+	To        []string  `json:"to,omitempty"`
+	Date      time.Time `json:"date,omitempty"`
+}
+
+// StubPath returns the path for a skipped-message stub
+func StubPath(base, box string, uid uint64) string {
+	return filepath.Join(MailboxDir(base, box), fmt.Sprintf("%d.skipped", uid))
+}
+
+// fetchEnvelope fetches just the envelope of a single message
+func fetchEnvelope(c *client.Client, uid uint32) (*imap.Envelope, error) {
+	msg, err := fetchOne(context.Background(), c, uid, []imap.FetchItem{imap.FetchEnvelope})
+	if err != nil {
+		return nil, err
+	}
+	if msg.Envelope == nil {
+		return nil, fmt.Errorf("no envelope returned for UID %d", uid)
+	}
+	return msg.Envelope, nil
+}
+
+func formatAddresses(addrs []*imap.Address) []string {
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, a.Address())
+	}
+	return out
+}
+
+// writeSkippedStub writes a small JSON stub describing an oversized message
+func writeSkippedStub(c *client.Client, path, box string, uid, size uint32, limit int64) error {
+	stub := SkippedStub{
+		UID:     uid,
+		Mailbox: box,
+		Size:    size,
+		Limit:   limit,
+		Reason:  "message exceeds MAX_MESSAGE_SIZE",
+	}
+
+	// The stub is still useful without an envelope, so a failed fetch is not fatal
+	if env, err := fetchEnvelope(c, uid); err == nil {
+		stub.MessageID = env.MessageId
+		stub.Subject = env.Subject
+		stub.From = formatAddresses(env.From)
+		stub.To = formatAddresses(env.To)
+		stub.Date = env.Date
+	}
+
+	data, err := json.MarshalIndent(stub, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
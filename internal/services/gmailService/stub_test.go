@@ -0,0 +1,57 @@
+package gmailService
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+)
+
+func TestOversizedMessageStub(t *testing.T) {
+	big := &imaptest.Message{
+		UID: 2,
+		Body: []byte("Message-ID: <big@example.com>\r\nDate: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+			"From: Alice <alice@example.com>\r\nSubject: holiday photos\r\n\r\n" + strings.Repeat("x", 500) + "\r\n"),
+	}
+	msgs := append(testMessages(1), big)
+	cfg := testServer(t, nil, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: msgs})
+	cfg.MaxMessageSize = 200
+	cfg.StubSkipped = true
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 1 || res.Skipped != 1 {
+		t.Fatalf("result: %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(MailboxDir(cfg.BackupDir, "INBOX"), "2.eml")); !os.IsNotExist(err) {
+		t.Errorf("oversized message was stored: %v", err)
+	}
+
+	data, err := os.ReadFile(StubPath(cfg.BackupDir, "INBOX", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stub SkippedStub
+	if err := json.Unmarshal(data, &stub); err != nil {
+		t.Fatal(err)
+	}
+	want := SkippedStub{
+		UID:       2,
+		Mailbox:   "INBOX",
+		Size:      uint32(len(big.Body)),
+		Limit:     200,
+		Reason:    "message exceeds MAX_MESSAGE_SIZE",
+		MessageID: "<big@example.com>",
+		Subject:   "holiday photos",
+		From:      []string{"alice@example.com"},
+		Date:      time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+	}
+	if stub.UID != want.UID || stub.Mailbox != want.Mailbox || stub.Size != want.Size || stub.Limit != want.Limit ||
+		stub.Reason != want.Reason || stub.MessageID != want.MessageID || stub.Subject != want.Subject ||
+		len(stub.From) != 1 || stub.From[0] != want.From[0] || !stub.Date.Equal(want.Date) {
+		t.Errorf("stub %+v, want %+v", stub, want)
+	}
+}
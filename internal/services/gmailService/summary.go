@@ -0,0 +1,194 @@
+package gmailService
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// MailboxTimings records how long each phase of a mailbox took
+type MailboxTimings struct {
+	Select   time.Duration `json:"select"`
+	Scan     time.Duration `json:"scan"`
+	Download time.Duration `json:"download"`
+	Write    time.Duration `json:"write"`
+}
+
+// MailboxResult is the outcome of processing a single mailbox
+type MailboxResult struct {
+	Name         string         `json:"name"`
+	Downloaded   int            `json:"downloaded"`
+	Skipped      int            `json:"skipped"`
+	Deduplicated int            `json:"deduplicated,omitempty"` // stored as a reference to a copy in another mailbox (DEDUP)
+	Repaired     int            `json:"repaired,omitempty"`     // truncated copies downloaded again (VERIFY)
+	Empty        bool           `json:"empty,omitempty"`
+	Paused       bool           `json:"paused,omitempty"`
+	Interrupted  bool           `json:"interrupted,omitempty"` // stopped by a shutdown signal
+	Deferred     bool           `json:"deferred,omitempty"`    // temporarily unavailable, retried at the end of the run
+	Error        string         `json:"error,omitempty"`
+	Timings      MailboxTimings `json:"timings"`
+
+	// Pending and PendingBytes count messages not yet downloaded (estimate only)
+	Pending      int   `json:"pending,omitempty"`
+	PendingBytes int64 `json:"pending_bytes,omitempty"`
+
+	// Failed lists UIDs whose fetch still failed after FETCH_RETRIES attempts;
+	// they are retried by the next run
+	Failed []uint32 `json:"failed,omitempty"`
+	// FailedIDs lists the Gmail message IDs that failed with BACKEND=api,
+	// which has no UIDs for them
+	FailedIDs []string `json:"failed_ids,omitempty"`
+
+	// Issues are notable events (conflicts, renumbering) to surface in reports
+	Issues []string `json:"issues,omitempty"`
+}
+
+// add merges the result of another worker on the same mailbox into r
+func (r *MailboxResult) add(o MailboxResult) {
+	r.Downloaded += o.Downloaded
+	r.Skipped += o.Skipped
+	r.Deduplicated += o.Deduplicated
+	r.Repaired += o.Repaired
+	r.Paused = r.Paused || o.Paused
+	r.Interrupted = r.Interrupted || o.Interrupted
+	r.Timings.Download += o.Timings.Download
+	r.Timings.Write += o.Timings.Write
+	r.Failed = append(r.Failed, o.Failed...)
+	r.FailedIDs = append(r.FailedIDs, o.FailedIDs...)
+	r.Issues = append(r.Issues, o.Issues...)
+	if r.Error == "" {
+		r.Error = o.Error
+	}
+}
+
+// RunSummary aggregates the results of a backup run
+type RunSummary struct {
+	Started    time.Time       `json:"started"`
+	Elapsed    time.Duration   `json:"elapsed"`
+	Downloaded uint64          `json:"downloaded"`
+	Mailboxes  []MailboxResult `json:"mailboxes"`
+
+	// Deferred lists mailboxes that were temporarily unavailable on the first
+	// pass and retried at the end of the run
+	Deferred []string `json:"deferred,omitempty"`
+
+	// Interrupted is set when a shutdown signal stopped the run early
+	Interrupted bool `json:"interrupted,omitempty"`
+
+	DailyLimitReached bool      `json:"daily_limit_reached,omitempty"`
+	ResumeAt          time.Time `json:"resume_at,omitempty"`
+
+	// Verified is set when RUN_MODE=archive+verify ran its verification
+	// phase; VerifyProblems lists what it found
+	Verified       bool     `json:"verified,omitempty"`
+	VerifyProblems []string `json:"verify_problems,omitempty"`
+
+	// Alerts are [ALERT] responses from the server, shown verbatim
+	Alerts []string `json:"alerts,omitempty"`
+}
+
+// FailedMailboxes returns the mailboxes that failed outright, as opposed to
+// ones with individual messages left for the next run. Mailboxes still
+// deferred as temporarily unavailable don't count.
+func (s *RunSummary) FailedMailboxes() []MailboxResult {
+	var failed []MailboxResult
+	for _, m := range s.Mailboxes {
+		if m.Error != "" && !m.Deferred {
+			failed = append(failed, m)
+		}
+	}
+	return failed
+}
+
+// Status describes how the mailbox's run ended: ok, deferred, FAILED with
+// the error, interrupted or paused
+func (r MailboxResult) Status() string {
+	switch {
+	case r.Deferred:
+		return "deferred"
+	case r.Error != "":
+		return "FAILED: " + r.Error
+	case r.Interrupted:
+		return "interrupted"
+	case r.Paused:
+		return "paused"
+	}
+	return "ok"
+}
+
+// FailedCount returns how many messages of the mailbox failed to download
+func (r MailboxResult) FailedCount() int {
+	return len(r.Failed) + len(r.FailedIDs)
+}
+
+// LogResults prints a per-mailbox table of what was downloaded and failed
+func (s *RunSummary) LogResults(log *logrus.Entry) {
+	for _, m := range s.Mailboxes {
+		log.Infof("  %-30s downloaded=%d skipped=%d failed=%d %s", m.Name, m.Downloaded, m.Skipped, m.FailedCount(), m.Status())
+	}
+}
+
+// LogTimings prints the per-mailbox phase breakdown
+func (s *RunSummary) LogTimings(log *logrus.Entry) {
+	for _, m := range s.Mailboxes {
+		t := m.Timings
+		log.Infof("  %-30s select=%s scan=%s download=%s write=%s",
+			m.Name,
+			t.Select.Round(time.Millisecond),
+			t.Scan.Round(time.Millisecond),
+			t.Download.Round(time.Millisecond),
+			t.Write.Round(time.Millisecond),
+		)
+	}
+}
+
+// LogFailed lists the messages that could not be fetched, per mailbox
+func (s *RunSummary) LogFailed(log *logrus.Entry) {
+	var total int
+	for _, m := range s.Mailboxes {
+		total += m.FailedCount()
+	}
+	if total == 0 {
+		return
+	}
+
+	log.Warnf("%d messages failed to download after all retries and will be retried next run:", total)
+	for _, m := range s.Mailboxes {
+		if len(m.Failed) > 0 {
+			sorted := slices.Clone(m.Failed)
+			slices.Sort(sorted)
+			log.Warnf("  %-30s UIDs %v", m.Name, sorted)
+		}
+		if len(m.FailedIDs) > 0 {
+			log.Warnf("  %-30s message IDs %v", m.Name, m.FailedIDs)
+		}
+	}
+}
+
+// LoadSummary reads a run summary written by Save
+func LoadSummary(path string) (*RunSummary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s RunSummary
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// Save atomically writes the summary as JSON
+func (s *RunSummary) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path, data, 0644)
+}
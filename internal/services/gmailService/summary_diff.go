@@ -0,0 +1,67 @@
+package gmailService
+
+import "sort"
+
+// MailboxDelta is how a mailbox's counts changed between two runs
+type MailboxDelta struct {
+	Name       string
+	Downloaded int
+	Skipped    int
+}
+
+// SummaryDiff describes what changed between two run summaries
+type SummaryDiff struct {
+	Downloaded int64 // change in the run total
+
+	Added        []string // mailboxes only in the newer run
+	Removed      []string // mailboxes only in the older run
+	NewlyFailing []string // mailboxes with an error now but not before
+	Recovered    []string // mailboxes with an error before but not now
+	Changed      []MailboxDelta
+}
+
+// DiffSummaries compares an older run summary with a newer one
+func DiffSummaries(older, newer *RunSummary) SummaryDiff {
+	d := SummaryDiff{Downloaded: int64(newer.Downloaded) - int64(older.Downloaded)}
+
+	before := map[string]MailboxResult{}
+	for _, m := range older.Mailboxes {
+		before[m.Name] = m
+	}
+
+	for _, m := range newer.Mailboxes {
+		old, ok := before[m.Name]
+		delete(before, m.Name)
+		if !ok {
+			d.Added = append(d.Added, m.Name)
+			if m.Error != "" {
+				d.NewlyFailing = append(d.NewlyFailing, m.Name)
+			}
+			continue
+		}
+
+		switch {
+		case m.Error != "" && old.Error == "":
+			d.NewlyFailing = append(d.NewlyFailing, m.Name)
+		case m.Error == "" && old.Error != "":
+			d.Recovered = append(d.Recovered, m.Name)
+		}
+		if m.Downloaded != old.Downloaded || m.Skipped != old.Skipped {
+			d.Changed = append(d.Changed, MailboxDelta{
+				Name:       m.Name,
+				Downloaded: m.Downloaded - old.Downloaded,
+				Skipped:    m.Skipped - old.Skipped,
+			})
+		}
+	}
+	for name := range before {
+		d.Removed = append(d.Removed, name)
+	}
+
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.NewlyFailing)
+	sort.Strings(d.Recovered)
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].Name < d.Changed[j].Name })
+	return d
+}
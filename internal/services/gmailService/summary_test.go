@@ -0,0 +1,92 @@
+package gmailService
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+)
+
+func TestMailboxTimings(t *testing.T) {
+	cfg := testServer(t, nil, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: testMessages(5)})
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 5 {
+		t.Fatalf("result: %+v", res)
+	}
+	timings := map[string]int64{
+		"select":   int64(res.Timings.Select),
+		"scan":     int64(res.Timings.Scan),
+		"download": int64(res.Timings.Download),
+		"write":    int64(res.Timings.Write),
+	}
+	for phase, d := range timings {
+		if d <= 0 {
+			t.Errorf("%s timing = %d, want it recorded", phase, d)
+		}
+	}
+
+	// Timings survive SUMMARY_FILE
+	path := filepath.Join(t.TempDir(), "summary.json")
+	summary := &RunSummary{Mailboxes: []MailboxResult{res.MailboxResult}}
+	if err := summary.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSummary(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Mailboxes[0].Timings; got != res.Timings {
+		t.Errorf("loaded timings %+v, want %+v", got, res.Timings)
+	}
+}
+
+func TestMailboxTimingsNonNegativeWhenEmpty(t *testing.T) {
+	cfg := testServer(t, nil, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1})
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" {
+		t.Fatalf("result: %+v", res)
+	}
+	tm := res.Timings
+	if tm.Select < 0 || tm.Scan < 0 || tm.Download < 0 || tm.Write < 0 {
+		t.Errorf("negative timing: %+v", tm)
+	}
+}
+
+func TestDiffSummaries(t *testing.T) {
+	older := &RunSummary{Downloaded: 30, Mailboxes: []MailboxResult{
+		{Name: "INBOX", Downloaded: 20, Skipped: 1},
+		{Name: "Sent", Downloaded: 10},
+		{Name: "Old"},
+		{Name: "Flaky", Error: "select failed"},
+	}}
+	newer := &RunSummary{Downloaded: 12, Mailboxes: []MailboxResult{
+		{Name: "INBOX", Downloaded: 5, Skipped: 3},
+		{Name: "Sent", Error: "connection lost"},
+		{Name: "Flaky", Downloaded: 7},
+		{Name: "New", Error: "select failed"},
+	}}
+
+	got := DiffSummaries(older, newer)
+	want := SummaryDiff{
+		Downloaded:   -18,
+		Added:        []string{"New"},
+		Removed:      []string{"Old"},
+		NewlyFailing: []string{"New", "Sent"},
+		Recovered:    []string{"Flaky"},
+		Changed: []MailboxDelta{
+			{Name: "Flaky", Downloaded: 7},
+			{Name: "INBOX", Downloaded: -15, Skipped: 2},
+			{Name: "Sent", Downloaded: -10},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diff\n%+v\nwant\n%+v", got, want)
+	}
+
+	if d := DiffSummaries(older, older); d.Downloaded != 0 || d.Added != nil || d.Removed != nil || d.NewlyFailing != nil || d.Changed != nil {
+		t.Errorf("diff of a summary with itself: %+v", d)
+	}
+}
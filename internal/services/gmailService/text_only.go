@@ -0,0 +1,174 @@
+package gmailService
+
+import (
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// textParts finds the first inline text/plain and text/html parts of a
+// message, ignoring attachments and attached messages
+func textParts(bs *imap.BodyStructure) (plain, html *imap.BodyStructure, plainPath, htmlPath []int) {
+	bs.Walk(func(path []int, part *imap.BodyStructure) bool {
+		mimeType := strings.ToLower(part.MIMEType)
+		if mimeType == "message" || strings.EqualFold(part.Disposition, "attachment") {
+			return false
+		}
+		if mimeType != "text" {
+			return true
+		}
+		switch strings.ToLower(part.MIMESubType) {
+		case "plain":
+			if plain == nil {
+				plain, plainPath = part, path
+			}
+		case "html":
+			if html == nil {
+				html, htmlPath = part, path
+			}
+		}
+		return true
+	})
+	return plain, html, plainPath, htmlPath
+}
+
+// decodePart undoes a part's content transfer encoding. The charset is kept
+// as sent.
+func decodePart(r io.Reader, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	return io.ReadAll(r)
+}
+
+// downloadText stores only the text of a message for TEXT_ONLY: its
+// text/plain part as <uid>.txt (empty when there is none, so the message
+// counts as stored) and, with TEXT_ONLY_HTML, its text/html part as
+// <uid>.html. Attachments are never fetched.
+func downloadText(c *client.Client, mb *openedMailbox, cfg config.Config, run *RunState, res *MailboxResult, m pendingMessage) {
+	box, uid := mb.box, m.UID
+	fetchStart := time.Now()
+	defer func() { res.Timings.Download += time.Since(fetchStart) }()
+
+	msg, err := fetchOne(mb.ctx, c, uid, []imap.FetchItem{imap.FetchBodyStructure})
+	run.Rate.observe(err)
+	if err != nil || msg.BodyStructure == nil {
+		mb.log.Warnf("Failed to fetch the structure of UID %d in %s: %v", uid, box, err)
+		if mb.ctx.Err() == nil {
+			res.Failed = append(res.Failed, uid)
+		}
+		return
+	}
+	plain, html, plainPath, htmlPath := textParts(msg.BodyStructure)
+	if !cfg.TextOnlyHTML {
+		html = nil
+	}
+
+	header := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier}, Peek: true}
+	sections := map[string]*imap.BodySectionName{}
+	items := []imap.FetchItem{header.FetchItem(), imap.FetchFlags}
+	if run.GmailExtensions {
+		items = append(items, fetchLabels, fetchMsgID)
+	}
+	for ext, path := range map[string][]int{archiveSvc.TextExt: plainPath, ".html": htmlPath} {
+		if (ext == archiveSvc.TextExt && plain == nil) || (ext == ".html" && html == nil) {
+			continue
+		}
+		section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Path: path}, Peek: true}
+		sections[ext] = section
+		items = append(items, section.FetchItem())
+	}
+
+	if err := run.Rate.Wait(mb.ctx); err != nil {
+		return
+	}
+	msg, err = fetchOne(mb.ctx, c, uid, items)
+	run.Rate.observe(err)
+	if err != nil {
+		mb.log.Warnf("Failed to fetch the text of UID %d in %s: %v", uid, box, err)
+		if mb.ctx.Err() == nil {
+			res.Failed = append(res.Failed, uid)
+		}
+		return
+	}
+
+	files := map[string][]byte{archiveSvc.TextExt: nil}
+	encodings := map[string]string{}
+	if plain != nil {
+		encodings[archiveSvc.TextExt] = plain.Encoding
+	}
+	if html != nil {
+		encodings[".html"] = html.Encoding
+	}
+	for ext, section := range sections {
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+		data, err := decodePart(body, encodings[ext])
+		if err != nil {
+			mb.log.Warnf("Failed to decode %s part of UID %d in %s: %v", ext, uid, box, err)
+			return
+		}
+		files[ext] = data
+	}
+
+	var headerData []byte
+	if body := msg.GetBody(header); body != nil {
+		headerData, _ = io.ReadAll(body)
+	}
+
+	base := strings.TrimSuffix(storedPath(cfg.BackupDir, box, uid, m.Thread, archiveSvc.MessageExt), archiveSvc.MessageExt)
+	for ext, data := range files {
+		run.Daily.Add(int64(len(data)))
+		if cfg.DryRun {
+			utils.DryRunWrite(base+ext, int64(len(data)))
+		}
+	}
+	if cfg.DryRun {
+		return
+	}
+
+	run.AcquireWrite()
+	defer run.ReleaseWrite()
+	writeStart := time.Now()
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		mb.log.Warnf("Failed to write UID %d in %s: %v", uid, box, err)
+		return
+	}
+	for ext, data := range files {
+		if err := utils.WriteFileAtomic(base+ext, data, 0644); err != nil {
+			mb.log.Warnf("Failed to write UID %d in %s: %v", uid, box, err)
+			return
+		}
+		run.Checksums.Add(base+ext, data)
+	}
+	res.Timings.Write += time.Since(writeStart)
+
+	rel, _ := filepath.Rel(mb.dir, base+archiveSvc.TextExt)
+	entry := archiveSvc.NewEntry(filepath.ToSlash(rel), headerData)
+	entry.Size = int64(m.Size)
+	entry.ThreadID = m.Thread
+	entry.Flags = msg.Flags
+	if run.GmailExtensions {
+		entry.Labels = labels(msg)
+		entry.GmMsgID = gmMsgID(msg)
+	}
+	mb.recordEntry(uid, entry)
+	run.AddDownloaded()
+	res.Downloaded++
+}
@@ -0,0 +1,71 @@
+package gmailService
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+)
+
+// multipartMessage returns a message with quoted-printable text, base64 HTML
+// and a PDF attachment
+func multipartMessage(uid uint32) *imaptest.Message {
+	return &imaptest.Message{
+		UID:  uid,
+		Body: []byte("Message-ID: <mp@example.com>\r\nSubject: report\r\nContent-Type: multipart/mixed; boundary=x\r\n\r\n(parts)\r\n"),
+		Structure: `((("TEXT" "PLAIN" ("CHARSET" "UTF-8") NIL NIL "QUOTED-PRINTABLE" 18 1)` +
+			`("TEXT" "HTML" ("CHARSET" "UTF-8") NIL NIL "BASE64" 16 1) "ALTERNATIVE")` +
+			`("APPLICATION" "PDF" ("NAME" "a.pdf") NIL NIL "BASE64" 8) "MIXED")`,
+		Sections: map[string][]byte{
+			"1.1": []byte("caf=C3=A9 text\r\n"),
+			"1.2": []byte("PHA+aHRtbDwvcD4="),
+			"2":   []byte("JVBERi0x"),
+		},
+	}
+}
+
+func TestTextOnly(t *testing.T) {
+	srv := &imaptest.Server{}
+	cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: []*imaptest.Message{multipartMessage(1)}})
+	cfg.TextOnly = true
+
+	res := testProcess(t, cfg, "INBOX")
+	if res.Error != "" || res.Downloaded != 1 {
+		t.Fatalf("result: %+v", res)
+	}
+	for _, cmd := range uidFetches(srv) {
+		if strings.Contains(cmd, "BODY.PEEK[]") || strings.Contains(cmd, "[2]") || strings.Contains(cmd, "[1.2]") {
+			t.Errorf("fetched more than the text part: %s", cmd)
+		}
+	}
+
+	base := strings.TrimSuffix(MessagePath(cfg.BackupDir, "INBOX", 1), archiveSvc.MessageExt)
+	if data, err := os.ReadFile(base + archiveSvc.TextExt); err != nil || string(data) != "café text\r\n" {
+		t.Errorf("text part %q, %v", data, err)
+	}
+	for _, ext := range []string{archiveSvc.MessageExt, ".html"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			t.Errorf("%s stored", ext)
+		}
+	}
+
+	m, err := archiveSvc.LoadManifest(MailboxDir(cfg.BackupDir, "INBOX"), "INBOX")
+	if err != nil || m.Messages[1].Subject != "report" {
+		t.Errorf("manifest entry %+v, %v", m.Messages[1], err)
+	}
+}
+
+func TestTextOnlyHTML(t *testing.T) {
+	cfg := testServer(t, nil, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, Messages: []*imaptest.Message{multipartMessage(1)}})
+	cfg.TextOnly, cfg.TextOnlyHTML = true, true
+
+	if res := testProcess(t, cfg, "INBOX"); res.Error != "" || res.Downloaded != 1 {
+		t.Fatalf("result: %+v", res)
+	}
+	base := strings.TrimSuffix(MessagePath(cfg.BackupDir, "INBOX", 1), archiveSvc.MessageExt)
+	if data, err := os.ReadFile(base + ".html"); err != nil || string(data) != "<p>html</p>" {
+		t.Errorf("html part %q, %v", data, err)
+	}
+}
@@ -0,0 +1,303 @@
+package gmailService
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	keyringSvc "github.com/redjax/archive-gmail/internal/services/keyringService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// sharedTokenSource serializes refreshes so concurrent connections share one
+// refreshed token instead of each hitting Google's token endpoint
+type sharedTokenSource struct {
+	mu   sync.Mutex
+	src  oauth2.TokenSource
+	cfg  config.Config
+	last string
+}
+
+// Token returns a valid token, refreshing at most once for all callers, and
+// persists it when it changed
+func (s *sharedTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.AccessToken != s.last {
+		if s.cfg.DryRun {
+			utils.DryRunWrite(tokenLocation(s.cfg), -1)
+		} else if err := saveToken(s.cfg, tok); err != nil {
+			logrus.Warnf("Failed to save refreshed token: %v", err)
+		}
+		s.last = tok.AccessToken
+	}
+	return tok, nil
+}
+
+var (
+	tokenSourcesMu sync.Mutex
+	tokenSources   = map[string]*sharedTokenSource{}
+)
+
+var (
+	serviceTokensMu sync.Mutex
+	serviceTokens   = map[string]oauth2.TokenSource{}
+)
+
+// MailScope grants full mailbox access, over IMAP and the Gmail API
+const MailScope = "https://mail.google.com/"
+
+// TokenSource returns the token source cfg authenticates with: the service
+// account in GMAIL_SERVICE_ACCOUNT_FILE impersonating GMAIL_EMAIL when set,
+// otherwise the OAuth2 token (see OAuth2TokenSource)
+func TokenSource(cfg config.Config) (oauth2.TokenSource, error) {
+	if cfg.ServiceAccountFile != "" {
+		return ServiceAccountTokenSource(cfg, cfg.Email, MailScope)
+	}
+	return OAuth2TokenSource(cfg)
+}
+
+// ServiceAccountTokenSource returns a token source for the service account in
+// GMAIL_SERVICE_ACCOUNT_FILE acting as subject through domain-wide delegation.
+// Sources are shared per subject and scope, so connections reuse one token.
+func ServiceAccountTokenSource(cfg config.Config, subject string, scopes ...string) (oauth2.TokenSource, error) {
+	key := subject + " " + strings.Join(scopes, " ")
+	serviceTokensMu.Lock()
+	defer serviceTokensMu.Unlock()
+	if ts, ok := serviceTokens[key]; ok {
+		return ts, nil
+	}
+
+	data, err := os.ReadFile(cfg.ServiceAccountFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading GMAIL_SERVICE_ACCOUNT_FILE: %w", err)
+	}
+	jwt, err := google.JWTConfigFromJSON(data, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing GMAIL_SERVICE_ACCOUNT_FILE: %w", err)
+	}
+	jwt.Subject = subject
+	ts := jwt.TokenSource(context.Background())
+	serviceTokens[key] = ts
+	return ts, nil
+}
+
+// oauth2Config returns the OAuth2 client config for IMAP access, with the
+// PROVIDER's endpoints and scopes unless OAUTH2_* overrides them
+func oauth2Config(cfg config.Config) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Scopes:       cfg.OAuth2Scopes,
+		RedirectURL:  "http://localhost",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:       cfg.OAuth2AuthURL,
+			TokenURL:      cfg.OAuth2TokenURL,
+			DeviceAuthURL: cfg.OAuth2DeviceURL,
+		},
+	}
+}
+
+// OAuth2TokenSource returns the process-wide token source for cfg's token file,
+// running the interactive login flow once if no usable token is cached
+func OAuth2TokenSource(cfg config.Config) (oauth2.TokenSource, error) {
+	if cfg.OAuth2TokenFile == "" {
+		return nil, fmt.Errorf("OAUTH2_TOKEN_FILE is not set")
+	}
+
+	tokenSourcesMu.Lock()
+	defer tokenSourcesMu.Unlock()
+
+	if ts, ok := tokenSources[cfg.OAuth2TokenFile]; ok {
+		return ts, nil
+	}
+
+	if err := ensureTokenDir(cfg); err != nil {
+		return nil, err
+	}
+
+	conf := oauth2Config(cfg)
+	ctx := context.Background()
+
+	// An expired access token is fine as long as it can be refreshed
+	var token *oauth2.Token
+	if t, err := loadToken(cfg); err == nil && (t.Valid() || t.RefreshToken != "") {
+		logrus.Infof("Loaded cached token from %s", tokenLocation(cfg))
+		token = t
+	} else if err != nil && cfg.OAuth2TokenStore == "keyring" && !errors.Is(err, errNoKeyringToken) {
+		logrus.Warnf("Failed to read token from the keyring: %v", err)
+	}
+
+	// First-time login
+	if token == nil {
+		tok, err := loginAndSave(ctx, cfg, conf)
+		if err != nil {
+			return nil, err
+		}
+		token = tok
+	}
+
+	// TokenSource auto-refresh
+	ts := &sharedTokenSource{
+		src:  oauth2.ReuseTokenSource(token, conf.TokenSource(ctx, token)),
+		cfg:  cfg,
+		last: token.AccessToken,
+	}
+	tokenSources[cfg.OAuth2TokenFile] = ts
+	return ts, nil
+}
+
+// LoginToken runs the OAuth2 login flow (see Login) and saves the new token
+// (see saveToken), replacing a cached one
+func LoginToken(ctx context.Context, cfg config.Config) (*oauth2.Token, error) {
+	if cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return nil, fmt.Errorf("GMAIL_CLIENT_ID and GMAIL_CLIENT_SECRET are required")
+	}
+	if err := ensureTokenDir(cfg); err != nil {
+		return nil, err
+	}
+	return loginAndSave(ctx, cfg, oauth2Config(cfg))
+}
+
+// loginAndSave runs the OAuth2 login flow and saves the token it returns
+func loginAndSave(ctx context.Context, cfg config.Config, conf *oauth2.Config) (*oauth2.Token, error) {
+	token, err := Login(ctx, conf, cfg.OAuth2Login, cfg.OAuth2RedirectPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.DryRun {
+		utils.DryRunWrite(tokenLocation(cfg), -1)
+	} else if err := saveToken(cfg, token); err != nil {
+		logrus.Warnf("Failed to save token: %v", err)
+	} else {
+		logrus.Infof("Saved token to %s", tokenLocation(cfg))
+	}
+	return token, nil
+}
+
+// VerifyToken checks that the cached token can still be refreshed without
+// connecting to IMAP. The access token is force-expired so a revoked refresh
+// token is detected even while the current access token is still valid.
+func VerifyToken(cfg config.Config) (*oauth2.Token, error) {
+	if cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return nil, fmt.Errorf("GMAIL_CLIENT_ID and GMAIL_CLIENT_SECRET are required")
+	}
+
+	tok, err := loadToken(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read token from %s: %w", tokenLocation(cfg), err)
+	}
+	if tok.RefreshToken == "" {
+		return nil, fmt.Errorf("token in %s has no refresh token", tokenLocation(cfg))
+	}
+
+	expired := *tok
+	expired.AccessToken = ""
+	expired.Expiry = time.Now().Add(-time.Minute)
+
+	fresh, err := oauth2Config(cfg).TokenSource(context.Background(), &expired).Token()
+	if err != nil {
+		return nil, fmt.Errorf("token refresh failed: %w", err)
+	}
+
+	if cfg.DryRun {
+		utils.DryRunWrite(tokenLocation(cfg), -1)
+	} else if err := saveToken(cfg, fresh); err != nil {
+		logrus.Warnf("Failed to save refreshed token: %v", err)
+	}
+	return fresh, nil
+}
+
+// ExportToken refreshes the cached token (see VerifyToken) and returns it as
+// the JSON stored in OAUTH2_TOKEN_FILE, for copying to another machine
+func ExportToken(cfg config.Config) ([]byte, error) {
+	tok, err := VerifyToken(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(tok, "", "  ")
+}
+
+// tokenLocation describes where cfg's token is cached, for log messages
+func tokenLocation(cfg config.Config) string {
+	if cfg.OAuth2TokenStore == "keyring" {
+		return fmt.Sprintf("the keyring (%s/%s)", keyringSvc.TokenService, cfg.Email)
+	}
+	return cfg.OAuth2TokenFile
+}
+
+// ensureTokenDir creates the directory of OAUTH2_TOKEN_FILE when the token is
+// stored there
+func ensureTokenDir(cfg config.Config) error {
+	if cfg.DryRun || cfg.OAuth2TokenStore == "keyring" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.OAuth2TokenFile), 0700); err != nil {
+		return fmt.Errorf("cannot create token dir: %w", err)
+	}
+	return nil
+}
+
+// errNoKeyringToken is returned by loadToken when neither the keyring nor
+// OAUTH2_TOKEN_FILE has a token
+var errNoKeyringToken = errors.New("no token in the keyring")
+
+// loadToken reads cfg's cached token from OAUTH2_TOKEN_FILE, or with
+// OAUTH2_TOKEN_STORE=keyring from the OS keyring under GMAIL_EMAIL. A keyring
+// without a token falls back to OAUTH2_TOKEN_FILE, whose token is then moved to
+// the keyring.
+func loadToken(cfg config.Config) (*oauth2.Token, error) {
+	if cfg.OAuth2TokenStore != "keyring" {
+		return loadTokenFromFile(cfg.OAuth2TokenFile)
+	}
+	if cfg.Email == "" {
+		return nil, fmt.Errorf("GMAIL_EMAIL is required to look up the keyring token")
+	}
+
+	tok, err := keyringSvc.GetToken(cfg.Email)
+	if err != nil || tok != nil {
+		return tok, err
+	}
+	tok, err = loadTokenFromFile(cfg.OAuth2TokenFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w for %s", errNoKeyringToken, cfg.Email)
+		}
+		return nil, err
+	}
+	if cfg.DryRun {
+		utils.DryRunWrite(tokenLocation(cfg), -1)
+	} else if err := keyringSvc.SetToken(cfg.Email, tok); err != nil {
+		logrus.Warnf("Failed to move token from %s to the keyring: %v", cfg.OAuth2TokenFile, err)
+	} else {
+		logrus.Infof("Moved token from %s to the keyring; the file can be deleted", cfg.OAuth2TokenFile)
+	}
+	return tok, nil
+}
+
+// saveToken caches cfg's token where loadToken reads it
+func saveToken(cfg config.Config, token *oauth2.Token) error {
+	if cfg.OAuth2TokenStore == "keyring" {
+		return keyringSvc.SetToken(cfg.Email, token)
+	}
+	return saveTokenToFile(cfg.OAuth2TokenFile, token)
+}
@@ -0,0 +1,156 @@
+package gmailService
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+// tokenEndpoint starts an OAuth2 token endpoint that answers refreshes with
+// status and body, and counts them
+func tokenEndpoint(t *testing.T, status int, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var refreshes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refreshes.Add(1)
+		// Keep the refresh in flight long enough for callers to pile up
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &refreshes
+}
+
+// tokenConfig returns the OAuth2 settings of a token cached in a temporary
+// file, refreshed through tokenURL
+func tokenConfig(t *testing.T, tokenURL string, cached *oauth2.Token) config.Config {
+	t.Helper()
+	cfg := config.Config{
+		Email:            testEmail,
+		ClientID:         "id",
+		ClientSecret:     "secret",
+		OAuth2TokenFile:  filepath.Join(t.TempDir(), "token.json"),
+		OAuth2TokenStore: "file",
+		OAuth2TokenURL:   tokenURL,
+	}
+	if err := saveTokenToFile(cfg.OAuth2TokenFile, cached); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestSharedTokenSourceRefreshesOnce(t *testing.T) {
+	srv, refreshes := tokenEndpoint(t, http.StatusOK,
+		`{"access_token":"fresh","token_type":"Bearer","refresh_token":"refresh","expires_in":3600}`)
+	expired := &oauth2.Token{AccessToken: "stale", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	cfg := tokenConfig(t, srv.URL, expired)
+
+	ts, err := OAuth2TokenSource(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := OAuth2TokenSource(cfg); again != ts {
+		t.Error("a second connection got its own token source")
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tok, err := ts.Token()
+			if err != nil {
+				t.Error(err)
+			} else if tok.AccessToken != "fresh" {
+				t.Errorf("got access token %q", tok.AccessToken)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("%d refreshes, want 1", n)
+	}
+	saved, err := loadTokenFromFile(cfg.OAuth2TokenFile)
+	if err != nil || saved.AccessToken != "fresh" {
+		t.Errorf("refreshed token not saved: %+v, %v", saved, err)
+	}
+}
+
+func TestVerifyTokenRejectedRefresh(t *testing.T) {
+	srv, refreshes := tokenEndpoint(t, http.StatusBadRequest,
+		`{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`)
+	// Still valid, so only a forced refresh notices the revocation
+	valid := &oauth2.Token{AccessToken: "current", RefreshToken: "revoked", Expiry: time.Now().Add(time.Hour)}
+	cfg := tokenConfig(t, srv.URL, valid)
+
+	if _, err := VerifyToken(cfg); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("VerifyToken = %v, want the invalid_grant refresh error", err)
+	}
+	// The auth style is auto-detected, so a rejection is tried both ways
+	if refreshes.Load() == 0 {
+		t.Error("the still valid access token was not refreshed")
+	}
+	saved, err := loadTokenFromFile(cfg.OAuth2TokenFile)
+	if err != nil || saved.AccessToken != "current" {
+		t.Errorf("cached token changed: %+v, %v", saved, err)
+	}
+}
+
+func TestVerifyTokenWithoutRefreshToken(t *testing.T) {
+	srv, refreshes := tokenEndpoint(t, http.StatusOK, `{}`)
+	cfg := tokenConfig(t, srv.URL, &oauth2.Token{AccessToken: "current"})
+
+	if _, err := VerifyToken(cfg); err == nil {
+		t.Error("a token without a refresh token verified")
+	}
+	if refreshes.Load() != 0 {
+		t.Error("refresh attempted without a refresh token")
+	}
+}
+
+func TestExportTokenRoundTrips(t *testing.T) {
+	srv, refreshes := tokenEndpoint(t, http.StatusOK,
+		`{"access_token":"fresh","token_type":"Bearer","refresh_token":"refresh","expires_in":3600}`)
+	cached := &oauth2.Token{AccessToken: "stale", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	cfg := tokenConfig(t, srv.URL, cached)
+
+	data, err := ExportToken(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshes.Load() != 1 {
+		t.Errorf("%d refreshes, want the exported token refreshed once", refreshes.Load())
+	}
+
+	// Copied to another machine's OAUTH2_TOKEN_FILE
+	path := filepath.Join(t.TempDir(), "token.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := loadTokenFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "fresh" || tok.RefreshToken != "refresh" || tok.TokenType != "Bearer" || !tok.Valid() {
+		t.Errorf("loaded token %+v", tok)
+	}
+
+	// Without a refresh token there is nothing worth exporting
+	noRefresh := tokenConfig(t, srv.URL, &oauth2.Token{AccessToken: "stale"})
+	if _, err := ExportToken(noRefresh); err == nil || !strings.Contains(err.Error(), "no refresh token") {
+		t.Errorf("export without a refresh token: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package gmailService
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	archiveSvc "github.com/redjax/archive-gmail/internal/services/archiveService"
+	"github.com/redjax/archive-gmail/internal/utils"
+)
+
+// renumberedToNewDir handles a changed UIDVALIDITY with UIDVALIDITY_ACTION
+// set to new-dir: the existing directory is kept untouched as
+// <dir>.uidvalidity-<old> and the mailbox is downloaded into a fresh one. It
+// returns false if the mailbox should be skipped.
+func renumberedToNewDir(mb *openedMailbox, cfg config.Config, res *MailboxResult) bool {
+	old := mb.manifest.UidValidity
+	aside := fmt.Sprintf("%s.uidvalidity-%d", mb.dir, old)
+	issue := fmt.Sprintf("UIDVALIDITY changed (%d -> %d), previous archive moved to %s", old, mb.status.UidValidity, aside)
+	mb.log.Warnf("Mailbox %s: %s", mb.box, issue)
+	res.Issues = append(res.Issues, issue)
+
+	mb.manifest = archiveSvc.NewManifest(mb.box)
+	if cfg.DryRun {
+		utils.DryRunWrite(aside+string(os.PathSeparator), -1)
+		return true
+	}
+
+	if utils.Exists(aside) {
+		err := fmt.Errorf("%s already exists", aside)
+		mb.log.Warnf("Skipping mailbox %s: cannot move the previous archive aside: %v", mb.box, err)
+		res.Error = err.Error()
+		return false
+	}
+	if err := os.Rename(mb.dir, aside); err != nil {
+		mb.log.Warnf("Skipping mailbox %s: cannot move the previous archive aside: %v", mb.box, err)
+		res.Error = err.Error()
+		return false
+	}
+	if err := os.MkdirAll(mb.dir, 0755); err != nil {
+		mb.log.Warnf("Skipping mailbox %s: %v", mb.box, err)
+		res.Error = err.Error()
+		return false
+	}
+	return true
+}
+
+// messageIDChunkSize is how many UIDs are fetched per chunk when collecting
+// Message-IDs (remap, restore)
+const messageIDChunkSize = 500
+
+// remapSuffix marks a stored file halfway through being renamed to its new UID
+const remapSuffix = ".remap"
+
+// remapByMessageID handles a changed UIDVALIDITY with UIDVALIDITY_ACTION set
+// to remap: stored messages are matched to their new UIDs by the Message-ID in
+// the manifest and renamed, and those without a match are moved to
+// <dir>.uidvalidity-<old>. It returns false if the mailbox should be
+// re-downloaded instead.
+func remapByMessageID(mb *openedMailbox, cfg config.Config, res *MailboxResult) bool {
+	old, box := mb.manifest.UidValidity, mb.box
+
+	// Message-IDs aren't unique (i.e. a message sent to yourself), so
+	// duplicates are paired up in UID order
+	oldUIDs := slices.Sorted(maps.Keys(mb.manifest.Messages))
+	byID := map[string][]uint32{}
+	for _, uid := range oldUIDs {
+		if id := normalizeMessageID(mb.manifest.Messages[uid].MessageID); id != "" {
+			byID[id] = append(byID[id], uid)
+		}
+	}
+
+	newUID := map[uint32]uint32{}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}
+	for _, seq := range scanChunks(1, mb.status.UidNext, messageIDChunkSize, mb.scanAll) {
+		err := scanChunk(mb.ctx, mb.client, seq, items, scanChunkTimeout, func(msg *imap.Message) {
+			if msg.Envelope == nil {
+				return
+			}
+			id := normalizeMessageID(msg.Envelope.MessageId)
+			if olds := byID[id]; id != "" && len(olds) > 0 {
+				newUID[olds[0]] = msg.Uid
+				byID[id] = olds[1:]
+			}
+		})
+		if err != nil {
+			mb.log.Warnf("Mailbox %s: fetching Message-IDs to remap failed, re-downloading instead: %v", box, err)
+			return false
+		}
+	}
+
+	// Files named after their UID are renamed; entries in a shared file (an
+	// mbox) are only re-keyed
+	type rename struct {
+		from, to string
+		uid      uint32
+	}
+	var renames []rename
+	var unmatched []string
+	entries := map[uint32]archiveSvc.ManifestEntry{}
+	for _, uid := range oldUIDs {
+		e := mb.manifest.Messages[uid]
+		nu, ok := newUID[uid]
+		file, own := remappedFile(e.File, uid, nu)
+		switch {
+		case ok:
+			if own {
+				renames = append(renames, rename{e.File, file, nu})
+				e.File = file
+			}
+			entries[nu] = e
+		case own:
+			unmatched = append(unmatched, e.File)
+		}
+	}
+
+	aside := fmt.Sprintf("%s.uidvalidity-%d", mb.dir, old)
+	issue := fmt.Sprintf("UIDVALIDITY changed (%d -> %d), remapped %d of %d stored messages by Message-ID", old, mb.status.UidValidity, len(newUID), len(oldUIDs))
+	if len(unmatched) > 0 {
+		issue += fmt.Sprintf(", moved %d unmatched to %s", len(unmatched), aside)
+	}
+
+	if !cfg.DryRun {
+		// Renamed in two steps, since a message's new UID may be another's old one
+		for i, r := range renames {
+			from := filepath.Join(mb.dir, filepath.FromSlash(r.from))
+			if err := os.Rename(from, from+remapSuffix); err != nil {
+				mb.log.Warnf("Mailbox %s: remapping failed, re-downloading instead: %v", box, err)
+				for _, done := range renames[:i] {
+					p := filepath.Join(mb.dir, filepath.FromSlash(done.from))
+					if err := os.Rename(p+remapSuffix, p); err != nil {
+						mb.log.Warnf("Mailbox %s: failed to restore %s: %v", box, p, err)
+					}
+				}
+				return false
+			}
+		}
+
+		for _, rel := range unmatched {
+			from := filepath.Join(mb.dir, filepath.FromSlash(rel))
+			to := filepath.Join(aside, filepath.FromSlash(rel))
+			if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+				mb.log.Warnf("Mailbox %s: failed to move %s aside: %v", box, from, err)
+				continue
+			}
+			if err := os.Rename(from, to); err != nil {
+				mb.log.Warnf("Mailbox %s: failed to move %s aside: %v", box, from, err)
+			}
+		}
+
+		for _, r := range renames {
+			from := filepath.Join(mb.dir, filepath.FromSlash(r.from)) + remapSuffix
+			if err := os.Rename(from, filepath.Join(mb.dir, filepath.FromSlash(r.to))); err != nil {
+				mb.log.Warnf("Mailbox %s: failed to rename %s, it will be downloaded again: %v", box, from, err)
+				delete(entries, r.uid)
+			}
+		}
+	}
+
+	mb.log.Warnf("Mailbox %s: %s", box, issue)
+	res.Issues = append(res.Issues, issue)
+	mb.manifest.Messages = entries
+	mb.manifest.HighestModSeq = 0
+	mb.manifest.SyncedUID = 0
+	return true
+}
+
+// remappedFile returns a stored file renamed from UID old to UID new, and
+// whether it is named after its UID at all
+func remappedFile(file string, old, new uint32) (string, bool) {
+	dir, base := path.Split(file)
+	prefix := strconv.FormatUint(uint64(old), 10) + "."
+	if !strings.HasPrefix(base, prefix) {
+		return file, false
+	}
+	return dir + strconv.FormatUint(uint64(new), 10) + base[len(prefix)-1:], true
+}
+
+// normalizeMessageID strips the whitespace and angle brackets around a
+// Message-ID, which differ between ENVELOPE and the raw header
+func normalizeMessageID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
@@ -0,0 +1,99 @@
+package gmailService
+
+import (
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/sirupsen/logrus"
+)
+
+// UpdateMonitor consumes a connection's unilateral server updates. Even a
+// read-only session can receive EXPUNGE/EXISTS for the selected mailbox, and
+// go-imap blocks the whole client if nobody reads them.
+type UpdateMonitor struct {
+	mu       sync.Mutex
+	expunged int
+	grew     bool
+	lastSeen uint32
+	alerts   []string
+}
+
+var monitors sync.Map // *client.Client -> *UpdateMonitor
+
+// watchUpdates attaches an UpdateMonitor to c
+func watchUpdates(c *client.Client) *UpdateMonitor {
+	m := &UpdateMonitor{}
+	ch := make(chan client.Update, 100)
+	c.Updates = ch
+	monitors.Store(c, m)
+
+	go func() {
+		for u := range ch {
+			m.handle(u)
+		}
+	}()
+	go func() {
+		<-c.LoggedOut()
+		monitors.Delete(c)
+	}()
+
+	return m
+}
+
+// updatesFor returns the monitor attached to c. Clients created outside
+// Connect get a detached monitor that never reports changes.
+func updatesFor(c *client.Client) *UpdateMonitor {
+	if m, ok := monitors.Load(c); ok {
+		return m.(*UpdateMonitor)
+	}
+	return &UpdateMonitor{}
+}
+
+func (m *UpdateMonitor) handle(u client.Update) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch u := u.(type) {
+	case *client.StatusUpdate:
+		// [ALERT] texts must be shown to the user (RFC 3501 7.1); Gmail uses
+		// them for suspicious sign-ins, IMAP being disabled and rate limits
+		if u.Status != nil && u.Status.Code == imap.CodeAlert {
+			logrus.Warnf("SERVER ALERT: %s", u.Status.Info)
+			m.alerts = append(m.alerts, u.Status.Info)
+		}
+	case *client.ExpungeUpdate:
+		m.expunged++
+		logrus.Debugf("Server expunged message seq %d during session", u.SeqNum)
+	case *client.MailboxUpdate:
+		if u.Mailbox == nil {
+			return
+		}
+		// The status is the client's own, which its reader keeps updating
+		// (RECENT, UIDNEXT, ...); only Messages, set before this update, is read
+		messages := u.Mailbox.Messages
+		if m.lastSeen != 0 && messages > m.lastSeen {
+			m.grew = true
+		}
+		m.lastSeen = messages
+		logrus.Debugf("Mailbox now has %d messages", messages)
+	}
+}
+
+// Take returns the changes seen since the last call and resets them
+func (m *UpdateMonitor) Take() (expunged int, grew bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expunged, grew = m.expunged, m.grew
+	m.expunged, m.grew, m.lastSeen = 0, false, 0
+	return expunged, grew
+}
+
+// ServerAlerts returns the [ALERT] messages the server sent on c so far
+func ServerAlerts(c *client.Client) []string {
+	m := updatesFor(c)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.alerts...)
+}
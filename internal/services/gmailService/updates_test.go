@@ -0,0 +1,113 @@
+package gmailService
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/redjax/archive-gmail/internal/imaptest"
+)
+
+func TestMailboxChangedDuringScan(t *testing.T) {
+	tests := []struct {
+		action    string
+		scans     int
+		warnPhase string
+	}{
+		{"log", 1, "changes will be picked up next run"},
+		{"ignore", 1, ""},
+		{"rescan", 2, "rescanning"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			// The first scan sees UID 2 expunged before its results
+			var expunged atomic.Bool
+			srv := &imaptest.Server{}
+			srv.Hook = func(s *imaptest.Session, cmd *imap.Command) bool {
+				if cmd.Name != "UID" || !isScanFetch(fmt.Sprint(cmd.Arguments)) || expunged.Swap(true) {
+					return false
+				}
+				srv.Do(func() {
+					box := s.Selected()
+					box.Messages = append(box.Messages[:1], box.Messages[2:]...)
+				})
+				s.Printf("* 2 EXPUNGE")
+				// Give the client time to hand the update to its monitor
+				time.Sleep(50 * time.Millisecond)
+				return false
+			}
+			cfg := testServer(t, srv, &imaptest.Mailbox{Name: "INBOX", UidValidity: 1, UidNext: 4, Messages: testMessages(3)})
+			cfg.MailboxChangeAction = tt.action
+
+			hook := test.NewGlobal()
+			t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+
+			res := testProcess(t, cfg, "INBOX")
+			if res.Error != "" || res.Downloaded != 2 {
+				t.Errorf("result: %+v", res)
+			}
+			if got := scanFetches(srv); got != tt.scans {
+				t.Errorf("%d scans, want %d", got, tt.scans)
+			}
+
+			var warned string
+			for _, e := range hook.AllEntries() {
+				if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "changed during scan") {
+					warned = e.Message
+				}
+			}
+			if tt.warnPhase == "" && warned != "" {
+				t.Errorf("ignore logged %q", warned)
+			}
+			if tt.warnPhase != "" && !strings.Contains(warned, tt.warnPhase) {
+				t.Errorf("warning %q, want one saying %q", warned, tt.warnPhase)
+			}
+		})
+	}
+}
+
+func TestServerAlerts(t *testing.T) {
+	const alert = "Please log in via your web browser"
+	srv := &imaptest.Server{Hook: func(s *imaptest.Session, cmd *imap.Command) bool {
+		if cmd.Name == "NOOP" {
+			s.Printf("* OK [ALERT] %s", alert)
+		}
+		return false
+	}}
+	cfg := testServer(t, srv)
+
+	hook := test.NewGlobal()
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+
+	c, err := Connect(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout()
+	if err := c.Noop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updates are handled off the client's goroutine
+	deadline := time.Now().Add(2 * time.Second)
+	for len(ServerAlerts(c)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := ServerAlerts(c); len(got) != 1 || got[0] != alert {
+		t.Fatalf("alerts %q, want [%q]", got, alert)
+	}
+
+	logged := false
+	for _, e := range hook.AllEntries() {
+		logged = logged || (e.Level == logrus.WarnLevel && strings.Contains(e.Message, alert))
+	}
+	if !logged {
+		t.Error("alert not logged at WARN")
+	}
+}
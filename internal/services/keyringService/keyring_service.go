@@ -0,0 +1,103 @@
+package keyringService
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/oauth2"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+// Keyring service names, keyed by account email
+const (
+	PasswordService     = "archive-gmail-password"
+	ClientSecretService = "archive-gmail-client-secret"
+	TokenService        = "archive-gmail-token"
+)
+
+// Get reads a secret for an account from the OS keyring. A missing entry
+// returns an empty string and no error.
+func Get(service, email string) (string, error) {
+	secret, err := keyring.Get(service, email)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return "", nil
+	}
+	return secret, err
+}
+
+// Set stores a secret for an account in the OS keyring
+func Set(service, email, secret string) error {
+	return keyring.Set(service, email, secret)
+}
+
+// GetToken reads an account's OAuth2 token from the OS keyring. A missing
+// entry returns a nil token and no error.
+func GetToken(email string) (*oauth2.Token, error) {
+	data, err := Get(TokenService, email)
+	if err != nil || data == "" {
+		return nil, err
+	}
+	var tok oauth2.Token
+	if err := json.Unmarshal([]byte(data), &tok); err != nil {
+		return nil, fmt.Errorf("parsing keyring token: %w", err)
+	}
+	return &tok, nil
+}
+
+// SetToken stores an account's OAuth2 token in the OS keyring. Keyrings that
+// limit the size of a secret (Windows Credential Manager) may not fit a long
+// access token, in which case only the refresh token is kept and the access
+// token is refreshed on next use.
+func SetToken(email string, tok *oauth2.Token) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	err = Set(TokenService, email, string(data))
+	if !errors.Is(err, keyring.ErrSetDataTooBig) {
+		return err
+	}
+
+	logrus.Debug("Token too large for the keyring, storing only its refresh token")
+	data, err = json.Marshal(&oauth2.Token{RefreshToken: tok.RefreshToken, TokenType: tok.TokenType})
+	if err != nil {
+		return err
+	}
+	return Set(TokenService, email, string(data))
+}
+
+// ResolveSecrets fills in the password and client secret from the keyring
+// when they were not provided through the environment
+func ResolveSecrets(cfg *config.Config) error {
+	if cfg.Email == "" {
+		return fmt.Errorf("GMAIL_EMAIL is required to look up keyring secrets")
+	}
+
+	if cfg.Password == "" {
+		pw, err := Get(PasswordService, cfg.Email)
+		if err != nil {
+			return fmt.Errorf("reading password from keyring: %w", err)
+		}
+		if pw != "" {
+			logrus.Debug("Loaded app password from keyring")
+			cfg.Password = pw
+		}
+	}
+
+	if cfg.ClientSecret == "" {
+		secret, err := Get(ClientSecretService, cfg.Email)
+		if err != nil {
+			return fmt.Errorf("reading client secret from keyring: %w", err)
+		}
+		if secret != "" {
+			logrus.Debug("Loaded OAuth2 client secret from keyring")
+			cfg.ClientSecret = secret
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package keyringService
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/oauth2"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	keyring.MockInit()
+	if err := Set(PasswordService, "a@example.com", "kr-password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(ClientSecretService, "a@example.com", "kr-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Config{Email: "a@example.com"}
+	if err := ResolveSecrets(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Password != "kr-password" || cfg.ClientSecret != "kr-secret" {
+		t.Errorf("got password %q, client secret %q", cfg.Password, cfg.ClientSecret)
+	}
+
+	// The environment wins over the keyring
+	cfg = config.Config{Email: "a@example.com", Password: "env-password"}
+	if err := ResolveSecrets(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Password != "env-password" {
+		t.Errorf("keyring overrode the environment: %q", cfg.Password)
+	}
+
+	// Nothing stored for the account is not an error
+	cfg = config.Config{Email: "b@example.com"}
+	if err := ResolveSecrets(&cfg); err != nil || cfg.Password != "" {
+		t.Errorf("missing entry: password %q, err %v", cfg.Password, err)
+	}
+
+	if err := ResolveSecrets(&config.Config{}); err == nil {
+		t.Error("no error without GMAIL_EMAIL")
+	}
+}
+
+func TestResolveSecretsKeyringError(t *testing.T) {
+	keyring.MockInitWithError(errors.New("keyring locked"))
+	t.Cleanup(keyring.MockInit)
+
+	cfg := config.Config{Email: "a@example.com"}
+	if err := ResolveSecrets(&cfg); err == nil {
+		t.Error("keyring failure not reported")
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	keyring.MockInit()
+	tok := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", TokenType: "Bearer"}
+	if err := SetToken("a@example.com", tok); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetToken("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != tok.AccessToken || got.RefreshToken != tok.RefreshToken {
+		t.Errorf("got %+v, want %+v", got, tok)
+	}
+	if got, err := GetToken("b@example.com"); got != nil || err != nil {
+		t.Errorf("missing token: %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,153 @@
+package metricsService
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shutdownTimeout bounds how long Stop waits for scrapes in progress
+const shutdownTimeout = 5 * time.Second
+
+// fetchBuckets are the upper bounds, in seconds, of the fetch latency histogram
+var fetchBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// The metrics are kept for the life of the process, whether or not
+// METRICS_ADDR is set; recording them is a few increments under a mutex
+var (
+	mu          sync.Mutex
+	downloaded  uint64
+	mailboxes   = map[string]int{}
+	fetchCounts = make([]uint64, len(fetchBuckets))
+	fetchSum    float64
+	fetchTotal  uint64
+	lastSuccess time.Time
+)
+
+// AddDownloaded counts a stored message
+func AddDownloaded() {
+	mu.Lock()
+	downloaded++
+	mu.Unlock()
+}
+
+// MailboxStarted marks box as being processed until MailboxFinished
+func MailboxStarted(box string) {
+	mu.Lock()
+	mailboxes[box]++
+	mu.Unlock()
+}
+
+// MailboxFinished ends a MailboxStarted
+func MailboxFinished(box string) {
+	mu.Lock()
+	if mailboxes[box]--; mailboxes[box] <= 0 {
+		delete(mailboxes, box)
+	}
+	mu.Unlock()
+}
+
+// ObserveFetch records the latency of one message fetch
+func ObserveFetch(d time.Duration) {
+	s := d.Seconds()
+	mu.Lock()
+	defer mu.Unlock()
+	for i, le := range fetchBuckets {
+		if s <= le {
+			fetchCounts[i]++
+		}
+	}
+	fetchSum += s
+	fetchTotal++
+}
+
+// RunSucceeded records the end of a successful backup run
+func RunSucceeded(at time.Time) {
+	mu.Lock()
+	lastSuccess = at
+	mu.Unlock()
+}
+
+// write renders the metrics in the Prometheus text exposition format
+func write(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP archive_gmail_messages_downloaded_total Messages downloaded since the process started.")
+	fmt.Fprintln(w, "# TYPE archive_gmail_messages_downloaded_total counter")
+	fmt.Fprintf(w, "archive_gmail_messages_downloaded_total %d\n", downloaded)
+
+	fmt.Fprintln(w, "# HELP archive_gmail_mailbox_processing Mailboxes currently being processed (1 per mailbox).")
+	fmt.Fprintln(w, "# TYPE archive_gmail_mailbox_processing gauge")
+	boxes := make([]string, 0, len(mailboxes))
+	for box := range mailboxes {
+		boxes = append(boxes, box)
+	}
+	sort.Strings(boxes)
+	for _, box := range boxes {
+		fmt.Fprintf(w, "archive_gmail_mailbox_processing{mailbox=\"%s\"} 1\n", escapeLabel(box))
+	}
+
+	fmt.Fprintln(w, "# HELP archive_gmail_fetch_duration_seconds Latency of message body fetches.")
+	fmt.Fprintln(w, "# TYPE archive_gmail_fetch_duration_seconds histogram")
+	for i, le := range fetchBuckets {
+		fmt.Fprintf(w, "archive_gmail_fetch_duration_seconds_bucket{le=\"%g\"} %d\n", le, fetchCounts[i])
+	}
+	fmt.Fprintf(w, "archive_gmail_fetch_duration_seconds_bucket{le=\"+Inf\"} %d\n", fetchTotal)
+	fmt.Fprintf(w, "archive_gmail_fetch_duration_seconds_sum %g\n", fetchSum)
+	fmt.Fprintf(w, "archive_gmail_fetch_duration_seconds_count %d\n", fetchTotal)
+
+	fmt.Fprintln(w, "# HELP archive_gmail_last_success_timestamp_seconds Unix time the last successful run finished, 0 before the first.")
+	fmt.Fprintln(w, "# TYPE archive_gmail_last_success_timestamp_seconds gauge")
+	var ts int64
+	if !lastSuccess.IsZero() {
+		ts = lastSuccess.Unix()
+	}
+	fmt.Fprintf(w, "archive_gmail_last_success_timestamp_seconds %d\n", ts)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// Serve exposes the metrics at http://<addr>/metrics. The listener is opened
+// before returning, so a bad address is reported right away. The returned
+// func shuts the server down.
+func Serve(addr string) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		write(w)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logrus.Warnf("Metrics server stopped: %v", err)
+		}
+	}()
+	logrus.Infof("Serving metrics at http://%s/metrics", ln.Addr())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logrus.Warnf("Metrics server shutdown: %v", err)
+		}
+	}, nil
+}
@@ -0,0 +1,138 @@
+package notifyService
+
+import (
+	"fmt"
+	"net/smtp"
+	"slices"
+	"strings"
+	"time"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// FormatReport renders a plain-text summary of a run
+func FormatReport(summary *gmailSvc.RunSummary, runErr error) string {
+	var b strings.Builder
+
+	status := "SUCCESS"
+	if runErr != nil {
+		status = "FAILED"
+	}
+	fmt.Fprintf(&b, "Status:     %s\n", status)
+	if runErr != nil {
+		fmt.Fprintf(&b, "Error:      %v\n", runErr)
+	}
+
+	if summary != nil {
+		fmt.Fprintf(&b, "Started:    %s\n", summary.Started.Format(time.RFC1123))
+		fmt.Fprintf(&b, "Duration:   %s\n", summary.Elapsed.Round(time.Second))
+		fmt.Fprintf(&b, "Downloaded: %d messages\n", summary.Downloaded)
+		if summary.DailyLimitReached {
+			fmt.Fprintf(&b, "Note:       daily download limit reached, run will resume later\n")
+		}
+		if summary.Interrupted {
+			fmt.Fprintf(&b, "Note:       interrupted by a shutdown signal, remaining messages will be fetched next run\n")
+		}
+
+		if len(summary.Alerts) > 0 {
+			fmt.Fprintf(&b, "\nServer alerts:\n")
+			for _, alert := range summary.Alerts {
+				fmt.Fprintf(&b, "  %s\n", alert)
+			}
+		}
+
+		if len(summary.Deferred) > 0 {
+			fmt.Fprintf(&b, "\nDeferred mailboxes (temporarily unavailable, retried at the end of the run):\n")
+			for _, name := range summary.Deferred {
+				fmt.Fprintf(&b, "  %s\n", name)
+			}
+		}
+
+		if len(summary.Mailboxes) > 0 {
+			fmt.Fprintf(&b, "\nMailboxes:\n")
+			for _, m := range summary.Mailboxes {
+				fmt.Fprintf(&b, "  %-30s downloaded=%d skipped=%d failed=%d %s\n", m.Name, m.Downloaded, m.Skipped, m.FailedCount(), m.Status())
+			}
+		}
+
+		var failed []string
+		for _, m := range summary.Mailboxes {
+			if len(m.Failed) > 0 {
+				uids := slices.Clone(m.Failed)
+				slices.Sort(uids)
+				failed = append(failed, fmt.Sprintf("%s: UIDs %v", m.Name, uids))
+			}
+			if len(m.FailedIDs) > 0 {
+				failed = append(failed, fmt.Sprintf("%s: message IDs %v", m.Name, m.FailedIDs))
+			}
+		}
+		if len(failed) > 0 {
+			fmt.Fprintf(&b, "\nFailed messages (retried next run):\n")
+			for _, f := range failed {
+				fmt.Fprintf(&b, "  %s\n", f)
+			}
+		}
+
+		if summary.Verified {
+			fmt.Fprintf(&b, "\nVerification: %d problems\n", len(summary.VerifyProblems))
+			for _, p := range summary.VerifyProblems {
+				fmt.Fprintf(&b, "  %s\n", p)
+			}
+		}
+
+		var issues []string
+		for _, m := range summary.Mailboxes {
+			for _, issue := range m.Issues {
+				issues = append(issues, fmt.Sprintf("%s: %s", m.Name, issue))
+			}
+		}
+		if len(issues) > 0 {
+			fmt.Fprintf(&b, "\nIssues:\n")
+			for _, issue := range issues {
+				fmt.Fprintf(&b, "  %s\n", issue)
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// SendEmailReport emails a run summary to REPORT_TO over SMTP
+func SendEmailReport(cfg config.Config, summary *gmailSvc.RunSummary, runErr error) error {
+	from := cfg.SMTPFrom
+	if from == "" {
+		from = cfg.SMTPUsername
+	}
+	if from == "" {
+		from = cfg.Email
+	}
+
+	status := "succeeded"
+	if runErr != nil {
+		status = "FAILED"
+	}
+	subject := fmt.Sprintf("archive-gmail backup %s for %s", status, cfg.Email)
+
+	to := strings.Split(cfg.ReportTo, ",")
+	for i := range to {
+		to[i] = strings.TrimSpace(to[i])
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(FormatReport(summary, runErr), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+
+	addr := fmt.Sprintf("%s:%d", cfg.SMTPHost, cfg.SMTPPort)
+	return smtp.SendMail(addr, auth, from, to, []byte(msg.String()))
+}
@@ -0,0 +1,114 @@
+package notifyService
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// fakeSMTP accepts one message and sends its DATA on the returned channel
+func fakeSMTP(t *testing.T) (net.Addr, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	data := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		reply("220 fake ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			verb, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				reply("250 fake")
+			case "DATA":
+				reply("354 go ahead")
+				var body strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					body.WriteString(l)
+				}
+				data <- body.String()
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr(), data
+}
+
+func TestSendEmailReport(t *testing.T) {
+	addr, data := fakeSMTP(t)
+	tcp := addr.(*net.TCPAddr)
+	cfg := config.Config{
+		Email:    "me@example.com",
+		SMTPHost: tcp.IP.String(),
+		SMTPPort: tcp.Port,
+		ReportTo: "ops@example.com, me@example.com",
+	}
+	summary := &gmailSvc.RunSummary{
+		Started:    time.Now(),
+		Elapsed:    90 * time.Second,
+		Downloaded: 42,
+		Mailboxes: []gmailSvc.MailboxResult{
+			{Name: "INBOX", Downloaded: 40, Skipped: 3},
+			{Name: "Sent", Downloaded: 2, Failed: []uint32{9, 7}},
+			{Name: "Broken", Error: "select failed"},
+		},
+	}
+
+	if err := SendEmailReport(cfg, summary, errors.New("1 mailboxes failed: Broken")); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg string
+	select {
+	case msg = <-data:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	for _, want := range []string{
+		"Subject: archive-gmail backup FAILED for me@example.com",
+		"To: ops@example.com, me@example.com",
+		"Status:     FAILED",
+		"Downloaded: 42 messages",
+		"INBOX                          downloaded=40 skipped=3 failed=0",
+		"Sent                           downloaded=2 skipped=0 failed=2",
+		"select failed",
+		"Sent: UIDs [7 9]",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("report lacks %q:\n%s", want, msg)
+		}
+	}
+}
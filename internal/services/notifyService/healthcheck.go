@@ -0,0 +1,92 @@
+package notifyService
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	config "github.com/redjax/archive-gmail/internal/config"
+	gmailSvc "github.com/redjax/archive-gmail/internal/services/gmailService"
+)
+
+// healthcheckTimeout bounds each ping so an unreachable monitor can't hold up
+// the run
+const healthcheckTimeout = 10 * time.Second
+
+// HealthcheckMailbox is the per-mailbox part of a healthcheck payload
+type HealthcheckMailbox struct {
+	Name       string `json:"name"`
+	Downloaded int    `json:"downloaded"`
+	Skipped    int    `json:"skipped"`
+	Error      string `json:"error,omitempty"`
+}
+
+// HealthcheckPayload is the JSON body POSTed when a run finishes
+type HealthcheckPayload struct {
+	Status         string               `json:"status"`
+	Error          string               `json:"error,omitempty"`
+	Downloaded     uint64               `json:"downloaded"`
+	ElapsedSeconds float64              `json:"elapsed_seconds"`
+	Mailboxes      []HealthcheckMailbox `json:"mailboxes,omitempty"`
+}
+
+// failURL is where a failed run is reported: HEALTHCHECK_FAIL_URL, or
+// HEALTHCHECK_URL/fail as healthchecks.io expects
+func failURL(cfg config.Config) string {
+	if cfg.HealthcheckFailURL != "" {
+		return cfg.HealthcheckFailURL
+	}
+	return strings.TrimSuffix(cfg.HealthcheckURL, "/") + "/fail"
+}
+
+// PingStart signals HEALTHCHECK_URL/start that a run began, so the monitor can
+// measure its duration and notice runs that never finish
+func PingStart(cfg config.Config) error {
+	return post(strings.TrimSuffix(cfg.HealthcheckURL, "/")+"/start", nil)
+}
+
+// PingResult POSTs a JSON summary of the run to HEALTHCHECK_URL, or to the
+// fail URL if runErr is set
+func PingResult(cfg config.Config, summary *gmailSvc.RunSummary, runErr error) error {
+	payload := HealthcheckPayload{Status: "success"}
+	url := cfg.HealthcheckURL
+	if runErr != nil {
+		payload.Status = "failed"
+		payload.Error = runErr.Error()
+		url = failURL(cfg)
+	}
+	if summary != nil {
+		payload.Downloaded = summary.Downloaded
+		payload.ElapsedSeconds = summary.Elapsed.Seconds()
+		for _, m := range summary.Mailboxes {
+			payload.Mailboxes = append(payload.Mailboxes, HealthcheckMailbox{
+				Name:       m.Name,
+				Downloaded: m.Downloaded,
+				Skipped:    m.Skipped,
+				Error:      m.Error,
+			})
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return post(url, body)
+}
+
+func post(url string, body []byte) error {
+	client := &http.Client{Timeout: healthcheckTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
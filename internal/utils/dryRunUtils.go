@@ -0,0 +1,16 @@
+package utils
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// DryRunWrite logs a write that DRY_RUN skipped. A negative size means the
+// size isn't known ahead of the write.
+func DryRunWrite(path string, size int64) {
+	entry := logrus.WithField("dry_run", true)
+	if size < 0 {
+		entry.Infof("DRY RUN: would write %s", path)
+		return
+	}
+	entry.Infof("DRY RUN: would write %s (%s)", path, FormatSize(size))
+}
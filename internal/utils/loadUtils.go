@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LoadAverage returns the 1-minute system load average. ok is false on
+// platforms without /proc/loadavg.
+func LoadAverage() (load float64, ok bool) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err = strconv.ParseFloat(fields[0], 64)
+	return load, err == nil
+}
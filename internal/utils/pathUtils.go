@@ -6,6 +6,9 @@ import (
 
 func EnsureDir(path string, dry bool) error {
 	if dry {
+		if !Exists(path) {
+			DryRunWrite(path+string(os.PathSeparator), -1)
+		}
 		return nil
 	}
 
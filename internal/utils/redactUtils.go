@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Redacted replaces masked values in log output
+const Redacted = "[REDACTED]"
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	// Google access/refresh tokens, bearer headers and XOAUTH2 payloads
+	tokenPattern = regexp.MustCompile(`ya29\.[\w\-.]+|1//[\w\-]+|(?i:bearer)\s+[\w\-.~+/]+=*|user=\S+\x01auth=[^\x01]*`)
+)
+
+// piiFields are log fields whose whole value is masked
+var piiFields = map[string]bool{
+	"subject": true,
+	"from":    true,
+	"to":      true,
+	"email":   true,
+	"token":   true,
+}
+
+// RedactHook masks email addresses, subjects and tokens in log entries before
+// they are written, for logs shipped to third-party aggregators
+type RedactHook struct{}
+
+// Levels applies the hook to every level
+func (RedactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire redacts the message and fields of e
+func (RedactHook) Fire(e *logrus.Entry) error {
+	e.Message = RedactText(e.Message)
+
+	// Data may be shared with the logger's other entries, so replace it
+	data := make(logrus.Fields, len(e.Data))
+	for k, v := range e.Data {
+		if piiFields[strings.ToLower(k)] {
+			data[k] = Redacted
+			continue
+		}
+		if s, ok := v.(string); ok {
+			v = RedactText(s)
+		} else if err, ok := v.(error); ok {
+			v = RedactText(err.Error())
+		}
+		data[k] = v
+	}
+	e.Data = data
+	return nil
+}
+
+// RedactText masks email addresses and tokens in s
+func RedactText(s string) string {
+	s = tokenPattern.ReplaceAllString(s, Redacted)
+	return emailPattern.ReplaceAllString(s, Redacted)
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedactText(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Downloading for alice.smith+news@example.co.uk", "Downloading for " + Redacted},
+		{"Authorization: Bearer abc.DEF-123", "Authorization: " + Redacted},
+		{"token ya29.a0AfH6SMB-xyz refresh 1//0gABC-def", "token " + Redacted + " refresh " + Redacted},
+		{"AUTHENTICATE XOAUTH2 user=bob@example.com\x01auth=Bearer tok\x01\x01", "AUTHENTICATE XOAUTH2 " + Redacted + "\x01\x01"},
+		{"Processing: INBOX", "Processing: INBOX"},
+	}
+	for _, tt := range tests {
+		if got := RedactText(tt.in); got != tt.want {
+			t.Errorf("RedactText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactHook(t *testing.T) {
+	log := func(redact bool) string {
+		var buf bytes.Buffer
+		l := logrus.New()
+		l.SetOutput(&buf)
+		if redact {
+			l.AddHook(RedactHook{})
+		}
+		e := l.WithFields(logrus.Fields{"subject": "Quarterly results", "account": "alice@example.com", "error": errors.New("login failed for alice@example.com")})
+		e.Warn("Skipping message from bob@example.com")
+		// The entry's fields are left alone for later lines
+		if e.Data["subject"] != "Quarterly results" {
+			t.Errorf("hook changed the shared fields: %v", e.Data)
+		}
+		return buf.String()
+	}
+
+	out := log(true)
+	for _, pii := range []string{"alice@example.com", "bob@example.com", "Quarterly results"} {
+		if strings.Contains(out, pii) {
+			t.Errorf("%q not redacted in %q", pii, out)
+		}
+	}
+	if !strings.Contains(out, "Skipping message from "+Redacted) {
+		t.Errorf("message not kept around the redaction: %q", out)
+	}
+
+	out = log(false)
+	for _, pii := range []string{"alice@example.com", "bob@example.com", "Quarterly results"} {
+		if !strings.Contains(out, pii) {
+			t.Errorf("%q redacted without the hook: %q", pii, out)
+		}
+	}
+}
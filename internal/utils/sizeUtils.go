@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize parses a byte size like "2500MB", "512KB" or "1048576"
+func ParseSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// FormatSize renders a byte count in a human-readable unit
+func FormatSize(n int64) string {
+	for _, u := range sizeUnits[:3] {
+		if n >= u.mult {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(u.mult), u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
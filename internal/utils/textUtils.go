@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"bytes"
+)
+
+// Line ending normalization modes
+const (
+	EOLNone = "none"
+	EOLCRLF = "crlf"
+	EOLLF   = "lf"
+)
+
+var binaryCTE = []byte("content-transfer-encoding: binary")
+
+// NormalizeEOL rewrites line endings to the given mode. Base64, quoted-printable
+// and 7bit/8bit text are line-oriented and safe to rewrite; messages that carry
+// raw binary parts (NUL bytes or a "binary" transfer encoding) are returned
+// unchanged, since rewriting would corrupt their payload.
+func NormalizeEOL(data []byte, mode string) []byte {
+	if mode != EOLCRLF && mode != EOLLF {
+		return data
+	}
+	if bytes.IndexByte(data, 0) >= 0 || bytes.Contains(bytes.ToLower(data), binaryCTE) {
+		return data
+	}
+
+	lf := bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	lf = bytes.ReplaceAll(lf, []byte("\r"), []byte("\n"))
+	if mode == EOLLF {
+		return lf
+	}
+	return bytes.ReplaceAll(lf, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNormalizeEOL(t *testing.T) {
+	mixed := []byte("Subject: hi\nFrom: a@example.com\r\nTo: b@example.com\r\rbody\n")
+
+	crlf := NormalizeEOL(mixed, EOLCRLF)
+	if want := []byte("Subject: hi\r\nFrom: a@example.com\r\nTo: b@example.com\r\n\r\nbody\r\n"); !bytes.Equal(crlf, want) {
+		t.Errorf("crlf: got %q, want %q", crlf, want)
+	}
+	if n := bytes.Count(crlf, []byte("\n")); n != bytes.Count(crlf, []byte("\r\n")) {
+		t.Errorf("crlf: bare LF left in %q", crlf)
+	}
+	if n := bytes.Count(crlf, []byte("\r")); n != bytes.Count(crlf, []byte("\r\n")) {
+		t.Errorf("crlf: bare CR left in %q", crlf)
+	}
+
+	lf := NormalizeEOL(mixed, EOLLF)
+	if want := []byte("Subject: hi\nFrom: a@example.com\nTo: b@example.com\n\nbody\n"); !bytes.Equal(lf, want) {
+		t.Errorf("lf: got %q, want %q", lf, want)
+	}
+
+	if got := NormalizeEOL(mixed, EOLNone); !bytes.Equal(got, mixed) {
+		t.Errorf("none changed the message: %q", got)
+	}
+}
+
+func TestNormalizeEOLLeavesBinaryAlone(t *testing.T) {
+	for name, msg := range map[string][]byte{
+		"NUL byte":        []byte("Subject: x\n\nraw\x00data\n"),
+		"binary encoding": []byte("Content-Transfer-Encoding: BINARY\n\nraw\rdata\n"),
+	} {
+		if got := NormalizeEOL(msg, EOLCRLF); !bytes.Equal(got, msg) {
+			t.Errorf("%s: rewritten to %q", name, got)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseSince parses a cutoff like "30d" (days before now), "2w", a Go
+// duration like "36h", an RFC3339 timestamp or a "2006-01-02" date
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	v := strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, v, now.Location()); err == nil {
+		return t, nil
+	}
+
+	for suffix, days := range map[string]int{"d": 1, "w": 7} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(v, suffix)); err == nil && strings.HasSuffix(v, suffix) && n >= 0 {
+			return now.AddDate(0, 0, -n*days), nil
+		}
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid cutoff %q", s)
+}